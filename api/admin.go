@@ -0,0 +1,94 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+var (
+	AdminSnapshotPostHandler = requireAdmin(jsonResponder(adminSnapshot))
+	AdminRestorePostHandler  = requireAdmin(jsonResponder(adminRestore))
+)
+
+// adminToken is the bearer token the admin API requires, from the ADMIN_TOKEN option. The admin API is disabled
+// while it's empty.
+var adminToken string
+
+// requireAdmin only lets requests through to h that carry the admin token as "Authorization: Bearer <token>".
+// Without a token configured, every admin route answers as though it didn't exist.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			res, code := problemNotFound.with("The admin API is disabled. Set ADMIN_TOKEN to enable it.")
+			writeJson(w, res, code)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			res, code := problemUnauthorized.with("The admin API requires \"Authorization: Bearer <ADMIN_TOKEN>\".")
+			writeJson(w, res, code)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func adminSnapshot(r *http.Request) (interface{}, int) {
+	snapshotter, ok := platformImpl.(platform.Snapshotter)
+	if !ok {
+		return errorResponse(&ErrNotSupported{Operation: "Snapshots"})
+	}
+
+	snapshot, err := snapshotter.SaveSnapshot()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toSnapshotDocument(snapshot), http.StatusOK
+}
+
+func adminRestore(r *http.Request) (interface{}, int) {
+	snapshotter, ok := platformImpl.(platform.Snapshotter)
+	if !ok {
+		return errorResponse(&ErrNotSupported{Operation: "Snapshots"})
+	}
+
+	snapshot, err := snapshotter.LoadSnapshot()
+	if os.IsNotExist(err) {
+		return problemNotFound.with("No snapshot has been saved.")
+	} else if err != nil {
+		return errorResponse(err)
+	}
+
+	// The snapshot holds the subscriptions and cursors of its own time, so deliver to those instead
+	err = webhookSubscriptions.restore()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toSnapshotDocument(snapshot), http.StatusOK
+}
+
+func toSnapshotDocument(snapshot *platform.Snapshot) *snapshotDocument {
+	return &snapshotDocument{
+		Path:    snapshot.Path,
+		TakenAt: snapshot.TakenAt.Format(time.RFC3339Nano),
+		Streams: snapshot.Streams,
+		Cursors: snapshot.Cursors}
+}
+
+type snapshotDocument struct {
+	Path    string `json:"path"`
+	TakenAt string `json:"takenAt"`
+	Streams int    `json:"streams"`
+	Cursors int    `json:"cursors"`
+}
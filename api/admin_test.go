@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	useMemoryPlatform()
+	defer func(token string) { adminToken = token }(adminToken)
+
+	tests := []struct {
+		name       string
+		token      string
+		auth       string
+		wantStatus int
+	}{
+		{"Disabled", "", "Bearer s3cr3t", http.StatusNotFound},
+		{"Missing", "s3cr3t", "", http.StatusUnauthorized},
+		{"NotBearer", "s3cr3t", "s3cr3t", http.StatusUnauthorized},
+		{"Wrong", "s3cr3t", "Bearer guess", http.StatusUnauthorized},
+		// The test platform has no snapshot path, so the snapshot itself is refused
+		{"Valid", "s3cr3t", "Bearer s3cr3t", http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adminToken = test.token
+
+			req := httptest.NewRequest("POST", "/admin/snapshot", nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			rec := httptest.NewRecorder()
+			AdminSnapshotPostHandler(rec, req)
+
+			if rec.Code != test.wantStatus {
+				t.Errorf("Status = %d, want %d: %s", rec.Code, test.wantStatus, rec.Body.String())
+			}
+			if test.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 response has no WWW-Authenticate header")
+			}
+		})
+	}
+}
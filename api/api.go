@@ -10,26 +10,30 @@ func jsonResponder(f func(r *http.Request) (result interface{}, statusCode int))
 	return func(w http.ResponseWriter, r *http.Request) {
 		res, code := f(r)
 
-		// Headers MUST be set before WriteHeader or Write is called.
-		w.Header().Set("Content-type", "application/json")
+		writeJson(w, res, code)
+	}
+}
 
-		// WriteHeader MUST be set before any calls to Write.
-		w.WriteHeader(code)
+func writeJson(w http.ResponseWriter, res interface{}, code int) {
+	// Headers MUST be set before WriteHeader or Write is called.
+	contentType := "application/json"
+	if _, ok := res.(*problem); ok {
+		contentType = PROBLEM_CONTENT_TYPE
+	}
+	w.Header().Set("Content-type", contentType)
 
-		output, err := json.Marshal(res)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	// WriteHeader MUST be set before any calls to Write.
+	w.WriteHeader(code)
 
-		fmt.Fprint(w, string(output))
+	// No Content responses must not include a body
+	if code == http.StatusNoContent {
+		return
 	}
-}
 
-func asJsonError(err error) *jsonError {
-	return &jsonError{
-		Error: err.Error()}
-}
+	output, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 
-type jsonError struct {
-	Error string `json:"error"`
+	fmt.Fprint(w, string(output))
 }
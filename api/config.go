@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+// DEFAULT_BACKEND is the platform used when STREAMS_BACKEND isn't set.
+const DEFAULT_BACKEND = "memory"
+
+var platformImpl platform.Platform
+
+// OpenPlatform opens the backend named by the STREAMS_BACKEND option, which must be registered with the platform
+// package. It must be called before any handler is served.
+//
+// Options are read from the file named by the STREAMS_CONFIG environment variable, if it's set, and then from the
+// environment, which takes precedence.
+func OpenPlatform() error {
+	opts, err := loadOptions(os.Getenv("STREAMS_CONFIG"))
+	if err != nil {
+		return err
+	}
+
+	name := opts["STREAMS_BACKEND"]
+	if name == "" {
+		name = DEFAULT_BACKEND
+	}
+
+	p, err := platform.Open(name, opts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Using the %s backend", name)
+	platformImpl = p
+	adminToken = opts["ADMIN_TOKEN"]
+
+	if value := opts["WEBHOOK_ALLOW_PRIVATE"]; value != "" {
+		webhookAllowPrivate, err = strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid WEBHOOK_ALLOW_PRIVATE \"%s\". Must be true or false.", value)
+		}
+	}
+
+	// Pick up delivery of the subscriptions created before the last restart
+	err = webhookSubscriptions.restore()
+	if err != nil {
+		return fmt.Errorf("Error restoring webhook subscriptions: %s", err)
+	}
+
+	return nil
+}
+
+// ClosePlatform stops webhook deliveries and releases the platform's resources, for backends which hold any, e.g.
+// so that the memory backend saves a last snapshot. It should be called on shutdown.
+func ClosePlatform() error {
+	webhookSubscriptions.stopAll()
+
+	if closer, ok := platformImpl.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// loadOptions reads the options in the config file at path, if any, and then the environment over the top.
+func loadOptions(path string) (platform.Options, error) {
+	opts := platform.Options{}
+
+	if path != "" {
+		err := readConfigFile(path, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pair := range os.Environ() {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && parts[1] != "" {
+			opts[parts[0]] = parts[1]
+		}
+	}
+
+	return opts, nil
+}
+
+// readConfigFile reads a file of KEY=VALUE lines into opts, in the same format as a .env file. Blank lines and
+// lines starting with # are skipped, and values may be quoted.
+func readConfigFile(path string, opts platform.Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: Expected KEY=VALUE.", path, n)
+		}
+
+		key := strings.TrimSpace(strings.TrimPrefix(parts[0], "export "))
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		opts[key] = value
+	}
+
+	return scanner.Err()
+}
@@ -1,42 +1,341 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/oceanhq/streams/platform"
 )
 
-var CursorCollectionPostHandler = jsonResponder(cursorCreate)
+var (
+	CursorCollectionPostHandler = jsonResponder(cursorCreate)
+	CursorCollectionGetHandler  = jsonResponder(cursorsIndex)
+	CursorDocumentGetHandler    = jsonResponder(cursorGet)
+	CursorDocumentPatchHandler  = jsonResponder(cursorSeek)
+	CursorDocumentDeleteHandler = jsonResponder(cursorDelete)
+	CursorClonePostHandler      = jsonResponder(cursorClone)
+	CursorAckPostHandler        = jsonResponder(cursorAck)
+	CursorNackPostHandler       = jsonResponder(cursorNack)
+)
 
 func cursorCreate(r *http.Request) (interface{}, int) {
 	// Get stream ID from path
 	vars := mux.Vars(r)
 	streamId := vars["stream_id"]
 
-	// Create the new cursor
-	cursor, err := platformImpl.CreateCursor(streamId)
+	// Parse the optional start position and dead-letter policy. Cursors start at the latest record by default.
+	parsed, err := parseCursorRequest(r)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	start, err := parsed.startPosition()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	cursor, err := createCursor(streamId, *start, parsed.deadLetterPolicy())
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toCursorDocument(cursor), http.StatusCreated
+}
+
+// createCursor creates a cursor and applies its dead-letter policy, if any. The cursor is removed again
+// if the policy can't be applied.
+func createCursor(streamId string, start platform.StartPosition, deadLetter *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	cursor, err := platformImpl.CreateCursor(streamId, start)
+	if err != nil || deadLetter == nil {
+		return cursor, err
+	}
+
+	withPolicy, err := platformImpl.SetDeadLetterPolicy(streamId, cursor.Id, deadLetter)
+	if err != nil {
+		platformImpl.DeleteCursor(streamId, cursor.Id)
+		return nil, err
+	}
+
+	return withPolicy, nil
+}
+
+func cursorsIndex(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	cursors, err := platformImpl.ListCursors(streamId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// Copy returned cursor list into marshallable response object
+	list := &cursorCollection{
+		Cursors: make([]cursorDocument, len(cursors))}
+	for i := 0; i < len(cursors); i++ {
+		list.Cursors[i] = *toCursorDocument(&cursors[i])
+	}
+
+	return list, http.StatusOK
+}
+
+func cursorGet(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	cursor, err := platformImpl.GetCursor(streamId, cursorId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toCursorDocument(cursor), http.StatusOK
+}
+
+func cursorDelete(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	err := platformImpl.DeleteCursor(streamId, cursorId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return nil, http.StatusNoContent
+}
+
+func cursorClone(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	cursor, err := platformImpl.CloneCursor(streamId, cursorId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toCursorDocument(cursor), http.StatusCreated
+}
+
+func cursorSeek(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	// Parse the position to move the cursor to and/or its new dead-letter policy
+	parsed, err := parseCursorRequest(r)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	position, err := parsed.startPosition()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	if position.Type == "" && parsed.DeadLetter == nil {
+		return invalidRequest("A start position or dead-letter policy must be specified.")
+	}
+
+	cursor, err := updateCursor(streamId, cursorId, position, parsed)
 	if err != nil {
-		code := http.StatusInternalServerError
+		return errorResponse(err)
+	}
+
+	return toCursorDocument(cursor), http.StatusOK
+}
 
-		// In case the client supplies a non-existant stream, bad request
-		if _, ok := err.(*platform.ErrStreamNotFound); ok {
-			code = http.StatusBadRequest
+// updateCursor applies the dead-letter policy of a PATCH, if given, and then any seek.
+func updateCursor(streamId string, cursorId string, position *platform.StartPosition, parsed *cursorRequestData) (*platform.Cursor, error) {
+	var cursor *platform.Cursor
+	var err error
+
+	if parsed.DeadLetter != nil {
+		cursor, err = platformImpl.SetDeadLetterPolicy(streamId, cursorId, parsed.deadLetterPolicy())
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	if position.Type != "" {
+		cursor, err = platformImpl.SeekCursor(streamId, cursorId, *position)
+	}
+
+	return cursor, err
+}
+
+func cursorAck(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	// Parse the receipt of the batch being acknowledged
+	// Example: { "receipt": "4f1c8a..." }
+	type requestData struct {
+		Receipt string `json:"receipt"`
+	}
+	parsed := &requestData{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(parsed)
+	if err != nil {
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	err = platformImpl.AckRecords(streamId, cursorId, parsed.Receipt)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resp := &ackDocument{
+		CursorId: cursorId,
+		StreamId: streamId,
+		Receipt:  parsed.Receipt}
+
+	return resp, http.StatusOK
+}
+
+func cursorNack(r *http.Request) (interface{}, int) {
+	// Get stream and cursor IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
+
+	// Parse the receipt of the batch being rejected and, optionally, why
+	// Example: { "receipt": "4f1c8a...", "reason": "Unknown event type" }
+	type requestData struct {
+		Receipt string `json:"receipt"`
+		Reason  string `json:"reason"`
+	}
+	parsed := &requestData{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(parsed)
+	if err != nil {
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	err = platformImpl.NackRecords(streamId, cursorId, parsed.Receipt, parsed.Reason)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	resp := &ackDocument{
+		CursorId: cursorId,
+		StreamId: streamId,
+		Receipt:  parsed.Receipt}
+
+	return resp, http.StatusOK
+}
+
+// parseCursorRequest reads the start position and dead-letter policy accepted when creating or updating a cursor
+// from the request body. An empty body gives the zero position and no policy.
+// Example: { "start": "at-timestamp", "timestamp": "2016-05-24T18:00:00Z", "deadLetter": { "streamId": "...", "maxDeliveries": 5 } }
+func parseCursorRequest(r *http.Request) (*cursorRequestData, error) {
+	parsed := &cursorRequestData{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(parsed)
+	if err != nil && err != io.EOF {
+		return nil, &ErrInvalidRequest{fmt.Sprintf("JSON parse error: %s", err.Error())}
+	}
+
+	return parsed, nil
+}
+
+type cursorRequestData struct {
+	startPositionData
+	DeadLetter *deadLetterDocument `json:"deadLetter"`
+}
+
+// deadLetterPolicy returns the requested policy, or nil if none was given or it has zero maxDeliveries,
+// which clears the policy.
+func (d *cursorRequestData) deadLetterPolicy() *platform.DeadLetterPolicy {
+	if d.DeadLetter == nil || d.DeadLetter.MaxDeliveries == 0 {
+		return nil
+	}
+
+	return &platform.DeadLetterPolicy{
+		StreamId:      d.DeadLetter.StreamId,
+		MaxDeliveries: d.DeadLetter.MaxDeliveries}
+}
+
+// startPositionData holds the start position fields of a request body. Embed it to accept a start position
+// alongside other fields.
+type startPositionData struct {
+	Start     string `json:"start"`
+	Timestamp string `json:"timestamp"`
+	RecordId  string `json:"recordId"`
+	Count     int    `json:"count"`
+}
 
-		return asJsonError(err), code
+func (d *startPositionData) startPosition() (*platform.StartPosition, error) {
+	start := &platform.StartPosition{
+		Type:     d.Start,
+		RecordId: d.RecordId,
+		Count:    d.Count}
+
+	if d.Timestamp != "" {
+		var err error
+		start.Timestamp, err = time.Parse(time.RFC3339Nano, d.Timestamp)
+		if err != nil {
+			return nil, &ErrInvalidRequest{fmt.Sprintf("Error parsing timestamp: %s", err.Error())}
+		}
 	}
 
-	resp := &cursorDocument{
+	return start, nil
+}
+
+func toCursorDocument(cursor *platform.Cursor) *cursorDocument {
+	doc := &cursorDocument{
 		CursorId: cursor.Id,
 		StreamId: cursor.StreamId,
 		Position: cursor.Position}
 
-	return resp, http.StatusCreated
+	if cursor.DeadLetter != nil {
+		doc.DeadLetter = &deadLetterDocument{
+			StreamId:      cursor.DeadLetter.StreamId,
+			MaxDeliveries: cursor.DeadLetter.MaxDeliveries}
+	}
+
+	return doc
+}
+
+// releaseBatch hands back a leased batch that never reached its client, so that it's redelivered straight away. It
+// only counts as a delivery on platforms that can't release a batch other than by nacking it.
+func releaseBatch(streamId string, cursorId string, batch *platform.Batch, reason string) error {
+	if releaser, ok := platformImpl.(platform.Releaser); ok {
+		return releaser.ReleaseRecords(streamId, cursorId, batch.Receipt)
+	}
+
+	return platformImpl.NackRecords(streamId, cursorId, batch.Receipt, reason)
 }
 
 type cursorDocument struct {
+	CursorId   string              `json:"cursorId"`
+	StreamId   string              `json:"streamId"`
+	Position   string              `json:"position"`
+	DeadLetter *deadLetterDocument `json:"deadLetter,omitempty"`
+}
+
+type deadLetterDocument struct {
+	StreamId      string `json:"streamId"`
+	MaxDeliveries int    `json:"maxDeliveries"`
+}
+
+type ackDocument struct {
 	CursorId string `json:"cursorId"`
 	StreamId string `json:"streamId"`
-	Position string `json:"position"`
+	Receipt  string `json:"receipt"`
+}
+
+type cursorCollection struct {
+	Cursors []cursorDocument `json:"cursors"`
 }
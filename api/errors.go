@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	PROBLEM_CONTENT_TYPE = "application/problem+json"
+	// PROBLEM_TYPE_PREFIX is prepended to an error code to give the problem type URI.
+	PROBLEM_TYPE_PREFIX = "urn:ocean:problem:"
+)
+
+// Error codes are stable, so clients can switch on them. The detail that accompanies them is meant for people
+// and may change.
+var (
+	problemInvalidRequest       = problemType{http.StatusBadRequest, "invalid_request", "The request is invalid."}
+	problemInvalidParam         = problemType{http.StatusBadRequest, "invalid_param", "A parameter has an invalid value."}
+	problemUnauthorized         = problemType{http.StatusUnauthorized, "unauthorized", "The request lacks valid credentials."}
+	problemStreamNotFound       = problemType{http.StatusNotFound, "stream_not_found", "The stream does not exist."}
+	problemCursorNotFound       = problemType{http.StatusNotFound, "cursor_not_found", "The cursor does not exist."}
+	problemRecordNotFound       = problemType{http.StatusNotFound, "record_not_found", "The record does not exist."}
+	problemSubscriptionNotFound = problemType{http.StatusNotFound, "subscription_not_found", "The subscription does not exist."}
+	problemNotFound             = problemType{http.StatusNotFound, "not_found", "There is nothing at this path."}
+	problemStreamDeleted        = problemType{http.StatusConflict, "stream_deleted", "The stream has been deleted and is read-only."}
+	problemReceiptNotFound      = problemType{http.StatusConflict, "receipt_not_found", "No batch with the receipt is leased to the cursor."}
+	problemIdempotencyKeyReused = problemType{http.StatusConflict, "idempotency_key_reused", "The idempotency key was used for different content."}
+	problemConflict             = problemType{http.StatusConflict, "conflict", "The request conflicts with the resource's current state."}
+	problemQuotaExceeded        = problemType{http.StatusTooManyRequests, "quota_exceeded", "A quota has been exceeded."}
+	problemUnavailable          = problemType{http.StatusServiceUnavailable, "unavailable", "The service is temporarily unavailable."}
+	problemNotSupported         = problemType{http.StatusNotImplemented, "not_supported", "The backend doesn't support this operation."}
+	problemInternal             = problemType{http.StatusInternalServerError, "internal_error", "An unexpected error occurred."}
+)
+
+var NotFoundHandler = jsonResponder(func(r *http.Request) (interface{}, int) {
+	return problemNotFound.with(fmt.Sprintf("No route matches %s %s.", r.Method, r.URL.Path))
+})
+
+type problemType struct {
+	status int
+	code   string
+	title  string
+}
+
+// with builds a response for this type of problem.
+func (t problemType) with(detail string) (*problem, int) {
+	return &problem{
+		Type:   PROBLEM_TYPE_PREFIX + t.code,
+		Title:  t.title,
+		Status: t.status,
+		Code:   t.code,
+		Detail: detail}, t.status
+}
+
+// problem is an RFC 7807 problem details body.
+// Example: { "type": "urn:ocean:problem:stream_not_found", "title": "The stream does not exist.", "status": 404, "code": "stream_not_found", "detail": "..." }
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ErrInvalidRequest is returned for requests which are malformed before they ever reach the platform.
+type ErrInvalidRequest struct {
+	Message string
+}
+
+func (e *ErrInvalidRequest) Error() string {
+	return e.Message
+}
+
+// ErrNotSupported is returned for operations which the configured backend can't carry out.
+type ErrNotSupported struct {
+	Operation string
+}
+
+func (e *ErrNotSupported) Error() string {
+	return fmt.Sprintf("%s aren't supported by this backend.", e.Operation)
+}
+
+// errorResponse gives the problem document and status code for an error. Handlers should use this rather than
+// picking a status themselves, so that each error means the same thing wherever it's returned.
+func errorResponse(err error) (*problem, int) {
+	return problemTypeOf(err).with(err.Error())
+}
+
+// writeError writes the problem document for an error, for handlers which don't go through jsonResponder.
+func writeError(w http.ResponseWriter, err error) {
+	res, code := errorResponse(err)
+	writeJson(w, res, code)
+}
+
+// invalidRequest gives the response for a request which couldn't be parsed or is missing something.
+func invalidRequest(format string, args ...interface{}) (*problem, int) {
+	return problemInvalidRequest.with(fmt.Sprintf(format, args...))
+}
+
+func problemTypeOf(err error) problemType {
+	switch err.(type) {
+	case *ErrInvalidRequest:
+		return problemInvalidRequest
+	case *platform.ErrInvalidParam:
+		return problemInvalidParam
+	case *platform.ErrStreamNotFound:
+		return problemStreamNotFound
+	case *platform.ErrCursorNotFound:
+		return problemCursorNotFound
+	case *platform.ErrRecordNotFound:
+		return problemRecordNotFound
+	case *ErrSubscriptionNotFound:
+		return problemSubscriptionNotFound
+	case *platform.ErrStreamDeleted:
+		return problemStreamDeleted
+	case *platform.ErrReceiptNotFound:
+		// The lease was lost, so the records have been or will be redelivered
+		return problemReceiptNotFound
+	case *platform.ErrIdempotencyKeyReused:
+		return problemIdempotencyKeyReused
+	case *platform.ErrConflict:
+		return problemConflict
+	case *platform.ErrQuotaExceeded:
+		return problemQuotaExceeded
+	case *platform.ErrUnavailable:
+		return problemUnavailable
+	case *ErrNotSupported:
+		return problemNotSupported
+	}
+
+	return problemInternal
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	// EVENTS_POLL_WAIT bounds each read so that keep-alives are sent and disconnected clients are noticed.
+	EVENTS_POLL_WAIT = 15 * time.Second
+)
+
+// eventsPollWait is how long each read waits for records. Tests shorten it so handlers notice disconnects sooner.
+var eventsPollWait = EVENTS_POLL_WAIT
+
+var RecordEventsGetHandler = recordEvents
+
+// recordEvents pushes records to the client as Server-Sent Events for as long as the connection stays open.
+// Each event's ID is its record ID so a reconnecting client's Last-Event-ID resumes just after the last record
+// it saw. Clients may read through an existing cursor with ?cursor={cursor_id}; otherwise a temporary cursor
+// is created for the connection, starting at the latest record.
+func recordEvents(w http.ResponseWriter, r *http.Request) {
+	// Get stream ID from path. EventSource can't set headers, so the cursor ID may also be passed in the query.
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := r.URL.Query().Get("cursor")
+	if cursorId == "" {
+		cursorId = r.Header.Get("X-Cursor-ID")
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, errors.New("Streaming is not supported."))
+		return
+	}
+	controller := http.NewResponseController(w)
+
+	// Resume after the last event the client saw
+	var start platform.StartPosition
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId != "" {
+		start = platform.StartPosition{
+			Type:     platform.START_AFTER_RECORD_ID,
+			RecordId: lastEventId}
+	}
+
+	if cursorId == "" {
+		cursor, err := platformImpl.CreateCursor(streamId, start)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		cursorId = cursor.Id
+		defer deleteEventsCursor(streamId, cursorId)
+	} else if lastEventId != "" {
+		_, err := platformImpl.SeekCursor(streamId, cursorId, start)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if controller.Flush() != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		batch, err := platformImpl.GetRecords(streamId, cursorId, eventsPollWait)
+		if err != nil {
+			// The status has already been sent so report the error as an event and hang up
+			problem, _ := errorResponse(err)
+			writeEvent(w, "", "error", problem)
+			controller.Flush()
+			return
+		}
+
+		if len(batch.Records) == 0 {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			if controller.Flush() != nil {
+				return
+			}
+			continue
+		}
+
+		// Records are only acknowledged once they've been flushed to the client. If the client has gone away
+		// the batch is nacked so it's redelivered when the client reconnects.
+		err = sendEvents(w, controller, batch)
+		if err != nil {
+			err = platformImpl.NackRecords(streamId, cursorId, batch.Receipt, fmt.Sprintf("Error sending event stream: %s", err))
+			if err != nil {
+				log.Printf("Error releasing records unsent to event stream for cursor %s: %s", cursorId, err)
+			}
+			return
+		}
+
+		// A lost lease only means the records are sent again, which clients can spot by event ID
+		err = platformImpl.AckRecords(streamId, cursorId, batch.Receipt)
+		if err != nil {
+			log.Printf("Error acknowledging records sent to event stream for cursor %s: %s", cursorId, err)
+		}
+	}
+}
+
+// sendEvents writes an event for each of the batch's records and flushes them to the client.
+func sendEvents(w http.ResponseWriter, controller *http.ResponseController, batch *platform.Batch) error {
+	for i := 0; i < len(batch.Records); i++ {
+		rec := &batch.Records[i]
+
+		err := writeEvent(w, rec.Id, "", toRecordDocument(rec))
+		if err != nil {
+			return err
+		}
+	}
+
+	return controller.Flush()
+}
+
+// writeEvent writes a single event. An empty event type gives a default "message" event.
+func writeEvent(w io.Writer, id string, eventType string, data interface{}) error {
+	output, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	if id != "" {
+		lines = append(lines, fmt.Sprintf("id: %s", id))
+	}
+	if eventType != "" {
+		lines = append(lines, fmt.Sprintf("event: %s", eventType))
+	}
+	lines = append(lines, fmt.Sprintf("data: %s", output))
+
+	_, err = fmt.Fprintf(w, "%s\n\n", strings.Join(lines, "\n"))
+
+	return err
+}
+
+func deleteEventsCursor(streamId string, cursorId string) {
+	err := platformImpl.DeleteCursor(streamId, cursorId)
+	if err != nil {
+		log.Printf("Error deleting temporary event stream cursor %s: %s", cursorId, err)
+	}
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oceanhq/streams/platform"
+)
+
+type event struct {
+	id        string
+	eventType string
+	data      string
+}
+
+func TestRecordEvents(t *testing.T) {
+	useMemoryPlatform()
+	srv := newEventsServer()
+	defer srv.Close()
+
+	stream, cursor := createEventsStream(t, "events")
+	recs := publishEvents(t, stream.Id, "a", "b")
+
+	res, err := http.Get(srv.URL + "/streams/" + stream.Id + "/records/events?cursor=" + cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	events := bufio.NewReader(res.Body)
+	for i := range recs {
+		e := readEvent(t, events)
+		if e.id != recs[i].Id || e.eventType != "" {
+			t.Errorf("Event %d has ID %q and type %q, want %q and no type", i, e.id, e.eventType, recs[i].Id)
+		}
+
+		var doc recordDocument
+		err = json.Unmarshal([]byte(e.data), &doc)
+		if err != nil {
+			t.Fatalf("Error decoding event data %q: %s", e.data, err)
+		} else if doc.RecordId != recs[i].Id || doc.Sequence != recs[i].Sequence {
+			t.Errorf("Event %d is record %s, want %s", i, doc.RecordId, recs[i].Id)
+		}
+	}
+
+	// The batch is acknowledged once it has been sent
+	waitFor(t, "the cursor to be acknowledged", func() bool {
+		c, err := platformImpl.GetCursor(stream.Id, cursor.Id)
+		return err == nil && c.Position == "2"
+	})
+}
+
+func TestRecordEventsError(t *testing.T) {
+	useMemoryPlatform()
+	srv := newEventsServer()
+	defer srv.Close()
+
+	stream, cursor := createEventsStream(t, "events-error")
+	err := platformImpl.DeleteCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/streams/" + stream.Id + "/records/events?cursor=" + cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	e := readEvent(t, bufio.NewReader(res.Body))
+	if e.eventType != "error" || e.id != "" {
+		t.Errorf("Got event type %q with ID %q, want an error event without an ID", e.eventType, e.id)
+	}
+
+	var p problem
+	err = json.Unmarshal([]byte(e.data), &p)
+	if err != nil {
+		t.Fatalf("Error decoding error event %q: %s", e.data, err)
+	} else if p.Status != http.StatusNotFound {
+		t.Errorf("Got status %d, want %d", p.Status, http.StatusNotFound)
+	}
+}
+
+func TestRecordEventsResume(t *testing.T) {
+	useMemoryPlatform()
+	srv := newEventsServer()
+	defer srv.Close()
+
+	stream, _ := createEventsStream(t, "events-resume")
+	recs := publishEvents(t, stream.Id, "a", "b", "c")
+
+	// A temporary cursor picks up after the last event the client saw
+	req, err := http.NewRequest("GET", srv.URL+"/streams/"+stream.Id+"/records/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", recs[0].Id)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	events := bufio.NewReader(res.Body)
+	for _, want := range recs[1:] {
+		if e := readEvent(t, events); e.id != want.Id {
+			t.Errorf("Got event %q, want %q", e.id, want.Id)
+		}
+	}
+}
+
+func TestRecordEventsDisconnect(t *testing.T) {
+	useMemoryPlatform()
+	srv := newEventsServer()
+	defer srv.Close()
+
+	stream, _ := createEventsStream(t, "events-disconnect")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/streams/"+stream.Id+"/records/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	cancel()
+
+	// Publishing wakes the handler, which notices the client has gone and removes its temporary cursor
+	waitFor(t, "the temporary cursor to be deleted", func() bool {
+		publishEvents(t, stream.Id, "x")
+
+		cursors, err := platformImpl.ListCursors(stream.Id)
+		return err == nil && len(cursors) == 1
+	})
+}
+
+func TestRecordEventsUnsent(t *testing.T) {
+	useMemoryPlatform()
+
+	stream, cursor := createEventsStream(t, "events-unsent")
+	publishEvents(t, stream.Id, "a", "b")
+
+	// The headers reach the client but the records don't
+	w := &unflushableWriter{header: http.Header{}, flushes: 1}
+	req := httptest.NewRequest("GET", "/streams/"+stream.Id+"/records/events?cursor="+cursor.Id, nil)
+	eventsRouter().ServeHTTP(w, req)
+
+	c, err := platformImpl.GetCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if c.Position != "-1" {
+		t.Errorf("Cursor position = %s, want -1", c.Position)
+	}
+
+	// The batch was released rather than left leased
+	batch, err := platformImpl.GetRecords(stream.Id, cursor.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batch.Records) != 2 {
+		t.Errorf("Got %d records, want 2", len(batch.Records))
+	}
+}
+
+// unflushableWriter accepts writes but fails every flush after the first few, as when the client has hung up.
+type unflushableWriter struct {
+	header  http.Header
+	flushes int
+}
+
+func (w *unflushableWriter) Header() http.Header         { return w.header }
+func (w *unflushableWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *unflushableWriter) WriteHeader(statusCode int)  {}
+func (w *unflushableWriter) Flush()                      { w.FlushError() }
+
+func (w *unflushableWriter) FlushError() error {
+	if w.flushes == 0 {
+		return errors.New("connection reset by peer")
+	}
+
+	w.flushes--
+	return nil
+}
+
+func eventsRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/streams/{stream_id}/records/events", RecordEventsGetHandler)
+
+	return r
+}
+
+func newEventsServer() *httptest.Server {
+	return httptest.NewServer(eventsRouter())
+}
+
+func createEventsStream(t *testing.T, name string) (*platform.Stream, *platform.Cursor) {
+	stream, err := platformImpl.CreateStream(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := platformImpl.CreateCursor(stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream, cursor
+}
+
+func publishEvents(t *testing.T, streamId string, contents ...string) []platform.Record {
+	recs := []platform.Record{}
+	for _, content := range contents {
+		rec, err := platformImpl.CreateRecord(streamId, []byte(content), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, *rec)
+	}
+
+	return recs
+}
+
+// readEvent reads the next event from the stream, passing over keep-alive comments.
+func readEvent(t *testing.T, r *bufio.Reader) event {
+	var e event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event: %s", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.data != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,15 +9,23 @@ import (
 
 	"encoding/hex"
 
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/oceanhq/streams/platform"
 )
 
+const (
+	MAX_BATCH_RECORDS = 500
+
+	IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+)
+
 var (
 	RecordCollectionPostHandler = jsonResponder(recordCreate)
 	RecordCollectionGetHandler  = jsonResponder(recordsIndex)
+	RecordDocumentGetHandler    = jsonResponder(recordGet)
 )
 
 func recordCreate(r *http.Request) (interface{}, int) {
@@ -25,94 +33,221 @@ func recordCreate(r *http.Request) (interface{}, int) {
 	vars := mux.Vars(r)
 	streamId := vars["stream_id"]
 
-	// Parse the content from the request
+	// A retried request carrying the same Idempotency-Key gets back the record it created the first time
+	idempotencyKey := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+
+	// Parse the content from the request. Either a single record or a batch of them may be posted, and each
+	// record in a batch may carry its own idempotency key.
+	// Example: { "records": [ { "content": "aGVsbG8=", "idempotencyKey": "order-1" }, { "content": "d29ybGQ=" } ] }
+	type recordData struct {
+		Content        string `json:"content"`
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
 	type requestData struct {
-		Content string `json:"content"`
+		Content string       `json:"content"`
+		Records []recordData `json:"records"`
 	}
 	parsed := &requestData{}
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(parsed)
 	if err != nil {
-		return jsonError{fmt.Sprintf("JSON parse error: %s", err.Error())}, http.StatusBadRequest
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	if parsed.Records != nil {
+		contents := make([]string, len(parsed.Records))
+		keys := make([]string, len(parsed.Records))
+		for i, rec := range parsed.Records {
+			contents[i] = rec.Content
+			keys[i] = rec.IdempotencyKey
+
+			// Records without a key of their own are keyed by the header and their position in the batch
+			if keys[i] == "" && idempotencyKey != "" {
+				keys[i] = fmt.Sprintf("%s/%d", idempotencyKey, i)
+			}
+		}
+
+		return recordBatchCreate(streamId, contents, keys)
 	}
 
 	content, err := base64.StdEncoding.DecodeString(parsed.Content)
 	if err != nil {
-		return jsonError{fmt.Sprintf("Error decoding content: %s", err.Error())}, http.StatusBadRequest
+		return invalidRequest("Error decoding content: %s", err.Error())
 	}
 
 	// Publish the new record to the stream
-	rec, err := platformImpl.CreateRecord(streamId, content)
+	rec, err := platformImpl.CreateRecord(streamId, content, idempotencyKey)
 	if err != nil {
-		code := http.StatusInternalServerError
+		return errorResponse(err)
+	}
+
+	return toCreatedRecordDocument(rec), http.StatusCreated
+}
 
-		// In case the client supplies a non-existant stream, bad request
-		if _, ok := err.(*platform.ErrStreamNotFound); ok {
-			code = http.StatusBadRequest
+// recordBatchCreate publishes a batch of base64 encoded records with their idempotency keys. Each record succeeds
+// or fails on its own; the response lists a result for every record, in order, and is a 207 if any of them failed.
+func recordBatchCreate(streamId string, encContents []string, idempotencyKeys []string) (interface{}, int) {
+	if len(encContents) == 0 {
+		return invalidRequest("At least one record must be supplied.")
+	} else if len(encContents) > MAX_BATCH_RECORDS {
+		return invalidRequest("No more than %d records may be published at once.", MAX_BATCH_RECORDS)
+	}
+
+	res := &recordBatchResultCollection{
+		Records: make([]recordBatchResult, len(encContents))}
+
+	// Records which fail to decode are left out of the batch sent to the platform
+	contents := [][]byte{}
+	keys := []string{}
+	indexes := []int{}
+	for i, encContent := range encContents {
+		content, err := base64.StdEncoding.DecodeString(encContent)
+		if err != nil {
+			res.Records[i] = failedBatchResult(&ErrInvalidRequest{fmt.Sprintf("Error decoding content: %s", err.Error())})
+			continue
 		}
 
-		return asJsonError(err), code
+		contents = append(contents, content)
+		keys = append(keys, idempotencyKeys[i])
+		indexes = append(indexes, i)
 	}
 
-	res := &recordDocument{
+	if len(contents) > 0 {
+		results, err := platformImpl.CreateRecords(streamId, contents, keys)
+		if err != nil {
+			return errorResponse(err)
+		}
+
+		for k, result := range results {
+			if result.Err != nil {
+				res.Records[indexes[k]] = failedBatchResult(result.Err)
+			} else {
+				res.Records[indexes[k]] = recordBatchResult{
+					Status:         http.StatusCreated,
+					recordDocument: toCreatedRecordDocument(result.Record)}
+			}
+		}
+	}
+
+	code := http.StatusCreated
+	for _, result := range res.Records {
+		if result.Status != http.StatusCreated {
+			code = http.StatusMultiStatus
+		}
+	}
+
+	return res, code
+}
+
+func toCreatedRecordDocument(rec *platform.Record) *recordDocument {
+	return &recordDocument{
 		RecordId:    rec.Id,
+		Sequence:    rec.Sequence,
 		Content:     "", // Omit content. Returning the hash is sufficient for client validation.
 		ContentSha1: hex.EncodeToString(rec.ContentHash),
 		Timestamp:   rec.Timestamp.Format(time.RFC3339Nano)}
-
-	return res, http.StatusCreated
 }
 
 func recordsIndex(r *http.Request) (interface{}, int) {
-	cursorId := r.Header.Get("X-Cursor-ID")
+	// Get stream ID, and the cursor ID when reading through a cursor's path, from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	cursorId := vars["cursor_id"]
 
 	if cursorId == "" {
-		return jsonError{"X-Cursor-ID header must be specified."}, http.StatusBadRequest
+		cursorId = r.Header.Get("X-Cursor-ID")
 	}
 
-	// Get stream ID from path
-	vars := mux.Vars(r)
-	streamId := vars["stream_id"]
+	if cursorId == "" {
+		return invalidRequest("X-Cursor-ID header must be specified.")
+	}
 
-	recs, err := platformImpl.GetRecords(streamId, cursorId)
-	if err != nil {
-		code := http.StatusInternalServerError
-
-		if _, ok := err.(*platform.ErrInvalidParam); ok {
-			code = http.StatusBadRequest
-		} else if _, ok := err.(*platform.ErrStreamNotFound); ok {
-			code = http.StatusNotFound
-		} else if _, ok := err.(*platform.ErrCursorNotFound); ok {
-			code = http.StatusBadRequest
+	// Optionally block for up to `wait` seconds until records are available
+	// Example: GET /streams/{stream_id}/records?wait=20
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > platform.MAX_WAIT {
+			return invalidRequest("wait must be a number of seconds between 0 and %d.", int(platform.MAX_WAIT.Seconds()))
 		}
 
-		return asJsonError(err), code
+		wait = time.Duration(seconds) * time.Second
 	}
 
-	res := &recordCollection{
-		Records: []recordDocument{}}
+	batch, err := platformImpl.GetRecords(streamId, cursorId, wait)
+	if err != nil {
+		return errorResponse(err)
+	}
 
-	for i := 0; i < len(recs); i++ {
-		rec := recs[i]
+	res := &recordCollection{
+		Receipt: batch.Receipt,
+		Records: []recordDocument{},
+		Skipped: batch.Skipped}
 
-		doc := recordDocument{
-			RecordId:    rec.Id,
-			Content:     base64.StdEncoding.EncodeToString(rec.Content),
-			ContentSha1: hex.EncodeToString(rec.ContentHash),
-			Timestamp:   rec.Timestamp.Format(time.RFC3339Nano)}
-		res.Records = append(res.Records, doc)
+	for i := 0; i < len(batch.Records); i++ {
+		res.Records = append(res.Records, *toRecordDocument(&batch.Records[i]))
 	}
 
 	return res, http.StatusOK
 }
 
+func recordGet(r *http.Request) (interface{}, int) {
+	// Get stream and record IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	recordId := vars["record_id"]
+
+	rec, err := platformImpl.GetRecord(streamId, recordId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toRecordDocument(rec), http.StatusOK
+}
+
+func toRecordDocument(rec *platform.Record) *recordDocument {
+	return &recordDocument{
+		RecordId:    rec.Id,
+		Sequence:    rec.Sequence,
+		Content:     base64.StdEncoding.EncodeToString(rec.Content),
+		ContentSha1: hex.EncodeToString(rec.ContentHash),
+		Timestamp:   rec.Timestamp.Format(time.RFC3339Nano)}
+}
+
 type recordDocument struct {
 	RecordId    string `json:"recordId"`
+	Sequence    uint64 `json:"sequence"`
 	Content     string `json:"content,omitempty"`
 	ContentSha1 string `json:"contentHash"`
 	Timestamp   string `json:"timestamp"`
 }
 
 type recordCollection struct {
+	// Receipt must be posted to the cursor's ack endpoint once the records have been processed.
+	Receipt string           `json:"receipt,omitempty"`
 	Records []recordDocument `json:"records"`
+	// Skipped counts corrupt records which were quarantined instead of being returned.
+	Skipped int `json:"skipped"`
+}
+
+// recordBatchResult is the outcome of publishing one record of a batch.
+type recordBatchResult struct {
+	Status int `json:"status"`
+	*recordDocument
+	// Code is one of the problem codes returned for whole requests.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func failedBatchResult(err error) recordBatchResult {
+	t := problemTypeOf(err)
+
+	return recordBatchResult{
+		Status: t.status,
+		Code:   t.code,
+		Error:  err.Error()}
+}
+
+type recordBatchResultCollection struct {
+	Records []recordBatchResult `json:"records"`
 }
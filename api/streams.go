@@ -1,11 +1,13 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 
 	"encoding/json"
 
-	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/oceanhq/streams/platform"
@@ -15,38 +17,42 @@ var (
 	StreamCollectionPostHandler = jsonResponder(streamCreate)
 	StreamCollectionGetHandler  = jsonResponder(streamsIndex)
 	StreamDocumentGetHandler    = jsonResponder(streamGet)
+	StreamDocumentPatchHandler  = jsonResponder(streamUpdate)
+	StreamDocumentDeleteHandler = jsonResponder(streamDelete)
+	StreamRestorePostHandler    = jsonResponder(streamRestore)
 )
 
 func streamCreate(r *http.Request) (interface{}, int) {
 	// Parse the expected request body
-	// Example: { "name": "tobyjsullivan/weather" }
+	// The window in which idempotency keys are remembered can optionally be given in seconds.
+	// Example: { "name": "tobyjsullivan/weather", "dedupeWindow": 3600 }
 	type requestData struct {
-		Name string `json:"name"`
+		Name         string `json:"name"`
+		DedupeWindow int64  `json:"dedupeWindow"`
 	}
 	parsed := &requestData{}
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(parsed)
 	if err != nil {
-		return jsonError{fmt.Sprintf("JSON parse error: %s", err.Error())}, http.StatusBadRequest
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	// Check the window up front so that a stream isn't left behind when it's invalid
+	window, err := secondsToDuration("dedupeWindow", parsed.DedupeWindow, platform.MAX_DEDUPE_WINDOW)
+	if err != nil {
+		return errorResponse(err)
 	}
 
 	// Create the actual stream on the platform
 	stream, err := platformImpl.CreateStream(parsed.Name)
+	if err == nil && window != 0 {
+		stream, err = platformImpl.SetDedupeWindow(stream.Id, window)
+	}
 	if err != nil {
-		code := http.StatusInternalServerError
-
-		// platform.InvalidParamErrors imply that the client didn't provide a required value.
-		// Details will be in error text.
-		if _, ok := err.(*platform.ErrInvalidParam); ok {
-			code = http.StatusBadRequest
-		}
-
-		return asJsonError(err), code
+		return errorResponse(err)
 	}
 
-	res := &streamDocument{
-		StreamId: stream.Id,
-		Name:     stream.Name}
+	res := toStreamDocument(stream)
 
 	// Return a success
 	return res, http.StatusCreated
@@ -55,7 +61,7 @@ func streamCreate(r *http.Request) (interface{}, int) {
 func streamsIndex(r *http.Request) (interface{}, int) {
 	streams, err := platformImpl.ListStreams()
 	if err != nil {
-		return asJsonError(err), http.StatusInternalServerError
+		return errorResponse(err)
 	}
 
 	// Copy returned stream list into marshallable response object
@@ -64,9 +70,7 @@ func streamsIndex(r *http.Request) (interface{}, int) {
 	for i := 0; i < len(streams); i++ {
 		stream := streams[i]
 
-		list.Streams[i] = streamDocument{
-			StreamId: stream.Id,
-			Name:     stream.Name}
+		list.Streams[i] = *toStreamDocument(&stream)
 	}
 
 	return list, http.StatusOK
@@ -79,30 +83,130 @@ func streamGet(r *http.Request) (interface{}, int) {
 
 	stream, err := platformImpl.GetStream(streamId)
 	if err != nil {
-		code := http.StatusInternalServerError
+		return errorResponse(err)
+	}
+
+	res := toStreamDocument(stream)
+
+	// Return a success
+	return res, http.StatusOK
+}
+
+func streamUpdate(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	// Only the dedupe window can be changed. Zero restores the default.
+	// Example: { "dedupeWindow": 3600 }
+	type requestData struct {
+		DedupeWindow *int64 `json:"dedupeWindow"`
+	}
+	parsed := &requestData{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(parsed)
+	if err != nil {
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	if parsed.DedupeWindow == nil {
+		return invalidRequest("dedupeWindow must be specified.")
+	}
+
+	window, err := secondsToDuration("dedupeWindow", *parsed.DedupeWindow, platform.MAX_DEDUPE_WINDOW)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	stream, err := platformImpl.SetDedupeWindow(streamId, window)
+	if err != nil {
+		return errorResponse(err)
+	}
 
-		if _, ok := err.(*platform.ErrStreamNotFound); ok {
-			code = http.StatusNotFound
-		} else if _, ok := err.(*platform.ErrInvalidParam); ok {
-			code = http.StatusBadRequest
+	return toStreamDocument(stream), http.StatusOK
+}
+
+func streamDelete(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	// The stream can optionally be kept around, read-only, for a number of seconds during which it can be restored.
+	// Example: DELETE /streams/{stream_id}?retention=86400
+	var retention time.Duration
+	if value := r.URL.Query().Get("retention"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return invalidRequest("Invalid retention: %s", value)
 		}
 
-		return asJsonError(err), code
+		retention, err = secondsToDuration("retention", seconds, platform.MAX_RETENTION)
+		if err != nil {
+			return errorResponse(err)
+		}
 	}
 
-	res := &streamDocument{
-		StreamId: stream.Id,
-		Name:     stream.Name}
+	stream, err := platformImpl.DeleteStream(streamId, retention)
+	if err != nil {
+		return errorResponse(err)
+	}
 
-	// Return a success
-	return res, http.StatusOK
+	// Purged streams are gone for good
+	if retention == 0 {
+		return nil, http.StatusNoContent
+	}
+
+	return toStreamDocument(stream), http.StatusOK
+}
+
+func streamRestore(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	stream, err := platformImpl.RestoreStream(streamId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toStreamDocument(stream), http.StatusOK
+}
+
+func toStreamDocument(stream *platform.Stream) *streamDocument {
+	doc := &streamDocument{
+		StreamId:     stream.Id,
+		Name:         stream.Name,
+		DedupeWindow: int64(stream.DedupeWindow / time.Second)}
+
+	if !stream.DeletedAt.IsZero() {
+		doc.DeletedAt = stream.DeletedAt.Format(time.RFC3339Nano)
+		doc.PurgeAt = stream.PurgeAt.Format(time.RFC3339Nano)
+	}
+
+	return doc
 }
 
 type streamDocument struct {
-	StreamId string `json:"streamId"`
-	Name     string `json:"name"`
+	StreamId     string `json:"streamId"`
+	Name         string `json:"name"`
+	DedupeWindow int64  `json:"dedupeWindow"`
+	DeletedAt    string `json:"deletedAt,omitempty"`
+	PurgeAt      string `json:"purgeAt,omitempty"`
 }
 
 type streamCollection struct {
 	Streams []streamDocument `json:"streams"`
 }
+
+// secondsToDuration converts a number of seconds given in a request, checking it against max first so that a huge
+// value can't overflow into a negative duration.
+func secondsToDuration(param string, seconds int64, max time.Duration) (time.Duration, error) {
+	if seconds < 0 || seconds > int64(max/time.Second) {
+		return 0, &platform.ErrInvalidParam{
+			Param: param,
+			Value: strconv.FormatInt(seconds, 10),
+			Err:   fmt.Errorf("Must be between 0 and %d seconds.", int64(max/time.Second))}
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+func TestSecondsToDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds int64
+		want    time.Duration
+		wantErr bool
+	}{
+		{"Zero", 0, 0, false},
+		{"Max", int64(platform.MAX_RETENTION / time.Second), platform.MAX_RETENTION, false},
+		{"OverMax", int64(platform.MAX_RETENTION/time.Second) + 1, 0, true},
+		{"Negative", -1, 0, true},
+		// Multiplied out, this would wrap around to a negative duration
+		{"Overflow", math.MaxInt64 / 1000, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := secondsToDuration("retention", test.seconds, platform.MAX_RETENTION)
+			if test.wantErr {
+				if _, ok := err.(*platform.ErrInvalidParam); !ok {
+					t.Errorf("Got %s, %v, want an *ErrInvalidParam", got, err)
+				}
+			} else if err != nil || got != test.want {
+				t.Errorf("Got %s, %v, want %s", got, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	SubscriptionCollectionPostHandler = jsonResponder(subscriptionCreate)
+	SubscriptionCollectionGetHandler  = jsonResponder(subscriptionsIndex)
+	SubscriptionDocumentGetHandler    = jsonResponder(subscriptionGet)
+	SubscriptionDocumentDeleteHandler = jsonResponder(subscriptionDelete)
+	SubscriptionResumePostHandler     = jsonResponder(subscriptionResume)
+)
+
+func subscriptionCreate(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	// Parse the target URL, optional secret and the optional start position and dead-letter policy of its cursor
+	// Example: { "url": "https://example.com/hooks/ocean", "secret": "s3cr3t", "start": "earliest" }
+	type requestData struct {
+		Url    string `json:"url"`
+		Secret string `json:"secret"`
+		cursorRequestData
+	}
+	parsed := &requestData{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(parsed)
+	if err != nil {
+		return invalidRequest("JSON parse error: %s", err.Error())
+	}
+
+	err = checkWebhookURL(parsed.Url, webhookAllowPrivate)
+	if err != nil {
+		return invalidRequest("%s", err.Error())
+	}
+
+	start, err := parsed.startPosition()
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	sub, err := webhookSubscriptions.create(streamId, parsed.Url, parsed.Secret, *start, parsed.deadLetterPolicy())
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// The secret is only ever returned when the subscription is created
+	resp := toSubscriptionDocument(sub)
+	resp.Secret = sub.secret
+
+	return resp, http.StatusCreated
+}
+
+func subscriptionsIndex(r *http.Request) (interface{}, int) {
+	// Get stream ID from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+
+	subs := webhookSubscriptions.list(streamId)
+
+	list := &subscriptionCollection{
+		Subscriptions: make([]subscriptionDocument, len(subs))}
+	for i := 0; i < len(subs); i++ {
+		list.Subscriptions[i] = *toSubscriptionDocument(subs[i])
+	}
+
+	return list, http.StatusOK
+}
+
+func subscriptionGet(r *http.Request) (interface{}, int) {
+	// Get stream and subscription IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	subscriptionId := vars["subscription_id"]
+
+	sub, err := webhookSubscriptions.get(streamId, subscriptionId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return toSubscriptionDocument(sub), http.StatusOK
+}
+
+func subscriptionDelete(r *http.Request) (interface{}, int) {
+	// Get stream and subscription IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	subscriptionId := vars["subscription_id"]
+
+	err := webhookSubscriptions.remove(streamId, subscriptionId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return nil, http.StatusNoContent
+}
+
+// subscriptionResume restarts delivery on a subscription that gave up after too many failures.
+func subscriptionResume(r *http.Request) (interface{}, int) {
+	// Get stream and subscription IDs from path
+	vars := mux.Vars(r)
+	streamId := vars["stream_id"]
+	subscriptionId := vars["subscription_id"]
+
+	sub, err := webhookSubscriptions.get(streamId, subscriptionId)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	webhookSubscriptions.resume(sub)
+
+	return toSubscriptionDocument(sub), http.StatusOK
+}
+
+func toSubscriptionDocument(sub *subscription) *subscriptionDocument {
+	status := sub.currentStatus()
+
+	return &subscriptionDocument{
+		SubscriptionId: sub.id,
+		StreamId:       sub.streamId,
+		CursorId:       sub.cursorId,
+		Url:            sub.url,
+		CreatedAt:      sub.createdAt.Format(time.RFC3339Nano),
+		Status: deliveryStatusDocument{
+			State:          status.State,
+			Delivered:      status.Delivered,
+			Failures:       status.Failures,
+			LastAttemptAt:  formatOptionalTime(status.LastAttemptAt),
+			LastDeliveryAt: formatOptionalTime(status.LastDeliveryAt),
+			NextAttemptAt:  formatOptionalTime(status.NextAttemptAt),
+			LastError:      status.LastError}}
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+type subscriptionDocument struct {
+	SubscriptionId string                 `json:"subscriptionId"`
+	StreamId       string                 `json:"streamId"`
+	CursorId       string                 `json:"cursorId"`
+	Url            string                 `json:"url"`
+	Secret         string                 `json:"secret,omitempty"`
+	CreatedAt      string                 `json:"createdAt"`
+	Status         deliveryStatusDocument `json:"status"`
+}
+
+type deliveryStatusDocument struct {
+	State          string `json:"state"`
+	Delivered      int64  `json:"delivered"`
+	Failures       int    `json:"failures"`
+	LastAttemptAt  string `json:"lastAttemptAt,omitempty"`
+	LastDeliveryAt string `json:"lastDeliveryAt,omitempty"`
+	NextAttemptAt  string `json:"nextAttemptAt,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+}
+
+type subscriptionCollection struct {
+	Subscriptions []subscriptionDocument `json:"subscriptions"`
+}
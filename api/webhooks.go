@@ -0,0 +1,756 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	WEBHOOK_TIMEOUT         = 10 * time.Second
+	WEBHOOK_INITIAL_BACKOFF = 1 * time.Second
+	WEBHOOK_MAX_BACKOFF     = 5 * time.Minute
+	// WEBHOOK_MAX_ATTEMPTS is the number of consecutive failures after which a subscription stops delivering.
+	WEBHOOK_MAX_ATTEMPTS = 10
+
+	WEBHOOK_SIGNATURE_HEADER    = "X-Signature"
+	WEBHOOK_SUBSCRIPTION_HEADER = "X-Subscription-ID"
+
+	SUBSCRIPTION_ACTIVE   = "active"
+	SUBSCRIPTION_RETRYING = "retrying"
+	SUBSCRIPTION_FAILED   = "failed"
+
+	SUBSCRIPTION_SECRET_LENGTH = 32
+	SUBSCRIPTION_ID_LENGTH     = 16
+
+	// SUBSCRIPTIONS_STREAM is the name of the stream in which subscriptions are recorded, so that they're restored
+	// along with their cursors when the server restarts.
+	SUBSCRIPTIONS_STREAM = "_webhook_subscriptions"
+
+	SUBSCRIPTION_CREATED = "created"
+	SUBSCRIPTION_REMOVED = "removed"
+)
+
+var webhookClient = newWebhookClient()
+
+// webhookAllowPrivate lets subscriptions deliver to loopback, link-local and private addresses. It's set by the
+// WEBHOOK_ALLOW_PRIVATE option, and is off by default so that a subscription can't be used to reach services on
+// the server's own network, such as a cloud provider's metadata endpoint.
+var webhookAllowPrivate bool
+
+// webhookSubscriptions holds every webhook subscription.
+var webhookSubscriptions = &subscriptionRegistry{
+	subs: map[string]*subscription{}}
+
+type subscriptionRegistry struct {
+	// mu guards subs and storeId, and is held while a subscription is started or stopped so that one can't be
+	// resumed as it's removed.
+	mu   sync.Mutex
+	subs map[string]*subscription
+
+	// storeId is the ID of the SUBSCRIPTIONS_STREAM, once it has been found or created.
+	storeId string
+}
+
+// subscriptionEvent is a record of the SUBSCRIPTIONS_STREAM. Created events hold everything needed to restart
+// a subscription, while removed events only carry its ID.
+// Example: { "type": "removed", "id": "3f2a..." }
+type subscriptionEvent struct {
+	Type       string    `json:"type"`
+	Id         string    `json:"id"`
+	StreamId   string    `json:"streamId,omitempty"`
+	CursorId   string    `json:"cursorId,omitempty"`
+	Url        string    `json:"url,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	DeadLetter bool      `json:"deadLetter,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// subscription pushes the records of an internal cursor to a URL. Each batch is retried with exponential
+// backoff until the receiver responds with a 2xx status, and only then acked, so delivery is at-least-once.
+// A failed batch is handed back while waiting out the backoff, so that its lease can't run out in the meantime,
+// and read again for the next attempt. When the cursor has a dead-letter policy, failed batches are nacked so
+// that records which keep failing are moved to the dead-letter stream rather than holding up the subscription.
+type subscription struct {
+	id         string
+	streamId   string
+	cursorId   string
+	url        string
+	secret     string
+	deadLetter bool
+	createdAt  time.Time
+
+	mu     sync.Mutex
+	stop   chan struct{}
+	status deliveryStatus
+	// removed is set once the subscription has been stopped for good. It is only changed while the registry's
+	// mu is held.
+	removed bool
+}
+
+type deliveryStatus struct {
+	State          string
+	Delivered      int64
+	Failures       int
+	LastAttemptAt  time.Time
+	LastDeliveryAt time.Time
+	NextAttemptAt  time.Time
+	LastError      string
+}
+
+// webhookPayload is the body POSTed to a subscription's URL.
+type webhookPayload struct {
+	SubscriptionId string           `json:"subscriptionId"`
+	StreamId       string           `json:"streamId"`
+	Records        []recordDocument `json:"records"`
+}
+
+type ErrSubscriptionNotFound struct {
+	SubscriptionID string
+	StreamID       string
+}
+
+func (e *ErrSubscriptionNotFound) Error() string {
+	return fmt.Sprintf("The subscription \"%s\" could not be found on stream \"%s\".", e.SubscriptionID, e.StreamID)
+}
+
+// create starts delivering a stream's records to url through a new cursor. A secret is generated when none is given.
+func (reg *subscriptionRegistry) create(streamId string, url string, secret string, start platform.StartPosition, deadLetter *platform.DeadLetterPolicy) (*subscription, error) {
+	var err error
+	if secret == "" {
+		secret, err = randomHex(SUBSCRIPTION_SECRET_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := randomHex(SUBSCRIPTION_ID_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := createCursor(streamId, start, deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		id:         id,
+		streamId:   streamId,
+		cursorId:   cursor.Id,
+		url:        url,
+		secret:     secret,
+		deadLetter: deadLetter != nil,
+		createdAt:  time.Now(),
+		stop:       make(chan struct{}),
+		status: deliveryStatus{
+			State: SUBSCRIPTION_ACTIVE}}
+
+	// Without a record of the subscription its cursor would be orphaned by a restart
+	err = reg.record(sub.createdEvent())
+	if err != nil {
+		deleteErr := platformImpl.DeleteCursor(streamId, cursor.Id)
+		if deleteErr != nil {
+			log.Printf("Error deleting cursor %s of unrecorded subscription: %s", cursor.Id, deleteErr)
+		}
+
+		return nil, err
+	}
+
+	reg.mu.Lock()
+	reg.subs[id] = sub
+	reg.mu.Unlock()
+
+	go sub.run(sub.stop)
+
+	return sub, nil
+}
+
+// restore replaces the registry's subscriptions with those recorded in the SUBSCRIPTIONS_STREAM, e.g. after a
+// restart or once a snapshot has been loaded. Subscriptions whose cursor has since gone are left out.
+func (reg *subscriptionRegistry) restore() error {
+	reg.stopAll()
+
+	reg.mu.Lock()
+	reg.storeId = ""
+	reg.mu.Unlock()
+
+	storeId, err := reg.store(false)
+	if err != nil || storeId == "" {
+		return err
+	}
+
+	recs, err := readAllRecords(storeId)
+	if err != nil {
+		return err
+	}
+
+	events := map[string]*subscriptionEvent{}
+	for i := 0; i < len(recs); i++ {
+		event := &subscriptionEvent{}
+		err = json.Unmarshal(recs[i].Content, event)
+		if err != nil {
+			log.Printf("Skipping unreadable subscription record %s: %s", recs[i].Id, err)
+			continue
+		}
+
+		switch event.Type {
+		case SUBSCRIPTION_CREATED:
+			events[event.Id] = event
+		case SUBSCRIPTION_REMOVED:
+			delete(events, event.Id)
+		}
+	}
+
+	subs := map[string]*subscription{}
+	for id, event := range events {
+		_, err = platformImpl.GetCursor(event.StreamId, event.CursorId)
+		if isPermanentDeliveryError(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		subs[id] = &subscription{
+			id:         id,
+			streamId:   event.StreamId,
+			cursorId:   event.CursorId,
+			url:        event.Url,
+			secret:     event.Secret,
+			deadLetter: event.DeadLetter,
+			createdAt:  event.CreatedAt,
+			stop:       make(chan struct{}),
+			status: deliveryStatus{
+				State: SUBSCRIPTION_ACTIVE}}
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.subs = subs
+	for _, sub := range subs {
+		go sub.run(sub.stop)
+	}
+
+	return nil
+}
+
+// stopAll stops delivery on every subscription, e.g. on shutdown, without removing any.
+func (reg *subscriptionRegistry) stopAll() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for id, sub := range reg.subs {
+		sub.mu.Lock()
+		sub.removed = true
+		close(sub.stop)
+		sub.mu.Unlock()
+
+		delete(reg.subs, id)
+	}
+}
+
+// store returns the ID of the SUBSCRIPTIONS_STREAM, creating the stream if it's missing and create is set.
+// Without create, an empty ID means no subscription has been recorded yet.
+func (reg *subscriptionRegistry) store(create bool) (string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.storeId != "" {
+		return reg.storeId, nil
+	}
+
+	streams, err := platformImpl.ListStreams()
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < len(streams); i++ {
+		if streams[i].Name == SUBSCRIPTIONS_STREAM && streams[i].DeletedAt.IsZero() {
+			reg.storeId = streams[i].Id
+			return reg.storeId, nil
+		}
+	}
+
+	if !create {
+		return "", nil
+	}
+
+	stream, err := platformImpl.CreateStream(SUBSCRIPTIONS_STREAM)
+	if err != nil {
+		return "", err
+	}
+
+	reg.storeId = stream.Id
+	return reg.storeId, nil
+}
+
+// record appends an event to the SUBSCRIPTIONS_STREAM.
+func (reg *subscriptionRegistry) record(event *subscriptionEvent) error {
+	storeId, err := reg.store(true)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = platformImpl.CreateRecord(storeId, content, "")
+	return err
+}
+
+func (reg *subscriptionRegistry) get(streamId string, id string) (*subscription, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	sub, ok := reg.subs[id]
+	if !ok || sub.streamId != streamId {
+		return nil, &ErrSubscriptionNotFound{
+			SubscriptionID: id,
+			StreamID:       streamId}
+	}
+
+	return sub, nil
+}
+
+// list returns a stream's subscriptions in the order they were created.
+func (reg *subscriptionRegistry) list(streamId string) []*subscription {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	out := []*subscription{}
+	for _, sub := range reg.subs {
+		if sub.streamId == streamId {
+			out = append(out, sub)
+		}
+	}
+	sort.Sort(subscriptionsByCreated(out))
+
+	return out
+}
+
+// remove stops a subscription and deletes its cursor.
+func (reg *subscriptionRegistry) remove(streamId string, id string) error {
+	_, err := reg.get(streamId, id)
+	if err != nil {
+		return err
+	}
+
+	// Once the removal is recorded the subscription won't be restored, even if the rest fails
+	err = reg.record(&subscriptionEvent{Type: SUBSCRIPTION_REMOVED, Id: id})
+	if err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	sub, ok := reg.subs[id]
+	if !ok || sub.streamId != streamId {
+		reg.mu.Unlock()
+		return &ErrSubscriptionNotFound{
+			SubscriptionID: id,
+			StreamID:       streamId}
+	}
+	delete(reg.subs, id)
+
+	sub.mu.Lock()
+	sub.removed = true
+	close(sub.stop)
+	sub.mu.Unlock()
+	reg.mu.Unlock()
+
+	err = platformImpl.DeleteCursor(sub.streamId, sub.cursorId)
+	if _, ok := err.(*platform.ErrCursorNotFound); ok {
+		// The cursor has already gone along with its stream
+		return nil
+	} else if _, ok := err.(*platform.ErrStreamNotFound); ok {
+		return nil
+	}
+
+	return err
+}
+
+// resume restarts delivery on a subscription that has failed. Active and removed subscriptions are left as they are.
+func (reg *subscriptionRegistry) resume(sub *subscription) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.removed || sub.status.State != SUBSCRIPTION_FAILED {
+		return
+	}
+
+	sub.status.State = SUBSCRIPTION_ACTIVE
+	sub.status.Failures = 0
+	sub.status.NextAttemptAt = time.Time{}
+	sub.stop = make(chan struct{})
+
+	go sub.run(sub.stop)
+}
+
+func (s *subscription) currentStatus() deliveryStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+// run delivers batches until the subscription is removed or fails permanently.
+func (s *subscription) run(stop chan struct{}) {
+	for {
+		batch, err := platformImpl.GetRecords(s.streamId, s.cursorId, EVENTS_POLL_WAIT)
+		if stopped(stop) {
+			// A subscription stopped without being removed is picked up again after a restart, so it mustn't be
+			// left waiting for the lease to run out
+			if err == nil && len(batch.Records) > 0 {
+				releaseErr := releaseBatch(s.streamId, s.cursorId, batch, "The subscription was stopped.")
+				if releaseErr != nil {
+					log.Printf("Error releasing webhook delivery for subscription %s: %s", s.id, releaseErr.Error())
+				}
+			}
+			return
+		}
+
+		if err != nil {
+			if isPermanentDeliveryError(err) {
+				s.fail(err)
+				return
+			}
+
+			if !s.retryAfter(err, stop) {
+				return
+			}
+			continue
+		}
+
+		if len(batch.Records) == 0 {
+			continue
+		}
+
+		if !s.deliver(batch, stop) {
+			return
+		}
+	}
+}
+
+// deliver POSTs a batch and acks it once it's accepted. A batch that isn't accepted is handed back before waiting
+// out the backoff, however long that is, and read again for the next attempt. It returns false if the subscription
+// stopped or failed.
+func (s *subscription) deliver(batch *platform.Batch, stop chan struct{}) bool {
+	payload := &webhookPayload{
+		SubscriptionId: s.id,
+		StreamId:       s.streamId,
+		Records:        make([]recordDocument, len(batch.Records))}
+	for i := 0; i < len(batch.Records); i++ {
+		payload.Records[i] = *toRecordDocument(&batch.Records[i])
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		s.fail(err)
+		return false
+	}
+
+	err = s.post(body)
+	if err != nil {
+		s.handBack(batch, err)
+		return s.retryAfter(err, stop)
+	}
+
+	err = platformImpl.AckRecords(s.streamId, s.cursorId, batch.Receipt)
+	if err != nil {
+		// The lease expired during the request, so the batch will be delivered again.
+		log.Printf("Error acknowledging webhook delivery for subscription %s: %s", s.id, err.Error())
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	s.status.State = SUBSCRIPTION_ACTIVE
+	s.status.Delivered += int64(len(batch.Records))
+	s.status.Failures = 0
+	s.status.LastAttemptAt = now
+	s.status.LastDeliveryAt = now
+	s.status.NextAttemptAt = time.Time{}
+	s.mu.Unlock()
+
+	return true
+}
+
+// handBack returns a batch that wasn't accepted to the cursor. With a dead-letter policy it's nacked, so it counts
+// against the policy when it's redelivered. Otherwise it's released.
+func (s *subscription) handBack(batch *platform.Batch, deliveryErr error) {
+	var err error
+	if s.deadLetter {
+		err = platformImpl.NackRecords(s.streamId, s.cursorId, batch.Receipt, deliveryErr.Error())
+	} else {
+		err = releaseBatch(s.streamId, s.cursorId, batch, deliveryErr.Error())
+	}
+
+	if err != nil {
+		log.Printf("Error handing back webhook delivery for subscription %s: %s", s.id, err.Error())
+	}
+}
+
+// post sends a signed payload to the subscription's URL. Any status other than 2xx is an error.
+func (s *subscription) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SUBSCRIPTION_HEADER, s.id)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signPayload(s.secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %d.", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// retryAfter records a failed attempt and waits out the backoff. It returns false if the subscription
+// stopped or has now failed too many times in a row. Subscriptions with a dead-letter policy never give up.
+func (s *subscription) retryAfter(err error, stop chan struct{}) bool {
+	s.mu.Lock()
+	now := time.Now()
+	s.status.Failures++
+	s.status.LastAttemptAt = now
+	s.status.LastError = err.Error()
+
+	if s.status.Failures >= WEBHOOK_MAX_ATTEMPTS && !s.deadLetter {
+		s.status.State = SUBSCRIPTION_FAILED
+		s.status.NextAttemptAt = time.Time{}
+		s.mu.Unlock()
+		return false
+	}
+
+	delay := webhookBackoff(s.status.Failures)
+	s.status.State = SUBSCRIPTION_RETRYING
+	s.status.NextAttemptAt = now.Add(delay)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (s *subscription) createdEvent() *subscriptionEvent {
+	return &subscriptionEvent{
+		Type:       SUBSCRIPTION_CREATED,
+		Id:         s.id,
+		StreamId:   s.streamId,
+		CursorId:   s.cursorId,
+		Url:        s.url,
+		Secret:     s.secret,
+		DeadLetter: s.deadLetter,
+		CreatedAt:  s.createdAt}
+}
+
+func (s *subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.State = SUBSCRIPTION_FAILED
+	s.status.LastAttemptAt = time.Now()
+	s.status.NextAttemptAt = time.Time{}
+	s.status.LastError = err.Error()
+}
+
+// webhookBackoff doubles the delay after each consecutive failure, up to WEBHOOK_MAX_BACKOFF.
+func webhookBackoff(failures int) time.Duration {
+	delay := WEBHOOK_INITIAL_BACKOFF
+	for i := 1; i < failures && delay < WEBHOOK_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+
+	if delay > WEBHOOK_MAX_BACKOFF {
+		return WEBHOOK_MAX_BACKOFF
+	}
+
+	return delay
+}
+
+// checkWebhookURL returns an error if rawUrl isn't an absolute http or https URL that subscriptions may deliver to.
+// Host names are only checked once they're resolved, when the webhook is sent. See webhookDialControl.
+func checkWebhookURL(rawUrl string, allowPrivate bool) error {
+	target, err := url.Parse(rawUrl)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be an absolute http or https URL.")
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(target.Hostname(), "."))
+	if allowPrivate {
+		return nil
+	} else if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("url must not refer to %s.", host)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	return checkWebhookIP(ip)
+}
+
+// checkWebhookIP refuses the loopback, link-local, private and unspecified addresses that only make sense from
+// inside the server's own network. Link-local covers the 169.254.169.254 metadata endpoint of most clouds.
+func checkWebhookIP(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return fmt.Errorf("Webhooks may not be sent to %s, a loopback, link-local or private address. Set WEBHOOK_ALLOW_PRIVATE to allow them.", ip)
+	}
+
+	return nil
+}
+
+// webhookDialControl checks the address each webhook connection is about to be made to, after any host name has
+// been resolved, so that a name can't be pointed at a private address once the subscription has been created.
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	if webhookAllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Unexpected webhook address %s.", address)
+	}
+
+	return checkWebhookIP(ip)
+}
+
+// newWebhookClient returns a client that only connects to the addresses checkWebhookIP allows. It ignores proxy
+// settings, which would have it connect to the proxy instead.
+func newWebhookClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: WEBHOOK_TIMEOUT,
+		Control: webhookDialControl}).DialContext
+
+	return &http.Client{
+		Timeout:   WEBHOOK_TIMEOUT,
+		Transport: transport}
+}
+
+// readAllRecords reads every record of a stream through a temporary cursor.
+func readAllRecords(streamId string) ([]platform.Record, error) {
+	cursor, err := platformImpl.CreateCursor(streamId, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := platformImpl.DeleteCursor(streamId, cursor.Id)
+		if err != nil {
+			log.Printf("Error deleting temporary cursor %s: %s", cursor.Id, err)
+		}
+	}()
+
+	recs := []platform.Record{}
+	for {
+		batch, err := platformImpl.GetRecords(streamId, cursor.Id, 0)
+		if err != nil {
+			return nil, err
+		} else if len(batch.Records) == 0 {
+			return recs, nil
+		}
+
+		recs = append(recs, batch.Records...)
+
+		err = platformImpl.AckRecords(streamId, cursor.Id, batch.Receipt)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// signPayload returns the hex HMAC-SHA256 of body, prefixed with the algorithm.
+// Example: sha256=5d41402abc4b2a76b9719d911017c592...
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPermanentDeliveryError reports whether a read error means the subscription can never deliver again.
+func isPermanentDeliveryError(err error) bool {
+	if _, ok := err.(*platform.ErrStreamNotFound); ok {
+		return true
+	} else if _, ok := err.(*platform.ErrCursorNotFound); ok {
+		return true
+	} else if _, ok := err.(*platform.ErrInvalidParam); ok {
+		return true
+	}
+
+	return false
+}
+
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+type subscriptionsByCreated []*subscription
+
+func (a subscriptionsByCreated) Len() int      { return len(a) }
+func (a subscriptionsByCreated) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a subscriptionsByCreated) Less(i, j int) bool {
+	if a[i].createdAt.Equal(a[j].createdAt) {
+		return a[i].id < a[j].id
+	}
+
+	return a[i].createdAt.Before(a[j].createdAt)
+}
+
+func randomHex(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+
+	return hex.EncodeToString(b), err
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/memory"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+var memoryPlatformOnce sync.Once
+
+// useMemoryPlatform points the api at an in-memory platform, with webhooks allowed to reach the test servers on
+// loopback addresses. The platform is shared by every test, as subscriptions keep polling it for a while after
+// they're removed, so each test works on its own stream. Event streams and WebSocket subscriptions poll it often so
+// that they notice disconnects quickly.
+func useMemoryPlatform() {
+	memoryPlatformOnce.Do(func() {
+		platformImpl = &memory.InMemoryPlatform{LeaseTimeout: time.Minute}
+		webhookAllowPrivate = true
+		eventsPollWait = 50 * time.Millisecond
+	})
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	useMemoryPlatform()
+
+	// The first attempt is refused so that the batch has to be retried
+	requests := make(chan webhookRequest, 10)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{header: r.Header, body: body}
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	stream, err := platformImpl.CreateStream("webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := platformImpl.CreateRecord(stream.Id, []byte("hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := webhookSubscriptions.create(stream.Id, srv.URL, "s3cr3t", platform.StartPosition{Type: platform.START_EARLIEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhookSubscriptions.remove(stream.Id, sub.id)
+
+	first := receiveWebhook(t, requests)
+	second := receiveWebhook(t, requests)
+
+	for _, req := range []webhookRequest{first, second} {
+		if got, want := req.header.Get(WEBHOOK_SIGNATURE_HEADER), signPayload("s3cr3t", req.body); got != want {
+			t.Errorf("%s = %q, want %q", WEBHOOK_SIGNATURE_HEADER, got, want)
+		}
+		if got := req.header.Get(WEBHOOK_SUBSCRIPTION_HEADER); got != sub.id {
+			t.Errorf("%s = %q, want %q", WEBHOOK_SUBSCRIPTION_HEADER, got, sub.id)
+		}
+	}
+
+	if string(first.body) != string(second.body) {
+		t.Errorf("Retried body %s differs from the first attempt %s", second.body, first.body)
+	}
+
+	payload := &webhookPayload{}
+	err = json.Unmarshal(second.body, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.SubscriptionId != sub.id || payload.StreamId != stream.Id {
+		t.Errorf("Payload is for subscription %q on stream %q, want %q on %q", payload.SubscriptionId, payload.StreamId, sub.id, stream.Id)
+	}
+	if len(payload.Records) != 1 || payload.Records[0].RecordId != rec.Id || payload.Records[0].Content != base64.StdEncoding.EncodeToString([]byte("hello")) {
+		t.Fatalf("Payload records = %+v, want the one published record", payload.Records)
+	}
+
+	// The batch is only acked after the successful attempt, which moves the cursor past the record
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cursor, err := platformImpl.GetCursor(stream.Id, sub.cursorId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status := sub.currentStatus()
+		if cursor.Position != "-1" && status.Delivered == 1 {
+			if status.State != SUBSCRIPTION_ACTIVE || status.Failures != 0 {
+				t.Errorf("Status after delivery = %+v, want active with no failures", status)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Batch was never acked: cursor at %s, status %+v", cursor.Position, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case req := <-requests:
+		t.Errorf("Unexpected redelivery after ack: %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSubscriptionsListedInOrder(t *testing.T) {
+	useMemoryPlatform()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	stream, err := platformImpl.CreateStream("webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		sub, err := webhookSubscriptions.create(stream.Id, srv.URL, "", platform.StartPosition{Type: platform.START_LATEST}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer webhookSubscriptions.remove(stream.Id, sub.id)
+
+		ids = append(ids, sub.id)
+	}
+
+	subs := webhookSubscriptions.list(stream.Id)
+	if len(subs) != len(ids) {
+		t.Fatalf("Listed %d subscriptions, want %d", len(subs), len(ids))
+	}
+	for i, sub := range subs {
+		if sub.id != ids[i] {
+			t.Errorf("Subscription %d is %s, want %s", i, sub.id, ids[i])
+		}
+	}
+}
+
+func TestWebhookSubscriptionsRestored(t *testing.T) {
+	useMemoryPlatform()
+
+	requests := make(chan webhookRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{header: r.Header, body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	stream, err := platformImpl.CreateStream("webhooks-restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := &subscriptionRegistry{subs: map[string]*subscription{}}
+	kept, err := before.create(stream.Id, srv.URL, "s3cr3t", platform.StartPosition{Type: platform.START_LATEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := before.create(stream.Id, srv.URL, "", platform.StartPosition{Type: platform.START_LATEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = before.remove(stream.Id, removed.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the server had restarted
+	before.stopAll()
+	after := &subscriptionRegistry{subs: map[string]*subscription{}}
+	err = after.restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.stopAll()
+
+	restored, err := after.get(stream.Id, kept.id)
+	if err != nil {
+		t.Fatal(err)
+	} else if restored.url != kept.url || restored.secret != kept.secret || restored.cursorId != kept.cursorId || !restored.createdAt.Equal(kept.createdAt) {
+		t.Errorf("Restored %+v, want %+v", restored, kept)
+	}
+
+	if _, err := after.get(stream.Id, removed.id); err == nil {
+		t.Errorf("Removed subscription %s was restored", removed.id)
+	}
+
+	// Delivery carries on through the same cursor
+	rec, err := platformImpl.CreateRecord(stream.Id, []byte("hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := receiveWebhook(t, requests)
+	if got := req.header.Get(WEBHOOK_SUBSCRIPTION_HEADER); got != kept.id {
+		t.Errorf("%s = %q, want %q", WEBHOOK_SUBSCRIPTION_HEADER, got, kept.id)
+	}
+	if got, want := req.header.Get(WEBHOOK_SIGNATURE_HEADER), signPayload("s3cr3t", req.body); got != want {
+		t.Errorf("%s = %q, want %q", WEBHOOK_SIGNATURE_HEADER, got, want)
+	}
+
+	payload := &webhookPayload{}
+	err = json.Unmarshal(req.body, payload)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(payload.Records) != 1 || payload.Records[0].RecordId != rec.Id {
+		t.Errorf("Payload records = %+v, want record %s", payload.Records, rec.Id)
+	}
+
+	err = after.remove(stream.Id, kept.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookFailedBatchHandedBack(t *testing.T) {
+	useMemoryPlatform()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	stream, err := platformImpl.CreateStream("webhooks-handed-back")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = platformImpl.CreateRecord(stream.Id, []byte("hello"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := webhookSubscriptions.create(stream.Id, srv.URL, "", platform.StartPosition{Type: platform.START_EARLIEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhookSubscriptions.remove(stream.Id, sub.id)
+
+	waitFor(t, "a failed delivery", func() bool {
+		return sub.currentStatus().Failures > 0
+	})
+
+	// The lease isn't held through the backoff, so it can't run out before the next attempt
+	batch, err := platformImpl.GetRecords(stream.Id, sub.cursorId, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batch.Records) != 1 {
+		t.Fatalf("Expected the failed batch to be readable, got %d records", len(batch.Records))
+	}
+
+	err = platformImpl.(platform.Releaser).ReleaseRecords(stream.Id, sub.cursorId, batch.Receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		ok           bool
+	}{
+		{"https://example.com/hooks", false, true},
+		{"http://93.184.216.34:8080/hooks", false, true},
+		{"ftp://example.com/", false, false},
+		{"/hooks", false, false},
+		{"http://localhost:3000/", false, false},
+		{"http://api.localhost/", false, false},
+		{"http://127.0.0.1/", false, false},
+		{"http://[::1]/", false, false},
+		{"http://0.0.0.0/", false, false},
+		{"http://169.254.169.254/latest/meta-data/", false, false},
+		{"http://[fe80::1]/", false, false},
+		{"http://10.1.2.3/", false, false},
+		{"http://192.168.0.1/", false, false},
+		{"http://[fd00:ec2::254]/", false, false},
+		{"http://127.0.0.1/", true, true},
+		{"http://localhost:3000/", true, true},
+		{"ftp://127.0.0.1/", true, false},
+	}
+
+	for _, test := range tests {
+		err := checkWebhookURL(test.url, test.allowPrivate)
+		if test.ok && err != nil {
+			t.Errorf("checkWebhookURL(%q, %t) = %s, want no error", test.url, test.allowPrivate, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("checkWebhookURL(%q, %t) = nil, want an error", test.url, test.allowPrivate)
+		}
+	}
+}
+
+func receiveWebhook(t *testing.T, requests chan webhookRequest) webhookRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a webhook delivery")
+	}
+
+	return webhookRequest{}
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oceanhq/streams/platform"
+)
+
+// Message types exchanged over a WebSocket connection. Clients send publish, subscribe, unsubscribe, ack
+// and nack messages, each answered with a message of the corresponding past-tense type (or an error) carrying
+// the same ID. Subscribed cursors push records messages, whose receipts the client acks once processed.
+const (
+	WS_PUBLISH      = "publish"
+	WS_PUBLISHED    = "published"
+	WS_SUBSCRIBE    = "subscribe"
+	WS_SUBSCRIBED   = "subscribed"
+	WS_UNSUBSCRIBE  = "unsubscribe"
+	WS_UNSUBSCRIBED = "unsubscribed"
+	WS_ACK          = "ack"
+	WS_ACKED        = "acked"
+	WS_NACK         = "nack"
+	WS_NACKED       = "nacked"
+	WS_RECORDS      = "records"
+	WS_ERROR        = "error"
+
+	WS_WRITE_WAIT    = 10 * time.Second
+	WS_PONG_WAIT     = 60 * time.Second
+	WS_PING_INTERVAL = 30 * time.Second
+	WS_SEND_BUFFER   = 16
+)
+
+var upgrader = websocket.Upgrader{
+	// Clients are devices and services rather than browsers, so don't restrict origins
+	CheckOrigin: func(r *http.Request) bool { return true }}
+
+var WebSocketHandler = webSocketConnect
+
+// wsMessage is the envelope for every message sent in either direction.
+// Example: { "type": "publish", "id": "1", "streamId": "...", "content": "aGVsbG8=" }
+type wsMessage struct {
+	Type           string           `json:"type"`
+	Id             string           `json:"id,omitempty"`
+	StreamId       string           `json:"streamId,omitempty"`
+	CursorId       string           `json:"cursorId,omitempty"`
+	Content        string           `json:"content,omitempty"`
+	IdempotencyKey string           `json:"idempotencyKey,omitempty"`
+	Receipt        string           `json:"receipt,omitempty"`
+	Reason         string           `json:"reason,omitempty"`
+	Record         *recordDocument  `json:"record,omitempty"`
+	Records        []recordDocument `json:"records,omitempty"`
+	Code           string           `json:"code,omitempty"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// wsSession is a single client connection. Only the write loop writes to the connection; everything
+// else queues messages on send.
+type wsSession struct {
+	conn *websocket.Conn
+	send chan *wsMessage
+	done chan struct{}
+
+	mu            sync.Mutex
+	subscriptions map[string]chan struct{}
+}
+
+func webSocketConnect(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an HTTP error
+		log.Printf("Error upgrading WebSocket connection: %s", err)
+		return
+	}
+
+	s := &wsSession{
+		conn:          conn,
+		send:          make(chan *wsMessage, WS_SEND_BUFFER),
+		done:          make(chan struct{}),
+		subscriptions: map[string]chan struct{}{}}
+
+	go s.writeLoop()
+	s.readLoop()
+
+	// Stops the write loop and every subscription
+	close(s.done)
+}
+
+func (s *wsSession) readLoop() {
+	s.conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	})
+
+	for {
+		msg := &wsMessage{}
+		err := s.conn.ReadJSON(msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading from WebSocket connection: %s", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case WS_PUBLISH:
+			s.publish(msg)
+		case WS_SUBSCRIBE:
+			s.subscribe(msg)
+		case WS_UNSUBSCRIBE:
+			s.unsubscribe(msg)
+		case WS_ACK:
+			s.ack(msg)
+		case WS_NACK:
+			s.nack(msg)
+		default:
+			s.pushError(msg, &ErrInvalidRequest{fmt.Sprintf("Unknown message type \"%s\".", msg.Type)})
+		}
+	}
+}
+
+func (s *wsSession) writeLoop() {
+	ticker := time.NewTicker(WS_PING_INTERVAL)
+	defer func() {
+		ticker.Stop()
+		s.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			err := s.conn.WriteJSON(msg)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			s.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			err := s.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		case <-s.done:
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(WS_WRITE_WAIT))
+			return
+		}
+	}
+}
+
+// push queues a message for the client, giving up if the connection has closed.
+func (s *wsSession) push(msg *wsMessage) bool {
+	select {
+	case s.send <- msg:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *wsSession) pushError(req *wsMessage, err error) {
+	s.push(&wsMessage{
+		Type:     WS_ERROR,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		CursorId: req.CursorId,
+		Code:     problemTypeOf(err).code,
+		Error:    err.Error()})
+}
+
+func (s *wsSession) publish(req *wsMessage) {
+	content, err := base64.StdEncoding.DecodeString(req.Content)
+	if err != nil {
+		s.pushError(req, &ErrInvalidRequest{fmt.Sprintf("Error decoding content: %s", err.Error())})
+		return
+	}
+
+	rec, err := platformImpl.CreateRecord(req.StreamId, content, req.IdempotencyKey)
+	if err != nil {
+		s.pushError(req, err)
+		return
+	}
+
+	s.push(&wsMessage{
+		Type:     WS_PUBLISHED,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		Record:   toCreatedRecordDocument(rec)})
+}
+
+func (s *wsSession) subscribe(req *wsMessage) {
+	// Make sure the cursor exists before acknowledging the subscription
+	_, err := platformImpl.GetCursor(req.StreamId, req.CursorId)
+	if err != nil {
+		s.pushError(req, err)
+		return
+	}
+
+	key := subscriptionKey(req.StreamId, req.CursorId)
+
+	s.mu.Lock()
+	if _, ok := s.subscriptions[key]; ok {
+		s.mu.Unlock()
+		s.pushError(req, &platform.ErrConflict{Message: fmt.Sprintf("Already subscribed to cursor \"%s\".", req.CursorId)})
+		return
+	}
+	stop := make(chan struct{})
+	s.subscriptions[key] = stop
+	s.mu.Unlock()
+
+	s.push(&wsMessage{
+		Type:     WS_SUBSCRIBED,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		CursorId: req.CursorId})
+
+	go s.consume(req.StreamId, req.CursorId, stop)
+}
+
+func (s *wsSession) unsubscribe(req *wsMessage) {
+	key := subscriptionKey(req.StreamId, req.CursorId)
+
+	s.mu.Lock()
+	stop, ok := s.subscriptions[key]
+	if ok {
+		close(stop)
+		delete(s.subscriptions, key)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		s.pushError(req, &platform.ErrConflict{Message: fmt.Sprintf("Not subscribed to cursor \"%s\".", req.CursorId)})
+		return
+	}
+
+	s.push(&wsMessage{
+		Type:     WS_UNSUBSCRIBED,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		CursorId: req.CursorId})
+}
+
+func (s *wsSession) ack(req *wsMessage) {
+	err := platformImpl.AckRecords(req.StreamId, req.CursorId, req.Receipt)
+	if err != nil {
+		s.pushError(req, err)
+		return
+	}
+
+	s.push(&wsMessage{
+		Type:     WS_ACKED,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		CursorId: req.CursorId,
+		Receipt:  req.Receipt})
+}
+
+func (s *wsSession) nack(req *wsMessage) {
+	err := platformImpl.NackRecords(req.StreamId, req.CursorId, req.Receipt, req.Reason)
+	if err != nil {
+		s.pushError(req, err)
+		return
+	}
+
+	s.push(&wsMessage{
+		Type:     WS_NACKED,
+		Id:       req.Id,
+		StreamId: req.StreamId,
+		CursorId: req.CursorId,
+		Receipt:  req.Receipt})
+}
+
+// consume pushes batches from a cursor to the client until unsubscribed or disconnected. Batches stay leased
+// until the client acks them, which keeps a slow client from being flooded.
+func (s *wsSession) consume(streamId string, cursorId string, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		default:
+		}
+
+		batch, err := platformImpl.GetRecords(streamId, cursorId, eventsPollWait)
+
+		// The client may have unsubscribed or disconnected while the read was waiting, in which case the batch
+		// mustn't be pushed
+		select {
+		case <-stop:
+			s.release(streamId, cursorId, batch)
+			return
+		case <-s.done:
+			s.release(streamId, cursorId, batch)
+			return
+		default:
+		}
+
+		if err != nil {
+			s.pushError(&wsMessage{StreamId: streamId, CursorId: cursorId}, err)
+			s.endSubscription(streamId, cursorId, stop)
+			return
+		}
+
+		if len(batch.Records) == 0 {
+			continue
+		}
+
+		msg := &wsMessage{
+			Type:     WS_RECORDS,
+			StreamId: streamId,
+			CursorId: cursorId,
+			Receipt:  batch.Receipt,
+			Records:  make([]recordDocument, len(batch.Records))}
+		for i := 0; i < len(batch.Records); i++ {
+			msg.Records[i] = *toRecordDocument(&batch.Records[i])
+		}
+
+		if !s.push(msg) {
+			s.release(streamId, cursorId, batch)
+			return
+		}
+	}
+}
+
+// release hands back a batch which was leased for a subscription but never pushed, so that it's redelivered straight
+// away instead of holding up the cursor until its lease runs out.
+func (s *wsSession) release(streamId string, cursorId string, batch *platform.Batch) {
+	if batch == nil || len(batch.Records) == 0 {
+		return
+	}
+
+	err := releaseBatch(streamId, cursorId, batch, "Unsubscribed before the batch was delivered.")
+	if err != nil {
+		log.Printf("Error releasing batch on cursor %s: %s", cursorId, err)
+	}
+}
+
+// endSubscription removes a subscription which can't go on. Nothing is sent to the client, which has already
+// been told why.
+func (s *wsSession) endSubscription(streamId string, cursorId string, stop chan struct{}) {
+	key := subscriptionKey(streamId, cursorId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The client may have unsubscribed and subscribed again in the meantime
+	if s.subscriptions[key] == stop {
+		close(stop)
+		delete(s.subscriptions, key)
+	}
+}
+
+func subscriptionKey(streamId string, cursorId string) string {
+	return fmt.Sprintf("%s/%s", streamId, cursorId)
+}
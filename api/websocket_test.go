@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oceanhq/streams/platform"
+)
+
+func TestWebSocketPublish(t *testing.T) {
+	useMemoryPlatform()
+	conn := dialWebSocket(t)
+
+	stream, err := platformImpl.CreateStream("ws-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := roundTrip(t, conn, &wsMessage{Type: WS_PUBLISH, Id: "1", StreamId: stream.Id, Content: base64.StdEncoding.EncodeToString([]byte("hello")), IdempotencyKey: "key-1"})
+	if res.Type != WS_PUBLISHED || res.Id != "1" || res.StreamId != stream.Id || res.Record == nil {
+		t.Fatalf("Expected a published message for request 1, got %+v", res)
+	}
+
+	rec, err := platformImpl.GetRecord(stream.Id, res.Record.RecordId)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(rec.Content) != "hello" {
+		t.Errorf("Published %q, want %q", rec.Content, "hello")
+	}
+
+	// Retrying with the same key gives back the original record
+	retried := roundTrip(t, conn, &wsMessage{Type: WS_PUBLISH, Id: "2", StreamId: stream.Id, Content: base64.StdEncoding.EncodeToString([]byte("hello")), IdempotencyKey: "key-1"})
+	if retried.Type != WS_PUBLISHED || retried.Record == nil || retried.Record.RecordId != res.Record.RecordId {
+		t.Errorf("Expected record %s to be published again, got %+v", res.Record.RecordId, retried)
+	}
+
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: WS_PUBLISH, Id: "3", StreamId: stream.Id, Content: "not base64!"}), "3", problemTypeOf(&ErrInvalidRequest{}).code)
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: WS_PUBLISH, Id: "4", StreamId: strings.Repeat("0", 32), Content: ""}), "4", problemTypeOf(&platform.ErrStreamNotFound{}).code)
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: "shout", Id: "5"}), "5", problemTypeOf(&ErrInvalidRequest{}).code)
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	useMemoryPlatform()
+	conn := dialWebSocket(t)
+
+	stream, cursor := createEventsStream(t, "ws-subscribe")
+	recs := publishEvents(t, stream.Id, "a", "b")
+
+	sub := &wsMessage{Type: WS_SUBSCRIBE, Id: "1", StreamId: stream.Id, CursorId: cursor.Id}
+	if res := roundTrip(t, conn, sub); res.Type != WS_SUBSCRIBED || res.Id != "1" || res.CursorId != cursor.Id {
+		t.Fatalf("Expected a subscribed message for request 1, got %+v", res)
+	}
+
+	batch := readWs(t, conn)
+	if batch.Type != WS_RECORDS || batch.CursorId != cursor.Id || batch.Receipt == "" || len(batch.Records) != len(recs) {
+		t.Fatalf("Expected a records message with %d records, got %+v", len(recs), batch)
+	}
+	for i := range recs {
+		if batch.Records[i].RecordId != recs[i].Id {
+			t.Errorf("Record %d is %s, want %s", i, batch.Records[i].RecordId, recs[i].Id)
+		}
+	}
+
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: WS_SUBSCRIBE, Id: "2", StreamId: stream.Id, CursorId: cursor.Id}), "2", problemTypeOf(&platform.ErrConflict{}).code)
+
+	res := roundTrip(t, conn, &wsMessage{Type: WS_ACK, Id: "3", StreamId: stream.Id, CursorId: cursor.Id, Receipt: batch.Receipt})
+	if res.Type != WS_ACKED || res.Id != "3" || res.Receipt != batch.Receipt {
+		t.Fatalf("Expected an acked message for request 3, got %+v", res)
+	}
+
+	c, err := platformImpl.GetCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if c.Position != "2" {
+		t.Errorf("Cursor position = %s, want 2", c.Position)
+	}
+
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: WS_ACK, Id: "4", StreamId: stream.Id, CursorId: cursor.Id, Receipt: batch.Receipt}), "4", problemTypeOf(&platform.ErrReceiptNotFound{}).code)
+
+	if res := roundTrip(t, conn, &wsMessage{Type: WS_UNSUBSCRIBE, Id: "5", StreamId: stream.Id, CursorId: cursor.Id}); res.Type != WS_UNSUBSCRIBED || res.Id != "5" {
+		t.Fatalf("Expected an unsubscribed message for request 5, got %+v", res)
+	}
+	expectWsError(t, roundTrip(t, conn, &wsMessage{Type: WS_UNSUBSCRIBE, Id: "6", StreamId: stream.Id, CursorId: cursor.Id}), "6", problemTypeOf(&platform.ErrConflict{}).code)
+
+	missing := &wsMessage{Type: WS_SUBSCRIBE, Id: "7", StreamId: stream.Id, CursorId: strings.Repeat("0", 32)}
+	expectWsError(t, roundTrip(t, conn, missing), "7", problemTypeOf(&platform.ErrCursorNotFound{}).code)
+}
+
+func TestWebSocketNack(t *testing.T) {
+	useMemoryPlatform()
+	conn := dialWebSocket(t)
+
+	stream, cursor := createEventsStream(t, "ws-nack")
+	publishEvents(t, stream.Id, "a")
+
+	roundTrip(t, conn, &wsMessage{Type: WS_SUBSCRIBE, Id: "1", StreamId: stream.Id, CursorId: cursor.Id})
+	first := readWs(t, conn)
+
+	err := conn.WriteJSON(&wsMessage{Type: WS_NACK, Id: "2", StreamId: stream.Id, CursorId: cursor.Id, Receipt: first.Receipt, Reason: "bad input"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch is pushed again under a new receipt, possibly before the reply to the nack
+	var res, again *wsMessage
+	for i := 0; i < 2; i++ {
+		msg := readWs(t, conn)
+		if msg.Type == WS_RECORDS {
+			again = msg
+		} else {
+			res = msg
+		}
+	}
+
+	if res == nil || res.Type != WS_NACKED || res.Id != "2" || res.Receipt != first.Receipt {
+		t.Fatalf("Expected a nacked message for request 2, got %+v", res)
+	} else if again == nil {
+		t.Fatalf("Expected the batch to be redelivered")
+	} else if again.Receipt == first.Receipt || len(again.Records) != 1 || again.Records[0].RecordId != first.Records[0].RecordId {
+		t.Fatalf("Expected record %s to be redelivered, got %+v", first.Records[0].RecordId, again)
+	}
+}
+
+func TestWebSocketReleaseUncounted(t *testing.T) {
+	useMemoryPlatform()
+
+	stream, cursor := createEventsStream(t, "ws-release")
+	dlq, _ := createEventsStream(t, "ws-release-dlq")
+	_, err := platformImpl.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishEvents(t, stream.Id, "a")
+
+	// A batch leased for a subscription which ended before it could be pushed doesn't use up the record's only delivery
+	s := &wsSession{}
+	for i := 0; i < 3; i++ {
+		batch, err := platformImpl.GetRecords(stream.Id, cursor.Id, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(batch.Records) != 1 {
+			t.Fatalf("Expected the record to be redelivered, got %d records", len(batch.Records))
+		}
+
+		s.release(stream.Id, cursor.Id, batch)
+	}
+}
+
+func dialWebSocket(t *testing.T) *websocket.Conn {
+	srv := httptest.NewServer(http.HandlerFunc(WebSocketHandler))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func roundTrip(t *testing.T, conn *websocket.Conn, req *wsMessage) *wsMessage {
+	err := conn.WriteJSON(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return readWs(t, conn)
+}
+
+func readWs(t *testing.T, conn *websocket.Conn) *wsMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	msg := &wsMessage{}
+	err := conn.ReadJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func expectWsError(t *testing.T, msg *wsMessage, id string, code string) {
+	t.Helper()
+
+	if msg.Type != WS_ERROR || msg.Id != id || msg.Code != code || msg.Error == "" {
+		t.Errorf("Expected a %s error for request %s, got %+v", code, id, msg)
+	}
+}
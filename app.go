@@ -1,12 +1,21 @@
 package main
 
 import (
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/codegangsta/negroni"
+	"github.com/oceanhq/streams/api"
 )
 
 func main() {
+	err := api.OpenPlatform()
+	if err != nil {
+		log.Fatalf("Error opening the platform: %s", err)
+	}
+
 	r := buildRoutes()
 
 	n := negroni.New()
@@ -17,5 +26,19 @@ func main() {
 		port = "3000"
 	}
 
+	// Give the platform a chance to save or flush its state before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+
+		err := api.ClosePlatform()
+		if err != nil {
+			log.Fatalf("Error closing the platform: %s", err)
+		}
+		os.Exit(0)
+	}()
+
 	n.Run(":" + port)
 }
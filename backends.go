@@ -0,0 +1,12 @@
+package main
+
+// Every backend is linked in, registering itself with the platform package, so that the one binary can run on
+// whichever STREAMS_BACKEND names.
+import (
+	_ "github.com/oceanhq/streams/platform/file"
+	_ "github.com/oceanhq/streams/platform/jetstream"
+	_ "github.com/oceanhq/streams/platform/memory"
+	_ "github.com/oceanhq/streams/platform/postgres"
+	_ "github.com/oceanhq/streams/platform/redis"
+	_ "github.com/oceanhq/streams/platform/sqs"
+)
@@ -0,0 +1,393 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+type cursor struct {
+	id     string
+	stream *stream
+	// position is the offset of the last record the cursor has committed, or -1 before the first record.
+	position   int64
+	deadLetter *platform.DeadLetterPolicy
+	lease      *lease
+
+	// deliveries tracks how often each record past the committed position has been handed out.
+	deliveries map[int64]*delivery
+}
+
+// cursorState is the part of a cursor kept in its file under the stream's cursors directory.
+type cursorState struct {
+	Position   int64                      `json:"position"`
+	DeadLetter *platform.DeadLetterPolicy `json:"deadLetter,omitempty"`
+}
+
+type delivery struct {
+	count        int
+	reason       string
+	message      string
+	deadLettered bool
+}
+
+// lease tracks the batch currently handed out to a cursor.
+type lease struct {
+	receipt string
+	last    int64
+	expires time.Time
+}
+
+func (p *FilePlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	position, err := s.resolveStart(&start)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.addCursor(s, position, nil)
+}
+
+func (p *FilePlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := s.resolveStart(&position)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.save(target, c.deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any outstanding batch is abandoned; its receipt can no longer be acknowledged.
+	c.lease = nil
+	c.deliveries = nil
+	s.signal()
+
+	return c.toExt(), nil
+}
+
+func (p *FilePlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *FilePlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []platform.Cursor{}
+	for _, c := range p.cursors {
+		if c.stream == s {
+			out = append(out, *(c.toExt()))
+		}
+	}
+
+	return out, nil
+}
+
+func (p *FilePlatform) DeleteCursor(streamId string, cursorId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(c.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := 0; i < len(p.cursors); i++ {
+		if p.cursors[i] == c {
+			p.cursors = append(p.cursors[:i], p.cursors[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (p *FilePlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, source, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The clone starts from the source's committed position. Any batch leased to the source stays with it.
+	return p.addCursor(s, source.position, source.deadLetter)
+}
+
+func (p *FilePlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if policy != nil {
+		err := policy.Validate(streamId)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = p.findStream(policy.StreamId)
+		if err != nil {
+			return nil, err
+		}
+
+		copied := *policy
+		policy = &copied
+	}
+
+	_, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.save(c.position, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+// addCursor creates a cursor on disk before adding it to the platform.
+func (p *FilePlatform) addCursor(s *stream, position int64, deadLetter *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cursor{
+		id:     id,
+		stream: s}
+
+	err = c.save(position, deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cursors = append(p.cursors, c)
+
+	return c.toExt(), nil
+}
+
+// findStreamCursor looks up a cursor belonging to a stream, returning the matching platform error if either is missing.
+func (p *FilePlatform) findStreamCursor(streamId string, cursorId string) (*stream, *cursor, error) {
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = validateId(cursorId)
+	if err != nil {
+		return nil, nil, &platform.ErrInvalidParam{Param: "cursorId", Value: cursorId, Err: err}
+	}
+
+	for _, c := range p.cursors {
+		if c.id == cursorId && c.stream == s {
+			return s, c, nil
+		}
+	}
+
+	return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+}
+
+// loadCursors reads the state of every cursor on the stream. Positions beyond the end of the log, left by
+// records lost in a crash, are pulled back to the last record.
+func (s *stream) loadCursors() ([]*cursor, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, CURSORS_DIR))
+	if err != nil {
+		return nil, err
+	}
+
+	last := s.log.nextOffset() - 1
+	cursors := []*cursor{}
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if validateId(id) != nil || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		state := &cursorState{}
+		err = readJson(filepath.Join(s.dir, CURSORS_DIR, file.Name()), state)
+		if err != nil {
+			return nil, err
+		}
+
+		position := state.Position
+		if position > last {
+			position = last
+		}
+
+		cursors = append(cursors, &cursor{
+			id:         id,
+			stream:     s,
+			position:   position,
+			deadLetter: state.DeadLetter})
+	}
+
+	return cursors, nil
+}
+
+// save writes the cursor's position and policy to disk, only applying them once they're there.
+func (c *cursor) save(position int64, deadLetter *platform.DeadLetterPolicy) error {
+	err := writeJson(c.path(), &cursorState{
+		Position:   position,
+		DeadLetter: deadLetter})
+	if err != nil {
+		return err
+	}
+
+	c.position = position
+	c.deadLetter = deadLetter
+
+	return nil
+}
+
+func (c *cursor) path() string {
+	return filepath.Join(c.stream.dir, CURSORS_DIR, c.id+".json")
+}
+
+// delivered counts a record being handed out in a batch.
+func (c *cursor) delivered(offset int64) {
+	if c.deliveries == nil {
+		c.deliveries = map[int64]*delivery{}
+	}
+
+	d := c.deliveries[offset]
+	if d == nil {
+		d = &delivery{}
+		c.deliveries[offset] = d
+	}
+	d.count++
+}
+
+// markFailed records why the cursor's leased batch wasn't acknowledged.
+func (c *cursor) markFailed(reason string, message string) {
+	if c.lease == nil {
+		return
+	}
+
+	for offset := c.position + 1; offset <= c.lease.last; offset++ {
+		if d := c.deliveries[offset]; d != nil && !d.deadLettered {
+			d.reason = reason
+			d.message = message
+		}
+	}
+}
+
+// undelivered uncounts the delivery of each record in the cursor's leased batch.
+func (c *cursor) undelivered() {
+	if c.lease == nil {
+		return
+	}
+
+	for offset, d := range c.deliveries {
+		if offset > c.position && offset <= c.lease.last && !d.deadLettered {
+			d.count--
+		}
+	}
+}
+
+// commit moves the cursor's position forward to last, forgetting the deliveries of the records passed.
+func (c *cursor) commit(last int64) error {
+	err := c.save(last, c.deadLetter)
+	if err != nil {
+		return err
+	}
+
+	for offset := range c.deliveries {
+		if offset <= last {
+			delete(c.deliveries, offset)
+		}
+	}
+
+	return nil
+}
+
+func (c *cursor) toExt() *platform.Cursor {
+	ext := &platform.Cursor{
+		Id:       c.id,
+		StreamId: c.stream.id,
+		Position: strconv.FormatInt(c.position, 10)}
+
+	if c.deadLetter != nil {
+		policy := *c.deadLetter
+		ext.DeadLetter = &policy
+	}
+
+	return ext
+}
+
+// resolveStart finds the offset a cursor should be positioned on for a start position, i.e. the
+// last record it will skip. -1 positions the cursor before the first record.
+func (s *stream) resolveStart(start *platform.StartPosition) (int64, error) {
+	err := start.Validate()
+	if err != nil {
+		return 0, err
+	}
+
+	next := s.log.nextOffset()
+
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return -1, nil
+	case platform.START_AT_TIMESTAMP:
+		return s.log.searchTimestamp(start.Timestamp) - 1, nil
+	case platform.START_AFTER_RECORD_ID:
+		sequence, _, err := platform.ParseRecordId(s.id, start.RecordId)
+		if err != nil {
+			return 0, err
+		} else if int64(sequence) > next {
+			return 0, &platform.ErrRecordNotFound{RecordID: start.RecordId, StreamID: s.id}
+		}
+
+		return int64(sequence) - 1, nil
+	case platform.START_LAST:
+		position := next - 1 - int64(start.Count)
+		if position < -1 {
+			position = -1
+		}
+
+		return position, nil
+	}
+
+	return next - 1, nil
+}
@@ -0,0 +1,712 @@
+// Package file is a single-node implementation of the platform which keeps everything on local disk.
+//
+// Each stream has a directory under Dir holding its metadata, its records in append-only segment files, the
+// idempotency keys it has seen and the state of its cursors. Records are framed with a CRC so that a write torn
+// by a crash is found and cut off when the platform next opens. How often writes are flushed to disk is set by
+// SyncPolicy.
+//
+// Leases and delivery counts are only held in memory, so batches leased when the process stops are redelivered
+// once it restarts.
+package file
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	ID_LENGTH   = 16 // 128-bit
+	MAX_RECORDS = 100
+
+	DEFAULT_DIR           = "data"
+	DEFAULT_LEASE_TIMEOUT = 30 * time.Second
+	DEFAULT_SEGMENT_SIZE  = 64 * 1024 * 1024
+	DEFAULT_SYNC_INTERVAL = time.Second
+
+	// SYNC_ALWAYS flushes every write to disk before returning. SYNC_INTERVAL flushes every SyncInterval, so a
+	// crash can lose the writes of the last interval. SYNC_NEVER leaves flushing to the operating system.
+	// Stream metadata and cursor state are always flushed.
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NEVER    = "never"
+
+	STREAMS_DIR = "streams"
+	CURSORS_DIR = "cursors"
+	META_FILE   = "meta.json"
+	KEYS_FILE   = "keys.jsonl"
+)
+
+type FilePlatform struct {
+	// mu guards all of the platform's state. Every exported method holds it for its duration.
+	mu sync.Mutex
+
+	// Dir is the directory the platform's data is kept in. It is created if it doesn't exist.
+	// Defaults to DEFAULT_DIR.
+	Dir string
+
+	// SyncPolicy is one of SYNC_ALWAYS, SYNC_INTERVAL or SYNC_NEVER. Defaults to SYNC_ALWAYS.
+	SyncPolicy string
+
+	// SyncInterval is how often writes are flushed under SYNC_INTERVAL. Defaults to DEFAULT_SYNC_INTERVAL.
+	SyncInterval time.Duration
+
+	// SegmentSize is the size at which a stream's segment file is sealed and a new one started.
+	// Defaults to DEFAULT_SEGMENT_SIZE.
+	SegmentSize int64
+
+	// LeaseTimeout is how long a batch returned by GetRecords stays leased to its cursor
+	// before it is redelivered. Defaults to DEFAULT_LEASE_TIMEOUT.
+	LeaseTimeout time.Duration
+
+	opened  bool
+	stop    chan struct{}
+	streams []*stream
+	cursors []*cursor
+}
+
+func init() {
+	platform.Register("file", func(opts platform.Options) (platform.Platform, error) {
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		syncInterval, err := opts.Duration("FSYNC_INTERVAL", time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FilePlatform{
+			Dir:          opts["DATA_DIR"],
+			SyncPolicy:   opts["FSYNC_POLICY"],
+			SyncInterval: syncInterval,
+			LeaseTimeout: leaseTimeout}, nil
+	})
+}
+
+// open loads the platform's state from disk the first time it's used.
+func (p *FilePlatform) open() error {
+	if p.opened {
+		return nil
+	}
+
+	switch p.syncPolicy() {
+	case SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER:
+	default:
+		return fmt.Errorf("Unknown sync policy \"%s\"", p.SyncPolicy)
+	}
+
+	err := os.MkdirAll(filepath.Join(p.dir(), STREAMS_DIR), 0755)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(p.dir(), STREAMS_DIR))
+	if err != nil {
+		return err
+	}
+
+	streams := []*stream{}
+	cursors := []*cursor{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		s, streamCursors, err := p.loadStream(dir.Name())
+		if err != nil {
+			for _, s := range streams {
+				s.close()
+			}
+			return err
+		} else if s == nil {
+			continue
+		}
+
+		streams = append(streams, s)
+		cursors = append(cursors, streamCursors...)
+	}
+
+	// Streams are listed in the order they were created
+	sort.Sort(byCreatedAt(streams))
+
+	p.streams = streams
+	p.cursors = cursors
+	p.opened = true
+
+	if p.syncPolicy() == SYNC_INTERVAL {
+		p.stop = make(chan struct{})
+		go p.syncEvery(p.syncInterval(), p.stop)
+	}
+
+	return nil
+}
+
+// loadStream opens a stream's directory, recovering its log. A nil stream is returned for a directory left
+// behind by a stream which was never fully created.
+func (p *FilePlatform) loadStream(id string) (*stream, []*cursor, error) {
+	dir := filepath.Join(p.dir(), STREAMS_DIR, id)
+
+	meta := &streamMeta{}
+	err := readJson(filepath.Join(dir, META_FILE), meta)
+	if os.IsNotExist(err) {
+		log.Printf("Ignoring incomplete stream directory %s", dir)
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := openLog(dir, p.segmentSize())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &stream{
+		id:      id,
+		dir:     dir,
+		meta:    *meta,
+		log:     records,
+		changed: make(chan struct{})}
+
+	err = s.loadKeys(time.Now())
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	cursors, err := s.loadCursors()
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	return s, cursors, nil
+}
+
+// Close flushes and closes every stream. The platform is reopened from disk if it's used again.
+func (p *FilePlatform) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.opened {
+		return nil
+	}
+
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+
+	var firstErr error
+	for _, s := range p.streams {
+		err := s.sync()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.close()
+	}
+
+	p.streams = nil
+	p.cursors = nil
+	p.opened = false
+
+	return firstErr
+}
+
+// syncEvery flushes streams with outstanding writes until stop is closed.
+func (p *FilePlatform) syncEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		for _, s := range p.streams {
+			if !s.unsynced {
+				continue
+			}
+
+			err := s.sync()
+			if err != nil {
+				log.Printf("Error syncing stream %s: %s", s.id, err)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// written flushes a stream's writes under SYNC_ALWAYS, or notes them for the next flush otherwise.
+func (p *FilePlatform) written(s *stream) error {
+	if p.syncPolicy() == SYNC_ALWAYS {
+		return s.sync()
+	}
+
+	s.unsynced = true
+	return nil
+}
+
+func (p *FilePlatform) CreateStream(name string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		return nil, &platform.ErrInvalidParam{Param: "name", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(p.dir(), STREAMS_DIR, id)
+	err = os.MkdirAll(filepath.Join(dir, CURSORS_DIR), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata is written last, since a directory without it is ignored
+	records, err := openLog(dir, p.segmentSize())
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &stream{
+		id:  id,
+		dir: dir,
+		meta: streamMeta{
+			Name:      name,
+			CreatedAt: time.Now().UTC()},
+		log:     records,
+		changed: make(chan struct{})}
+
+	err = s.loadKeys(time.Now())
+	if err == nil {
+		err = s.saveMeta()
+	}
+	if err != nil {
+		s.close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	p.streams = append(p.streams, s)
+
+	return s.toExt(), nil
+}
+
+func (p *FilePlatform) ListStreams() ([]platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.open()
+	if err != nil {
+		return nil, err
+	}
+
+	p.purgeExpiredStreams()
+
+	out := make([]platform.Stream, len(p.streams))
+	for i, s := range p.streams {
+		out[i] = *(s.toExt())
+	}
+
+	return out, nil
+}
+
+func (p *FilePlatform) GetStream(streamId string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *FilePlatform) DeleteStream(streamId string, retention time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a retention period there's nothing to restore so remove it straight away
+	if retention <= 0 {
+		now := time.Now().UTC()
+		if s.meta.DeletedAt.IsZero() {
+			s.meta.DeletedAt = now
+		}
+		s.meta.PurgeAt = now
+		res := s.toExt()
+
+		return res, p.purgeStream(s)
+	}
+
+	meta := s.meta
+	now := time.Now().UTC()
+	if meta.DeletedAt.IsZero() {
+		meta.DeletedAt = now
+	}
+	meta.PurgeAt = now.Add(retention)
+
+	err = s.updateMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *FilePlatform) RestoreStream(streamId string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := s.meta
+	meta.DeletedAt = time.Time{}
+	meta.PurgeAt = time.Time{}
+
+	err = s.updateMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *FilePlatform) SetDedupeWindow(streamId string, window time.Duration) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := platform.ValidateDedupeWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys already remembered keep the expiry they were given
+	meta := s.meta
+	meta.DedupeWindow = window
+
+	err = s.updateMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+// findStream opens the platform if need be and looks up a stream, returning the matching platform error if
+// it's missing. Streams whose retention period is up are purged on the way.
+func (p *FilePlatform) findStream(streamId string) (*stream, error) {
+	err := p.open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	}
+
+	for _, s := range p.streams {
+		if s.id != streamId {
+			continue
+		}
+
+		// Deleted streams vanish once their retention period is up
+		if s.expired(time.Now()) {
+			err = p.purgeStream(s)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		return s, nil
+	}
+
+	return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+}
+
+func (p *FilePlatform) purgeExpiredStreams() {
+	now := time.Now()
+	for i := len(p.streams) - 1; i >= 0; i-- {
+		if p.streams[i].expired(now) {
+			err := p.purgeStream(p.streams[i])
+			if err != nil {
+				log.Printf("Error purging stream %s: %s", p.streams[i].id, err)
+			}
+		}
+	}
+}
+
+// purgeStream removes a stream along with all of its cursors, on disk and in memory.
+func (p *FilePlatform) purgeStream(s *stream) error {
+	cursors := p.cursors[:0]
+	for _, c := range p.cursors {
+		if c.stream != s {
+			cursors = append(cursors, c)
+		}
+	}
+	p.cursors = cursors
+
+	for i := 0; i < len(p.streams); i++ {
+		if p.streams[i] == s {
+			p.streams = append(p.streams[:i], p.streams[i+1:]...)
+			break
+		}
+	}
+
+	// Wake any reads waiting on the stream so they find it's gone
+	s.signal()
+	s.close()
+
+	return os.RemoveAll(s.dir)
+}
+
+func (p *FilePlatform) dir() string {
+	if p.Dir == "" {
+		return DEFAULT_DIR
+	}
+
+	return p.Dir
+}
+
+func (p *FilePlatform) syncPolicy() string {
+	if p.SyncPolicy == "" {
+		return SYNC_ALWAYS
+	}
+
+	return p.SyncPolicy
+}
+
+func (p *FilePlatform) syncInterval() time.Duration {
+	if p.SyncInterval <= 0 {
+		return DEFAULT_SYNC_INTERVAL
+	}
+
+	return p.SyncInterval
+}
+
+func (p *FilePlatform) segmentSize() int64 {
+	if p.SegmentSize <= 0 {
+		return DEFAULT_SEGMENT_SIZE
+	}
+
+	return p.SegmentSize
+}
+
+func (p *FilePlatform) leaseTimeout() time.Duration {
+	if p.LeaseTimeout <= 0 {
+		return DEFAULT_LEASE_TIMEOUT
+	}
+
+	return p.LeaseTimeout
+}
+
+type stream struct {
+	id   string
+	dir  string
+	meta streamMeta
+	log  *streamLog
+
+	// changed is closed, and replaced, to wake waiting reads whenever the stream or one of its cursors moves on.
+	changed chan struct{}
+
+	// unsynced is set when the stream has writes which haven't been flushed yet under SYNC_INTERVAL or SYNC_NEVER.
+	unsynced bool
+
+	// keys indexes the records published with an idempotency key. keyOrder holds the same entries oldest
+	// first so that expired keys can be dropped from the front. Both are backed by keysFile.
+	keys     map[string]*idempotencyKey
+	keyOrder []*idempotencyKey
+	keysFile *os.File
+}
+
+// streamMeta is the part of a stream's state kept in its metadata file.
+type streamMeta struct {
+	Name         string        `json:"name"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	DeletedAt    time.Time     `json:"deletedAt"`
+	PurgeAt      time.Time     `json:"purgeAt"`
+	DedupeWindow time.Duration `json:"dedupeWindow"`
+}
+
+// updateMeta writes a change to the stream's metadata, only applying it once it's on disk.
+func (s *stream) updateMeta(meta streamMeta) error {
+	previous := s.meta
+	s.meta = meta
+
+	err := s.saveMeta()
+	if err != nil {
+		s.meta = previous
+	}
+
+	return err
+}
+
+func (s *stream) saveMeta() error {
+	return writeJson(filepath.Join(s.dir, META_FILE), &s.meta)
+}
+
+func (s *stream) sync() error {
+	err := s.log.sync()
+	if err != nil {
+		return err
+	}
+
+	if s.keysFile != nil {
+		err = s.keysFile.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.unsynced = false
+	return nil
+}
+
+func (s *stream) close() {
+	s.log.close()
+
+	if s.keysFile != nil {
+		s.keysFile.Close()
+	}
+}
+
+func (s *stream) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// expired reports whether a deleted stream's retention period is up.
+func (s *stream) expired(now time.Time) bool {
+	return !s.meta.DeletedAt.IsZero() && !now.Before(s.meta.PurgeAt)
+}
+
+func (s *stream) dedupeWindow() time.Duration {
+	if s.meta.DedupeWindow == 0 {
+		return platform.DEFAULT_DEDUPE_WINDOW
+	}
+
+	return s.meta.DedupeWindow
+}
+
+func (s *stream) toExt() *platform.Stream {
+	return &platform.Stream{
+		Id:           s.id,
+		Name:         s.meta.Name,
+		DeletedAt:    s.meta.DeletedAt,
+		PurgeAt:      s.meta.PurgeAt,
+		DedupeWindow: s.dedupeWindow()}
+}
+
+type byCreatedAt []*stream
+
+func (a byCreatedAt) Len() int           { return len(a) }
+func (a byCreatedAt) Less(i, j int) bool { return a[i].meta.CreatedAt.Before(a[j].meta.CreatedAt) }
+func (a byCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func generateId() (string, error) {
+	b := make([]byte, ID_LENGTH)
+	_, err := rand.Read(b)
+
+	return hex.EncodeToString(b), err
+}
+
+// validateId checks an ID is one this platform could have generated. IDs name directories on disk, so
+// nothing else is accepted.
+func validateId(id string) error {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return err
+	} else if len(b) != ID_LENGTH {
+		return errors.New("Wrong length.")
+	}
+
+	return nil
+}
+
+func readJson(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// writeJson replaces a file atomically, so a crash leaves either the old or the new version behind, and
+// flushes it to disk.
+func writeJson(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
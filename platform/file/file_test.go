@@ -0,0 +1,31 @@
+package file
+
+import (
+	"testing"
+
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+func TestConformance(t *testing.T) {
+	platformtest.Run(t, testPlatforms(t))
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	platformtest.Benchmark(b, testPlatforms(b))
+}
+
+// testPlatforms returns a factory for platforms in directories of their own, which are removed after the test.
+func testPlatforms(tb testing.TB) platform.Factory {
+	return func(opts platform.Options) (platform.Platform, error) {
+		opts["DATA_DIR"] = tb.TempDir()
+
+		p, err := platform.Open("file", opts)
+		if err != nil {
+			return nil, err
+		}
+		tb.Cleanup(func() { p.(*FilePlatform).Close() })
+
+		return p, nil
+	}
+}
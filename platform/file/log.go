@@ -0,0 +1,459 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SEGMENT_EXT = ".log"
+	INDEX_EXT   = ".index"
+
+	// Every record is framed by the length of its body and a CRC of the body, so torn or corrupt writes
+	// can be spotted on recovery.
+	FRAME_HEADER_SIZE = 8
+	// A record's body starts with its offset and timestamp, followed by its content.
+	RECORD_HEADER_SIZE = 16
+	// Index entries hold a record's position in its segment and its timestamp.
+	INDEX_ENTRY_SIZE = 16
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// streamLog is a stream's records, stored as a sequence of append-only segment files. Each segment is named after
+// the offset of its first record and has an index with an entry for every record it holds.
+type streamLog struct {
+	dir         string
+	segmentSize int64
+	segments    []*segment
+}
+
+type segment struct {
+	base    int64
+	file    *os.File
+	index   *os.File
+	size    int64
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	pos       int64
+	timestamp int64
+}
+
+// logRecord is a record as read back from a segment.
+type logRecord struct {
+	offset    int64
+	timestamp time.Time
+	content   []byte
+}
+
+// openLog opens the segments in dir, recovering from any write that was interrupted by a crash. Sealed segments
+// are trusted as long as their index is consistent. The active segment is always rescanned, and cut off at the
+// first record which is incomplete or fails its CRC.
+func openLog(dir string, segmentSize int64) (*streamLog, error) {
+	l := &streamLog{
+		dir:         dir,
+		segmentSize: segmentSize}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+SEGMENT_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	bases := []int64{}
+	for _, name := range names {
+		base, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), SEGMENT_EXT), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected segment file %s", name)
+		}
+		bases = append(bases, base)
+	}
+	sort.Sort(int64s(bases))
+
+	if len(bases) == 0 {
+		bases = append(bases, 0)
+	}
+
+	for i, base := range bases {
+		active := i == len(bases)-1
+
+		seg, err := openSegment(dir, base)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+
+		if !active {
+			err = seg.recoverSealed(bases[i+1])
+		} else {
+			err = seg.recoverActive()
+		}
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func openSegment(dir string, base int64) (*segment, error) {
+	name := filepath.Join(dir, fmt.Sprintf("%020d", base))
+
+	file, err := os.OpenFile(name+SEGMENT_EXT, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(name+INDEX_EXT, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		index.Close()
+		return nil, err
+	}
+
+	return &segment{
+		base:  base,
+		file:  file,
+		index: index,
+		size:  info.Size()}, nil
+}
+
+// recoverSealed loads the index of a segment which has since been rolled over. The index is rebuilt if it
+// doesn't account for every record up to next, the base of the following segment.
+func (s *segment) recoverSealed(next int64) error {
+	entries, err := s.readIndex()
+	if err == nil && int64(len(entries)) == next-s.base {
+		s.entries = entries
+		return nil
+	}
+
+	entries, valid, err := s.scan()
+	if err != nil {
+		return err
+	}
+
+	// Only the active segment can have been cut short by a crash
+	if valid != s.size || int64(len(entries)) != next-s.base {
+		return fmt.Errorf("Segment %s is corrupt", s.file.Name())
+	}
+
+	s.entries = entries
+	return s.writeIndex()
+}
+
+// recoverActive rescans the segment being appended to, truncating it after its last intact record.
+func (s *segment) recoverActive() error {
+	entries, valid, err := s.scan()
+	if err != nil {
+		return err
+	}
+
+	if valid < s.size {
+		log.Printf("Truncating torn write at byte %d of %s (%d bytes discarded)", valid, s.file.Name(), s.size-valid)
+
+		err = s.file.Truncate(valid)
+		if err != nil {
+			return err
+		}
+
+		err = s.file.Sync()
+		if err != nil {
+			return err
+		}
+		s.size = valid
+	}
+
+	s.entries = entries
+	return s.writeIndex()
+}
+
+func (s *segment) readIndex() ([]indexEntry, error) {
+	b, err := ioutil.ReadAll(io.NewSectionReader(s.index, 0, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b)%INDEX_ENTRY_SIZE != 0 {
+		return nil, errors.New("Index is truncated")
+	}
+
+	entries := make([]indexEntry, len(b)/INDEX_ENTRY_SIZE)
+	for i := range entries {
+		entry := b[i*INDEX_ENTRY_SIZE:]
+		entries[i] = indexEntry{
+			pos:       int64(binary.BigEndian.Uint64(entry[0:8])),
+			timestamp: int64(binary.BigEndian.Uint64(entry[8:16]))}
+	}
+
+	return entries, nil
+}
+
+func (s *segment) writeIndex() error {
+	b := make([]byte, len(s.entries)*INDEX_ENTRY_SIZE)
+	for i, entry := range s.entries {
+		encodeIndexEntry(b[i*INDEX_ENTRY_SIZE:], entry)
+	}
+
+	err := s.index.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.index.WriteAt(b, 0)
+	if err != nil {
+		return err
+	}
+
+	return s.index.Sync()
+}
+
+// scan reads through every record in the segment. It returns the index entries of the intact records and the
+// size of the segment up to the end of the last of them.
+func (s *segment) scan() ([]indexEntry, int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.file, 0, s.size))
+	entries := []indexEntry{}
+	var pos int64
+
+	header := make([]byte, FRAME_HEADER_SIZE)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return entries, pos, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length < RECORD_HEADER_SIZE || pos+FRAME_HEADER_SIZE+length > s.size {
+			return entries, pos, nil
+		}
+
+		body := make([]byte, length)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offset := int64(binary.BigEndian.Uint64(body[0:8]))
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) || offset != s.base+int64(len(entries)) {
+			return entries, pos, nil
+		}
+
+		entries = append(entries, indexEntry{
+			pos:       pos,
+			timestamp: int64(binary.BigEndian.Uint64(body[8:16]))})
+		pos += FRAME_HEADER_SIZE + length
+	}
+}
+
+// nextOffset is the offset the next record appended will be given.
+func (l *streamLog) nextOffset() int64 {
+	active := l.active()
+	return active.base + int64(len(active.entries))
+}
+
+func (l *streamLog) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// append writes a record to the end of the log, rolling over to a new segment once the active one is full.
+// Timestamps never go backwards, so that the log can be searched by time.
+func (l *streamLog) append(content []byte, now time.Time) (*logRecord, error) {
+	offset := l.nextOffset()
+
+	timestamp := now.UnixNano()
+	if last, ok := l.lastTimestamp(); ok && timestamp < last {
+		timestamp = last
+	}
+
+	active := l.active()
+	if active.size >= l.segmentSize && len(active.entries) > 0 {
+		var err error
+		active, err = l.roll()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body := make([]byte, RECORD_HEADER_SIZE+len(content))
+	binary.BigEndian.PutUint64(body[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(body[8:16], uint64(timestamp))
+	copy(body[RECORD_HEADER_SIZE:], content)
+
+	frame := make([]byte, FRAME_HEADER_SIZE+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(body, crcTable))
+	copy(frame[FRAME_HEADER_SIZE:], body)
+
+	_, err := active.file.WriteAt(frame, active.size)
+	if err != nil {
+		// Don't leave part of a record behind for the next one to be written after
+		active.file.Truncate(active.size)
+		return nil, err
+	}
+
+	entry := indexEntry{
+		pos:       active.size,
+		timestamp: timestamp}
+	b := make([]byte, INDEX_ENTRY_SIZE)
+	encodeIndexEntry(b, entry)
+
+	// The index can be rebuilt from the segment, so a failure here is only a problem once the segment is sealed
+	_, err = active.index.WriteAt(b, int64(len(active.entries))*INDEX_ENTRY_SIZE)
+	if err != nil {
+		active.file.Truncate(active.size)
+		return nil, err
+	}
+
+	active.size += int64(len(frame))
+	active.entries = append(active.entries, entry)
+
+	return &logRecord{
+		offset:    offset,
+		timestamp: time.Unix(0, timestamp).UTC(),
+		content:   content}, nil
+}
+
+// roll seals the active segment and starts a new one.
+func (l *streamLog) roll() (*segment, error) {
+	err := l.active().sync()
+	if err != nil {
+		return nil, err
+	}
+
+	seg, err := openSegment(l.dir, l.nextOffset())
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, seg)
+
+	return seg, syncDir(l.dir)
+}
+
+func (l *streamLog) lastTimestamp() (int64, bool) {
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if n := len(l.segments[i].entries); n > 0 {
+			return l.segments[i].entries[n-1].timestamp, true
+		}
+	}
+
+	return 0, false
+}
+
+// read returns the record at offset, checking it against its CRC.
+func (l *streamLog) read(offset int64) (*logRecord, error) {
+	seg, entry, err := l.locate(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err = seg.file.ReadAt(header, entry.pos)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	_, err = seg.file.ReadAt(body, entry.pos+FRAME_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("Record %d in %s failed its CRC check", offset, seg.file.Name())
+	}
+
+	return &logRecord{
+		offset:    offset,
+		timestamp: time.Unix(0, entry.timestamp).UTC(),
+		content:   body[RECORD_HEADER_SIZE:]}, nil
+}
+
+func (l *streamLog) locate(offset int64) (*segment, indexEntry, error) {
+	if offset < 0 || offset >= l.nextOffset() {
+		return nil, indexEntry{}, fmt.Errorf("Offset %d is out of range", offset)
+	}
+
+	// Find the last segment starting at or before offset
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].base > offset
+	}) - 1
+	seg := l.segments[i]
+
+	return seg, seg.entries[offset-seg.base], nil
+}
+
+// searchTimestamp returns the offset of the first record written at or after t, or the next offset if there's none.
+func (l *streamLog) searchTimestamp(t time.Time) int64 {
+	target := t.UnixNano()
+	next := l.nextOffset()
+
+	return int64(sort.Search(int(next), func(i int) bool {
+		_, entry, _ := l.locate(int64(i))
+		return entry.timestamp >= target
+	}))
+}
+
+// sync flushes the active segment and its index to disk. Sealed segments were synced when they were rolled over.
+func (l *streamLog) sync() error {
+	return l.active().sync()
+}
+
+func (s *segment) sync() error {
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return s.index.Sync()
+}
+
+func (l *streamLog) close() {
+	for _, seg := range l.segments {
+		seg.file.Close()
+		seg.index.Close()
+	}
+}
+
+func encodeIndexEntry(b []byte, entry indexEntry) {
+	binary.BigEndian.PutUint64(b[0:8], uint64(entry.pos))
+	binary.BigEndian.PutUint64(b[8:16], uint64(entry.timestamp))
+}
+
+// syncDir flushes a directory's entries, so that files created or renamed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
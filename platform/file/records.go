@@ -0,0 +1,567 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+type idempotencyKey struct {
+	Key     string    `json:"key"`
+	Offset  int64     `json:"offset"`
+	Hash    []byte    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+func (p *FilePlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := p.findWritableStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// A retried publish gets back the record it created the first time
+	s.forgetExpiredKeys(time.Now())
+	if original, err := s.findIdempotentRecord(idempotencyKey, content); original != nil || err != nil {
+		return original, err
+	}
+
+	rec, err := s.appendRecord(content, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.written(s)
+	if err != nil {
+		return nil, err
+	}
+	s.signal()
+
+	return rec, nil
+}
+
+func (p *FilePlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findWritableStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]platform.RecordResult, len(contents))
+	appended := []int{}
+	s.forgetExpiredKeys(time.Now())
+	for i, content := range contents {
+		key := ""
+		if idempotencyKeys != nil {
+			key = idempotencyKeys[i]
+		}
+
+		err := platform.ValidateIdempotencyKey(key)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		original, err := s.findIdempotentRecord(key, content)
+		if original != nil || err != nil {
+			results[i] = platform.RecordResult{Record: original, Err: err}
+			continue
+		}
+
+		rec, err := s.appendRecord(content, key)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		results[i].Record = rec
+		appended = append(appended, i)
+	}
+
+	// The whole batch is flushed at once. If that fails none of it can be relied on.
+	err = p.written(s)
+	if err != nil {
+		for _, i := range appended {
+			results[i] = platform.RecordResult{Err: err}
+		}
+	}
+	s.signal()
+
+	return results, nil
+}
+
+// findWritableStream looks up a stream which records can be published to.
+func (p *FilePlatform) findWritableStream(streamId string) (*stream, error) {
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted streams are read-only until they're restored
+	if !s.meta.DeletedAt.IsZero() {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: s.meta.PurgeAt}
+	}
+
+	return s, nil
+}
+
+func (p *FilePlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.findStream(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	sequence, _, err := platform.ParseRecordId(s.id, recordId)
+	if err != nil {
+		return nil, err
+	} else if int64(sequence) > s.log.nextOffset() {
+		return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+	}
+
+	rec, err := s.log.read(int64(sequence) - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// An ID with the right sequence number but the wrong time doesn't refer to the record
+	res := rec.toExt(s.id)
+	if res.Id != recordId {
+		return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+	}
+
+	return res, nil
+}
+
+func (p *FilePlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		res, changed, retryAt, err := p.leaseRecords(streamId, cursorId)
+		if err != nil || len(res.Records) > 0 {
+			return res, err
+		}
+
+		// Nothing to hand out yet. Sleep until the stream changes, the cursor's lease runs out or it's time to give up.
+		now := time.Now()
+		if !now.Before(deadline) {
+			return res, nil
+		}
+
+		if retryAt.IsZero() || retryAt.After(deadline) {
+			retryAt = deadline
+		}
+
+		timer := time.NewTimer(retryAt.Sub(now))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// leaseRecords leases the cursor's next batch. When there's nothing to hand out it also returns the stream's
+// changed channel and, if a batch is already leased, the time that lease expires.
+func (p *FilePlatform) leaseRecords(streamId string, cursorId string) (*platform.Batch, <-chan struct{}, time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	res := &platform.Batch{
+		Records: []platform.Record{}}
+
+	// Only one batch is leased to a cursor at a time. Until it is acknowledged or the lease
+	// expires there is nothing more to hand out.
+	now := time.Now()
+	if c.lease != nil && now.Before(c.lease.expires) {
+		return res, s.changed, c.lease.expires, nil
+	}
+
+	// Any expired lease is dropped so its records are redelivered from the committed position.
+	if c.lease != nil {
+		c.markFailed(platform.DEAD_LETTER_LEASE_EXPIRED, "")
+		c.lease = nil
+	}
+
+	// Read through the records after the committed position, passing over any that have run out of deliveries
+	next := s.log.nextOffset()
+	last := c.position
+	for offset := c.position + 1; offset < next && len(res.Records) < MAX_RECORDS; offset++ {
+		rec, err := s.log.read(offset)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+
+		last = offset
+		if p.deadLetterRecord(c, s, rec) {
+			continue
+		}
+
+		res.Records = append(res.Records, *rec.toExt(s.id))
+		c.delivered(offset)
+	}
+
+	// Everything left was dead-lettered, so there's nothing to lease and the cursor moves straight past it
+	if len(res.Records) == 0 {
+		if last != c.position {
+			err = c.commit(last)
+			if err != nil {
+				return nil, nil, time.Time{}, err
+			}
+		}
+
+		return res, s.changed, time.Time{}, nil
+	}
+
+	receipt, err := generateId()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	c.lease = &lease{
+		receipt: receipt,
+		last:    last,
+		expires: now.Add(p.leaseTimeout())}
+
+	res.Receipt = c.lease.receipt
+
+	return res, nil, time.Time{}, nil
+}
+
+func (p *FilePlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	// An expired lease can still be acknowledged as long as its records haven't been handed out again.
+	if c.lease == nil || c.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Commit the cursor's progress and wake any read waiting on the lease
+	err = c.commit(c.lease.last)
+	if err != nil {
+		return err
+	}
+	c.lease = nil
+	s.signal()
+
+	return nil
+}
+
+func (p *FilePlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	if c.lease == nil || c.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Release the lease so the batch is redelivered straight away
+	c.markFailed(platform.DEAD_LETTER_NACKED, reason)
+	c.lease = nil
+	s.signal()
+
+	return nil
+}
+
+func (p *FilePlatform) ReleaseRecords(streamId string, cursorId string, receipt string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, c, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	if c.lease == nil || c.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Take back the batch's deliveries and release the lease so it's redelivered straight away
+	c.undelivered()
+	c.lease = nil
+	s.signal()
+
+	return nil
+}
+
+// deadLetterRecord reports whether a record should be passed over by the cursor, publishing it to the cursor's
+// dead-letter stream if it has just run out of deliveries.
+func (p *FilePlatform) deadLetterRecord(c *cursor, s *stream, rec *logRecord) bool {
+	d := c.deliveries[rec.offset]
+	if d == nil || c.deadLetter == nil {
+		return false
+	} else if d.deadLettered {
+		return true
+	} else if d.count < c.deadLetter.MaxDeliveries {
+		return false
+	}
+
+	// Keep delivering the record rather than lose it while the dead-letter stream is unavailable
+	target := p.deadLetterStream(c.deadLetter.StreamId)
+	if target == nil {
+		return false
+	}
+
+	reason := d.reason
+	if reason == "" {
+		reason = platform.DEAD_LETTER_LEASE_EXPIRED
+	}
+
+	content, err := platform.NewDeadLetter(rec.toExt(s.id), c.id, reason, d.message, d.count).Encode()
+	if err != nil {
+		return false
+	}
+
+	_, err = target.appendRecord(content, "")
+	if err == nil {
+		err = p.written(target)
+	}
+	if err != nil {
+		log.Printf("Error publishing dead letter to stream %s: %s", target.id, err)
+		return false
+	}
+
+	target.signal()
+	d.deadLettered = true
+
+	return true
+}
+
+// deadLetterStream finds a stream which dead letters can be published to. Unlike findStream it never purges
+// streams, so the caller's streams stay open.
+func (p *FilePlatform) deadLetterStream(streamId string) *stream {
+	for _, s := range p.streams {
+		if s.id == streamId {
+			if !s.meta.DeletedAt.IsZero() {
+				return nil
+			}
+
+			return s
+		}
+	}
+
+	return nil
+}
+
+// appendRecord writes a record to the end of the stream's log, remembering its idempotency key if it has one.
+func (s *stream) appendRecord(content []byte, key string) (*platform.Record, error) {
+	rec, err := s.log.append(content, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	res := rec.toExt(s.id)
+
+	err = s.rememberKey(key, rec.offset, res.ContentHash)
+	if err != nil {
+		// The record is already in the log, so a retry would publish it twice. That's no worse than publishing
+		// without a key.
+		log.Printf("Error remembering idempotency key %q on stream %s: %s", key, s.id, err)
+	}
+
+	return res, nil
+}
+
+// findIdempotentRecord returns the record already published with key, if any. Reusing a key with different
+// content is an error.
+func (s *stream) findIdempotentRecord(key string, content []byte) (*platform.Record, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	entry, ok := s.keys[key]
+	if !ok || !time.Now().Before(entry.Expires) {
+		return nil, nil
+	}
+
+	if !bytes.Equal(entry.Hash, hashContent(content)) {
+		return nil, &platform.ErrIdempotencyKeyReused{IdempotencyKey: key, StreamID: s.id}
+	}
+
+	rec, err := s.log.read(entry.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec.toExt(s.id), nil
+}
+
+// rememberKey appends a key to the stream's keys file. It's flushed along with the stream's log.
+func (s *stream) rememberKey(key string, offset int64, hash []byte) error {
+	if key == "" {
+		return nil
+	}
+
+	entry := &idempotencyKey{
+		Key:     key,
+		Offset:  offset,
+		Hash:    hash,
+		Expires: time.Now().Add(s.dedupeWindow())}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.keysFile.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	s.keys[key] = entry
+	s.keyOrder = append(s.keyOrder, entry)
+
+	return nil
+}
+
+// forgetExpiredKeys drops the keys whose dedupe window has passed. Windows can shrink, so keyOrder is only
+// roughly by expiry and a key stuck behind a longer-lived one lingers, though lookups ignore it. Expired keys
+// stay in the keys file until the stream is next loaded.
+func (s *stream) forgetExpiredKeys(now time.Time) {
+	n := 0
+	for ; n < len(s.keyOrder) && !now.Before(s.keyOrder[n].Expires); n++ {
+		// A newer entry may have replaced this one in the index
+		if s.keys[s.keyOrder[n].Key] == s.keyOrder[n] {
+			delete(s.keys, s.keyOrder[n].Key)
+		}
+	}
+
+	s.keyOrder = s.keyOrder[n:]
+}
+
+// loadKeys reads the stream's unexpired idempotency keys and rewrites the keys file without the expired ones.
+// Keys for records lost in a crash, and a line torn by one, are dropped.
+func (s *stream) loadKeys(now time.Time) error {
+	path := filepath.Join(s.dir, KEYS_FILE)
+	s.keys = map[string]*idempotencyKey{}
+	s.keyOrder = []*idempotencyKey{}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if f != nil {
+		next := s.log.nextOffset()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := &idempotencyKey{}
+			err := json.Unmarshal(scanner.Bytes(), entry)
+			if err != nil || entry.Offset >= next || !now.Before(entry.Expires) {
+				continue
+			}
+
+			s.keys[entry.Key] = entry
+			s.keyOrder = append(s.keyOrder, entry)
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Compact the file down to the keys still in use
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	for _, entry := range s.keyOrder {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	s.keysFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+
+	return err
+}
+
+// toExt converts a record. Offsets count from 0, so a record's sequence number is one past its offset.
+func (r *logRecord) toExt(streamId string) *platform.Record {
+	sequence := uint64(r.offset) + 1
+
+	return &platform.Record{
+		Id:          platform.FormatRecordId(streamId, sequence, r.timestamp),
+		StreamId:    streamId,
+		Sequence:    sequence,
+		Content:     r.content,
+		ContentHash: hashContent(r.content),
+		Timestamp:   r.timestamp}
+}
+
+func hashContent(content []byte) []byte {
+	h := sha1.New()
+	h.Write(content)
+	return h.Sum(nil)
+}
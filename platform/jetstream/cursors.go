@@ -0,0 +1,453 @@
+package jetstream
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/oceanhq/streams/platform"
+)
+
+// Keys of a cursor's consumer metadata, on top of META_CREATED_AT.
+const (
+	META_DEAD_LETTER_STREAM_ID = "ocean.dead_letter_stream_id"
+	META_MAX_DELIVERIES        = "ocean.max_deliveries"
+)
+
+type cursor struct {
+	id        string
+	streamId  string
+	createdAt time.Time
+	// position is the sequence of the last record the cursor has committed, i.e. its consumer's ack floor, or
+	// 0 if it hasn't passed any.
+	position   uint64
+	deadLetter *platform.DeadLetterPolicy
+
+	config nats.ConsumerConfig
+}
+
+// lease is kept in the lease bucket under the cursor's lease key. Receipt is empty unless a batch is leased to the
+// cursor, in which case Replies holds the subjects to acknowledge its records on, in order. Reason and Message
+// record why the last batch wasn't acknowledged, for any of its records that are dead-lettered when they're
+// next read.
+type lease struct {
+	Receipt string   `json:"receipt,omitempty"`
+	Expires int64    `json:"expires,omitempty"`
+	Replies []string `json:"replies,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+func (p *JetStreamPlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := s.resolveStart(conn, &start)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := p.addCursor(conn, s.id, id, time.Now(), config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *JetStreamPlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := s.resolveStart(conn, &position)
+	if err != nil {
+		return nil, err
+	}
+
+	// A consumer's start can't be changed, so it's replaced by one with the same name. Any outstanding batch is
+	// abandoned; its receipt can no longer be acknowledged.
+	err = conn.js.DeleteConsumer(streamName(s.id), c.id)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	err = conn.leases.Purge(leaseKey(s.id, c.id))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	c, err = p.addCursor(conn, s.id, c.id, c.createdAt, config, c.deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *JetStreamPlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *JetStreamPlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := []*cursor{}
+	for info := range conn.js.Consumers(streamName(s.id)) {
+		c, err := cursorFromInfo(s.id, info)
+		if err != nil {
+			return nil, err
+		}
+
+		cursors = append(cursors, c)
+	}
+
+	sort.Sort(cursorsByCreatedAt(cursors))
+
+	out := []platform.Cursor{}
+	for _, c := range cursors {
+		out = append(out, *(c.toExt()))
+	}
+
+	return out, nil
+}
+
+func (p *JetStreamPlatform) DeleteCursor(streamId string, cursorId string) error {
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return err
+	}
+
+	if !validId(cursorId) {
+		return &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	err = conn.js.DeleteConsumer(streamName(s.id), cursorId)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	} else if err != nil {
+		return unavailable(err)
+	}
+
+	return unavailable(conn.leases.Purge(leaseKey(s.id, cursorId)))
+}
+
+func (p *JetStreamPlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, source, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	// The clone starts from the source's committed position. Any batch leased to the source stays with it.
+	config := &nats.ConsumerConfig{
+		DeliverPolicy: nats.DeliverByStartSequencePolicy,
+		OptStartSeq:   source.position + 1}
+	c, err := p.addCursor(conn, s.id, id, time.Now(), config, source.deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *JetStreamPlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != nil {
+		err := policy.Validate(streamId)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = findStream(conn, policy.StreamId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The policy is kept in the consumer's metadata, which can be changed in place
+	c.deadLetter = policy
+	c.config.Metadata = c.metadata()
+	info, err := conn.js.UpdateConsumer(streamName(c.streamId), &c.config)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	c, err = cursorFromInfo(c.streamId, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+// addCursor creates the durable consumer for a cursor. config gives where the consumer starts; the rest of it
+// is filled in here.
+func (p *JetStreamPlatform) addCursor(conn *conn, streamId string, id string, createdAt time.Time, config *nats.ConsumerConfig, deadLetter *platform.DeadLetterPolicy) (*cursor, error) {
+	c := &cursor{
+		id:         id,
+		streamId:   streamId,
+		createdAt:  createdAt,
+		deadLetter: deadLetter}
+
+	// Acknowledging a batch's last record acknowledges the whole batch. Records are redelivered without limit,
+	// as the platform dead-letters them itself.
+	c.config = *config
+	c.config.Durable = id
+	c.config.AckPolicy = nats.AckAllPolicy
+	c.config.AckWait = p.leaseTimeout()
+	c.config.MaxDeliver = -1
+	c.config.MaxAckPending = MAX_RECORDS
+	c.config.ReplayPolicy = nats.ReplayInstantPolicy
+	c.config.Metadata = c.metadata()
+
+	info, err := conn.js.AddConsumer(streamName(streamId), &c.config)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return cursorFromInfo(streamId, info)
+}
+
+// findStreamCursor looks up a cursor belonging to a stream, returning the matching platform error if either is
+// missing.
+func findStreamCursor(conn *conn, streamId string, cursorId string) (*stream, *cursor, error) {
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !validId(cursorId) {
+		return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	info, err := conn.js.ConsumerInfo(streamName(s.id), cursorId)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	} else if err != nil {
+		return nil, nil, unavailable(err)
+	}
+
+	c, err := cursorFromInfo(s.id, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, c, nil
+}
+
+// cursorFromInfo reads a cursor from its consumer.
+func cursorFromInfo(streamId string, info *nats.ConsumerInfo) (*cursor, error) {
+	c := &cursor{
+		id:       info.Name,
+		streamId: streamId,
+		position: info.AckFloor.Stream,
+		config:   info.Config}
+
+	meta := info.Config.Metadata
+	var err error
+	c.createdAt, err = parseTime(meta[META_CREATED_AT])
+	if err != nil {
+		return nil, err
+	}
+
+	if meta[META_DEAD_LETTER_STREAM_ID] != "" {
+		maxDeliveries, err := strconv.Atoi(meta[META_MAX_DELIVERIES])
+		if err != nil {
+			return nil, err
+		}
+
+		c.deadLetter = &platform.DeadLetterPolicy{
+			StreamId:      meta[META_DEAD_LETTER_STREAM_ID],
+			MaxDeliveries: maxDeliveries}
+	}
+
+	return c, nil
+}
+
+type cursorsByCreatedAt []*cursor
+
+func (a cursorsByCreatedAt) Len() int           { return len(a) }
+func (a cursorsByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a cursorsByCreatedAt) Less(i, j int) bool { return a[i].createdAt.Before(a[j].createdAt) }
+
+func (c *cursor) metadata() map[string]string {
+	meta := map[string]string{
+		META_CREATED_AT: formatTime(c.createdAt)}
+	if c.deadLetter != nil {
+		meta[META_DEAD_LETTER_STREAM_ID] = c.deadLetter.StreamId
+		meta[META_MAX_DELIVERIES] = strconv.Itoa(c.deadLetter.MaxDeliveries)
+	}
+
+	return meta
+}
+
+func (c *cursor) toExt() *platform.Cursor {
+	return &platform.Cursor{
+		Id:         c.id,
+		StreamId:   c.streamId,
+		Position:   formatSequence(c.position),
+		DeadLetter: c.deadLetter}
+}
+
+// loadLease reads the cursor's lease along with its revision, which is 0 if it has none.
+func (c *cursor) loadLease(conn *conn) (*lease, uint64, error) {
+	entry, err := conn.leases.Get(leaseKey(c.streamId, c.id))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return &lease{}, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	l := &lease{}
+	err = json.Unmarshal(entry.Value(), l)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return l, entry.Revision(), nil
+}
+
+// saveLease writes the cursor's lease if it's still at revision, reporting false if another server changed it
+// first.
+func (c *cursor) saveLease(conn *conn, l *lease, revision uint64) (uint64, bool, error) {
+	value, err := json.Marshal(l)
+	if err != nil {
+		return 0, false, err
+	}
+
+	key := leaseKey(c.streamId, c.id)
+	if revision == 0 {
+		revision, err = conn.leases.Create(key, value)
+	} else {
+		revision, err = conn.leases.Update(key, value, revision)
+	}
+	if errors.Is(err, nats.ErrKeyExists) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	return revision, true, nil
+}
+
+// leased reports whether a batch is leased to the cursor which hasn't expired yet.
+func (l *lease) leased(now time.Time) bool {
+	return l.Receipt != "" && now.UnixNano() < l.Expires
+}
+
+// resolveStart gives where a cursor's consumer should start for a start position.
+func (s *stream) resolveStart(conn *conn, start *platform.StartPosition) (*nats.ConsumerConfig, error) {
+	err := start.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverAllPolicy}, nil
+	case platform.START_AT_TIMESTAMP:
+		t := start.Timestamp
+		return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverByStartTimePolicy, OptStartTime: &t}, nil
+	case platform.START_AFTER_RECORD_ID:
+		seq, _, err := platform.ParseRecordId(s.id, start.RecordId)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = getRecord(conn, s.id, seq)
+		if _, ok := err.(*platform.ErrRecordNotFound); ok {
+			return nil, &platform.ErrRecordNotFound{RecordID: start.RecordId, StreamID: s.id}
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverByStartSequencePolicy, OptStartSeq: seq + 1}, nil
+	case platform.START_LAST:
+		if start.Count == 0 {
+			break
+		}
+
+		// Records are never removed from a stream, so the last count records are numbered from last-count+1
+		last := s.state.LastSeq
+		if uint64(start.Count) >= last {
+			return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverAllPolicy}, nil
+		}
+
+		return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverByStartSequencePolicy, OptStartSeq: last - uint64(start.Count) + 1}, nil
+	}
+
+	return &nats.ConsumerConfig{DeliverPolicy: nats.DeliverNewPolicy}, nil
+}
+
+func formatSequence(seq uint64) string {
+	return strconv.FormatUint(seq, 10)
+}
@@ -0,0 +1,557 @@
+// Package jetstream is an implementation of the platform on NATS JetStream (nats-server 2.10 or later), for
+// self-hosted deployments which need to replay streams from any point.
+//
+// Each stream is a JetStream stream holding one subject, so records are numbered by their stream sequence, and
+// record IDs are made from it and the message's timestamp by platform.FormatRecordId. Idempotency keys are
+// JetStream message IDs, deduplicated over the stream's duplicates window. Each cursor is a durable pull
+// consumer, whose ack floor is the cursor's position. JetStream redelivers unacknowledged records on its own, so
+// the platform only keeps track of which batch is leased to each cursor, in a key-value bucket shared by every
+// server.
+package jetstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	ID_LENGTH   = 16 // 128-bit
+	MAX_RECORDS = 100
+
+	DEFAULT_URL           = nats.DefaultURL
+	DEFAULT_LEASE_TIMEOUT = 30 * time.Second
+
+	// REQUEST_TIMEOUT bounds each request made to the server.
+	REQUEST_TIMEOUT = 5 * time.Second
+
+	// MAX_UPDATE_ATTEMPTS is how many times a change to a cursor's lease is retried when another server changes it first.
+	MAX_UPDATE_ATTEMPTS = 10
+
+	// STREAM_PREFIX is prepended to a stream's ID to name its JetStream stream.
+	STREAM_PREFIX = "OCEAN_"
+	// RECORDS_SUBJECT_PREFIX is prepended to a stream's ID to give the subject its records are published on.
+	// While a stream is deleted it listens on DELETED_SUBJECT_PREFIX instead, so that nothing can be published to it.
+	RECORDS_SUBJECT_PREFIX = "ocean.records."
+	DELETED_SUBJECT_PREFIX = "ocean.deleted."
+	// LEASES_BUCKET is the key-value bucket holding the batch leased to each cursor.
+	LEASES_BUCKET = "OCEAN_LEASES"
+)
+
+// Keys of a stream's metadata. Times are in Unix nanoseconds.
+const (
+	META_NAME       = "ocean.name"
+	META_CREATED_AT = "ocean.created_at"
+	META_DELETED_AT = "ocean.deleted_at"
+	META_PURGE_AT   = "ocean.purge_at"
+)
+
+type JetStreamPlatform struct {
+	// URL locates the NATS servers, e.g. "nats://localhost:4222". Several can be given separated by commas.
+	// Defaults to DEFAULT_URL.
+	URL string
+
+	// LeaseTimeout is how long a batch returned by GetRecords stays leased to its cursor
+	// before it is redelivered. Defaults to DEFAULT_LEASE_TIMEOUT.
+	LeaseTimeout time.Duration
+
+	mu   sync.Mutex
+	conn *conn
+}
+
+func init() {
+	platform.Register("jetstream", func(opts platform.Options) (platform.Platform, error) {
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		return &JetStreamPlatform{
+			URL:          opts["NATS_URL"],
+			LeaseTimeout: leaseTimeout}, nil
+	})
+}
+
+// conn is a connection to NATS along with the JetStream context and lease bucket used over it.
+type conn struct {
+	nc     *nats.Conn
+	js     nats.JetStreamContext
+	leases nats.KeyValue
+}
+
+// connect returns the platform's connection, connecting the first time it's used and again if the connection
+// has been closed.
+func (p *JetStreamPlatform) connect() (*conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && !p.conn.nc.IsClosed() {
+		return p.conn, nil
+	}
+
+	url := p.URL
+	if url == "" {
+		url = DEFAULT_URL
+	}
+
+	nc, err := nats.Connect(url, nats.Name("ocean-streams"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	js, err := nc.JetStream(nats.MaxWait(REQUEST_TIMEOUT))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	leases, err := js.KeyValue(LEASES_BUCKET)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		leases, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  LEASES_BUCKET,
+			Storage: nats.FileStorage})
+	}
+	if err != nil {
+		nc.Close()
+		return nil, unavailable(err)
+	}
+
+	p.conn = &conn{
+		nc:     nc,
+		js:     js,
+		leases: leases}
+
+	return p.conn, nil
+}
+
+// Close closes the platform's connection. The platform reconnects if it's used again.
+func (p *JetStreamPlatform) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.nc.Drain()
+	p.conn = nil
+
+	return err
+}
+
+func (p *JetStreamPlatform) CreateStream(name string) (*platform.Stream, error) {
+	if name == "" {
+		return nil, &platform.ErrInvalidParam{Param: "name", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := conn.js.AddStream(&nats.StreamConfig{
+		Name:       streamName(id),
+		Subjects:   []string{recordsSubject(id)},
+		Retention:  nats.LimitsPolicy,
+		Storage:    nats.FileStorage,
+		Duplicates: platform.DEFAULT_DEDUPE_WINDOW,
+		Metadata: map[string]string{
+			META_NAME:       name,
+			META_CREATED_AT: formatTime(time.Now())}})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	s, err := streamFromInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *JetStreamPlatform) ListStreams() ([]platform.Stream, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Listing doesn't report errors, so make sure the server is there first
+	_, err = conn.js.AccountInfo()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	streams := []*stream{}
+	for info := range conn.js.Streams(nats.StreamListFilter("ocean.>")) {
+		s, err := streamFromInfo(info)
+		if err != nil {
+			log.Printf("Skipping JetStream stream %s: %s", info.Config.Name, err)
+			continue
+		}
+
+		streams = append(streams, s)
+	}
+
+	sort.Sort(byCreatedAt(streams))
+
+	// Deleted streams vanish once their retention period is up
+	out := []platform.Stream{}
+	now := time.Now()
+	for _, s := range streams {
+		if s.expired(now) {
+			err = purgeStream(conn, s.id)
+			if err != nil {
+				log.Printf("Error purging stream %s: %s", s.id, err)
+			}
+			continue
+		}
+
+		out = append(out, *(s.toExt()))
+	}
+
+	return out, nil
+}
+
+func (p *JetStreamPlatform) GetStream(streamId string) (*platform.Stream, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *JetStreamPlatform) DeleteStream(streamId string, retention time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if s.deletedAt.IsZero() {
+		s.deletedAt = now
+	}
+
+	// Without a retention period there's nothing to restore so remove it straight away
+	if retention <= 0 {
+		s.purgeAt = now
+		res := s.toExt()
+
+		return res, unavailable(purgeStream(conn, s.id))
+	}
+
+	s.purgeAt = now.Add(retention)
+	err = s.save(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *JetStreamPlatform) RestoreStream(streamId string) (*platform.Stream, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deletedAt = time.Time{}
+	s.purgeAt = time.Time{}
+	err = s.save(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *JetStreamPlatform) SetDedupeWindow(streamId string, window time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateDedupeWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// JetStream applies the new window to message IDs it's already holding, too
+	if window == 0 {
+		window = platform.DEFAULT_DEDUPE_WINDOW
+	}
+	s.config.Duplicates = window
+	err = s.save(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+type stream struct {
+	id        string
+	name      string
+	createdAt time.Time
+	deletedAt time.Time
+	purgeAt   time.Time
+
+	config nats.StreamConfig
+	state  nats.StreamState
+}
+
+// streamFromInfo reads a stream from its JetStream stream.
+func streamFromInfo(info *nats.StreamInfo) (*stream, error) {
+	meta := info.Config.Metadata
+	if len(info.Config.Name) <= len(STREAM_PREFIX) || meta == nil {
+		return nil, errors.New("Not a stream created by the platform.")
+	}
+
+	s := &stream{
+		id:     info.Config.Name[len(STREAM_PREFIX):],
+		name:   meta[META_NAME],
+		config: info.Config,
+		state:  info.State}
+
+	var err error
+	s.createdAt, err = parseTime(meta[META_CREATED_AT])
+	if err != nil {
+		return nil, err
+	}
+
+	s.deletedAt, err = parseTime(meta[META_DELETED_AT])
+	if err != nil {
+		return nil, err
+	}
+
+	s.purgeAt, err = parseTime(meta[META_PURGE_AT])
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// save writes the stream's metadata and settings back to its JetStream stream. A deleted stream is moved onto
+// its deleted subject so that records can't be published to it.
+func (s *stream) save(conn *conn) error {
+	meta := map[string]string{
+		META_NAME:       s.name,
+		META_CREATED_AT: formatTime(s.createdAt)}
+	subject := recordsSubject(s.id)
+	if !s.deletedAt.IsZero() {
+		meta[META_DELETED_AT] = formatTime(s.deletedAt)
+		meta[META_PURGE_AT] = formatTime(s.purgeAt)
+		subject = DELETED_SUBJECT_PREFIX + s.id
+	}
+
+	s.config.Metadata = meta
+	s.config.Subjects = []string{subject}
+	info, err := conn.js.UpdateStream(&s.config)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return &platform.ErrStreamNotFound{SearchParam: "ID", Value: s.id}
+	} else if err != nil {
+		return unavailable(err)
+	}
+
+	s.config = info.Config
+	s.state = info.State
+
+	return nil
+}
+
+// findStream looks up a stream, returning the matching platform error if it's missing. A stream whose retention
+// period is up is purged on the way.
+func findStream(conn *conn, streamId string) (*stream, error) {
+	if !validId(streamId) {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	info, err := conn.js.StreamInfo(streamName(streamId))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	s, err := streamFromInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted streams vanish once their retention period is up
+	if s.expired(time.Now()) {
+		err = purgeStream(conn, s.id)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	return s, nil
+}
+
+// findWritableStream looks up a stream which records can be published to.
+func findWritableStream(conn *conn, streamId string) (*stream, error) {
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted streams are read-only until they're restored
+	if !s.deletedAt.IsZero() {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: s.purgeAt}
+	}
+
+	return s, nil
+}
+
+// purgeStream removes a stream along with its records and cursors, and the leases of its cursors.
+func purgeStream(conn *conn, streamId string) error {
+	for cursorId := range conn.js.ConsumerNames(streamName(streamId)) {
+		err := conn.leases.Purge(leaseKey(streamId, cursorId))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := conn.js.DeleteStream(streamName(streamId))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// expired reports whether a deleted stream's retention period is up.
+func (s *stream) expired(now time.Time) bool {
+	return !s.deletedAt.IsZero() && !now.Before(s.purgeAt)
+}
+
+func (s *stream) toExt() *platform.Stream {
+	return &platform.Stream{
+		Id:           s.id,
+		Name:         s.name,
+		DeletedAt:    s.deletedAt,
+		PurgeAt:      s.purgeAt,
+		DedupeWindow: s.config.Duplicates}
+}
+
+type byCreatedAt []*stream
+
+func (a byCreatedAt) Len() int           { return len(a) }
+func (a byCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreatedAt) Less(i, j int) bool { return a[i].createdAt.Before(a[j].createdAt) }
+
+func (p *JetStreamPlatform) leaseTimeout() time.Duration {
+	if p.LeaseTimeout <= 0 {
+		return DEFAULT_LEASE_TIMEOUT
+	}
+
+	return p.LeaseTimeout
+}
+
+func streamName(streamId string) string {
+	return STREAM_PREFIX + streamId
+}
+
+func recordsSubject(streamId string) string {
+	return RECORDS_SUBJECT_PREFIX + streamId
+}
+
+func leaseKey(streamId string, cursorId string) string {
+	return streamId + "." + cursorId
+}
+
+// unavailable wraps an error from failing to reach NATS, or JetStream not answering, so that it's reported as
+// temporary. Any other error is returned as it is.
+func unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(net.Error); ok ||
+		errors.Is(err, nats.ErrNoServers) ||
+		errors.Is(err, nats.ErrConnectionClosed) ||
+		errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrJetStreamNotEnabled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return &platform.ErrUnavailable{Service: "NATS", Err: err}
+	}
+
+	return err
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	nanos, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// validId reports whether id could have been given by generateId. Other IDs can't name a JetStream stream or
+// consumer, so are never found.
+func validId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == ID_LENGTH
+}
+
+func generateId() (string, error) {
+	b := make([]byte, ID_LENGTH)
+	_, err := rand.Read(b)
+
+	return hex.EncodeToString(b), err
+}
@@ -0,0 +1,111 @@
+package jetstream
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+// TEST_URL_ENV names the environment variable holding the NATS server the tests run against. Every stream named
+// with STREAM_PREFIX and the LEASES_BUCKET are deleted before each test, so it mustn't be one that's in use.
+const TEST_URL_ENV = "TEST_NATS_URL"
+
+func TestConformance(t *testing.T) {
+	url := os.Getenv(TEST_URL_ENV)
+	if url == "" {
+		t.Skipf("Set %s to run the NATS JetStream tests", TEST_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(url)
+	defer closeLast()
+
+	platformtest.Run(t, factory)
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	url := os.Getenv(TEST_URL_ENV)
+	if url == "" {
+		b.Skipf("Set %s to run the NATS JetStream benchmarks", TEST_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(url)
+	defer closeLast()
+
+	platformtest.Benchmark(b, factory)
+}
+
+// emptyPlatforms returns a factory for platforms on an emptied server. Each platform is closed when the next is
+// made, and closeLast closes the final one.
+func emptyPlatforms(url string) (factory platform.Factory, closeLast func()) {
+	var last *JetStreamPlatform
+
+	factory = func(opts platform.Options) (platform.Platform, error) {
+		if last != nil {
+			last.Close()
+		}
+
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		err = deleteStreams(url)
+		if err != nil {
+			return nil, err
+		}
+
+		last = &JetStreamPlatform{
+			URL:          url,
+			LeaseTimeout: leaseTimeout}
+
+		return last, nil
+	}
+
+	closeLast = func() {
+		if last != nil {
+			last.Close()
+		}
+	}
+
+	return factory, closeLast
+}
+
+// deleteStreams deletes the platform's streams and its lease bucket, which it creates again when it connects.
+func deleteStreams(url string) error {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.MaxWait(REQUEST_TIMEOUT))
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range js.StreamNames() {
+		if strings.HasPrefix(name, STREAM_PREFIX) {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		err = js.DeleteStream(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = js.DeleteKeyValue(LEASES_BUCKET)
+	if err != nil && !errors.Is(err, nats.ErrBucketNotFound) && !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,593 @@
+package jetstream
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/oceanhq/streams/platform"
+)
+
+// TIMESTAMP_HEADER carries the time a record was published, in Unix nanoseconds, so that it reads back the same as
+// it was returned to the publisher.
+const TIMESTAMP_HEADER = "Ocean-Timestamp"
+
+const (
+	// FETCH_MIN_WAIT is how long a read waits on its consumer when it isn't blocking, as JetStream only reports
+	// having no records once it has checked.
+	FETCH_MIN_WAIT = 100 * time.Millisecond
+
+	// LEASE_POLL_INTERVAL is how often a read waiting on a leased batch checks whether another server has
+	// acknowledged it.
+	LEASE_POLL_INTERVAL = 500 * time.Millisecond
+)
+
+// Verbs posted to a record's reply subject to acknowledge it.
+var (
+	ACK  = []byte("+ACK")
+	NAK  = []byte("-NAK")
+	TERM = []byte("+TERM")
+)
+
+func (p *JetStreamPlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findWritableStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, rec := s.newMsg(content)
+	ack, err := conn.js.PublishMsg(msg, s.publishOpts(idempotencyKey)...)
+
+	return s.published(conn, rec, idempotencyKey, ack, err)
+}
+
+func (p *JetStreamPlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findWritableStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every record is published before any acknowledgement is waited on. JetStream stores them in order, so a
+	// key repeated within the batch finds the record published for it earlier on.
+	results := make([]platform.RecordResult, len(contents))
+	keys := make([]string, len(contents))
+	recs := make([]*platform.Record, len(contents))
+	futures := make([]nats.PubAckFuture, len(contents))
+	for i, content := range contents {
+		if idempotencyKeys != nil {
+			keys[i] = idempotencyKeys[i]
+		}
+
+		err := platform.ValidateIdempotencyKey(keys[i])
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		var msg *nats.Msg
+		msg, recs[i] = s.newMsg(content)
+		futures[i], err = conn.js.PublishMsgAsync(msg, s.publishOpts(keys[i])...)
+		if err != nil {
+			results[i].Err = unavailable(err)
+		}
+	}
+
+	timeout := time.After(REQUEST_TIMEOUT)
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+
+		var ack *nats.PubAck
+		var err error
+		select {
+		case ack = <-future.Ok():
+		case err = <-future.Err():
+		case <-timeout:
+			return nil, &platform.ErrUnavailable{Service: "NATS", Err: nats.ErrTimeout}
+		}
+
+		rec, err := s.published(conn, recs[i], keys[i], ack, err)
+		results[i] = platform.RecordResult{Record: rec, Err: err}
+	}
+
+	return results, nil
+}
+
+// newMsg builds the message for a record, returning it along with the record it will become once published.
+func (s *stream) newMsg(content []byte) (*nats.Msg, *platform.Record) {
+	rec := &platform.Record{
+		StreamId:    s.id,
+		Content:     content,
+		ContentHash: hashContent(content),
+		Timestamp:   time.Now().UTC()}
+
+	msg := nats.NewMsg(recordsSubject(s.id))
+	msg.Data = content
+	msg.Header.Set(TIMESTAMP_HEADER, formatTime(rec.Timestamp))
+
+	return msg, rec
+}
+
+// publishOpts gives the options to publish a record with. Publishing isn't retried when nothing answers, as that
+// means the stream has been deleted.
+func (s *stream) publishOpts(key string) []nats.PubOpt {
+	opts := []nats.PubOpt{nats.ExpectStream(streamName(s.id)), nats.RetryAttempts(0)}
+	if key != "" {
+		opts = append(opts, nats.MsgId(key))
+	}
+
+	return opts
+}
+
+// published completes the record rec once JetStream has acknowledged it, or gives the record published earlier
+// with the same idempotency key.
+func (s *stream) published(conn *conn, rec *platform.Record, key string, ack *nats.PubAck, err error) (*platform.Record, error) {
+	if errors.Is(err, nats.ErrNoStreamResponse) || errors.Is(err, nats.ErrNoResponders) {
+		// The stream was deleted after it was looked up, so it no longer listens on its subject
+		return nil, s.gone(conn)
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	if !ack.Duplicate {
+		rec.Sequence = ack.Sequence
+		rec.Id = platform.FormatRecordId(s.id, rec.Sequence, rec.Timestamp)
+		return rec, nil
+	}
+
+	// A retried publish gets back the record it created the first time
+	original, err := getRecord(conn, s.id, ack.Sequence)
+	if err != nil {
+		return nil, err
+	} else if !bytes.Equal(original.ContentHash, rec.ContentHash) {
+		return nil, &platform.ErrIdempotencyKeyReused{IdempotencyKey: key, StreamID: s.id}
+	}
+
+	return original, nil
+}
+
+// gone gives the error for a publish to the stream which nothing answered.
+func (s *stream) gone(conn *conn) error {
+	current, err := findStream(conn, s.id)
+	if err != nil {
+		return err
+	} else if !current.deletedAt.IsZero() {
+		return &platform.ErrStreamDeleted{StreamID: s.id, PurgeAt: current.purgeAt}
+	}
+
+	return &platform.ErrUnavailable{Service: "NATS", Err: nats.ErrNoStreamResponse}
+}
+
+func (p *JetStreamPlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, _, err := platform.ParseRecordId(s.id, recordId)
+	if err != nil {
+		return nil, err
+	}
+
+	// An ID with the right sequence number but the wrong time doesn't refer to the record
+	rec, err := getRecord(conn, s.id, seq)
+	if _, ok := err.(*platform.ErrRecordNotFound); ok || (err == nil && rec.Id != recordId) {
+		return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (p *JetStreamPlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		res, retryAt, err := p.leaseRecords(streamId, cursorId, deadline)
+		if err != nil || len(res.Records) > 0 {
+			return res, err
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			return res, nil
+		}
+
+		// A batch is already leased. Sleep until it runs out, checking back in case another server has it acknowledged.
+		if !retryAt.IsZero() {
+			until := now.Add(LEASE_POLL_INTERVAL)
+			if retryAt.Before(until) {
+				until = retryAt
+			}
+			if deadline.Before(until) {
+				until = deadline
+			}
+
+			time.Sleep(until.Sub(now))
+		}
+	}
+}
+
+// leaseRecords leases the cursor's next batch, waiting until deadline for records to arrive. If a batch is
+// already leased, it returns the time that lease expires instead.
+func (p *JetStreamPlatform) leaseRecords(streamId string, cursorId string, deadline time.Time) (*platform.Batch, time.Time, error) {
+	res := &platform.Batch{
+		Records: []platform.Record{}}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// The cursor's lease is claimed before reading, so that only one server reads from its consumer at a time.
+	// The claim lasts through the read.
+	var l *lease
+	var revision uint64
+	var retryAt time.Time
+	err = update(func() (bool, error) {
+		var err error
+		l, revision, err = c.loadLease(conn)
+		if err != nil {
+			return false, err
+		}
+
+		// Only one batch is leased to a cursor at a time. Until it is acknowledged or the lease
+		// expires there is nothing more to hand out.
+		now := time.Now()
+		if l.leased(now) {
+			retryAt = time.Unix(0, l.Expires)
+			return true, nil
+		}
+
+		// Any expired lease is handed straight back so its records are redelivered from the committed position.
+		if l.Receipt != "" {
+			err = conn.reply(l.Replies, NAK)
+			if err != nil {
+				return false, err
+			}
+
+			l.Reason = platform.DEAD_LETTER_LEASE_EXPIRED
+			l.Message = ""
+		}
+
+		claim := *l
+		claim.Receipt, err = generateId()
+		if err != nil {
+			return false, err
+		}
+		claim.Replies = nil
+		claim.Expires = deadline.Add(p.leaseTimeout()).UnixNano()
+
+		var ok bool
+		revision, ok, err = c.saveLease(conn, &claim, revision)
+		return ok, err
+	})
+	if err != nil || !retryAt.IsZero() {
+		return res, retryAt, err
+	}
+
+	msgs, err := c.fetch(conn, deadline.Sub(time.Now()))
+	if err != nil {
+		c.release(conn, l, revision)
+		return nil, time.Time{}, err
+	}
+
+	// Pass over any records which have run out of deliveries
+	replies := []string{}
+	for i, msg := range msgs {
+		rec, skip, err := c.readMsg(conn, msg, l)
+		if err != nil {
+			// Hand back everything read so far along with the rest of the batch
+			for _, rest := range msgs[i:] {
+				replies = append(replies, rest.Reply)
+			}
+			conn.reply(replies, NAK)
+			c.release(conn, l, revision)
+			return nil, time.Time{}, err
+		} else if skip {
+			msg.Respond(TERM)
+			continue
+		}
+
+		res.Records = append(res.Records, *rec)
+		replies = append(replies, msg.Reply)
+	}
+
+	// Nothing arrived in time, or everything read was dead-lettered and so is done with
+	if len(res.Records) == 0 {
+		if len(msgs) > 0 {
+			l = &lease{}
+		}
+
+		return res, time.Time{}, c.release(conn, l, revision)
+	}
+
+	receipt, err := generateId()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	_, ok, err := c.saveLease(conn, &lease{
+		Receipt: receipt,
+		Expires: time.Now().Add(p.leaseTimeout()).UnixNano(),
+		Replies: replies}, revision)
+	if err == nil && !ok {
+		err = &platform.ErrConflict{Message: "The cursor's lease was taken over while it was being read. Try again."}
+	}
+	if err != nil {
+		conn.reply(replies, NAK)
+		return nil, time.Time{}, unavailable(err)
+	}
+
+	res.Receipt = receipt
+	return res, time.Time{}, nil
+}
+
+// readMsg reads a record fetched from the cursor's consumer, reporting whether it should be passed over as it
+// has been dead-lettered.
+func (c *cursor) readMsg(conn *conn, msg *nats.Msg, l *lease) (*platform.Record, bool, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, false, err
+	}
+
+	rec := recordFromMsg(c.streamId, meta.Sequence.Stream, msg.Data, msg.Header, meta.Timestamp)
+	skip, err := c.deadLetterRecord(conn, rec, l, int(meta.NumDelivered)-1)
+
+	return rec, skip, err
+}
+
+// fetch reads the cursor's next records from its consumer, waiting up to wait for the first to arrive.
+func (c *cursor) fetch(conn *conn, wait time.Duration) ([]*nats.Msg, error) {
+	sub, err := conn.js.PullSubscribe("", c.id, nats.Bind(streamName(c.streamId), c.id))
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil, &platform.ErrCursorNotFound{CursorID: c.id, StreamID: c.streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+	defer sub.Unsubscribe()
+
+	msgs, err := sub.Fetch(MAX_RECORDS, nats.MaxWait(FETCH_MIN_WAIT))
+	if len(msgs) > 0 || wait <= FETCH_MIN_WAIT {
+		return msgs, fetched(err)
+	} else if err = fetched(err); err != nil {
+		return nil, err
+	}
+
+	// A fetch only returns early once its batch is full, so wait on one record and then take any which follow it
+	msgs, err = sub.Fetch(1, nats.MaxWait(wait-FETCH_MIN_WAIT))
+	if len(msgs) == 0 {
+		return nil, fetched(err)
+	}
+
+	more, err := sub.Fetch(MAX_RECORDS-1, nats.MaxWait(FETCH_MIN_WAIT))
+	return append(msgs, more...), fetched(err)
+}
+
+// fetched filters the error from a fetch which timed out without any records, as that's how an empty consumer is
+// reported.
+func fetched(err error) error {
+	if errors.Is(err, nats.ErrTimeout) {
+		return nil
+	}
+
+	return unavailable(err)
+}
+
+// release gives up the cursor's claim on its lease, leaving l in its place.
+func (c *cursor) release(conn *conn, l *lease, revision uint64) error {
+	released := *l
+	released.Receipt = ""
+	released.Replies = nil
+	released.Expires = 0
+
+	_, _, err := c.saveLease(conn, &released, revision)
+	return unavailable(err)
+}
+
+func (p *JetStreamPlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	return update(func() (bool, error) {
+		l, revision, err := c.loadLease(conn)
+		if err != nil {
+			return false, err
+		}
+
+		// An expired lease can still be acknowledged as long as its records haven't been handed out again.
+		if l.Receipt != receipt || len(l.Replies) == 0 {
+			return false, &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		// Acknowledging the batch's last record commits the cursor's progress through all of it
+		err = conn.reply(l.Replies[len(l.Replies)-1:], ACK)
+		if err != nil {
+			return false, err
+		}
+
+		_, ok, err := c.saveLease(conn, &lease{}, revision)
+		return ok, err
+	})
+}
+
+func (p *JetStreamPlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	return update(func() (bool, error) {
+		l, revision, err := c.loadLease(conn)
+		if err != nil {
+			return false, err
+		}
+
+		if l.Receipt != receipt || len(l.Replies) == 0 {
+			return false, &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		// Hand the records back before releasing the lease, so that the next batch starts with them
+		err = conn.reply(l.Replies, NAK)
+		if err != nil {
+			return false, err
+		}
+
+		_, ok, err := c.saveLease(conn, &lease{
+			Reason:  platform.DEAD_LETTER_NACKED,
+			Message: reason}, revision)
+		return ok, err
+	})
+}
+
+// deadLetterRecord reports whether a record should be passed over by the cursor, publishing it to the dead-letter
+// stream if it has run out of deliveries. l is the cursor's lease from before the record was read, telling why it
+// was last handed back.
+func (c *cursor) deadLetterRecord(conn *conn, rec *platform.Record, l *lease, deliveryCount int) (bool, error) {
+	policy := c.deadLetter
+	if policy == nil || deliveryCount < policy.MaxDeliveries {
+		return false, nil
+	}
+
+	reason := l.Reason
+	if reason == "" {
+		reason = platform.DEAD_LETTER_LEASE_EXPIRED
+	}
+
+	content, err := platform.NewDeadLetter(rec, c.id, reason, l.Message, deliveryCount).Encode()
+	if err != nil {
+		return false, err
+	}
+
+	// Records are kept rather than lost if the dead-letter stream has gone
+	target := &stream{id: policy.StreamId}
+	msg, _ := target.newMsg(content)
+	_, err = conn.js.PublishMsg(msg, target.publishOpts("")...)
+	if errors.Is(err, nats.ErrNoStreamResponse) || errors.Is(err, nats.ErrStreamNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, unavailable(err)
+	}
+
+	return true, nil
+}
+
+// reply posts verb to each of the reply subjects. The last is sent as a request, so that once it's answered the
+// server has handled them all.
+func (conn *conn) reply(subjects []string, verb []byte) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	for _, subject := range subjects[:len(subjects)-1] {
+		err := conn.nc.Publish(subject, verb)
+		if err != nil {
+			return unavailable(err)
+		}
+	}
+
+	_, err := conn.nc.Request(subjects[len(subjects)-1], verb, REQUEST_TIMEOUT)
+	return unavailable(err)
+}
+
+// getRecord reads a record from a stream by its sequence.
+func getRecord(conn *conn, streamId string, seq uint64) (*platform.Record, error) {
+	raw, err := conn.js.GetMsg(streamName(streamId), seq)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return nil, &platform.ErrRecordNotFound{RecordID: formatSequence(seq), StreamID: streamId}
+	} else if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return recordFromMsg(streamId, raw.Sequence, raw.Data, raw.Header, raw.Time), nil
+}
+
+// recordFromMsg reads a record from a message. stored is when JetStream stored it, which is used if it wasn't
+// given a timestamp when it was published.
+func recordFromMsg(streamId string, seq uint64, data []byte, header nats.Header, stored time.Time) *platform.Record {
+	timestamp, err := parseTime(header.Get(TIMESTAMP_HEADER))
+	if err != nil || timestamp.IsZero() {
+		timestamp = stored.UTC()
+	}
+
+	return &platform.Record{
+		Id:          platform.FormatRecordId(streamId, seq, timestamp),
+		StreamId:    streamId,
+		Sequence:    seq,
+		Content:     data,
+		ContentHash: hashContent(data),
+		Timestamp:   timestamp}
+}
+
+// update runs fn until the change to a lease it ends with goes through. fn returns false when another server
+// changed the lease first, so it should run again.
+func update(fn func() (bool, error)) error {
+	for i := 0; i < MAX_UPDATE_ATTEMPTS; i++ {
+		done, err := fn()
+		if err != nil {
+			return unavailable(err)
+		} else if done {
+			return nil
+		}
+	}
+
+	return &platform.ErrConflict{Message: "The cursor is being changed by too many clients at once. Try again."}
+}
+
+func hashContent(content []byte) []byte {
+	h := sha1.New()
+	h.Write(content)
+	return h.Sum(nil)
+}
@@ -1,32 +1,132 @@
 // Package memory is an in-memory implementation for the platform.
 // This implementation is intended entirely for development purposes and demoability.
-// This implementation will not and cannot scale beyond a single node and offers zero persistence.
+// This implementation will not and cannot scale beyond a single node. Its state lives only in memory, though it can
+// be saved to and restored from a snapshot file, see SnapshotPath.
 package memory
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
-	"math/big"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
-	"bytes"
-
 	"github.com/oceanhq/streams/platform"
 )
 
 const (
 	ID_LENGTH   = 16 // 128-bit
 	MAX_RECORDS = 100
+
+	DEFAULT_LEASE_TIMEOUT = 30 * time.Second
 )
 
 type InMemoryPlatform struct {
-	streams []stream
-	cursors []cursor
+	// mu guards all of the platform's state. Every exported method holds it for its duration.
+	mu sync.Mutex
+
+	// LeaseTimeout is how long a batch returned by GetRecords stays leased to its cursor
+	// before it is redelivered. Defaults to DEFAULT_LEASE_TIMEOUT.
+	LeaseTimeout time.Duration
+
+	// SnapshotPath is the file the platform's state is saved to by SaveSnapshot and Close, and restored from by
+	// Open and LoadSnapshot. Snapshots are disabled if it's empty.
+	SnapshotPath string
+
+	// SnapshotInterval is how often an opened platform saves a snapshot. Zero only saves on Close.
+	SnapshotInterval time.Duration
+
+	stop chan struct{}
+	// snapshotMu serialises saving and loading snapshots, which happen largely outside mu.
+	snapshotMu sync.Mutex
+
+	// streams and cursors are keyed by their hex IDs. A stream also indexes its own cursors.
+	streams map[string]*stream
+	cursors map[string]*cursor
+	// created counts the streams and cursors made so far, so that they can be listed in the order they were made.
+	created uint64
+}
+
+func init() {
+	platform.Register("memory", func(opts platform.Options) (platform.Platform, error) {
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotInterval, err := opts.Duration("SNAPSHOT_INTERVAL", time.Second)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &InMemoryPlatform{
+			LeaseTimeout:     leaseTimeout,
+			SnapshotPath:     opts["SNAPSHOT_PATH"],
+			SnapshotInterval: snapshotInterval}
+
+		err = p.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
+
+// Open restores the platform from SnapshotPath, if the file exists, and starts saving a snapshot every
+// SnapshotInterval. A platform without a SnapshotPath needn't be opened.
+func (p *InMemoryPlatform) Open() error {
+	if p.SnapshotPath == "" {
+		return nil
+	}
+
+	snapshot, err := p.LoadSnapshot()
+	if os.IsNotExist(err) {
+		log.Printf("No snapshot at %s, starting empty", p.SnapshotPath)
+	} else if err != nil {
+		return err
+	} else {
+		log.Printf("Restored %d streams from the snapshot taken at %s", snapshot.Streams, snapshot.TakenAt.Format(time.RFC3339))
+	}
+
+	if p.SnapshotInterval > 0 {
+		p.mu.Lock()
+		p.stop = make(chan struct{})
+		go p.snapshotEvery(p.SnapshotInterval, p.stop)
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Close stops the periodic snapshots and saves a final one.
+func (p *InMemoryPlatform) Close() error {
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.mu.Unlock()
+
+	if p.SnapshotPath == "" {
+		return nil
+	}
+
+	_, err := p.SaveSnapshot()
+
+	return err
 }
 
 func (p *InMemoryPlatform) CreateStream(name string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if name == "" {
 		return nil, &platform.ErrInvalidParam{Param: "name", Value: "", Err: errors.New("Must not be empty.")}
 	}
@@ -36,19 +136,37 @@ func (p *InMemoryPlatform) CreateStream(name string) (*platform.Stream, error) {
 		return nil, err
 	}
 
-	stream := stream{
-		id:   id,
-		name: name}
+	if p.streams == nil {
+		p.streams = map[string]*stream{}
+	}
+
+	p.created++
+	stream := &stream{
+		id:      id,
+		name:    name,
+		created: p.created,
+		cursors: map[string]*cursor{},
+		changed: make(chan struct{})}
 
-	p.streams = append(p.streams, stream)
+	p.streams[hex.EncodeToString(id)] = stream
 
-	return (&stream).toExt(), nil
+	return stream.toExt(), nil
 }
 
 func (p *InMemoryPlatform) ListStreams() ([]platform.Stream, error) {
-	out := make([]platform.Stream, len(p.streams))
-	for i := 0; i < len(p.streams); i++ {
-		s := &(p.streams[i])
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.purgeExpiredStreams()
+
+	streams := make([]*stream, 0, len(p.streams))
+	for _, s := range p.streams {
+		streams = append(streams, s)
+	}
+	sort.Sort(streamsByCreated(streams))
+
+	out := make([]platform.Stream, len(streams))
+	for i, s := range streams {
 		out[i] = *(s.toExt())
 	}
 
@@ -56,6 +174,28 @@ func (p *InMemoryPlatform) ListStreams() ([]platform.Stream, error) {
 }
 
 func (p *InMemoryPlatform) GetStream(streamId string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	return stream.toExt(), nil
+}
+
+func (p *InMemoryPlatform) DeleteStream(streamId string, retention time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	stream, err := p.findStream(streamId)
 	if err != nil {
 		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
@@ -63,10 +203,65 @@ func (p *InMemoryPlatform) GetStream(streamId string) (*platform.Stream, error)
 		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
 	}
 
+	now := time.Now().UTC()
+	if stream.deletedAt.IsZero() {
+		stream.deletedAt = now
+	}
+	stream.purgeAt = now.Add(retention)
+
+	res := stream.toExt()
+
+	// Without a retention period there's nothing to restore so remove it straight away
+	if retention <= 0 {
+		p.purgeStream(stream)
+	}
+
+	return res, nil
+}
+
+func (p *InMemoryPlatform) RestoreStream(streamId string) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	stream.deletedAt = time.Time{}
+	stream.purgeAt = time.Time{}
+
 	return stream.toExt(), nil
 }
 
-func (p *InMemoryPlatform) CreateCursor(streamId string) (*platform.Cursor, error) {
+func (p *InMemoryPlatform) SetDedupeWindow(streamId string, window time.Duration) (*platform.Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := platform.ValidateDedupeWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	// Keys already remembered keep the expiry they were given
+	stream.dedupeWindow = window
+
+	return stream.toExt(), nil
+}
+
+func (p *InMemoryPlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	stream, err := p.findStream(streamId)
 	if err != nil {
 		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
@@ -74,22 +269,64 @@ func (p *InMemoryPlatform) CreateCursor(streamId string) (*platform.Cursor, erro
 		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
 	}
 
+	position, err := stream.resolveStart(&start)
+	if err != nil {
+		return nil, err
+	}
+
 	id, err := generateId()
 	if err != nil {
 		return nil, err
 	}
 
-	cursor := cursor{
+	cursor := &cursor{
 		id:       id,
 		stream:   stream,
-		position: stream.findLastRecord()}
+		position: position}
+	p.addCursor(cursor)
+
+	return cursor.toExt(), nil
+}
 
-	p.cursors = append(p.cursors, cursor)
+func (p *InMemoryPlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return (&cursor).toExt(), nil
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := stream.resolveStart(&position)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any outstanding batch is abandoned; its receipt can no longer be acknowledged.
+	cursor.position = target
+	cursor.lease = nil
+	cursor.deliveries = nil
+	stream.signal()
+
+	return cursor.toExt(), nil
+}
+
+func (p *InMemoryPlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursor.toExt(), nil
 }
 
-func (p *InMemoryPlatform) CreateRecord(streamId string, content []byte) (*platform.Record, error) {
+func (p *InMemoryPlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	stream, err := p.findStream(streamId)
 	if err != nil {
 		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
@@ -97,23 +334,99 @@ func (p *InMemoryPlatform) CreateRecord(streamId string, content []byte) (*platf
 		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
 	}
 
-	record := &record{
-		id:        nextRecordId(),
-		stream:    stream,
-		content:   content,
-		timestamp: time.Now().UTC()}
+	cursors := make([]*cursor, 0, len(stream.cursors))
+	for _, c := range stream.cursors {
+		cursors = append(cursors, c)
+	}
+	sort.Sort(cursorsByCreated(cursors))
 
-	previousRec := stream.findLastRecord()
-	if previousRec == nil {
-		stream.root = record
-	} else {
-		previousRec.next = record
+	out := make([]platform.Cursor, len(cursors))
+	for i, c := range cursors {
+		out[i] = *(c.toExt())
+	}
+
+	return out, nil
+}
+
+func (p *InMemoryPlatform) DeleteCursor(streamId string, cursorId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	key := hex.EncodeToString(cursor.id)
+	delete(p.cursors, key)
+	delete(stream.cursors, key)
+
+	return nil
+}
+
+func (p *InMemoryPlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, source, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	// The clone starts from the source's committed position. Any batch leased to the source stays with it.
+	clone := &cursor{
+		id:         id,
+		stream:     stream,
+		position:   source.position,
+		deadLetter: source.deadLetter}
+	p.addCursor(clone)
+
+	return clone.toExt(), nil
+}
+
+func (p *InMemoryPlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	// Deleted streams are read-only until they're restored
+	if !stream.deletedAt.IsZero() {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: stream.purgeAt}
 	}
 
+	// A retried publish gets back the record it created the first time
+	stream.forgetExpiredKeys(time.Now())
+	if original, err := stream.findIdempotentRecord(idempotencyKey, content); original != nil || err != nil {
+		return original, err
+	}
+
+	record := stream.appendRecord(content)
+	stream.rememberKey(idempotencyKey, record)
+	stream.signal()
+
 	return record.toExt(), nil
 }
 
-func (p *InMemoryPlatform) GetRecords(streamId string, cursorId string) ([]platform.Record, error) {
+func (p *InMemoryPlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	stream, err := p.findStream(streamId)
 	if err != nil {
 		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
@@ -121,41 +434,320 @@ func (p *InMemoryPlatform) GetRecords(streamId string, cursorId string) ([]platf
 		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
 	}
 
-	cursor, err := p.findCursor(cursorId)
+	// Deleted streams are read-only until they're restored
+	if !stream.deletedAt.IsZero() {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: stream.purgeAt}
+	}
+
+	// Appending in memory can't fail, so only invalid or reused idempotency keys fail records
+	results := make([]platform.RecordResult, len(contents))
+	stream.forgetExpiredKeys(time.Now())
+	for i, content := range contents {
+		key := ""
+		if idempotencyKeys != nil {
+			key = idempotencyKeys[i]
+		}
+
+		err := platform.ValidateIdempotencyKey(key)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		original, err := stream.findIdempotentRecord(key, content)
+		if original != nil || err != nil {
+			results[i] = platform.RecordResult{Record: original, Err: err}
+			continue
+		}
+
+		record := stream.appendRecord(content)
+		stream.rememberKey(key, record)
+		results[i].Record = record.toExt()
+	}
+	stream.signal()
+
+	return results, nil
+}
+
+func (p *InMemoryPlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	rec := stream.findRecord(recordId)
+	if rec == nil {
+		return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: streamId}
+	}
+
+	return rec.toExt(), nil
+}
+
+func (p *InMemoryPlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		res, changed, retryAt, err := p.leaseRecords(streamId, cursorId)
+		if err != nil || len(res.Records) > 0 {
+			return res, err
+		}
+
+		// Nothing to hand out yet. Sleep until the stream changes, the cursor's lease runs out or it's time to give up.
+		now := time.Now()
+		if !now.Before(deadline) {
+			return res, nil
+		}
+
+		if retryAt.IsZero() || retryAt.After(deadline) {
+			retryAt = deadline
+		}
+
+		timer := time.NewTimer(retryAt.Sub(now))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// leaseRecords leases the cursor's next batch. When there's nothing to hand out it also returns the stream's
+// changed channel and, if a batch is already leased, the time that lease expires.
+func (p *InMemoryPlatform) leaseRecords(streamId string, cursorId string) (*platform.Batch, <-chan struct{}, time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
 	if err != nil {
-		return nil, &platform.ErrInvalidParam{Param: "cursorId", Value: cursorId, Err: err}
-	} else if cursor == nil {
-		return nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+		return nil, nil, time.Time{}, err
 	}
 
-	res := []platform.Record{}
+	res := &platform.Batch{
+		Records: []platform.Record{}}
+
+	// Only one batch is leased to a cursor at a time. Until it is acknowledged or the lease
+	// expires there is nothing more to hand out.
+	now := time.Now()
+	if cursor.lease != nil && now.Before(cursor.lease.expires) {
+		return res, stream.changed, cursor.lease.expires, nil
+	}
+
+	// Any expired lease is dropped so its records are redelivered from the committed position.
+	if cursor.lease != nil {
+		cursor.markFailed(stream, platform.DEAD_LETTER_LEASE_EXPIRED, "")
+		cursor.lease = nil
+	}
 
-	// Return the empty array if there are no records in the stream or if already positioned on the last record.
-	if stream.root == nil || (cursor.position != nil && cursor.position.next == nil) {
-		return res, nil
+	// Return the empty batch if there are no records in the stream or if already positioned on the last record.
+	if stream.tail == nil || cursor.position == stream.tail {
+		return res, stream.changed, time.Time{}, nil
 	}
 
-	// Either initialise the cursor to the root record or step the cursor ahead
+	// Either start from the root record or the first record after the committed position
+	next := stream.root
 	if cursor.position != nil {
-		cursor.position = cursor.position.next
-	} else {
-		cursor.position = stream.root
+		next = cursor.position.next
 	}
 
-	// Otherwise, start reading through the records
-	for len(res) < MAX_RECORDS {
-		rec := cursor.position.toExt()
+	// Otherwise, start reading through the records, passing over any that have run out of deliveries
+	var last *record
+	for ; next != nil && len(res.Records) < MAX_RECORDS; next = next.next {
+		last = next
+		if p.deadLetterRecord(cursor, next) {
+			continue
+		}
+
+		res.Records = append(res.Records, *next.toExt())
+		cursor.delivered(next)
+	}
 
-		res = append(res, *rec)
+	// Everything left was dead-lettered, so there's nothing to lease and the cursor moves straight past it
+	if len(res.Records) == 0 {
+		cursor.commit(stream, last)
+		return res, stream.changed, time.Time{}, nil
+	}
 
-		if cursor.position.next == nil {
-			break
-		} else {
-			cursor.position = cursor.position.next
+	receipt, err := generateId()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	cursor.lease = &lease{
+		receipt: hex.EncodeToString(receipt),
+		last:    last,
+		expires: now.Add(p.leaseTimeout())}
+
+	res.Receipt = cursor.lease.receipt
+
+	return res, nil, time.Time{}, nil
+}
+
+func (p *InMemoryPlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	// An expired lease can still be acknowledged as long as its records haven't been handed out again.
+	if cursor.lease == nil || cursor.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Commit the cursor's progress and wake any read waiting on the lease
+	cursor.commit(stream, cursor.lease.last)
+	cursor.lease = nil
+	stream.signal()
+
+	return nil
+}
+
+func (p *InMemoryPlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	if cursor.lease == nil || cursor.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Release the lease so the batch is redelivered straight away
+	cursor.markFailed(stream, platform.DEAD_LETTER_NACKED, reason)
+	cursor.lease = nil
+	stream.signal()
+
+	return nil
+}
+
+func (p *InMemoryPlatform) ReleaseRecords(streamId string, cursorId string, receipt string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	if cursor.lease == nil || cursor.lease.receipt != receipt {
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// Take back the batch's deliveries and release the lease so it's redelivered straight away
+	cursor.undelivered(stream)
+	cursor.lease = nil
+	stream.signal()
+
+	return nil
+}
+
+func (p *InMemoryPlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if policy != nil {
+		err := policy.Validate(streamId)
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := p.findStream(policy.StreamId)
+		if err != nil {
+			return nil, &platform.ErrInvalidParam{Param: "deadLetter.streamId", Value: policy.StreamId, Err: err}
+		} else if target == nil {
+			return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: policy.StreamId}
 		}
+
+		copied := *policy
+		policy = &copied
 	}
 
-	return res, nil
+	_, cursor, err := p.findStreamCursor(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor.deadLetter = policy
+
+	return cursor.toExt(), nil
+}
+
+// deadLetterRecord reports whether a record should be passed over by the cursor, publishing it to the cursor's
+// dead-letter stream if it has just run out of deliveries.
+func (p *InMemoryPlatform) deadLetterRecord(cursor *cursor, rec *record) bool {
+	d := cursor.deliveries[rec]
+	if d == nil || cursor.deadLetter == nil {
+		return false
+	} else if d.deadLettered {
+		return true
+	} else if d.count < cursor.deadLetter.MaxDeliveries {
+		return false
+	}
+
+	// Keep delivering the record rather than lose it while the dead-letter stream is unavailable
+	target := p.deadLetterStream(cursor.deadLetter.StreamId)
+	if target == nil {
+		return false
+	}
+
+	reason := d.reason
+	if reason == "" {
+		reason = platform.DEAD_LETTER_LEASE_EXPIRED
+	}
+
+	content, err := platform.NewDeadLetter(rec.toExt(), hex.EncodeToString(cursor.id), reason, d.message, d.count).Encode()
+	if err != nil {
+		return false
+	}
+
+	target.appendRecord(content)
+	target.signal()
+	d.deadLettered = true
+
+	return true
+}
+
+// deadLetterStream finds a stream which dead letters can be published to, i.e. one that exists and isn't deleted.
+func (p *InMemoryPlatform) deadLetterStream(streamId string) *stream {
+	stream, err := p.findStream(streamId)
+	if err != nil || stream == nil || !stream.deletedAt.IsZero() {
+		return nil
+	}
+
+	return stream
+}
+
+func (p *InMemoryPlatform) leaseTimeout() time.Duration {
+	if p.LeaseTimeout <= 0 {
+		return DEFAULT_LEASE_TIMEOUT
+	}
+
+	return p.LeaseTimeout
 }
 
 func generateId() ([]byte, error) {
@@ -165,11 +757,6 @@ func generateId() ([]byte, error) {
 	return b, err
 }
 
-func nextRecordId() []byte {
-	lastRecordId.Add(lastRecordId, big.NewInt(1))
-	return lastRecordId.Bytes()
-}
-
 func (p *InMemoryPlatform) findStream(streamId string) (*stream, error) {
 	// Parse ID
 	byteId, err := hex.DecodeString(streamId)
@@ -177,15 +764,68 @@ func (p *InMemoryPlatform) findStream(streamId string) (*stream, error) {
 		return nil, err
 	}
 
-	list := p.streams
+	stream, ok := p.streams[hex.EncodeToString(byteId)]
+	if !ok {
+		return nil, nil
+	}
+
+	// Deleted streams vanish once their retention period is up
+	if stream.expired(time.Now()) {
+		p.purgeStream(stream)
+		return nil, nil
+	}
 
-	for i := 0; i < len(list); i++ {
-		if bytes.Equal(list[i].id, byteId) {
-			return &(list[i]), nil
+	return stream, nil
+}
+
+func (p *InMemoryPlatform) purgeExpiredStreams() {
+	now := time.Now()
+	for _, s := range p.streams {
+		if s.expired(now) {
+			p.purgeStream(s)
 		}
 	}
+}
 
-	return nil, nil
+// purgeStream removes a stream along with all of its cursors.
+func (p *InMemoryPlatform) purgeStream(s *stream) {
+	for key := range s.cursors {
+		delete(p.cursors, key)
+	}
+
+	delete(p.streams, hex.EncodeToString(s.id))
+}
+
+func (p *InMemoryPlatform) addCursor(c *cursor) {
+	if p.cursors == nil {
+		p.cursors = map[string]*cursor{}
+	}
+
+	p.created++
+	c.created = p.created
+
+	key := hex.EncodeToString(c.id)
+	p.cursors[key] = c
+	c.stream.cursors[key] = c
+}
+
+// findStreamCursor looks up a cursor belonging to a stream, returning the matching platform error if either is missing.
+func (p *InMemoryPlatform) findStreamCursor(streamId string, cursorId string) (*stream, *cursor, error) {
+	stream, err := p.findStream(streamId)
+	if err != nil {
+		return nil, nil, &platform.ErrInvalidParam{Param: "streamId", Value: streamId, Err: err}
+	} else if stream == nil {
+		return nil, nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	cursor, err := p.findCursor(cursorId)
+	if err != nil {
+		return nil, nil, &platform.ErrInvalidParam{Param: "cursorId", Value: cursorId, Err: err}
+	} else if cursor == nil || cursor.stream != stream {
+		return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	return stream, cursor, nil
 }
 
 func (p *InMemoryPlatform) findCursor(cursorId string) (*cursor, error) {
@@ -195,31 +835,207 @@ func (p *InMemoryPlatform) findCursor(cursorId string) (*cursor, error) {
 		return nil, err
 	}
 
-	list := p.cursors
+	return p.cursors[hex.EncodeToString(byteId)], nil
+}
+
+type stream struct {
+	id        []byte
+	name      string
+	created   uint64
+	root      *record
+	tail      *record
+	deletedAt time.Time
+	purgeAt   time.Time
+
+	// records indexes the stream's records by sequence number, which starts at 1, so records[0] is the root.
+	records []*record
+	cursors map[string]*cursor
+
+	// changed is closed, and replaced, to wake waiting reads whenever the stream or one of its cursors moves on.
+	changed chan struct{}
+
+	// dedupeWindow is how long idempotency keys are remembered for, or zero for the default.
+	dedupeWindow time.Duration
+	// keys indexes the records published with an idempotency key. keyOrder holds the same entries oldest
+	// first so that expired keys can be dropped from the front.
+	keys     map[string]*idempotencyKey
+	keyOrder []*idempotencyKey
+}
 
-	for i := 0; i < len(list); i++ {
-		if bytes.Equal(list[i].id, byteId) {
-			return &(list[i]), nil
+type idempotencyKey struct {
+	key     string
+	record  *record
+	expires time.Time
+}
+
+// findIdempotentRecord returns the record already published with key, if any. Reusing a key with different
+// content is an error.
+func (s *stream) findIdempotentRecord(key string, content []byte) (*platform.Record, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	entry, ok := s.keys[key]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, nil
+	}
+
+	if !bytes.Equal(entry.record.content, content) {
+		return nil, &platform.ErrIdempotencyKeyReused{IdempotencyKey: key, StreamID: hex.EncodeToString(s.id)}
+	}
+
+	return entry.record.toExt(), nil
+}
+
+func (s *stream) rememberKey(key string, rec *record) {
+	if key == "" {
+		return
+	}
+
+	if s.keys == nil {
+		s.keys = map[string]*idempotencyKey{}
+	}
+
+	window := s.dedupeWindow
+	if window == 0 {
+		window = platform.DEFAULT_DEDUPE_WINDOW
+	}
+
+	entry := &idempotencyKey{
+		key:     key,
+		record:  rec,
+		expires: time.Now().Add(window)}
+	s.keys[key] = entry
+	s.keyOrder = append(s.keyOrder, entry)
+}
+
+// forgetExpiredKeys drops the keys whose dedupe window has passed. Windows can shrink, so keyOrder is only
+// roughly by expiry and a key stuck behind a longer-lived one lingers, though lookups ignore it.
+func (s *stream) forgetExpiredKeys(now time.Time) {
+	n := 0
+	for ; n < len(s.keyOrder) && !now.Before(s.keyOrder[n].expires); n++ {
+		// A newer entry may have replaced this one in the index
+		if s.keys[s.keyOrder[n].key] == s.keyOrder[n] {
+			delete(s.keys, s.keyOrder[n].key)
 		}
 	}
 
-	return nil, nil
+	s.keyOrder = s.keyOrder[n:]
 }
 
-type stream struct {
-	id   []byte
-	name string
-	root *record
+func (s *stream) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// expired reports whether a deleted stream's retention period is up.
+func (s *stream) expired(now time.Time) bool {
+	return !s.deletedAt.IsZero() && !now.Before(s.purgeAt)
 }
 
 type cursor struct {
-	id       []byte
-	stream   *stream
-	position *record
+	id         []byte
+	created    uint64
+	stream     *stream
+	position   *record
+	lease      *lease
+	deadLetter *platform.DeadLetterPolicy
+
+	// deliveries tracks how often each record past the committed position has been handed out.
+	deliveries map[*record]*delivery
+}
+
+type delivery struct {
+	count        int
+	reason       string
+	message      string
+	deadLettered bool
+}
+
+// delivered counts a record being handed out in a batch.
+func (c *cursor) delivered(rec *record) {
+	if c.deliveries == nil {
+		c.deliveries = map[*record]*delivery{}
+	}
+
+	d := c.deliveries[rec]
+	if d == nil {
+		d = &delivery{}
+		c.deliveries[rec] = d
+	}
+	d.count++
+}
+
+// markFailed records why the cursor's leased batch wasn't acknowledged.
+func (c *cursor) markFailed(s *stream, reason string, message string) {
+	if c.lease == nil {
+		return
+	}
+
+	rec := s.root
+	if c.position != nil {
+		rec = c.position.next
+	}
+	for ; rec != nil; rec = rec.next {
+		if d := c.deliveries[rec]; d != nil && !d.deadLettered {
+			d.reason = reason
+			d.message = message
+		}
+
+		if rec == c.lease.last {
+			return
+		}
+	}
+}
+
+// undelivered uncounts the delivery of each record in the cursor's leased batch.
+func (c *cursor) undelivered(s *stream) {
+	if c.lease == nil {
+		return
+	}
+
+	rec := s.root
+	if c.position != nil {
+		rec = c.position.next
+	}
+	for ; rec != nil; rec = rec.next {
+		if d := c.deliveries[rec]; d != nil && !d.deadLettered {
+			d.count--
+		}
+
+		if rec == c.lease.last {
+			return
+		}
+	}
+}
+
+// commit moves the cursor's position forward to last, forgetting the deliveries of the records passed.
+func (c *cursor) commit(s *stream, last *record) {
+	rec := s.root
+	if c.position != nil {
+		rec = c.position.next
+	}
+	for ; rec != nil; rec = rec.next {
+		delete(c.deliveries, rec)
+
+		if rec == last {
+			break
+		}
+	}
+
+	c.position = last
+}
+
+// lease tracks the batch currently handed out to a cursor.
+type lease struct {
+	receipt string
+	last    *record
+	expires time.Time
 }
 
 type record struct {
-	id        []byte
+	// seq is the record's position in its stream, counting from 1.
+	seq       uint64
 	stream    *stream
 	content   []byte
 	timestamp time.Time
@@ -227,9 +1043,17 @@ type record struct {
 }
 
 func (s *stream) toExt() *platform.Stream {
+	window := s.dedupeWindow
+	if window == 0 {
+		window = platform.DEFAULT_DEDUPE_WINDOW
+	}
+
 	return &platform.Stream{
-		Id:   hex.EncodeToString(s.id),
-		Name: s.name}
+		Id:           hex.EncodeToString(s.id),
+		Name:         s.name,
+		DeletedAt:    s.deletedAt,
+		PurgeAt:      s.purgeAt,
+		DedupeWindow: window}
 }
 
 func (c *cursor) toExt() *platform.Cursor {
@@ -241,44 +1065,133 @@ func (c *cursor) toExt() *platform.Cursor {
 	}
 
 	if c.position != nil {
-		ext.Position = c.position.idToString()
+		ext.Position = strconv.FormatUint(c.position.seq, 10)
 	} else {
 		ext.Position = "-1"
 	}
 
+	if c.deadLetter != nil {
+		policy := *c.deadLetter
+		ext.DeadLetter = &policy
+	}
+
 	return ext
 }
 
-func (s *stream) findLastRecord() *record {
-	var lastRecord *record = s.root
-	if lastRecord == nil {
+// appendRecord adds a new record to the end of the stream.
+func (s *stream) appendRecord(content []byte) *record {
+	record := &record{
+		seq:       uint64(len(s.records)) + 1,
+		stream:    s,
+		content:   content,
+		timestamp: time.Now().UTC()}
+
+	// Keep timestamps in order even if the clock steps back, so that they can be searched
+	if s.tail == nil {
+		s.root = record
+	} else {
+		if record.timestamp.Before(s.tail.timestamp) {
+			record.timestamp = s.tail.timestamp
+		}
+
+		s.tail.next = record
+	}
+
+	s.tail = record
+	s.records = append(s.records, record)
+
+	return record
+}
+
+// findRecord looks up a record by its ID, returning nil if there's no such record.
+func (s *stream) findRecord(recordId string) *record {
+	seq, timestamp, err := platform.ParseRecordId(hex.EncodeToString(s.id), recordId)
+	if err != nil {
+		return nil
+	}
+
+	// The ID has to match to the millisecond as well
+	rec := s.recordAt(seq)
+	if rec == nil || !rec.timestamp.Truncate(time.Millisecond).Equal(timestamp) {
+		return nil
+	}
+
+	return rec
+}
+
+// recordAt returns the record with sequence number seq, or nil if there's no such record.
+func (s *stream) recordAt(seq uint64) *record {
+	if seq == 0 || seq > uint64(len(s.records)) {
 		return nil
 	}
 
-	for ; lastRecord.next != nil; lastRecord = lastRecord.next {
+	return s.records[seq-1]
+}
+
+// resolveStart finds the record a cursor should be positioned on for a start position, i.e. the
+// last record it will skip. A nil result positions the cursor before the root record.
+func (s *stream) resolveStart(start *platform.StartPosition) (*record, error) {
+	err := start.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return nil, nil
+	case platform.START_AT_TIMESTAMP:
+		n := sort.Search(len(s.records), func(i int) bool {
+			return !s.records[i].timestamp.Before(start.Timestamp)
+		})
+
+		return s.recordBefore(n), nil
+	case platform.START_AFTER_RECORD_ID:
+		rec := s.findRecord(start.RecordId)
+		if rec == nil {
+			return nil, &platform.ErrRecordNotFound{RecordID: start.RecordId, StreamID: hex.EncodeToString(s.id)}
+		}
+
+		return rec, nil
+	case platform.START_LAST:
+		return s.recordBefore(len(s.records) - start.Count), nil
 	}
 
-	return lastRecord
+	return s.tail, nil
+}
+
+// recordBefore returns the record a cursor must be positioned on for the record at index n of s.records to be
+// read next. It returns nil, i.e. before the root, if n is at or before the start of the stream.
+func (s *stream) recordBefore(n int) *record {
+	if n <= 0 {
+		return nil
+	}
+
+	return s.records[n-1]
 }
 
 func (r *record) toExt() *platform.Record {
 	h := sha1.New()
 	h.Write(r.content)
 
+	streamId := hex.EncodeToString(r.stream.id)
+
 	return &platform.Record{
-		Id:          r.idToString(),
-		StreamId:    hex.EncodeToString(r.stream.id),
+		Id:          platform.FormatRecordId(streamId, r.seq, r.timestamp),
+		StreamId:    streamId,
+		Sequence:    r.seq,
 		Content:     r.content,
 		ContentHash: h.Sum(nil),
 		Timestamp:   r.timestamp}
 }
 
-func (r *record) idToString() string {
-	recId := &big.Int{}
-	recId.SetBytes(r.id)
-	return recId.String()
-}
+type streamsByCreated []*stream
 
-var (
-	lastRecordId = big.NewInt(0)
-)
+func (a streamsByCreated) Len() int           { return len(a) }
+func (a streamsByCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a streamsByCreated) Less(i, j int) bool { return a[i].created < a[j].created }
+
+type cursorsByCreated []*cursor
+
+func (a cursorsByCreated) Len() int           { return len(a) }
+func (a cursorsByCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a cursorsByCreated) Less(i, j int) bool { return a[i].created < a[j].created }
@@ -0,0 +1,25 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+func TestConformance(t *testing.T) {
+	platformtest.Run(t, newTestPlatform)
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	platformtest.Benchmark(b, newTestPlatform)
+}
+
+func newTestPlatform(opts platform.Options) (platform.Platform, error) {
+	leaseTimeout, err := opts.LeaseTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	return &InMemoryPlatform{LeaseTimeout: leaseTimeout}, nil
+}
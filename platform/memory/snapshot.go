@@ -0,0 +1,341 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+// SNAPSHOT_VERSION is written to every snapshot. Snapshots of any other version are refused.
+const SNAPSHOT_VERSION = 1
+
+var errNoSnapshotPath = &platform.ErrConflict{Message: "Snapshots are disabled. Set SNAPSHOT_PATH to enable them."}
+
+// snapshotFile is the JSON document a snapshot is saved as. Records are numbered by their position in their
+// stream's list, and leases aren't kept, so batches leased when the snapshot was taken are redelivered after it's
+// restored.
+type snapshotFile struct {
+	Version int              `json:"version"`
+	TakenAt time.Time        `json:"takenAt"`
+	Streams []snapshotStream `json:"streams"`
+	Cursors []snapshotCursor `json:"cursors"`
+}
+
+type snapshotStream struct {
+	Id           string           `json:"id"`
+	Name         string           `json:"name"`
+	Created      uint64           `json:"created"`
+	DeletedAt    time.Time        `json:"deletedAt,omitempty"`
+	PurgeAt      time.Time        `json:"purgeAt,omitempty"`
+	DedupeWindow time.Duration    `json:"dedupeWindow,omitempty"`
+	Records      []snapshotRecord `json:"records"`
+	Keys         []snapshotKey    `json:"keys,omitempty"`
+}
+
+type snapshotRecord struct {
+	Content   []byte    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type snapshotKey struct {
+	Key     string    `json:"key"`
+	Seq     uint64    `json:"seq"`
+	Expires time.Time `json:"expires"`
+}
+
+type snapshotCursor struct {
+	Id       string `json:"id"`
+	StreamId string `json:"streamId"`
+	Created  uint64 `json:"created"`
+	// Position is the sequence number of the last record the cursor committed, or 0 before the first.
+	Position   uint64                     `json:"position"`
+	DeadLetter *platform.DeadLetterPolicy `json:"deadLetter,omitempty"`
+	Deliveries []snapshotDelivery         `json:"deliveries,omitempty"`
+}
+
+type snapshotDelivery struct {
+	Seq          uint64 `json:"seq"`
+	Count        int    `json:"count"`
+	Reason       string `json:"reason,omitempty"`
+	Message      string `json:"message,omitempty"`
+	DeadLettered bool   `json:"deadLettered,omitempty"`
+}
+
+// SaveSnapshot writes the platform's state to SnapshotPath, replacing the file atomically so that a crash leaves
+// the previous snapshot in place.
+func (p *InMemoryPlatform) SaveSnapshot() (*platform.Snapshot, error) {
+	if p.SnapshotPath == "" {
+		return nil, errNoSnapshotPath
+	}
+
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	// Record contents never change once published, so the state can be encoded after the lock is released
+	p.mu.Lock()
+	snapshot := p.takeSnapshot()
+	p.mu.Unlock()
+
+	tmp := p.SnapshotPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	err = os.Rename(tmp, p.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.describe(p.SnapshotPath), nil
+}
+
+// LoadSnapshot replaces the platform's state with the snapshot at SnapshotPath. Reads waiting on the old state
+// are woken, and outstanding receipts can no longer be acknowledged. If the file is missing the error satisfies
+// os.IsNotExist and the platform is left as it was.
+func (p *InMemoryPlatform) LoadSnapshot() (*platform.Snapshot, error) {
+	if p.SnapshotPath == "" {
+		return nil, errNoSnapshotPath
+	}
+
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	f, err := os.Open(p.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snapshot := &snapshotFile{}
+	err = json.NewDecoder(bufio.NewReader(f)).Decode(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot %s: %s", p.SnapshotPath, err)
+	} else if snapshot.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("Snapshot %s has version %d. Expected %d.", p.SnapshotPath, snapshot.Version, SNAPSHOT_VERSION)
+	}
+
+	streams, cursors, created, err := snapshot.restore()
+	if err != nil {
+		return nil, fmt.Errorf("Error restoring snapshot %s: %s", p.SnapshotPath, err)
+	}
+
+	p.mu.Lock()
+	old := p.streams
+	p.streams = streams
+	p.cursors = cursors
+	p.created = created
+	for _, s := range old {
+		s.signal()
+	}
+	p.mu.Unlock()
+
+	return snapshot.describe(p.SnapshotPath), nil
+}
+
+func (p *InMemoryPlatform) snapshotEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := p.SaveSnapshot()
+		if err != nil {
+			log.Printf("Error saving snapshot to %s: %s", p.SnapshotPath, err)
+		}
+	}
+}
+
+// takeSnapshot copies the platform's state. The caller must hold p.mu.
+func (p *InMemoryPlatform) takeSnapshot() *snapshotFile {
+	now := time.Now()
+	snapshot := &snapshotFile{
+		Version: SNAPSHOT_VERSION,
+		TakenAt: now.UTC(),
+		Streams: []snapshotStream{},
+		Cursors: []snapshotCursor{}}
+
+	for _, s := range p.streams {
+		out := snapshotStream{
+			Id:           hex.EncodeToString(s.id),
+			Name:         s.name,
+			Created:      s.created,
+			DeletedAt:    s.deletedAt,
+			PurgeAt:      s.purgeAt,
+			DedupeWindow: s.dedupeWindow,
+			Records:      make([]snapshotRecord, len(s.records))}
+
+		for i, rec := range s.records {
+			out.Records[i] = snapshotRecord{Content: rec.content, Timestamp: rec.timestamp}
+		}
+
+		// Only the live entry for each key is kept, oldest first
+		for _, entry := range s.keyOrder {
+			if s.keys[entry.key] == entry && now.Before(entry.expires) {
+				out.Keys = append(out.Keys, snapshotKey{Key: entry.key, Seq: entry.record.seq, Expires: entry.expires})
+			}
+		}
+
+		snapshot.Streams = append(snapshot.Streams, out)
+	}
+
+	for _, c := range p.cursors {
+		out := snapshotCursor{
+			Id:         hex.EncodeToString(c.id),
+			StreamId:   hex.EncodeToString(c.stream.id),
+			Created:    c.created,
+			DeadLetter: c.deadLetter}
+
+		if c.position != nil {
+			out.Position = c.position.seq
+		}
+
+		for rec, d := range c.deliveries {
+			out.Deliveries = append(out.Deliveries, snapshotDelivery{
+				Seq:          rec.seq,
+				Count:        d.count,
+				Reason:       d.reason,
+				Message:      d.message,
+				DeadLettered: d.deadLettered})
+		}
+
+		snapshot.Cursors = append(snapshot.Cursors, out)
+	}
+
+	return snapshot
+}
+
+// restore rebuilds the streams and cursors held in the snapshot, along with the count of those created.
+func (f *snapshotFile) restore() (map[string]*stream, map[string]*cursor, uint64, error) {
+	streams := map[string]*stream{}
+	cursors := map[string]*cursor{}
+	var created uint64
+
+	for _, in := range f.Streams {
+		id, err := hex.DecodeString(in.Id)
+		if err != nil || len(id) != ID_LENGTH {
+			return nil, nil, 0, fmt.Errorf("Invalid stream ID \"%s\".", in.Id)
+		} else if _, ok := streams[hex.EncodeToString(id)]; ok {
+			return nil, nil, 0, fmt.Errorf("Stream \"%s\" appears twice.", in.Id)
+		}
+
+		s := &stream{
+			id:           id,
+			name:         in.Name,
+			created:      in.Created,
+			deletedAt:    in.DeletedAt,
+			purgeAt:      in.PurgeAt,
+			dedupeWindow: in.DedupeWindow,
+			cursors:      map[string]*cursor{},
+			changed:      make(chan struct{})}
+
+		for _, rec := range in.Records {
+			s.appendRecord(rec.Content).timestamp = rec.Timestamp
+		}
+
+		for _, key := range in.Keys {
+			rec := s.recordAt(key.Seq)
+			if rec == nil {
+				return nil, nil, 0, fmt.Errorf("Idempotency key \"%s\" refers to a missing record.", key.Key)
+			}
+
+			entry := &idempotencyKey{key: key.Key, record: rec, expires: key.Expires}
+			if s.keys == nil {
+				s.keys = map[string]*idempotencyKey{}
+			}
+			s.keys[key.Key] = entry
+			s.keyOrder = append(s.keyOrder, entry)
+		}
+
+		streams[hex.EncodeToString(id)] = s
+		if s.created > created {
+			created = s.created
+		}
+	}
+
+	for _, in := range f.Cursors {
+		id, err := hex.DecodeString(in.Id)
+		if err != nil || len(id) != ID_LENGTH {
+			return nil, nil, 0, fmt.Errorf("Invalid cursor ID \"%s\".", in.Id)
+		}
+
+		s, ok := streams[strings.ToLower(in.StreamId)]
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("Cursor \"%s\" refers to a missing stream.", in.Id)
+		}
+
+		c := &cursor{
+			id:         id,
+			created:    in.Created,
+			stream:     s,
+			deadLetter: in.DeadLetter}
+
+		if in.Position != 0 {
+			c.position = s.recordAt(in.Position)
+			if c.position == nil {
+				return nil, nil, 0, fmt.Errorf("Cursor \"%s\" is positioned on a missing record.", in.Id)
+			}
+		}
+
+		for _, d := range in.Deliveries {
+			rec := s.recordAt(d.Seq)
+			if rec == nil {
+				return nil, nil, 0, fmt.Errorf("Cursor \"%s\" has deliveries of a missing record.", in.Id)
+			}
+
+			if c.deliveries == nil {
+				c.deliveries = map[*record]*delivery{}
+			}
+			c.deliveries[rec] = &delivery{
+				count:        d.Count,
+				reason:       d.Reason,
+				message:      d.Message,
+				deadLettered: d.DeadLettered}
+		}
+
+		key := hex.EncodeToString(id)
+		cursors[key] = c
+		s.cursors[key] = c
+		if c.created > created {
+			created = c.created
+		}
+	}
+
+	return streams, cursors, created, nil
+}
+
+func (f *snapshotFile) describe(path string) *platform.Snapshot {
+	return &platform.Snapshot{
+		Path:    path,
+		TakenAt: f.TakenAt,
+		Streams: len(f.Streams),
+		Cursors: len(f.Cursors)}
+}
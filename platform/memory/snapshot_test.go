@@ -0,0 +1,308 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	p := &InMemoryPlatform{LeaseTimeout: time.Minute, SnapshotPath: path}
+
+	orders := mustCreateStream(t, p, "orders")
+	dlq := mustCreateStream(t, p, "dlq")
+	archive := mustCreateStream(t, p, "archive")
+
+	_, err := p.SetDedupeWindow(orders.Id, time.Hour)
+	if err != nil {
+		t.Fatalf("Error setting dedupe window: %s", err)
+	}
+
+	first, err := p.CreateRecord(orders.Id, []byte("a"), "key-1")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	}
+	for _, content := range []string{"b", "c"} {
+		_, err = p.CreateRecord(orders.Id, []byte(content), "")
+		if err != nil {
+			t.Fatalf("Error publishing record: %s", err)
+		}
+	}
+
+	_, err = p.CreateRecord(archive.Id, []byte("old"), "")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	}
+	_, err = p.DeleteStream(archive.Id, time.Hour)
+	if err != nil {
+		t.Fatalf("Error deleting stream: %s", err)
+	}
+
+	// One cursor has committed its whole stream
+	acked := mustCreateCursor(t, p, orders.Id)
+	batch := mustGetBatch(t, p, orders.Id, acked.Id, 3)
+	err = p.AckRecords(orders.Id, acked.Id, batch.Receipt)
+	if err != nil {
+		t.Fatalf("Error acking records: %s", err)
+	}
+
+	// The other has nacked its batch once and holds a lease on the redelivery
+	leased := mustCreateCursor(t, p, orders.Id)
+	_, err = p.SetDeadLetterPolicy(orders.Id, leased.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 3})
+	if err != nil {
+		t.Fatalf("Error setting dead-letter policy: %s", err)
+	}
+	batch = mustGetBatch(t, p, orders.Id, leased.Id, 3)
+	err = p.NackRecords(orders.Id, leased.Id, batch.Receipt, "boom")
+	if err != nil {
+		t.Fatalf("Error nacking records: %s", err)
+	}
+	mustGetBatch(t, p, orders.Id, leased.Id, 3)
+
+	saved, err := p.SaveSnapshot()
+	if err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	} else if saved.Streams != 3 || saved.Cursors != 2 {
+		t.Fatalf("Expected 3 streams and 2 cursors saved, got %d and %d", saved.Streams, saved.Cursors)
+	}
+
+	restored := &InMemoryPlatform{LeaseTimeout: time.Minute, SnapshotPath: path}
+	loaded, err := restored.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	} else if !loaded.TakenAt.Equal(saved.TakenAt) || loaded.Streams != 3 || loaded.Cursors != 2 {
+		t.Fatalf("Expected %v, got %v", saved, loaded)
+	}
+
+	expectSameStreams(t, p, restored)
+	for _, stream := range []*platform.Stream{orders, dlq, archive} {
+		expectSameCursors(t, p, restored, stream.Id)
+	}
+	expectSameRecord(t, p, restored, orders.Id, first.Id)
+
+	// Idempotency keys survive the restore
+	retried, err := restored.CreateRecord(orders.Id, []byte("a"), "key-1")
+	if err != nil {
+		t.Fatalf("Error retrying publish: %s", err)
+	} else if retried.Id != first.Id {
+		t.Fatalf("Expected the original record %s, got %s", first.Id, retried.Id)
+	}
+	_, err = restored.CreateRecord(orders.Id, []byte("x"), "key-1")
+	if _, ok := err.(*platform.ErrIdempotencyKeyReused); !ok {
+		t.Fatalf("Expected *platform.ErrIdempotencyKeyReused, got %v", err)
+	}
+
+	// The deleted stream is still read-only and restorable
+	_, err = restored.CreateRecord(archive.Id, []byte("new"), "")
+	if _, ok := err.(*platform.ErrStreamDeleted); !ok {
+		t.Fatalf("Expected *platform.ErrStreamDeleted, got %v", err)
+	}
+	_, err = restored.RestoreStream(archive.Id)
+	if err != nil {
+		t.Fatalf("Error restoring stream: %s", err)
+	}
+
+	// The committed cursor has nothing left to read
+	batch = mustGetBatch(t, restored, orders.Id, acked.Id, 0)
+
+	// Leases aren't saved, so the leased batch is redelivered straight away. Its deliveries carry over, so
+	// the third delivery is the last before the records are dead-lettered with the original nack's reason.
+	batch = mustGetBatch(t, restored, orders.Id, leased.Id, 3)
+	err = restored.NackRecords(orders.Id, leased.Id, batch.Receipt, "again")
+	if err != nil {
+		t.Fatalf("Error nacking records: %s", err)
+	}
+	mustGetBatch(t, restored, orders.Id, leased.Id, 0)
+
+	reader := mustCreateCursor(t, restored, dlq.Id)
+	batch = mustGetBatch(t, restored, dlq.Id, reader.Id, 3)
+	for _, rec := range batch.Records {
+		var letter platform.DeadLetter
+		err = json.Unmarshal(rec.Content, &letter)
+		if err != nil {
+			t.Fatalf("Error decoding dead letter: %s", err)
+		} else if letter.Reason != platform.DEAD_LETTER_NACKED || letter.Message != "again" || letter.DeliveryCount != 3 {
+			t.Fatalf("Expected a letter nacked with \"again\" after 3 deliveries, got %+v", letter)
+		}
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	p := &InMemoryPlatform{SnapshotPath: filepath.Join(dir, "valid.json")}
+	stream := mustCreateStream(t, p, "orders")
+	mustCreateCursor(t, p, stream.Id)
+	for _, content := range []string{"a", "b"} {
+		_, err := p.CreateRecord(stream.Id, []byte(content), content)
+		if err != nil {
+			t.Fatalf("Error publishing record: %s", err)
+		}
+	}
+
+	_, err := p.SaveSnapshot()
+	if err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	}
+
+	valid, err := ioutil.ReadFile(p.SnapshotPath)
+	if err != nil {
+		t.Fatalf("Error reading snapshot: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(f *snapshotFile)
+		raw    []byte
+	}{
+		{name: "truncated", raw: valid[:len(valid)/2]},
+		{name: "empty", raw: []byte{}},
+		{name: "garbage", raw: []byte("not a snapshot")},
+		{name: "wrong version", modify: func(f *snapshotFile) { f.Version = SNAPSHOT_VERSION + 1 }},
+		{name: "bad stream id", modify: func(f *snapshotFile) { f.Streams[0].Id = "zz" }},
+		{name: "duplicate stream", modify: func(f *snapshotFile) { f.Streams = append(f.Streams, f.Streams[0]) }},
+		{name: "key of missing record", modify: func(f *snapshotFile) { f.Streams[0].Keys[0].Seq = 99 }},
+		{name: "cursor of missing stream", modify: func(f *snapshotFile) { f.Streams = nil }},
+		{name: "cursor on missing record", modify: func(f *snapshotFile) { f.Cursors[0].Position = 99 }},
+	}
+
+	for _, test := range tests {
+		raw := test.raw
+		if test.modify != nil {
+			var f snapshotFile
+			err = json.Unmarshal(valid, &f)
+			if err != nil {
+				t.Fatalf("Error decoding snapshot: %s", err)
+			}
+
+			test.modify(&f)
+			raw, err = json.Marshal(&f)
+			if err != nil {
+				t.Fatalf("Error encoding snapshot: %s", err)
+			}
+		}
+
+		path := filepath.Join(dir, "corrupt.json")
+		err = ioutil.WriteFile(path, raw, 0644)
+		if err != nil {
+			t.Fatalf("Error writing snapshot: %s", err)
+		}
+
+		// A snapshot that fails to load leaves the platform as it was
+		target := &InMemoryPlatform{SnapshotPath: path}
+		kept := mustCreateStream(t, target, "kept")
+
+		_, err = target.LoadSnapshot()
+		if err == nil {
+			t.Fatalf("%s: Expected an error loading the snapshot", test.name)
+		}
+
+		streams, err := target.ListStreams()
+		if err != nil {
+			t.Fatalf("%s: Error listing streams: %s", test.name, err)
+		} else if len(streams) != 1 || streams[0].Id != kept.Id {
+			t.Fatalf("%s: Expected only stream %s, got %v", test.name, kept.Id, streams)
+		}
+	}
+
+	missing := &InMemoryPlatform{SnapshotPath: filepath.Join(dir, "missing.json")}
+	_, err = missing.LoadSnapshot()
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected a not-exist error, got %v", err)
+	}
+}
+
+func mustCreateStream(t *testing.T, p *InMemoryPlatform, name string) *platform.Stream {
+	stream, err := p.CreateStream(name)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+
+	return stream
+}
+
+func mustCreateCursor(t *testing.T, p *InMemoryPlatform, streamId string) *platform.Cursor {
+	cursor, err := p.CreateCursor(streamId, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		t.Fatalf("Error creating cursor: %s", err)
+	}
+
+	return cursor
+}
+
+// mustGetBatch reads the cursor's next batch without waiting and checks it has count records.
+func mustGetBatch(t *testing.T, p *InMemoryPlatform, streamId string, cursorId string, count int) *platform.Batch {
+	batch, err := p.GetRecords(streamId, cursorId, 0)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if len(batch.Records) != count {
+		t.Fatalf("Expected %d records, got %d", count, len(batch.Records))
+	}
+
+	return batch
+}
+
+func expectSameStreams(t *testing.T, want *InMemoryPlatform, got *InMemoryPlatform) {
+	wantStreams, err := want.ListStreams()
+	if err != nil {
+		t.Fatalf("Error listing streams: %s", err)
+	}
+
+	gotStreams, err := got.ListStreams()
+	if err != nil {
+		t.Fatalf("Error listing restored streams: %s", err)
+	} else if len(gotStreams) != len(wantStreams) {
+		t.Fatalf("Expected %d streams, got %d", len(wantStreams), len(gotStreams))
+	}
+
+	for i, w := range wantStreams {
+		g := gotStreams[i]
+		if g.Id != w.Id || g.Name != w.Name || g.DedupeWindow != w.DedupeWindow || !g.DeletedAt.Equal(w.DeletedAt) || !g.PurgeAt.Equal(w.PurgeAt) {
+			t.Fatalf("Expected stream %+v, got %+v", w, g)
+		}
+	}
+}
+
+func expectSameCursors(t *testing.T, want *InMemoryPlatform, got *InMemoryPlatform, streamId string) {
+	wantCursors, err := want.ListCursors(streamId)
+	if err != nil {
+		t.Fatalf("Error listing cursors: %s", err)
+	}
+
+	gotCursors, err := got.ListCursors(streamId)
+	if err != nil {
+		t.Fatalf("Error listing restored cursors: %s", err)
+	} else if len(gotCursors) != len(wantCursors) {
+		t.Fatalf("Expected %d cursors, got %d", len(wantCursors), len(gotCursors))
+	}
+
+	for i, w := range wantCursors {
+		g := gotCursors[i]
+		if g.Id != w.Id || g.StreamId != w.StreamId || g.Position != w.Position {
+			t.Fatalf("Expected cursor %+v, got %+v", w, g)
+		} else if (g.DeadLetter == nil) != (w.DeadLetter == nil) || (w.DeadLetter != nil && *g.DeadLetter != *w.DeadLetter) {
+			t.Fatalf("Expected dead-letter policy %+v, got %+v", w.DeadLetter, g.DeadLetter)
+		}
+	}
+}
+
+func expectSameRecord(t *testing.T, want *InMemoryPlatform, got *InMemoryPlatform, streamId string, recordId string) {
+	w, err := want.GetRecord(streamId, recordId)
+	if err != nil {
+		t.Fatalf("Error getting record: %s", err)
+	}
+
+	g, err := got.GetRecord(streamId, recordId)
+	if err != nil {
+		t.Fatalf("Error getting restored record: %s", err)
+	} else if g.Id != w.Id || g.Sequence != w.Sequence || !bytes.Equal(g.Content, w.Content) || !g.Timestamp.Equal(w.Timestamp) {
+		t.Fatalf("Expected record %+v, got %+v", w, g)
+	}
+}
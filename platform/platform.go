@@ -1,38 +1,256 @@
 package platform
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 )
 
+// MAX_WAIT caps how long GetRecords blocks waiting for records to arrive.
+const MAX_WAIT = 20 * time.Second
+
+// Idempotency keys are remembered for a stream's dedupe window, which defaults to DEFAULT_DEDUPE_WINDOW.
+const (
+	DEFAULT_DEDUPE_WINDOW    = 24 * time.Hour
+	MAX_DEDUPE_WINDOW        = 7 * 24 * time.Hour
+	MAX_IDEMPOTENCY_KEY_SIZE = 255
+)
+
+// MAX_RETENTION caps how long a deleted stream is kept around to be restored.
+const MAX_RETENTION = 365 * 24 * time.Hour
+
+// Start position types accepted by CreateCursor.
+const (
+	START_EARLIEST        = "earliest"
+	START_LATEST          = "latest"
+	START_AT_TIMESTAMP    = "at-timestamp"
+	START_AFTER_RECORD_ID = "after-record-id"
+	START_LAST            = "last"
+)
+
+// Reasons recorded on records moved to a dead-letter stream.
+const (
+	DEAD_LETTER_NACKED        = "nacked"
+	DEAD_LETTER_LEASE_EXPIRED = "lease-expired"
+)
+
 type Platform interface {
 	CreateStream(name string) (*Stream, error)
 	ListStreams() ([]Stream, error)
 	GetStream(streamId string) (*Stream, error)
-	CreateCursor(streamId string) (*Cursor, error)
-	CreateRecord(streamId string, content []byte) (*Record, error)
-	GetRecords(streamId string, cursorId string) ([]Record, error)
+	DeleteStream(streamId string, retention time.Duration) (*Stream, error)
+	RestoreStream(streamId string) (*Stream, error)
+	SetDedupeWindow(streamId string, window time.Duration) (*Stream, error)
+	CreateCursor(streamId string, start StartPosition) (*Cursor, error)
+	SeekCursor(streamId string, cursorId string, position StartPosition) (*Cursor, error)
+	GetCursor(streamId string, cursorId string) (*Cursor, error)
+	ListCursors(streamId string) ([]Cursor, error)
+	DeleteCursor(streamId string, cursorId string) error
+	CloneCursor(streamId string, cursorId string) (*Cursor, error)
+	CreateRecord(streamId string, content []byte, idempotencyKey string) (*Record, error)
+	// idempotencyKeys is either nil or holds a key, possibly empty, for each of contents.
+	CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]RecordResult, error)
+	// GetRecord looks up one of a stream's records by its ID without reading it through a cursor.
+	GetRecord(streamId string, recordId string) (*Record, error)
+	GetRecords(streamId string, cursorId string, wait time.Duration) (*Batch, error)
+	AckRecords(streamId string, cursorId string, receipt string) error
+	NackRecords(streamId string, cursorId string, receipt string, reason string) error
+	SetDeadLetterPolicy(streamId string, cursorId string, policy *DeadLetterPolicy) (*Cursor, error)
+}
+
+// Snapshotter is implemented by platforms which can save their whole state to a file and later restore it.
+type Snapshotter interface {
+	// SaveSnapshot writes the platform's current state to its snapshot file.
+	SaveSnapshot() (*Snapshot, error)
+	// LoadSnapshot replaces the platform's state with that in its snapshot file.
+	LoadSnapshot() (*Snapshot, error)
+}
+
+// Releaser is implemented by platforms which can hand back a leased batch that never reached a client without
+// counting it as a delivery towards the cursor's DeadLetterPolicy. Backends whose broker counts deliveries itself,
+// such as SQS and JetStream, can't.
+type Releaser interface {
+	// ReleaseRecords ends a batch's lease so it's redelivered straight away, as if it had never been read.
+	ReleaseRecords(streamId string, cursorId string, receipt string) error
+}
+
+// Snapshot describes a copy of a platform's state which has been saved or restored.
+type Snapshot struct {
+	Path    string
+	TakenAt time.Time
+	Streams int
+	Cursors int
 }
 
 type Stream struct {
 	Id   string
 	Name string
+
+	// DeletedAt is set on streams deleted with a retention period. Such streams are read-only
+	// and can be restored until PurgeAt, after which they and their cursors are removed.
+	DeletedAt time.Time
+	PurgeAt   time.Time
+
+	// DedupeWindow is how long an idempotency key passed to CreateRecord or CreateRecords is remembered.
+	// Publishing again with the same key within the window returns the original record rather than
+	// creating another.
+	DedupeWindow time.Duration
+}
+
+// ValidateDedupeWindow returns an *ErrInvalidParam if window is out of range. A zero window restores the default.
+func ValidateDedupeWindow(window time.Duration) error {
+	if window < 0 || window > MAX_DEDUPE_WINDOW {
+		return &ErrInvalidParam{Param: "dedupeWindow", Value: window.String(), Err: fmt.Errorf("Must be between 0 and %s.", MAX_DEDUPE_WINDOW)}
+	}
+
+	return nil
+}
+
+// ValidateRetention returns an *ErrInvalidParam if a deleted stream's retention period is out of range. Zero purges
+// the stream straight away.
+func ValidateRetention(retention time.Duration) error {
+	if retention < 0 || retention > MAX_RETENTION {
+		return &ErrInvalidParam{Param: "retention", Value: retention.String(), Err: fmt.Errorf("Must be between 0 and %s.", MAX_RETENTION)}
+	}
+
+	return nil
+}
+
+// ValidateIdempotencyKey returns an *ErrInvalidParam if key is too long. An empty key is valid and disables deduplication.
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > MAX_IDEMPOTENCY_KEY_SIZE {
+		return &ErrInvalidParam{Param: "idempotencyKey", Value: key, Err: fmt.Errorf("Must be no longer than %d bytes.", MAX_IDEMPOTENCY_KEY_SIZE)}
+	}
+
+	return nil
 }
 
 type Cursor struct {
 	Id       string
 	StreamId string
 	Position string
+
+	// DeadLetter is nil unless records the cursor fails to process are moved to a dead-letter stream.
+	DeadLetter *DeadLetterPolicy
+}
+
+// DeadLetterPolicy moves records off a cursor once they have been delivered MaxDeliveries times without being
+// acknowledged, whether they were nacked or their lease expired. Each is published to the stream StreamId as a
+// DeadLetter so the cursor can carry on past it.
+type DeadLetterPolicy struct {
+	StreamId      string
+	MaxDeliveries int
+}
+
+// Validate returns an *ErrInvalidParam if the policy can't be applied to a cursor on the stream sourceStreamId.
+func (d *DeadLetterPolicy) Validate(sourceStreamId string) error {
+	if d.StreamId == "" {
+		return &ErrInvalidParam{Param: "deadLetter.streamId", Value: "", Err: errors.New("Must not be empty.")}
+	} else if d.StreamId == sourceStreamId {
+		return &ErrInvalidParam{Param: "deadLetter.streamId", Value: d.StreamId, Err: errors.New("Must not be the cursor's own stream.")}
+	} else if d.MaxDeliveries < 1 {
+		return &ErrInvalidParam{Param: "deadLetter.maxDeliveries", Value: fmt.Sprintf("%d", d.MaxDeliveries), Err: errors.New("Must be at least 1.")}
+	}
+
+	return nil
+}
+
+// DeadLetter is the content, encoded as JSON, of a record published to a dead-letter stream.
+type DeadLetter struct {
+	StreamId       string    `json:"streamId"`
+	CursorId       string    `json:"cursorId"`
+	RecordId       string    `json:"recordId"`
+	Timestamp      time.Time `json:"timestamp"`
+	Content        []byte    `json:"content"`
+	Reason         string    `json:"reason"`
+	Message        string    `json:"message,omitempty"`
+	DeliveryCount  int       `json:"deliveryCount"`
+	DeadLetteredAt time.Time `json:"deadLetteredAt"`
+}
+
+// NewDeadLetter wraps a record that a cursor gave up on after deliveryCount deliveries.
+func NewDeadLetter(rec *Record, cursorId string, reason string, message string, deliveryCount int) *DeadLetter {
+	return &DeadLetter{
+		StreamId:       rec.StreamId,
+		CursorId:       cursorId,
+		RecordId:       rec.Id,
+		Timestamp:      rec.Timestamp,
+		Content:        rec.Content,
+		Reason:         reason,
+		Message:        message,
+		DeliveryCount:  deliveryCount,
+		DeadLetteredAt: time.Now().UTC()}
+}
+
+func (d *DeadLetter) Encode() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// StartPosition describes where a new cursor begins reading, or where SeekCursor moves a cursor to. Only the field matching Type is used:
+// Timestamp for START_AT_TIMESTAMP, RecordId for START_AFTER_RECORD_ID and Count for START_LAST.
+// The zero value starts at the latest record.
+type StartPosition struct {
+	Type      string
+	Timestamp time.Time
+	RecordId  string
+	Count     int
+}
+
+// Validate returns an *ErrInvalidParam if the start position is incomplete or of an unknown type.
+func (s *StartPosition) Validate() error {
+	switch s.Type {
+	case "", START_EARLIEST, START_LATEST:
+		return nil
+	case START_AT_TIMESTAMP:
+		if s.Timestamp.IsZero() {
+			return &ErrInvalidParam{Param: "timestamp", Value: "", Err: errors.New("Must be set when starting at a timestamp.")}
+		}
+	case START_AFTER_RECORD_ID:
+		if s.RecordId == "" {
+			return &ErrInvalidParam{Param: "recordId", Value: "", Err: errors.New("Must be set when starting after a record.")}
+		}
+	case START_LAST:
+		if s.Count < 0 {
+			return &ErrInvalidParam{Param: "count", Value: fmt.Sprintf("%d", s.Count), Err: errors.New("Must not be negative.")}
+		}
+	default:
+		return &ErrInvalidParam{Param: "start", Value: s.Type, Err: errors.New("Unknown start position.")}
+	}
+
+	return nil
 }
 
 type Record struct {
-	Id          string
-	StreamId    string
+	// Id is built by FormatRecordId from the record's stream, sequence number and timestamp.
+	Id       string
+	StreamId string
+	// Sequence numbers a stream's records from 1, in the order they were published. Numbers are never reused,
+	// but a backend which numbers a record before storing it skips the number if storing it fails.
+	Sequence    uint64
 	Content     []byte
 	ContentHash []byte
 	Timestamp   time.Time
 }
 
+// RecordResult is the outcome of publishing one record of a CreateRecords batch.
+// Exactly one of Record and Err is set.
+type RecordResult struct {
+	Record *Record
+	Err    error
+}
+
+// Batch is a set of records leased to a cursor by GetRecords. When the cursor has nothing to read,
+// GetRecords waits up to its wait argument for records to arrive before returning an empty batch. The cursor does not advance
+// past the records until the batch is acknowledged with its receipt. Batches that are not
+// acknowledged before the lease expires, or that are nacked, are redelivered.
+type Batch struct {
+	Receipt string
+	Records []Record
+	// Skipped counts corrupt records which were quarantined rather than returned.
+	Skipped int
+}
+
 type ErrInvalidParam struct {
 	Param string
 	Value string
@@ -52,6 +270,24 @@ func (e *ErrStreamNotFound) Error() string {
 	return fmt.Sprintf("A stream with the %s \"%s\" does not exist.", e.SearchParam, e.Value)
 }
 
+type ErrStreamDeleted struct {
+	StreamID string
+	PurgeAt  time.Time
+}
+
+func (e *ErrStreamDeleted) Error() string {
+	return fmt.Sprintf("The stream with ID \"%s\" has been deleted and is read-only. It can be restored until %s.", e.StreamID, e.PurgeAt.Format(time.RFC3339))
+}
+
+type ErrIdempotencyKeyReused struct {
+	IdempotencyKey string
+	StreamID       string
+}
+
+func (e *ErrIdempotencyKeyReused) Error() string {
+	return fmt.Sprintf("The idempotency key \"%s\" was already used to publish different content to the stream with ID \"%s\".", e.IdempotencyKey, e.StreamID)
+}
+
 type ErrCursorNotFound struct {
 	CursorID string
 	StreamID string
@@ -60,3 +296,56 @@ type ErrCursorNotFound struct {
 func (e *ErrCursorNotFound) Error() string {
 	return fmt.Sprintf("A cursor with ID \"%s\" does not exist for a stream with ID \"%s\".", e.CursorID, e.StreamID)
 }
+
+type ErrRecordNotFound struct {
+	RecordID string
+	StreamID string
+}
+
+func (e *ErrRecordNotFound) Error() string {
+	return fmt.Sprintf("A record with ID \"%s\" does not exist in a stream with ID \"%s\".", e.RecordID, e.StreamID)
+}
+
+type ErrReceiptNotFound struct {
+	Receipt  string
+	CursorID string
+}
+
+func (e *ErrReceiptNotFound) Error() string {
+	return fmt.Sprintf("No batch with receipt \"%s\" is leased to the cursor with ID \"%s\". The lease may have expired and the records been redelivered.", e.Receipt, e.CursorID)
+}
+
+// ErrConflict means the request can't be carried out in the resource's current state.
+type ErrConflict struct {
+	Message string
+}
+
+func (e *ErrConflict) Error() string {
+	return e.Message
+}
+
+// ErrQuotaExceeded means a limit on how much can be stored or requested has been reached. Limit is zero when the
+// backing service doesn't say what the limit is.
+type ErrQuotaExceeded struct {
+	Quota string
+	Limit int64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("The %s quota has been exceeded.", e.Quota)
+	}
+
+	return fmt.Sprintf("The %s quota of %d has been exceeded.", e.Quota, e.Limit)
+}
+
+// ErrUnavailable means a backing service couldn't be reached or is throttling requests. The request may
+// succeed if it is retried later.
+type ErrUnavailable struct {
+	Service string
+	Err     error
+}
+
+func (e *ErrUnavailable) Error() string {
+	return fmt.Sprintf("The %s service is unavailable. %s", e.Service, e.Err.Error())
+}
@@ -0,0 +1,150 @@
+package platformtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+// BENCHMARK_HISTORY are the numbers of records already in a stream when publishing to it is benchmarked. A
+// backend whose appends take constant time reports about the same ns/op for each.
+var BENCHMARK_HISTORY = []int{0, 10000, 100000}
+
+// Benchmark measures the platforms created by factory under parallel load. Run it with -cpu to vary how many
+// goroutines publish and read at once.
+//
+// FailNow may only be called from the benchmark's own goroutine, so the parallel bodies report errors and return.
+func Benchmark(b *testing.B, factory platform.Factory) {
+	for _, history := range BENCHMARK_HISTORY {
+		b.Run(fmt.Sprintf("CreateRecord/history=%d", history), func(b *testing.B) {
+			p, stream := benchmarkStream(b, factory, history)
+			content := []byte("benchmark")
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := p.CreateRecord(stream.Id, content, "")
+					if err != nil {
+						b.Errorf("Error publishing record: %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+
+	b.Run("CreateRecords", func(b *testing.B) {
+		p, stream := benchmarkStream(b, factory, 0)
+		contents := make([][]byte, 100)
+		for i := range contents {
+			contents[i] = []byte("benchmark")
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, err := p.CreateRecords(stream.Id, contents, nil)
+				if err != nil {
+					b.Errorf("Error publishing records: %s", err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("GetStream", func(b *testing.B) {
+		p, err := factory(platform.Options{})
+		if err != nil {
+			b.Fatalf("Error creating the platform: %s", err)
+		}
+
+		ids := make([]string, 1000)
+		for i := range ids {
+			stream, err := p.CreateStream(fmt.Sprintf("stream-%d", i))
+			if err != nil {
+				b.Fatalf("Error creating stream: %s", err)
+			}
+			ids[i] = stream.Id
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				_, err := p.GetStream(ids[i%len(ids)])
+				if err != nil {
+					b.Errorf("Error getting stream: %s", err)
+					return
+				}
+			}
+		})
+	})
+
+	// Each goroutine reads through its own cursor while the others publish to the same stream
+	b.Run("PublishAndRead", func(b *testing.B) {
+		p, stream := benchmarkStream(b, factory, 0)
+		content := []byte("benchmark")
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			cursor, err := p.CreateCursor(stream.Id, platform.StartPosition{})
+			if err != nil {
+				b.Errorf("Error creating cursor: %s", err)
+				return
+			}
+
+			for pb.Next() {
+				_, err := p.CreateRecord(stream.Id, content, "")
+				if err != nil {
+					b.Errorf("Error publishing record: %s", err)
+					return
+				}
+
+				batch, err := p.GetRecords(stream.Id, cursor.Id, 0)
+				if err != nil {
+					b.Errorf("Error getting records: %s", err)
+					return
+				} else if len(batch.Records) == 0 {
+					continue
+				}
+
+				err = p.AckRecords(stream.Id, cursor.Id, batch.Receipt)
+				if err != nil {
+					b.Errorf("Error acknowledging records: %s", err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// benchmarkStream creates a platform holding one stream with history records already published to it.
+func benchmarkStream(b *testing.B, factory platform.Factory, history int) (platform.Platform, *platform.Stream) {
+	p, err := factory(platform.Options{})
+	if err != nil {
+		b.Fatalf("Error creating the platform: %s", err)
+	}
+
+	stream, err := p.CreateStream("benchmark")
+	if err != nil {
+		b.Fatalf("Error creating stream: %s", err)
+	}
+
+	contents := make([][]byte, 500)
+	for i := range contents {
+		contents[i] = []byte("history")
+	}
+
+	for n := 0; n < history; n += len(contents) {
+		if history-n < len(contents) {
+			contents = contents[:history-n]
+		}
+
+		_, err := p.CreateRecords(stream.Id, contents, nil)
+		if err != nil {
+			b.Fatalf("Error publishing records: %s", err)
+		}
+	}
+
+	return p, stream
+}
@@ -0,0 +1,267 @@
+package platformtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+func testCreateCursor(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	if cursor.Id == "" {
+		t.Fatalf("Expected the cursor to have an ID")
+	} else if cursor.StreamId != stream.Id {
+		t.Fatalf("Expected stream %q, got %q", stream.Id, cursor.StreamId)
+	} else if cursor.DeadLetter != nil {
+		t.Fatalf("Expected no dead-letter policy, got %v", cursor.DeadLetter)
+	}
+
+	got, err := p.GetCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error getting cursor: %s", err)
+	} else if got.Id != cursor.Id || got.StreamId != stream.Id {
+		t.Fatalf("Expected %v, got %v", cursor, got)
+	}
+
+	_, err = p.CreateCursor(missingStreamId(t, p), platform.StartPosition{})
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	_, err = p.CreateCursor(stream.Id, platform.StartPosition{Type: "sideways"})
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	// A cursor only belongs to the stream it was created on
+	other := mustCreateStream(t, p, "other")
+	_, err = p.GetCursor(other.Id, cursor.Id)
+	expectError(t, err, &platform.ErrCursorNotFound{})
+}
+
+func testCursorStartPositions(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	recs := mustPublish(t, p, stream.Id, "a", "b", "c")
+	// Leave a gap so that a timestamp falls cleanly between records, whatever the backend's clock resolution
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	mustPublish(t, p, stream.Id, "d", "e")
+
+	tests := []struct {
+		start platform.StartPosition
+		want  []string
+	}{
+		{platform.StartPosition{}, nil},
+		{platform.StartPosition{Type: platform.START_LATEST}, nil},
+		{platform.StartPosition{Type: platform.START_EARLIEST}, []string{"a", "b", "c", "d", "e"}},
+		{platform.StartPosition{Type: platform.START_AFTER_RECORD_ID, RecordId: recs[1].Id}, []string{"c", "d", "e"}},
+		{platform.StartPosition{Type: platform.START_AT_TIMESTAMP, Timestamp: between}, []string{"d", "e"}},
+		{platform.StartPosition{Type: platform.START_LAST, Count: 2}, []string{"d", "e"}},
+		{platform.StartPosition{Type: platform.START_LAST, Count: 10}, []string{"a", "b", "c", "d", "e"}},
+		{platform.StartPosition{Type: platform.START_LAST, Count: 0}, nil},
+	}
+
+	for _, test := range tests {
+		cursor := mustCreateCursor(t, p, stream.Id, test.start)
+		expectContents(t, readAll(t, p, stream.Id, cursor.Id), test.want...)
+	}
+
+	_, err := p.CreateCursor(stream.Id, platform.StartPosition{Type: platform.START_AFTER_RECORD_ID, RecordId: "missing"})
+	expectError(t, err, &platform.ErrRecordNotFound{}, &platform.ErrInvalidParam{})
+
+	_, err = p.CreateCursor(stream.Id, platform.StartPosition{Type: platform.START_AT_TIMESTAMP})
+	expectError(t, err, &platform.ErrInvalidParam{})
+}
+
+func testSeekCursor(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	recs := mustPublish(t, p, stream.Id, "a", "b", "c")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "a", "b", "c")
+
+	sought, err := p.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: platform.START_AFTER_RECORD_ID, RecordId: recs[0].Id})
+	if err != nil {
+		t.Fatalf("Error seeking cursor: %s", err)
+	} else if sought.Id != cursor.Id {
+		t.Fatalf("Expected cursor %q, got %q", cursor.Id, sought.Id)
+	}
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "b", "c")
+
+	// Seeking abandons the batch currently leased
+	_, err = p.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		t.Fatalf("Error seeking cursor: %s", err)
+	}
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+
+	_, err = p.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: platform.START_LAST, Count: 1})
+	if err != nil {
+		t.Fatalf("Error seeking cursor: %s", err)
+	}
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, batch.Receipt), &platform.ErrReceiptNotFound{})
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "c")
+
+	_, err = p.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: platform.START_LATEST})
+	if err != nil {
+		t.Fatalf("Error seeking cursor: %s", err)
+	}
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id))
+
+	_, err = p.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: "sideways"})
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	_, err = p.SeekCursor(stream.Id, missingCursorId(t, p, stream.Id), platform.StartPosition{})
+	expectError(t, err, &platform.ErrCursorNotFound{})
+}
+
+func testListCursors(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	other := mustCreateStream(t, p, "other")
+
+	cursors, err := p.ListCursors(stream.Id)
+	if err != nil {
+		t.Fatalf("Error listing cursors: %s", err)
+	} else if len(cursors) != 0 {
+		t.Fatalf("Expected no cursors, got %d", len(cursors))
+	}
+
+	a := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	b := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	mustCreateCursor(t, p, other.Id, platform.StartPosition{})
+
+	cursors, err = p.ListCursors(stream.Id)
+	if err != nil {
+		t.Fatalf("Error listing cursors: %s", err)
+	}
+
+	ids := map[string]bool{}
+	for _, c := range cursors {
+		if c.StreamId != stream.Id {
+			t.Fatalf("Expected only cursors on stream %q, got one on %q", stream.Id, c.StreamId)
+		}
+		ids[c.Id] = true
+	}
+	if len(ids) != 2 || !ids[a.Id] || !ids[b.Id] {
+		t.Fatalf("Expected cursors %q and %q, got %v", a.Id, b.Id, cursors)
+	}
+
+	_, err = p.ListCursors(missingStreamId(t, p))
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+func testDeleteCursor(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	kept := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	err := p.DeleteCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error deleting cursor: %s", err)
+	}
+
+	_, err = p.GetCursor(stream.Id, cursor.Id)
+	expectError(t, err, &platform.ErrCursorNotFound{})
+
+	_, err = p.GetRecords(stream.Id, cursor.Id, 0)
+	expectError(t, err, &platform.ErrCursorNotFound{})
+
+	expectError(t, p.DeleteCursor(stream.Id, cursor.Id), &platform.ErrCursorNotFound{})
+
+	_, err = p.GetCursor(stream.Id, kept.Id)
+	if err != nil {
+		t.Fatalf("Expected the other cursor to be kept, got %s", err)
+	}
+}
+
+func testCloneCursor(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	mustPublish(t, p, stream.Id, "a", "b")
+	source := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	expectContents(t, readAll(t, p, stream.Id, source.Id), "a", "b")
+	mustPublish(t, p, stream.Id, "c")
+
+	// The batch leased to the source stays with it, and the clone starts from the committed position
+	batch := mustGetBatch(t, p, stream.Id, source.Id)
+	expectContents(t, contentsOf(batch.Records), "c")
+
+	clone, err := p.CloneCursor(stream.Id, source.Id)
+	if err != nil {
+		t.Fatalf("Error cloning cursor: %s", err)
+	} else if clone.Id == source.Id {
+		t.Fatalf("Expected the clone to have its own ID")
+	} else if clone.StreamId != stream.Id {
+		t.Fatalf("Expected stream %q, got %q", stream.Id, clone.StreamId)
+	}
+
+	err = p.AckRecords(stream.Id, source.Id, batch.Receipt)
+	if err != nil {
+		t.Fatalf("Error acknowledging the source's batch: %s", err)
+	}
+
+	expectContents(t, readAll(t, p, stream.Id, clone.Id), "c")
+	expectContents(t, readAll(t, p, stream.Id, source.Id))
+
+	_, err = p.CloneCursor(stream.Id, missingCursorId(t, p, stream.Id))
+	expectError(t, err, &platform.ErrCursorNotFound{})
+}
+
+func testSetDeadLetterPolicy(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	dlq := mustCreateStream(t, p, "orders-dlq")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	updated, err := p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 3})
+	if err != nil {
+		t.Fatalf("Error setting dead-letter policy: %s", err)
+	} else if updated.DeadLetter == nil || updated.DeadLetter.StreamId != dlq.Id || updated.DeadLetter.MaxDeliveries != 3 {
+		t.Fatalf("Expected the policy to be set, got %v", updated.DeadLetter)
+	}
+
+	got, err := p.GetCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error getting cursor: %s", err)
+	} else if got.DeadLetter == nil || got.DeadLetter.StreamId != dlq.Id || got.DeadLetter.MaxDeliveries != 3 {
+		t.Fatalf("Expected the policy to be kept, got %v", got.DeadLetter)
+	}
+
+	_, err = p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: stream.Id, MaxDeliveries: 3})
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	_, err = p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 0})
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	_, err = p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: missingStreamId(t, p), MaxDeliveries: 3})
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	updated, err = p.SetDeadLetterPolicy(stream.Id, cursor.Id, nil)
+	if err != nil {
+		t.Fatalf("Error removing dead-letter policy: %s", err)
+	} else if updated.DeadLetter != nil {
+		t.Fatalf("Expected the policy to be removed, got %v", updated.DeadLetter)
+	}
+
+	// Clones inherit the policy
+	_, err = p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 2})
+	if err != nil {
+		t.Fatalf("Error setting dead-letter policy: %s", err)
+	}
+	clone, err := p.CloneCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error cloning cursor: %s", err)
+	} else if clone.DeadLetter == nil || clone.DeadLetter.StreamId != dlq.Id || clone.DeadLetter.MaxDeliveries != 2 {
+		t.Fatalf("Expected the clone to have the source's policy, got %v", clone.DeadLetter)
+	}
+}
+
+// missingCursorId returns the ID of a cursor on the stream which has been deleted.
+func missingCursorId(t *testing.T, p platform.Platform, streamId string) string {
+	t.Helper()
+
+	cursor := mustCreateCursor(t, p, streamId, platform.StartPosition{})
+	err := p.DeleteCursor(streamId, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error deleting cursor: %s", err)
+	}
+
+	return cursor.Id
+}
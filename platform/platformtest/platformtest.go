@@ -0,0 +1,234 @@
+// Package platformtest is a conformance suite for implementations of platform.Platform. Every backend should
+// pass it, so that the API behaves the same whichever one it runs on.
+//
+// A backend's tests call Run with a factory for fresh, empty platforms:
+//
+//	func TestConformance(t *testing.T) {
+//		platformtest.Run(t, func(opts platform.Options) (platform.Platform, error) {
+//			leaseTimeout, err := opts.LeaseTimeout()
+//			if err != nil {
+//				return nil, err
+//			}
+//
+//			return &memory.InMemoryPlatform{LeaseTimeout: leaseTimeout}, nil
+//		})
+//	}
+//
+// Only what the Platform interface promises is checked. IDs, receipts and positions are treated as opaque and
+// batches may hold any number of records from one up to the backend's limit.
+package platformtest
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+// TEST_LEASE_TIMEOUT is passed as LEASE_TIMEOUT to the platforms of tests which wait for leases to expire.
+const TEST_LEASE_TIMEOUT = 1 * time.Second
+
+// Run checks the platforms created by factory against the contract of platform.Platform. Each test gets a new
+// platform, which must start out with no streams. The factory is passed the options the test needs, which may
+// include LEASE_TIMEOUT, and should fill in anything else the backend requires.
+func Run(t *testing.T, factory platform.Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, p platform.Platform)
+		opts platform.Options
+	}{
+		{"CreateStream", testCreateStream, nil},
+		{"ListStreams", testListStreams, nil},
+		{"GetStream", testGetStream, nil},
+		{"DeleteStream", testDeleteStream, nil},
+		{"DeleteStreamWithRetention", testDeleteStreamWithRetention, nil},
+		{"SetDedupeWindow", testSetDedupeWindow, nil},
+
+		{"CreateCursor", testCreateCursor, nil},
+		{"CursorStartPositions", testCursorStartPositions, nil},
+		{"SeekCursor", testSeekCursor, nil},
+		{"ListCursors", testListCursors, nil},
+		{"DeleteCursor", testDeleteCursor, nil},
+		{"CloneCursor", testCloneCursor, nil},
+		{"SetDeadLetterPolicy", testSetDeadLetterPolicy, nil},
+
+		{"CreateRecord", testCreateRecord, nil},
+		{"CreateRecords", testCreateRecords, nil},
+		{"IdempotentPublish", testIdempotentPublish, nil},
+		{"ReadInOrder", testReadInOrder, nil},
+		{"RecordSequence", testRecordSequence, nil},
+		{"GetRecord", testGetRecord, nil},
+		{"NewCursorSkipsHistory", testNewCursorSkipsHistory, nil},
+		{"AckRecords", testAckRecords, nil},
+		{"NackRecords", testNackRecords, nil},
+		{"LeaseExpiry", testLeaseExpiry, platform.Options{"LEASE_TIMEOUT": seconds(TEST_LEASE_TIMEOUT)}},
+		{"WaitForRecords", testWaitForRecords, nil},
+		{"DeadLetterOnNack", testDeadLetterOnNack, nil},
+		{"ReleaseRecords", testReleaseRecords, nil},
+
+		{"ConcurrentPublish", testConcurrentPublish, nil},
+		{"ConcurrentReads", testConcurrentReads, nil},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			opts := platform.Options{}
+			for k, v := range test.opts {
+				opts[k] = v
+			}
+
+			p, err := factory(opts)
+			if err != nil {
+				t.Fatalf("Error creating the platform: %s", err)
+			}
+
+			test.fn(t, p)
+		})
+	}
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%d", int(d/time.Second))
+}
+
+// expectError fails the test unless err is of the same type as one of want, e.g. &platform.ErrStreamNotFound{}.
+func expectError(t *testing.T, err error, want ...error) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("Expected %s, got no error", errorTypes(want))
+	}
+
+	for _, w := range want {
+		if reflect.TypeOf(err) == reflect.TypeOf(w) {
+			return
+		}
+	}
+
+	t.Fatalf("Expected %s, got %T: %s", errorTypes(want), err, err)
+}
+
+func errorTypes(errs []error) string {
+	s := ""
+	for i, err := range errs {
+		if i > 0 {
+			s += " or "
+		}
+		s += fmt.Sprintf("%T", err)
+	}
+
+	return s
+}
+
+func mustCreateStream(t *testing.T, p platform.Platform, name string) *platform.Stream {
+	t.Helper()
+
+	stream, err := p.CreateStream(name)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+
+	return stream
+}
+
+func mustCreateCursor(t *testing.T, p platform.Platform, streamId string, start platform.StartPosition) *platform.Cursor {
+	t.Helper()
+
+	cursor, err := p.CreateCursor(streamId, start)
+	if err != nil {
+		t.Fatalf("Error creating cursor: %s", err)
+	}
+
+	return cursor
+}
+
+// mustPublish publishes each of contents in turn, returning the records created.
+func mustPublish(t *testing.T, p platform.Platform, streamId string, contents ...string) []platform.Record {
+	t.Helper()
+
+	recs := []platform.Record{}
+	for _, content := range contents {
+		rec, err := p.CreateRecord(streamId, []byte(content), "")
+		if err != nil {
+			t.Fatalf("Error publishing %q: %s", content, err)
+		}
+
+		recs = append(recs, *rec)
+	}
+
+	return recs
+}
+
+// readAll reads and acknowledges batches until the cursor has caught up, returning the content of every record.
+func readAll(t *testing.T, p platform.Platform, streamId string, cursorId string) []string {
+	t.Helper()
+
+	contents := []string{}
+	for {
+		batch, err := p.GetRecords(streamId, cursorId, 0)
+		if err != nil {
+			t.Fatalf("Error getting records: %s", err)
+		} else if len(batch.Records) == 0 {
+			return contents
+		}
+
+		for _, rec := range batch.Records {
+			contents = append(contents, string(rec.Content))
+		}
+
+		err = p.AckRecords(streamId, cursorId, batch.Receipt)
+		if err != nil {
+			t.Fatalf("Error acknowledging records: %s", err)
+		}
+	}
+}
+
+// mustGetBatch reads the cursor's next batch, failing the test if it's empty.
+func mustGetBatch(t *testing.T, p platform.Platform, streamId string, cursorId string) *platform.Batch {
+	t.Helper()
+
+	batch, err := p.GetRecords(streamId, cursorId, 0)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if len(batch.Records) == 0 {
+		t.Fatalf("Expected records, got an empty batch")
+	} else if batch.Receipt == "" {
+		t.Fatalf("Expected a receipt with %d records", len(batch.Records))
+	}
+
+	return batch
+}
+
+func expectContents(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(want) == 0 {
+		want = []string{}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected records %q, got %q", want, got)
+	}
+}
+
+func contentsOf(recs []platform.Record) []string {
+	contents := []string{}
+	for _, rec := range recs {
+		contents = append(contents, string(rec.Content))
+	}
+
+	return contents
+}
+
+// numbered returns n distinct record contents, "0" to n-1.
+func numbered(n int) []string {
+	contents := make([]string, n)
+	for i := range contents {
+		contents[i] = fmt.Sprintf("%d", i)
+	}
+
+	return contents
+}
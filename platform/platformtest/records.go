@@ -0,0 +1,652 @@
+package platformtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+func testCreateRecord(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	before := time.Now().Add(-time.Second)
+
+	rec, err := p.CreateRecord(stream.Id, []byte("a"), "")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	} else if rec.Id == "" {
+		t.Fatalf("Expected the record to have an ID")
+	} else if rec.StreamId != stream.Id {
+		t.Fatalf("Expected stream %q, got %q", stream.Id, rec.StreamId)
+	} else if string(rec.Content) != "a" {
+		t.Fatalf("Expected content %q, got %q", "a", rec.Content)
+	} else if len(rec.ContentHash) == 0 {
+		t.Fatalf("Expected a content hash")
+	} else if rec.Timestamp.Before(before) || rec.Timestamp.After(time.Now().Add(time.Second)) {
+		t.Fatalf("Expected a timestamp of around now, got %s", rec.Timestamp)
+	}
+
+	// Identical content hashes alike but is still a separate record
+	same, err := p.CreateRecord(stream.Id, []byte("a"), "")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	} else if same.Id == rec.Id {
+		t.Fatalf("Expected a new record ID, got %q again", rec.Id)
+	} else if !bytes.Equal(same.ContentHash, rec.ContentHash) {
+		t.Fatalf("Expected identical content to have the same hash")
+	}
+
+	different, err := p.CreateRecord(stream.Id, []byte("b"), "")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	} else if bytes.Equal(different.ContentHash, rec.ContentHash) {
+		t.Fatalf("Expected different content to have a different hash")
+	}
+
+	_, err = p.CreateRecord(missingStreamId(t, p), []byte("a"), "")
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+func testCreateRecords(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	contents := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	results, err := p.CreateRecords(stream.Id, contents, nil)
+	if err != nil {
+		t.Fatalf("Error publishing records: %s", err)
+	} else if len(results) != len(contents) {
+		t.Fatalf("Expected %d results, got %d", len(contents), len(results))
+	}
+
+	ids := map[string]bool{}
+	for i, res := range results {
+		if res.Err != nil {
+			t.Fatalf("Error publishing record %d: %s", i, res.Err)
+		} else if res.Record == nil || !bytes.Equal(res.Record.Content, contents[i]) {
+			t.Fatalf("Expected result %d to hold %q, got %v", i, contents[i], res.Record)
+		}
+		ids[res.Record.Id] = true
+	}
+	if len(ids) != len(contents) {
+		t.Fatalf("Expected each record to have its own ID, got %v", ids)
+	}
+
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "a", "b", "c")
+
+	// A bad key fails only its own record
+	keys := []string{"", string(make([]byte, platform.MAX_IDEMPOTENCY_KEY_SIZE+1)), ""}
+	results, err = p.CreateRecords(stream.Id, [][]byte{[]byte("d"), []byte("e"), []byte("f")}, keys)
+	if err != nil {
+		t.Fatalf("Error publishing records: %s", err)
+	} else if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	} else if results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("Expected records with valid keys to be published, got %v and %v", results[0].Err, results[2].Err)
+	}
+	expectError(t, results[1].Err, &platform.ErrInvalidParam{})
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "d", "f")
+
+	_, err = p.CreateRecords(missingStreamId(t, p), contents, nil)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+func testIdempotentPublish(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	first, err := p.CreateRecord(stream.Id, []byte("a"), "key-1")
+	if err != nil {
+		t.Fatalf("Error publishing record: %s", err)
+	}
+
+	retried, err := p.CreateRecord(stream.Id, []byte("a"), "key-1")
+	if err != nil {
+		t.Fatalf("Error retrying publish: %s", err)
+	} else if retried.Id != first.Id || retried.Sequence != first.Sequence || !retried.Timestamp.Equal(first.Timestamp) {
+		t.Fatalf("Expected the original record %v, got %v", first, retried)
+	}
+
+	_, err = p.CreateRecord(stream.Id, []byte("b"), "key-1")
+	expectError(t, err, &platform.ErrIdempotencyKeyReused{})
+
+	_, err = p.CreateRecord(stream.Id, []byte("a"), string(make([]byte, platform.MAX_IDEMPOTENCY_KEY_SIZE+1)))
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	// Keys are per stream
+	other := mustCreateStream(t, p, "other")
+	elsewhere, err := p.CreateRecord(other.Id, []byte("b"), "key-1")
+	if err != nil {
+		t.Fatalf("Error publishing record to another stream: %s", err)
+	} else if elsewhere.StreamId != other.Id {
+		t.Fatalf("Expected stream %q, got %q", other.Id, elsewhere.StreamId)
+	}
+
+	// Batches are deduplicated against earlier publishes and each other
+	results, err := p.CreateRecords(stream.Id, [][]byte{[]byte("a"), []byte("c"), []byte("c"), []byte("x")}, []string{"key-1", "key-2", "key-2", "key-2"})
+	if err != nil {
+		t.Fatalf("Error publishing records: %s", err)
+	} else if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	} else if results[0].Err != nil || results[0].Record.Id != first.Id {
+		t.Fatalf("Expected the original record for key-1, got %v", results[0])
+	} else if results[1].Err != nil || results[2].Err != nil || results[1].Record.Id != results[2].Record.Id {
+		t.Fatalf("Expected one record for key-2, got %v and %v", results[1], results[2])
+	}
+	expectError(t, results[3].Err, &platform.ErrIdempotencyKeyReused{})
+
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "a", "c")
+}
+
+func testReadInOrder(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	// Enough to need several batches on any backend
+	contents := numbered(250)
+	for i := 0; i < len(contents); i += 50 {
+		batch := make([][]byte, 50)
+		for j := range batch {
+			batch[j] = []byte(contents[i+j])
+		}
+
+		results, err := p.CreateRecords(stream.Id, batch, nil)
+		if err != nil {
+			t.Fatalf("Error publishing records: %s", err)
+		}
+		for _, res := range results {
+			if res.Err != nil {
+				t.Fatalf("Error publishing record: %s", res.Err)
+			}
+		}
+	}
+
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), contents...)
+
+	// A batch's records belong to the stream and come with their content hashes
+	mustPublish(t, p, stream.Id, "last")
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+	for _, rec := range batch.Records {
+		if rec.StreamId != stream.Id || rec.Id == "" || len(rec.ContentHash) == 0 || rec.Timestamp.IsZero() {
+			t.Fatalf("Expected a complete record, got %v", rec)
+		}
+	}
+}
+
+func testRecordSequence(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+
+	published := mustPublish(t, p, stream.Id, "a")
+	published = append(published, mustPublish(t, p, stream.Id, "b", "c")...)
+	for i, rec := range published {
+		if rec.Sequence != uint64(i+1) {
+			t.Fatalf("Expected record %d to have sequence %d, got %d", i, i+1, rec.Sequence)
+		} else if len(rec.Id) != platform.RECORD_ID_LENGTH {
+			t.Fatalf("Expected a %d character record ID, got %q", platform.RECORD_ID_LENGTH, rec.Id)
+		} else if i > 0 && rec.Id <= published[i-1].Id {
+			t.Fatalf("Expected record IDs to sort in publish order, got %q after %q", rec.Id, published[i-1].Id)
+		}
+	}
+
+	// Records read back have the same IDs and sequence numbers they were published with
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+	if len(batch.Records) != len(published) {
+		t.Fatalf("Expected %d records, got %d", len(published), len(batch.Records))
+	}
+	for i, rec := range batch.Records {
+		if rec.Id != published[i].Id || rec.Sequence != published[i].Sequence {
+			t.Fatalf("Expected record %s (%d), got %s (%d)", published[i].Id, published[i].Sequence, rec.Id, rec.Sequence)
+		}
+	}
+
+	// Each stream counts from 1, and its records can't be found through another stream
+	other := mustCreateStream(t, p, "other")
+	elsewhere := mustPublish(t, p, other.Id, "x")
+	if elsewhere[0].Sequence != 1 {
+		t.Fatalf("Expected the first record of a new stream to have sequence 1, got %d", elsewhere[0].Sequence)
+	}
+
+	_, err := p.CreateCursor(other.Id, platform.StartPosition{Type: platform.START_AFTER_RECORD_ID, RecordId: published[0].Id})
+	expectError(t, err, &platform.ErrRecordNotFound{})
+}
+
+func testGetRecord(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	published := mustPublish(t, p, stream.Id, "a", "b")
+
+	for _, want := range published {
+		rec, err := p.GetRecord(stream.Id, want.Id)
+		if err != nil {
+			t.Fatalf("Error getting record %s: %s", want.Id, err)
+		} else if rec.Id != want.Id || rec.StreamId != stream.Id || rec.Sequence != want.Sequence {
+			t.Fatalf("Expected record %s (%d), got %s (%d)", want.Id, want.Sequence, rec.Id, rec.Sequence)
+		} else if !bytes.Equal(rec.Content, want.Content) || !bytes.Equal(rec.ContentHash, want.ContentHash) {
+			t.Fatalf("Expected content %q, got %q", want.Content, rec.Content)
+		} else if !rec.Timestamp.Equal(want.Timestamp) {
+			t.Fatalf("Expected timestamp %s, got %s", want.Timestamp, rec.Timestamp)
+		}
+	}
+
+	// Reading a record doesn't move any cursor past it
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "a", "b")
+
+	_, err := p.GetRecord(stream.Id, "missing")
+	expectError(t, err, &platform.ErrRecordNotFound{})
+
+	other := mustCreateStream(t, p, "other")
+	_, err = p.GetRecord(other.Id, published[0].Id)
+	expectError(t, err, &platform.ErrRecordNotFound{})
+
+	_, err = p.GetRecord(missingStreamId(t, p), published[0].Id)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+func testNewCursorSkipsHistory(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	mustPublish(t, p, stream.Id, "a", "b")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	batch, err := p.GetRecords(stream.Id, cursor.Id, 0)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if batch.Records == nil || len(batch.Records) != 0 {
+		t.Fatalf("Expected an empty, non-nil batch, got %v", batch.Records)
+	}
+
+	mustPublish(t, p, stream.Id, "c")
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "c")
+
+	empty := mustCreateStream(t, p, "empty")
+	cursor = mustCreateCursor(t, p, empty.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	expectContents(t, readAll(t, p, empty.Id, cursor.Id))
+}
+
+func testAckRecords(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	mustPublish(t, p, stream.Id, "a")
+
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+	expectContents(t, contentsOf(batch.Records), "a")
+
+	// Only one batch is leased at a time, even once more records arrive
+	mustPublish(t, p, stream.Id, "b")
+	leased, err := p.GetRecords(stream.Id, cursor.Id, 0)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if len(leased.Records) != 0 {
+		t.Fatalf("Expected nothing while a batch is leased, got %q", contentsOf(leased.Records))
+	}
+
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, ""), &platform.ErrInvalidParam{})
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, batch.Receipt+"x"), &platform.ErrReceiptNotFound{}, &platform.ErrInvalidParam{})
+
+	err = p.AckRecords(stream.Id, cursor.Id, batch.Receipt)
+	if err != nil {
+		t.Fatalf("Error acknowledging records: %s", err)
+	}
+
+	// Acknowledging commits the cursor's position, and a receipt can't be used twice
+	got, err := p.GetCursor(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatalf("Error getting cursor: %s", err)
+	} else if got.Position == cursor.Position {
+		t.Fatalf("Expected the cursor's position to move on from %q", cursor.Position)
+	}
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, batch.Receipt), &platform.ErrReceiptNotFound{})
+
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "b")
+
+	// Receipts belong to the cursor they were issued to
+	other := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	batch = mustGetBatch(t, p, stream.Id, other.Id)
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, batch.Receipt), &platform.ErrReceiptNotFound{})
+
+	expectError(t, p.AckRecords(stream.Id, missingCursorId(t, p, stream.Id), batch.Receipt), &platform.ErrCursorNotFound{})
+}
+
+func testNackRecords(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	mustPublish(t, p, stream.Id, "a", "b")
+
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+	first := contentsOf(batch.Records)
+
+	expectError(t, p.NackRecords(stream.Id, cursor.Id, "", "failed"), &platform.ErrInvalidParam{})
+
+	err := p.NackRecords(stream.Id, cursor.Id, batch.Receipt, "failed")
+	if err != nil {
+		t.Fatalf("Error nacking records: %s", err)
+	}
+	expectError(t, p.NackRecords(stream.Id, cursor.Id, batch.Receipt, "failed"), &platform.ErrReceiptNotFound{})
+	expectError(t, p.AckRecords(stream.Id, cursor.Id, batch.Receipt), &platform.ErrReceiptNotFound{})
+
+	// The batch is redelivered straight away under a new receipt
+	redelivered := mustGetBatch(t, p, stream.Id, cursor.Id)
+	if redelivered.Receipt == batch.Receipt {
+		t.Fatalf("Expected a new receipt for the redelivered batch")
+	}
+	got := contentsOf(redelivered.Records)
+	if len(got) < len(first) || fmt.Sprint(got[:len(first)]) != fmt.Sprint(first) {
+		t.Fatalf("Expected %q to be redelivered first, got %q", first, got)
+	}
+
+	err = p.AckRecords(stream.Id, cursor.Id, redelivered.Receipt)
+	if err != nil {
+		t.Fatalf("Error acknowledging records: %s", err)
+	}
+
+	all := append(got, readAll(t, p, stream.Id, cursor.Id)...)
+	expectContents(t, all, "a", "b")
+}
+
+func testLeaseExpiry(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	mustPublish(t, p, stream.Id, "a")
+
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+
+	// Waiting on a leased cursor returns once the lease runs out and the batch is redelivered
+	start := time.Now()
+	redelivered, err := p.GetRecords(stream.Id, cursor.Id, TEST_LEASE_TIMEOUT+5*time.Second)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	}
+	if len(redelivered.Records) == 0 {
+		// Not every backend wakes on an expired lease, but a fresh read after it must see the batch again
+		redelivered = mustGetBatch(t, p, stream.Id, cursor.Id)
+	}
+	if elapsed := time.Since(start); elapsed < TEST_LEASE_TIMEOUT/2 {
+		t.Fatalf("Expected the batch to stay leased for around %s, redelivered after %s", TEST_LEASE_TIMEOUT, elapsed)
+	}
+
+	expectContents(t, contentsOf(redelivered.Records), "a")
+	if redelivered.Receipt == batch.Receipt {
+		t.Fatalf("Expected a new receipt for the redelivered batch")
+	}
+
+	err = p.AckRecords(stream.Id, cursor.Id, redelivered.Receipt)
+	if err != nil {
+		t.Fatalf("Error acknowledging records: %s", err)
+	}
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id))
+}
+
+func testWaitForRecords(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	// An empty stream is waited on for no longer than asked
+	start := time.Now()
+	batch, err := p.GetRecords(stream.Id, cursor.Id, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if len(batch.Records) != 0 {
+		t.Fatalf("Expected no records, got %q", contentsOf(batch.Records))
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected to wait around 200ms, waited %s", elapsed)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		p.CreateRecord(stream.Id, []byte("a"), "")
+	}()
+
+	start = time.Now()
+	batch, err = p.GetRecords(stream.Id, cursor.Id, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Error getting records: %s", err)
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the read to return once a record arrived, waited %s", elapsed)
+	}
+	expectContents(t, contentsOf(batch.Records), "a")
+}
+
+func testDeadLetterOnNack(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	dlq := mustCreateStream(t, p, "orders-dlq")
+	dlqCursor := mustCreateCursor(t, p, dlq.Id, platform.StartPosition{})
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	_, err := p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 2})
+	if err != nil {
+		t.Fatalf("Error setting dead-letter policy: %s", err)
+	}
+
+	recs := mustPublish(t, p, stream.Id, "poison")
+	for i := 0; i < 2; i++ {
+		batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+		expectContents(t, contentsOf(batch.Records), "poison")
+
+		err = p.NackRecords(stream.Id, cursor.Id, batch.Receipt, "bad input")
+		if err != nil {
+			t.Fatalf("Error nacking records: %s", err)
+		}
+	}
+
+	// Out of deliveries, the record moves to the dead-letter stream and the cursor carries on past it
+	mustPublish(t, p, stream.Id, "good")
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "good")
+
+	batch := mustGetBatch(t, p, dlq.Id, dlqCursor.Id)
+	if len(batch.Records) != 1 {
+		t.Fatalf("Expected one dead letter, got %d", len(batch.Records))
+	}
+
+	var letter platform.DeadLetter
+	err = json.Unmarshal(batch.Records[0].Content, &letter)
+	if err != nil {
+		t.Fatalf("Error decoding dead letter: %s", err)
+	}
+	if letter.StreamId != stream.Id || letter.CursorId != cursor.Id || letter.RecordId != recs[0].Id {
+		t.Fatalf("Expected a dead letter for record %q, got %v", recs[0].Id, letter)
+	} else if string(letter.Content) != "poison" {
+		t.Fatalf("Expected the dead letter to hold %q, got %q", "poison", letter.Content)
+	} else if letter.Reason != platform.DEAD_LETTER_NACKED {
+		t.Fatalf("Expected reason %q, got %q", platform.DEAD_LETTER_NACKED, letter.Reason)
+	} else if letter.Message != "bad input" {
+		t.Fatalf("Expected message %q, got %q", "bad input", letter.Message)
+	} else if letter.DeliveryCount != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d", letter.DeliveryCount)
+	}
+}
+
+func testReleaseRecords(t *testing.T, p platform.Platform) {
+	releaser, ok := p.(platform.Releaser)
+	if !ok {
+		t.Skip("The platform can't release batches.")
+	}
+
+	stream := mustCreateStream(t, p, "orders")
+	dlq := mustCreateStream(t, p, "orders-dlq")
+	dlqCursor := mustCreateCursor(t, p, dlq.Id, platform.StartPosition{})
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	_, err := p.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 2})
+	if err != nil {
+		t.Fatalf("Error setting dead-letter policy: %s", err)
+	}
+
+	mustPublish(t, p, stream.Id, "poison")
+	batch := mustGetBatch(t, p, stream.Id, cursor.Id)
+	expectError(t, releaser.ReleaseRecords(stream.Id, cursor.Id, ""), &platform.ErrInvalidParam{})
+
+	// Released batches are redelivered straight away without using up any deliveries
+	for i := 0; i < 3; i++ {
+		err = releaser.ReleaseRecords(stream.Id, cursor.Id, batch.Receipt)
+		if err != nil {
+			t.Fatalf("Error releasing records: %s", err)
+		}
+		expectError(t, releaser.ReleaseRecords(stream.Id, cursor.Id, batch.Receipt), &platform.ErrReceiptNotFound{})
+
+		batch = mustGetBatch(t, p, stream.Id, cursor.Id)
+		expectContents(t, contentsOf(batch.Records), "poison")
+	}
+
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			batch = mustGetBatch(t, p, stream.Id, cursor.Id)
+			expectContents(t, contentsOf(batch.Records), "poison")
+		}
+
+		err = p.NackRecords(stream.Id, cursor.Id, batch.Receipt, "bad input")
+		if err != nil {
+			t.Fatalf("Error nacking records: %s", err)
+		}
+	}
+
+	mustPublish(t, p, stream.Id, "good")
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "good")
+
+	batch = mustGetBatch(t, p, dlq.Id, dlqCursor.Id)
+	if len(batch.Records) != 1 {
+		t.Fatalf("Expected one dead letter, got %d", len(batch.Records))
+	}
+
+	var letter platform.DeadLetter
+	err = json.Unmarshal(batch.Records[0].Content, &letter)
+	if err != nil {
+		t.Fatalf("Error decoding dead letter: %s", err)
+	} else if letter.DeliveryCount != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d", letter.DeliveryCount)
+	}
+}
+
+func testConcurrentPublish(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+
+	const publishers = 8
+	const perPublisher = 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, publishers*perPublisher)
+	ids := make(chan string, publishers*perPublisher)
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < perPublisher; j++ {
+				rec, err := p.CreateRecord(stream.Id, []byte(fmt.Sprintf("%d-%03d", i, j)), "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids <- rec.Id
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+
+	for err := range errs {
+		t.Fatalf("Error publishing concurrently: %s", err)
+	}
+
+	seen := map[string]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("Expected unique record IDs, got %q twice", id)
+		}
+		seen[id] = true
+	}
+
+	// Every record arrives exactly once, and each publisher's records in the order it published them
+	got := readAll(t, p, stream.Id, cursor.Id)
+	if len(got) != publishers*perPublisher {
+		t.Fatalf("Expected %d records, got %d", publishers*perPublisher, len(got))
+	}
+
+	last := map[string]string{}
+	for _, content := range got {
+		parts := strings.SplitN(content, "-", 2)
+		publisher, n := parts[0], parts[1]
+		if n <= last[publisher] {
+			t.Fatalf("Expected publisher %s's records in order, got %s after %s", publisher, n, last[publisher])
+		}
+		last[publisher] = n
+	}
+}
+
+func testConcurrentReads(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{})
+	want := numbered(300)
+	mustPublish(t, p, stream.Id, want...)
+
+	const readers = 8
+
+	// Readers sharing a cursor never hold the same records at once, so between them they see each record once
+	var mu sync.Mutex
+	got := []string{}
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				batch, err := p.GetRecords(stream.Id, cursor.Id, 100*time.Millisecond)
+				if err != nil {
+					errs <- err
+					return
+				} else if len(batch.Records) == 0 {
+					mu.Lock()
+					done := len(got) >= len(want)
+					mu.Unlock()
+					if done {
+						return
+					}
+					continue
+				}
+
+				mu.Lock()
+				got = append(got, contentsOf(batch.Records)...)
+				mu.Unlock()
+
+				err = p.AckRecords(stream.Id, cursor.Id, batch.Receipt)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("Timed out reading concurrently, read %d of %d records", len(got), len(want))
+	}
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Error reading concurrently: %s", err)
+	}
+
+	sort.Strings(got)
+	sorted := append([]string{}, want...)
+	sort.Strings(sorted)
+	expectContents(t, got, sorted...)
+}
@@ -0,0 +1,209 @@
+package platformtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oceanhq/streams/platform"
+)
+
+func testCreateStream(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	if stream.Id == "" {
+		t.Fatalf("Expected the stream to have an ID")
+	} else if stream.Name != "orders" {
+		t.Fatalf("Expected name %q, got %q", "orders", stream.Name)
+	} else if stream.DedupeWindow != platform.DEFAULT_DEDUPE_WINDOW {
+		t.Fatalf("Expected the default dedupe window, got %s", stream.DedupeWindow)
+	} else if !stream.DeletedAt.IsZero() {
+		t.Fatalf("Expected a new stream not to be deleted")
+	}
+
+	other := mustCreateStream(t, p, "orders")
+	if other.Id == stream.Id {
+		t.Fatalf("Expected streams to have distinct IDs, both are %q", stream.Id)
+	}
+
+	_, err := p.CreateStream("")
+	expectError(t, err, &platform.ErrInvalidParam{})
+}
+
+func testListStreams(t *testing.T, p platform.Platform) {
+	streams, err := p.ListStreams()
+	if err != nil {
+		t.Fatalf("Error listing streams: %s", err)
+	} else if len(streams) != 0 {
+		t.Fatalf("Expected no streams, got %d", len(streams))
+	}
+
+	a := mustCreateStream(t, p, "a")
+	b := mustCreateStream(t, p, "b")
+
+	streams, err = p.ListStreams()
+	if err != nil {
+		t.Fatalf("Error listing streams: %s", err)
+	}
+
+	names := map[string]string{}
+	for _, s := range streams {
+		names[s.Id] = s.Name
+	}
+	if len(names) != 2 || names[a.Id] != "a" || names[b.Id] != "b" {
+		t.Fatalf("Expected streams %q and %q, got %v", a.Id, b.Id, streams)
+	}
+}
+
+func testGetStream(t *testing.T, p platform.Platform) {
+	created := mustCreateStream(t, p, "orders")
+
+	stream, err := p.GetStream(created.Id)
+	if err != nil {
+		t.Fatalf("Error getting stream: %s", err)
+	} else if stream.Id != created.Id || stream.Name != created.Name {
+		t.Fatalf("Expected %v, got %v", created, stream)
+	}
+
+	_, err = p.GetStream(missingStreamId(t, p))
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	// Backends differ in whether they can tell a malformed ID from an unknown one
+	_, err = p.GetStream("not a stream")
+	expectError(t, err, &platform.ErrInvalidParam{}, &platform.ErrStreamNotFound{})
+}
+
+func testDeleteStream(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	mustPublish(t, p, stream.Id, "a")
+	mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+
+	deleted, err := p.DeleteStream(stream.Id, 0)
+	if err != nil {
+		t.Fatalf("Error deleting stream: %s", err)
+	} else if deleted.Id != stream.Id {
+		t.Fatalf("Expected stream %q, got %q", stream.Id, deleted.Id)
+	}
+
+	_, err = p.GetStream(stream.Id)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	_, err = p.ListCursors(stream.Id)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	_, err = p.CreateRecord(stream.Id, []byte("b"), "")
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	_, err = p.DeleteStream(stream.Id, 0)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+
+	streams, err := p.ListStreams()
+	if err != nil {
+		t.Fatalf("Error listing streams: %s", err)
+	}
+	for _, s := range streams {
+		if s.Id == stream.Id {
+			t.Fatalf("Expected the deleted stream not to be listed")
+		}
+	}
+}
+
+func testDeleteStreamWithRetention(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+	mustPublish(t, p, stream.Id, "a")
+	cursor := mustCreateCursor(t, p, stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+
+	_, err := p.DeleteStream(stream.Id, platform.MAX_RETENTION+time.Second)
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	deleted, err := p.DeleteStream(stream.Id, time.Hour)
+	if err != nil {
+		t.Fatalf("Error deleting stream: %s", err)
+	} else if deleted.DeletedAt.IsZero() {
+		t.Fatalf("Expected DeletedAt to be set")
+	} else if !deleted.PurgeAt.After(deleted.DeletedAt) {
+		t.Fatalf("Expected PurgeAt %s to be after DeletedAt %s", deleted.PurgeAt, deleted.DeletedAt)
+	}
+
+	// The stream stays readable but takes no new records
+	got, err := p.GetStream(stream.Id)
+	if err != nil {
+		t.Fatalf("Error getting deleted stream: %s", err)
+	} else if got.DeletedAt.IsZero() {
+		t.Fatalf("Expected the stream to be marked deleted")
+	}
+
+	_, err = p.CreateRecord(stream.Id, []byte("b"), "")
+	expectError(t, err, &platform.ErrStreamDeleted{})
+
+	results, err := p.CreateRecords(stream.Id, [][]byte{[]byte("b")}, nil)
+	if err == nil {
+		// Backends may reject the whole batch or each record in it
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %d", len(results))
+		}
+		err = results[0].Err
+	}
+	expectError(t, err, &platform.ErrStreamDeleted{})
+
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "a")
+
+	restored, err := p.RestoreStream(stream.Id)
+	if err != nil {
+		t.Fatalf("Error restoring stream: %s", err)
+	} else if !restored.DeletedAt.IsZero() || !restored.PurgeAt.IsZero() {
+		t.Fatalf("Expected the restored stream not to be deleted, got %v", restored)
+	}
+
+	mustPublish(t, p, stream.Id, "b")
+	expectContents(t, readAll(t, p, stream.Id, cursor.Id), "b")
+
+	_, err = p.RestoreStream(missingStreamId(t, p))
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+func testSetDedupeWindow(t *testing.T, p platform.Platform) {
+	stream := mustCreateStream(t, p, "orders")
+
+	updated, err := p.SetDedupeWindow(stream.Id, time.Hour)
+	if err != nil {
+		t.Fatalf("Error setting dedupe window: %s", err)
+	} else if updated.DedupeWindow != time.Hour {
+		t.Fatalf("Expected a dedupe window of 1h, got %s", updated.DedupeWindow)
+	}
+
+	got, err := p.GetStream(stream.Id)
+	if err != nil {
+		t.Fatalf("Error getting stream: %s", err)
+	} else if got.DedupeWindow != time.Hour {
+		t.Fatalf("Expected the dedupe window to be kept, got %s", got.DedupeWindow)
+	}
+
+	updated, err = p.SetDedupeWindow(stream.Id, 0)
+	if err != nil {
+		t.Fatalf("Error resetting dedupe window: %s", err)
+	} else if updated.DedupeWindow != platform.DEFAULT_DEDUPE_WINDOW {
+		t.Fatalf("Expected the default dedupe window, got %s", updated.DedupeWindow)
+	}
+
+	_, err = p.SetDedupeWindow(stream.Id, platform.MAX_DEDUPE_WINDOW+time.Second)
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	_, err = p.SetDedupeWindow(stream.Id, -time.Second)
+	expectError(t, err, &platform.ErrInvalidParam{})
+
+	_, err = p.SetDedupeWindow(missingStreamId(t, p), time.Hour)
+	expectError(t, err, &platform.ErrStreamNotFound{})
+}
+
+// missingStreamId returns the ID of a stream which has been deleted, so that it's well formed for the backend
+// but refers to nothing.
+func missingStreamId(t *testing.T, p platform.Platform) string {
+	t.Helper()
+
+	stream := mustCreateStream(t, p, "deleted")
+	_, err := p.DeleteStream(stream.Id, 0)
+	if err != nil {
+		t.Fatalf("Error deleting stream: %s", err)
+	}
+
+	return stream.Id
+}
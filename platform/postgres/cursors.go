@@ -0,0 +1,417 @@
+package postgres
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/oceanhq/streams/platform"
+)
+
+// CURSOR_COLUMNS are the columns scanCursor reads.
+const CURSOR_COLUMNS = "id, stream_id, position, dead_letter_stream_id, max_deliveries, receipt, leased_through, lease_expires_at"
+
+type cursor struct {
+	id       string
+	streamId string
+	// position is the sequence of the last record the cursor has committed, or 0 before the first record.
+	position   int64
+	deadLetter *platform.DeadLetterPolicy
+	lease      *lease
+}
+
+// lease tracks the batch currently handed out to a cursor.
+type lease struct {
+	receipt string
+	last    int64
+	expires time.Time
+}
+
+func (p *PostgresPlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	var c *cursor
+	err := p.withTx(func(tx *sql.Tx) error {
+		s, err := findStream(tx, streamId, false)
+		if err != nil {
+			return err
+		}
+
+		position, err := s.resolveStart(tx, &start)
+		if err != nil {
+			return err
+		}
+
+		c, err = insertCursor(tx, s.id, position, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *PostgresPlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	var c *cursor
+	err := p.withTx(func(tx *sql.Tx) error {
+		var s *stream
+		var err error
+		s, c, err = findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		target, err := s.resolveStart(tx, &position)
+		if err != nil {
+			return err
+		}
+
+		// Any outstanding batch is abandoned; its receipt can no longer be acknowledged.
+		err = c.moveTo(tx, target, true)
+		if err != nil {
+			return err
+		}
+
+		return notify(tx, s.id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *PostgresPlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	var c *cursor
+	err := p.withTx(func(tx *sql.Tx) error {
+		var err error
+		_, c, err = findStreamCursor(tx, streamId, cursorId, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *PostgresPlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	out := []platform.Cursor{}
+	err := p.withTx(func(tx *sql.Tx) error {
+		s, err := findStream(tx, streamId, false)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT `+CURSOR_COLUMNS+` FROM cursors WHERE stream_id = $1 ORDER BY created_at, id`, s.id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			c, err := scanCursor(rows)
+			if err != nil {
+				return err
+			}
+
+			out = append(out, *(c.toExt()))
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *PostgresPlatform) DeleteCursor(streamId string, cursorId string) error {
+	return p.withTx(func(tx *sql.Tx) error {
+		s, err := findStream(tx, streamId, false)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`DELETE FROM cursors WHERE id = $1 AND stream_id = $2`, cursorId, s.id)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if deleted == 0 {
+			return &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresPlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	var c *cursor
+	err := p.withTx(func(tx *sql.Tx) error {
+		s, source, err := findStreamCursor(tx, streamId, cursorId, false)
+		if err != nil {
+			return err
+		}
+
+		// The clone starts from the source's committed position. Any batch leased to the source stays with it.
+		c, err = insertCursor(tx, s.id, source.position, source.deadLetter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *PostgresPlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	if policy != nil {
+		err := policy.Validate(streamId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var c *cursor
+	err := p.withTx(func(tx *sql.Tx) error {
+		var err error
+		if policy != nil {
+			_, err = findStream(tx, policy.StreamId, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, c, err = findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		deadLetterStreamId, maxDeliveries := deadLetterColumns(policy)
+		_, err = tx.Exec(`UPDATE cursors SET dead_letter_stream_id = $2, max_deliveries = $3 WHERE id = $1`,
+			c.id, deadLetterStreamId, maxDeliveries)
+		if err != nil {
+			return err
+		}
+
+		c.deadLetter = copyPolicy(policy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func insertCursor(tx *sql.Tx, streamId string, position int64, deadLetter *platform.DeadLetterPolicy) (*cursor, error) {
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetterStreamId, maxDeliveries := deadLetterColumns(deadLetter)
+	_, err = tx.Exec(`INSERT INTO cursors (id, stream_id, created_at, position, dead_letter_stream_id, max_deliveries) VALUES ($1, $2, $3, $4, $5, $6)`,
+		id, streamId, now(), position, deadLetterStreamId, maxDeliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor{
+		id:         id,
+		streamId:   streamId,
+		position:   position,
+		deadLetter: copyPolicy(deadLetter)}, nil
+}
+
+// findStreamCursor looks up a cursor belonging to a stream, returning the matching platform error if either is
+// missing. With forUpdate, the cursor is locked until the transaction ends.
+func findStreamCursor(tx *sql.Tx, streamId string, cursorId string, forUpdate bool) (*stream, *cursor, error) {
+	s, err := findStream(tx, streamId, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := `SELECT ` + CURSOR_COLUMNS + ` FROM cursors WHERE id = $1 AND stream_id = $2`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	c, err := scanCursor(tx.QueryRow(query, cursorId, s.id))
+	if err == sql.ErrNoRows {
+		return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return s, c, nil
+}
+
+func scanCursor(row scanner) (*cursor, error) {
+	c := &cursor{}
+	var deadLetterStreamId, receipt sql.NullString
+	var maxDeliveries int
+	var leasedThrough sql.NullInt64
+	var leaseExpires pq.NullTime
+
+	err := row.Scan(&c.id, &c.streamId, &c.position, &deadLetterStreamId, &maxDeliveries, &receipt, &leasedThrough, &leaseExpires)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadLetterStreamId.Valid {
+		c.deadLetter = &platform.DeadLetterPolicy{
+			StreamId:      deadLetterStreamId.String,
+			MaxDeliveries: maxDeliveries}
+	}
+
+	if receipt.Valid {
+		c.lease = &lease{
+			receipt: receipt.String,
+			last:    leasedThrough.Int64,
+			expires: leaseExpires.Time}
+	}
+
+	return c, nil
+}
+
+// moveTo sets the cursor's committed position and releases its lease, forgetting the deliveries of the records
+// passed. With resetDeliveries, every delivery is forgotten, as the cursor may be moving backwards.
+func (c *cursor) moveTo(tx *sql.Tx, position int64, resetDeliveries bool) error {
+	_, err := tx.Exec(`UPDATE cursors SET position = $2, receipt = NULL, leased_through = NULL, lease_expires_at = NULL WHERE id = $1`, c.id, position)
+	if err != nil {
+		return err
+	}
+
+	if resetDeliveries {
+		_, err = tx.Exec(`DELETE FROM deliveries WHERE cursor_id = $1`, c.id)
+	} else {
+		_, err = tx.Exec(`DELETE FROM deliveries WHERE cursor_id = $1 AND sequence <= $2`, c.id, position)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.position = position
+	c.lease = nil
+
+	return nil
+}
+
+// release drops the cursor's lease so its batch is redelivered from the committed position.
+func (c *cursor) release(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE cursors SET receipt = NULL, leased_through = NULL, lease_expires_at = NULL WHERE id = $1`, c.id)
+	if err != nil {
+		return err
+	}
+
+	c.lease = nil
+	return nil
+}
+
+// markFailed records why the cursor's leased batch wasn't acknowledged.
+func (c *cursor) markFailed(tx *sql.Tx, reason string, message string) error {
+	if c.lease == nil {
+		return nil
+	}
+
+	_, err := tx.Exec(`UPDATE deliveries SET reason = $4, message = $5
+		WHERE cursor_id = $1 AND sequence > $2 AND sequence <= $3 AND NOT dead_lettered`,
+		c.id, c.position, c.lease.last, reason, message)
+	return err
+}
+
+// undelivered uncounts the delivery of each record in the cursor's leased batch.
+func (c *cursor) undelivered(tx *sql.Tx) error {
+	if c.lease == nil {
+		return nil
+	}
+
+	_, err := tx.Exec(`UPDATE deliveries SET delivery_count = delivery_count - 1
+		WHERE cursor_id = $1 AND sequence > $2 AND sequence <= $3 AND NOT dead_lettered`,
+		c.id, c.position, c.lease.last)
+	return err
+}
+
+func (c *cursor) toExt() *platform.Cursor {
+	return &platform.Cursor{
+		Id:         c.id,
+		StreamId:   c.streamId,
+		Position:   formatSequence(c.position),
+		DeadLetter: copyPolicy(c.deadLetter)}
+}
+
+// resolveStart finds the sequence a cursor should be positioned on for a start position, i.e. the last record
+// it will skip. 0 positions the cursor before the first record.
+func (s *stream) resolveStart(tx *sql.Tx, start *platform.StartPosition) (int64, error) {
+	err := start.Validate()
+	if err != nil {
+		return 0, err
+	}
+
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return 0, nil
+	case platform.START_AT_TIMESTAMP:
+		var first sql.NullInt64
+		err := tx.QueryRow(`SELECT MIN(sequence) FROM records WHERE stream_id = $1 AND created_at >= $2`, s.id, start.Timestamp).Scan(&first)
+		if err != nil {
+			return 0, err
+		} else if !first.Valid {
+			return s.lastSequence, nil
+		}
+
+		return first.Int64 - 1, nil
+	case platform.START_AFTER_RECORD_ID:
+		sequence, _, err := platform.ParseRecordId(s.id, start.RecordId)
+		if err != nil {
+			return 0, err
+		}
+
+		var exists bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM records WHERE stream_id = $1 AND sequence = $2)`, s.id, sequence).Scan(&exists)
+		if err != nil {
+			return 0, err
+		} else if !exists {
+			return 0, &platform.ErrRecordNotFound{RecordID: start.RecordId, StreamID: s.id}
+		}
+
+		return int64(sequence), nil
+	case platform.START_LAST:
+		position := s.lastSequence - int64(start.Count)
+		if position < 0 {
+			position = 0
+		}
+
+		return position, nil
+	}
+
+	return s.lastSequence, nil
+}
+
+// deadLetterColumns gives the values stored for a dead-letter policy.
+func deadLetterColumns(policy *platform.DeadLetterPolicy) (sql.NullString, int) {
+	if policy == nil {
+		return sql.NullString{}, 0
+	}
+
+	return sql.NullString{String: policy.StreamId, Valid: true}, policy.MaxDeliveries
+}
+
+func copyPolicy(policy *platform.DeadLetterPolicy) *platform.DeadLetterPolicy {
+	if policy == nil {
+		return nil
+	}
+
+	copied := *policy
+	return &copied
+}
+
+func formatSequence(sequence int64) string {
+	return strconv.FormatInt(sequence, 10)
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"os"
+	"testing"
+
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+// TEST_DATABASE_URL_ENV names the environment variable holding the database the tests run against. Every stream
+// in it is deleted before each test, so it mustn't be one that's in use.
+const TEST_DATABASE_URL_ENV = "TEST_DATABASE_URL"
+
+func TestConformance(t *testing.T) {
+	dataSource := os.Getenv(TEST_DATABASE_URL_ENV)
+	if dataSource == "" {
+		t.Skipf("Set %s to run the PostgreSQL tests", TEST_DATABASE_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(dataSource)
+	defer closeLast()
+
+	platformtest.Run(t, factory)
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	dataSource := os.Getenv(TEST_DATABASE_URL_ENV)
+	if dataSource == "" {
+		b.Skipf("Set %s to run the PostgreSQL benchmarks", TEST_DATABASE_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(dataSource)
+	defer closeLast()
+
+	platformtest.Benchmark(b, factory)
+}
+
+// emptyPlatforms returns a factory for platforms on an emptied database. Each platform is closed when the next is
+// made, so that the tests don't run the server out of connections, and closeLast closes the final one.
+func emptyPlatforms(dataSource string) (factory platform.Factory, closeLast func()) {
+	var last *PostgresPlatform
+
+	factory = func(opts platform.Options) (platform.Platform, error) {
+		if last != nil {
+			last.Close()
+		}
+
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		p := &PostgresPlatform{
+			DataSource:   dataSource,
+			LeaseTimeout: leaseTimeout}
+		last = p
+
+		db, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+
+		// Everything else belongs to a stream and goes with it
+		_, err = db.Exec("DELETE FROM streams")
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	closeLast = func() {
+		if last != nil {
+			last.Close()
+		}
+	}
+
+	return factory, closeLast
+}
@@ -0,0 +1,524 @@
+package postgres
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/oceanhq/streams/platform"
+)
+
+func (p *PostgresPlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec *platform.Record
+	err = p.withTx(func(tx *sql.Tx) error {
+		s, err := findWritableStream(tx, streamId)
+		if err != nil {
+			return err
+		}
+
+		err = s.forgetExpiredKeys(tx)
+		if err != nil {
+			return err
+		}
+
+		// A retried publish gets back the record it created the first time
+		rec, err = s.findIdempotentRecord(tx, idempotencyKey, content)
+		if rec != nil || err != nil {
+			return err
+		}
+
+		rec, err = s.appendRecord(tx, content, idempotencyKey)
+		if err != nil {
+			return err
+		}
+
+		return notify(tx, s.id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (p *PostgresPlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	results := make([]platform.RecordResult, len(contents))
+	err := p.withTx(func(tx *sql.Tx) error {
+		s, err := findWritableStream(tx, streamId)
+		if err != nil {
+			return err
+		}
+
+		err = s.forgetExpiredKeys(tx)
+		if err != nil {
+			return err
+		}
+
+		// Records are checked one at a time, so that a key repeated within the batch finds the record published
+		// for it earlier on. A database error leaves the transaction unusable, so it fails the whole batch.
+		for i, content := range contents {
+			key := ""
+			if idempotencyKeys != nil {
+				key = idempotencyKeys[i]
+			}
+
+			err := platform.ValidateIdempotencyKey(key)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+
+			original, err := s.findIdempotentRecord(tx, key, content)
+			if _, reused := err.(*platform.ErrIdempotencyKeyReused); reused {
+				results[i].Err = err
+				continue
+			} else if err != nil {
+				return err
+			} else if original != nil {
+				results[i].Record = original
+				continue
+			}
+
+			rec, err := s.appendRecord(tx, content, key)
+			if err != nil {
+				return err
+			}
+
+			results[i].Record = rec
+		}
+
+		return notify(tx, s.id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (p *PostgresPlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	var rec *platform.Record
+	err := p.withTx(func(tx *sql.Tx) error {
+		s, err := findStream(tx, streamId, false)
+		if err != nil {
+			return err
+		}
+
+		sequence, _, err := platform.ParseRecordId(s.id, recordId)
+		if err != nil {
+			return err
+		}
+
+		rec = &platform.Record{
+			StreamId: s.id,
+			Sequence: sequence}
+		err = tx.QueryRow(`SELECT content, content_hash, created_at FROM records WHERE stream_id = $1 AND sequence = $2`, s.id, sequence).
+			Scan(&rec.Content, &rec.ContentHash, &rec.Timestamp)
+		if err == sql.ErrNoRows {
+			return &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+		} else if err != nil {
+			return err
+		}
+
+		rec.Timestamp = rec.Timestamp.UTC()
+		rec.Id = platform.FormatRecordId(s.id, rec.Sequence, rec.Timestamp)
+
+		// An ID with the right sequence number but the wrong time doesn't refer to the record
+		if rec.Id != recordId {
+			return &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (p *PostgresPlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		// Take the stream's channel before reading, so a notification which arrives in between isn't missed
+		changed := p.changes(streamId)
+
+		res, retryAt, err := p.leaseRecords(streamId, cursorId)
+		if err != nil || len(res.Records) > 0 {
+			return res, err
+		}
+
+		// Nothing to hand out yet. Sleep until the stream changes, the cursor's lease runs out or it's time to give up.
+		current := time.Now()
+		if !current.Before(deadline) {
+			return res, nil
+		}
+
+		if retryAt.IsZero() || retryAt.After(deadline) {
+			retryAt = deadline
+		}
+
+		timer := time.NewTimer(retryAt.Sub(current))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// storedRecord is a record read back for a cursor, along with how often the cursor has been handed it.
+type storedRecord struct {
+	record       platform.Record
+	sequence     int64
+	deliveries   int
+	reason       string
+	message      string
+	deadLettered bool
+}
+
+// leaseRecords leases the cursor's next batch. When a batch is already leased and there's nothing to hand out
+// it also returns the time that lease expires.
+func (p *PostgresPlatform) leaseRecords(streamId string, cursorId string) (*platform.Batch, time.Time, error) {
+	var res *platform.Batch
+	var retryAt time.Time
+	err := p.withTx(func(tx *sql.Tx) error {
+		res = &platform.Batch{
+			Records: []platform.Record{}}
+
+		s, c, err := findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		// Only one batch is leased to a cursor at a time. Until it is acknowledged or the lease
+		// expires there is nothing more to hand out.
+		current := time.Now()
+		if c.lease != nil && current.Before(c.lease.expires) {
+			retryAt = c.lease.expires
+			return nil
+		}
+
+		// Any expired lease is dropped so its records are redelivered from the committed position.
+		if c.lease != nil {
+			err = c.markFailed(tx, platform.DEAD_LETTER_LEASE_EXPIRED, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		stored, err := readRecords(tx, s.id, c.id, c.position)
+		if err != nil {
+			return err
+		}
+
+		// Pass over any records which have run out of deliveries
+		last := c.position
+		delivered := []int64{}
+		for _, rec := range stored {
+			last = rec.sequence
+
+			skip, err := deadLetterRecord(tx, c, rec)
+			if err != nil {
+				return err
+			} else if skip {
+				continue
+			}
+
+			res.Records = append(res.Records, rec.record)
+			delivered = append(delivered, rec.sequence)
+		}
+
+		// Everything left was dead-lettered, so there's nothing to lease and the cursor moves straight past it
+		if len(res.Records) == 0 {
+			if last != c.position || c.lease != nil {
+				return c.moveTo(tx, last, false)
+			}
+
+			return nil
+		}
+
+		_, err = tx.Exec(`INSERT INTO deliveries (cursor_id, sequence, delivery_count) SELECT $1, sequence, 1 FROM unnest($2::bigint[]) AS sequence
+			ON CONFLICT (cursor_id, sequence) DO UPDATE SET delivery_count = deliveries.delivery_count + 1`,
+			c.id, pq.Array(delivered))
+		if err != nil {
+			return err
+		}
+
+		receipt, err := generateId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE cursors SET receipt = $2, leased_through = $3, lease_expires_at = $4 WHERE id = $1`,
+			c.id, receipt, last, current.Add(p.leaseTimeout()))
+		if err != nil {
+			return err
+		}
+
+		res.Receipt = receipt
+		return nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return res, retryAt, nil
+}
+
+// readRecords reads the next records after a cursor's position, with the cursor's deliveries of each.
+func readRecords(tx *sql.Tx, streamId string, cursorId string, position int64) ([]*storedRecord, error) {
+	rows, err := tx.Query(`SELECT r.sequence, r.content, r.content_hash, r.created_at,
+			COALESCE(d.delivery_count, 0), COALESCE(d.reason, ''), COALESCE(d.message, ''), COALESCE(d.dead_lettered, FALSE)
+		FROM records r LEFT JOIN deliveries d ON d.cursor_id = $2 AND d.sequence = r.sequence
+		WHERE r.stream_id = $1 AND r.sequence > $3
+		ORDER BY r.sequence
+		LIMIT $4`, streamId, cursorId, position, MAX_RECORDS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := []*storedRecord{}
+	for rows.Next() {
+		rec := &storedRecord{}
+		err := rows.Scan(&rec.sequence, &rec.record.Content, &rec.record.ContentHash, &rec.record.Timestamp,
+			&rec.deliveries, &rec.reason, &rec.message, &rec.deadLettered)
+		if err != nil {
+			return nil, err
+		}
+
+		rec.record.StreamId = streamId
+		rec.record.Sequence = uint64(rec.sequence)
+		rec.record.Timestamp = rec.record.Timestamp.UTC()
+		rec.record.Id = platform.FormatRecordId(streamId, rec.record.Sequence, rec.record.Timestamp)
+		stored = append(stored, rec)
+	}
+
+	return stored, rows.Err()
+}
+
+func (p *PostgresPlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	return p.withTx(func(tx *sql.Tx) error {
+		s, c, err := findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		// An expired lease can still be acknowledged as long as its records haven't been handed out again.
+		if c.lease == nil || c.lease.receipt != receipt {
+			return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		// Commit the cursor's progress and wake any read waiting on the lease
+		err = c.moveTo(tx, c.lease.last, false)
+		if err != nil {
+			return err
+		}
+
+		return notify(tx, s.id)
+	})
+}
+
+func (p *PostgresPlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	return p.withTx(func(tx *sql.Tx) error {
+		s, c, err := findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		if c.lease == nil || c.lease.receipt != receipt {
+			return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		// Release the lease so the batch is redelivered straight away
+		err = c.markFailed(tx, platform.DEAD_LETTER_NACKED, reason)
+		if err != nil {
+			return err
+		}
+
+		err = c.release(tx)
+		if err != nil {
+			return err
+		}
+
+		return notify(tx, s.id)
+	})
+}
+
+func (p *PostgresPlatform) ReleaseRecords(streamId string, cursorId string, receipt string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	return p.withTx(func(tx *sql.Tx) error {
+		s, c, err := findStreamCursor(tx, streamId, cursorId, true)
+		if err != nil {
+			return err
+		}
+
+		if c.lease == nil || c.lease.receipt != receipt {
+			return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		// Take back the batch's deliveries and release the lease so it's redelivered straight away
+		err = c.undelivered(tx)
+		if err != nil {
+			return err
+		}
+
+		err = c.release(tx)
+		if err != nil {
+			return err
+		}
+
+		return notify(tx, s.id)
+	})
+}
+
+// deadLetterRecord reports whether a record should be passed over by the cursor, publishing it to the cursor's
+// dead-letter stream if it has just run out of deliveries.
+func deadLetterRecord(tx *sql.Tx, c *cursor, rec *storedRecord) (bool, error) {
+	if rec.deliveries == 0 || c.deadLetter == nil {
+		return false, nil
+	} else if rec.deadLettered {
+		return true, nil
+	} else if rec.deliveries < c.deadLetter.MaxDeliveries {
+		return false, nil
+	}
+
+	// Keep delivering the record rather than lose it while the dead-letter stream is missing or deleted
+	target, err := findWritableStream(tx, c.deadLetter.StreamId)
+	switch err.(type) {
+	case nil:
+	case *platform.ErrStreamNotFound, *platform.ErrStreamDeleted:
+		return false, nil
+	default:
+		return false, err
+	}
+
+	reason := rec.reason
+	if reason == "" {
+		reason = platform.DEAD_LETTER_LEASE_EXPIRED
+	}
+
+	content, err := platform.NewDeadLetter(&rec.record, c.id, reason, rec.message, rec.deliveries).Encode()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = target.appendRecord(tx, content, "")
+	if err != nil {
+		return false, err
+	}
+
+	err = notify(tx, target.id)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE deliveries SET dead_lettered = TRUE WHERE cursor_id = $1 AND sequence = $2`, c.id, rec.sequence)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// appendRecord adds a record to the end of a stream locked by the transaction, remembering its idempotency key
+// if it has one. Holding the lock until the transaction commits means records become visible in sequence order.
+func (s *stream) appendRecord(tx *sql.Tx, content []byte, key string) (*platform.Record, error) {
+	err := tx.QueryRow(`UPDATE streams SET last_sequence = last_sequence + 1 WHERE id = $1 RETURNING last_sequence`, s.id).Scan(&s.lastSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &platform.Record{
+		StreamId:    s.id,
+		Sequence:    uint64(s.lastSequence),
+		Content:     content,
+		ContentHash: hashContent(content),
+		Timestamp:   now()}
+	rec.Id = platform.FormatRecordId(s.id, rec.Sequence, rec.Timestamp)
+
+	_, err = tx.Exec(`INSERT INTO records (stream_id, sequence, content, content_hash, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		s.id, s.lastSequence, rec.Content, rec.ContentHash, rec.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		// An expired key may linger if it ran out after forgetExpiredKeys, so it's replaced
+		_, err = tx.Exec(`INSERT INTO idempotency_keys (stream_id, idempotency_key, sequence, expires_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (stream_id, idempotency_key) DO UPDATE SET sequence = EXCLUDED.sequence, expires_at = EXCLUDED.expires_at`,
+			s.id, key, s.lastSequence, rec.Timestamp.Add(s.dedupeWindowOrDefault()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rec, nil
+}
+
+// findIdempotentRecord returns the record already published with key, if any. Reusing a key with different
+// content is an error.
+func (s *stream) findIdempotentRecord(tx *sql.Tx, key string, content []byte) (*platform.Record, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	var sequence int64
+	rec := &platform.Record{
+		StreamId: s.id}
+	err := tx.QueryRow(`SELECT r.sequence, r.content, r.content_hash, r.created_at
+		FROM idempotency_keys k JOIN records r ON r.stream_id = k.stream_id AND r.sequence = k.sequence
+		WHERE k.stream_id = $1 AND k.idempotency_key = $2 AND k.expires_at > $3`, s.id, key, now()).
+		Scan(&sequence, &rec.Content, &rec.ContentHash, &rec.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(rec.ContentHash, hashContent(content)) {
+		return nil, &platform.ErrIdempotencyKeyReused{IdempotencyKey: key, StreamID: s.id}
+	}
+
+	rec.Sequence = uint64(sequence)
+	rec.Timestamp = rec.Timestamp.UTC()
+	rec.Id = platform.FormatRecordId(s.id, rec.Sequence, rec.Timestamp)
+
+	return rec, nil
+}
+
+// forgetExpiredKeys drops the stream's keys whose dedupe window has passed.
+func (s *stream) forgetExpiredKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM idempotency_keys WHERE stream_id = $1 AND expires_at <= $2`, s.id, now())
+	return err
+}
+
+func hashContent(content []byte) []byte {
+	h := sha1.New()
+	h.Write(content)
+	return h.Sum(nil)
+}
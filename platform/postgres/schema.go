@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MIGRATION_LOCK_ID is the advisory lock held while migrating, so that nodes starting together take turns.
+const MIGRATION_LOCK_ID = 0x6f6365616e // "ocean"
+
+// migrations bring the database schema up to date. Each is applied once, in order, and recorded in
+// schema_migrations. A migration which has been released must never be edited; add another instead.
+var migrations = []string{
+	// 1: streams, records, idempotency keys, cursors and their deliveries
+	`CREATE TABLE streams (
+		id text PRIMARY KEY,
+		name text NOT NULL,
+		created_at timestamptz NOT NULL,
+		deleted_at timestamptz,
+		purge_at timestamptz,
+		-- in nanoseconds, 0 for the default
+		dedupe_window bigint NOT NULL DEFAULT 0,
+		-- the sequence of the stream's latest record, 0 while it has none
+		last_sequence bigint NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE records (
+		stream_id text NOT NULL REFERENCES streams ON DELETE CASCADE,
+		sequence bigint NOT NULL,
+		content bytea NOT NULL,
+		content_hash bytea NOT NULL,
+		created_at timestamptz NOT NULL,
+		PRIMARY KEY (stream_id, sequence)
+	);
+
+	CREATE INDEX records_created_at ON records (stream_id, created_at);
+
+	CREATE TABLE idempotency_keys (
+		stream_id text NOT NULL REFERENCES streams ON DELETE CASCADE,
+		idempotency_key text NOT NULL,
+		sequence bigint NOT NULL,
+		expires_at timestamptz NOT NULL,
+		PRIMARY KEY (stream_id, idempotency_key)
+	);
+
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (stream_id, expires_at);
+
+	CREATE TABLE cursors (
+		id text PRIMARY KEY,
+		stream_id text NOT NULL REFERENCES streams ON DELETE CASCADE,
+		created_at timestamptz NOT NULL,
+		-- the sequence of the last record the cursor has committed, 0 before the first
+		position bigint NOT NULL,
+		dead_letter_stream_id text,
+		max_deliveries integer NOT NULL DEFAULT 0,
+		-- set while a batch is leased to the cursor
+		receipt text,
+		leased_through bigint,
+		lease_expires_at timestamptz
+	);
+
+	CREATE INDEX cursors_stream_id ON cursors (stream_id);
+
+	CREATE TABLE deliveries (
+		cursor_id text NOT NULL REFERENCES cursors ON DELETE CASCADE,
+		sequence bigint NOT NULL,
+		delivery_count integer NOT NULL,
+		reason text NOT NULL DEFAULT '',
+		message text NOT NULL DEFAULT '',
+		dead_lettered boolean NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (cursor_id, sequence)
+	);`,
+}
+
+// migrate applies any migrations the database hasn't seen yet, all in one transaction.
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = applyMigrations(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func applyMigrations(tx *sql.Tx) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, MIGRATION_LOCK_ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("The database schema is at version %d, which is newer than this build knows about (%d).", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			return fmt.Errorf("Error applying migration %d: %s", i+1, err)
+		}
+
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, i+1, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package platform
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// Record IDs are 128-bit values written as 26 characters of Crockford's base32, in the manner of a ULID. The
+// first 48 bits are the record's timestamp in milliseconds since the Unix epoch, so IDs sort by time across
+// streams. The rest hold a 32-bit hash of the stream's ID and the record's sequence number, so that IDs are
+// unique and, so long as a stream's timestamps don't go backwards, sort by sequence within a stream.
+//
+// IDs are only unique within a stream. Two streams whose IDs hash alike can give a record the same ID if they
+// number it alike in the same millisecond, so the hash only turns away most IDs from other streams. Records must
+// always be looked up by stream ID and record ID together, never by record ID alone.
+const (
+	RECORD_ID_LENGTH = 26
+	MAX_SEQUENCE     = 1<<48 - 1
+
+	recordIdAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// FormatRecordId gives the ID of the record with the given sequence number and timestamp in a stream.
+func FormatRecordId(streamId string, sequence uint64, timestamp time.Time) string {
+	ms := uint64(timestamp.UnixNano() / int64(time.Millisecond))
+
+	hi := ms<<16 | uint64(streamHash(streamId))>>16
+	lo := uint64(streamHash(streamId))<<48 | sequence&MAX_SEQUENCE
+
+	// 26 characters of 5 bits hold 130 bits, so the first character only carries the top 3
+	b := make([]byte, RECORD_ID_LENGTH)
+	for i := RECORD_ID_LENGTH - 1; i >= 0; i-- {
+		b[i] = recordIdAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(b)
+}
+
+// ParseRecordId returns the sequence number of the record a stream's record ID refers to, along with its
+// timestamp to the millisecond. As with ULIDs, IDs are read without regard to case. IDs which are malformed or
+// whose hash is another stream's can't refer to any of the stream's records, so they give an *ErrRecordNotFound.
+func ParseRecordId(streamId string, recordId string) (uint64, time.Time, error) {
+	notFound := &ErrRecordNotFound{RecordID: recordId, StreamID: streamId}
+	if len(recordId) != RECORD_ID_LENGTH {
+		return 0, time.Time{}, notFound
+	}
+
+	var hi, lo uint64
+	for i, c := range strings.ToUpper(recordId) {
+		n := strings.IndexRune(recordIdAlphabet, c)
+		if n < 0 || (i == 0 && n > 7) {
+			return 0, time.Time{}, notFound
+		}
+
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(n)
+	}
+
+	ms := hi >> 16
+	hash := uint32(hi<<16 | lo>>48)
+	sequence := lo & MAX_SEQUENCE
+	if hash != streamHash(streamId) || sequence == 0 {
+		return 0, time.Time{}, notFound
+	}
+
+	return sequence, time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC(), nil
+}
+
+func streamHash(streamId string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(streamId))
+
+	return h.Sum32()
+}
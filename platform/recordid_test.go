@@ -0,0 +1,39 @@
+package platform
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecordId(t *testing.T) {
+	timestamp := time.Date(2024, 3, 1, 12, 30, 45, 123000000, time.UTC)
+	id := FormatRecordId("stream-1", 42, timestamp)
+
+	// IDs are case insensitive, so a lowercased ID refers to the same record
+	for _, recordId := range []string{id, strings.ToLower(id)} {
+		sequence, ts, err := ParseRecordId("stream-1", recordId)
+		if err != nil {
+			t.Fatalf("ParseRecordId(%q) returned %v", recordId, err)
+		}
+		if sequence != 42 || !ts.Equal(timestamp) {
+			t.Errorf("ParseRecordId(%q) = %d, %s, want 42, %s", recordId, sequence, ts, timestamp)
+		}
+	}
+}
+
+func TestParseRecordIdNotFound(t *testing.T) {
+	id := FormatRecordId("stream-1", 42, time.Now())
+
+	for _, recordId := range []string{"", id[1:], "8" + id[1:], id[:25] + "U", FormatRecordId("stream-1", 0, time.Now())} {
+		_, _, err := ParseRecordId("stream-1", recordId)
+		if _, ok := err.(*ErrRecordNotFound); !ok {
+			t.Errorf("ParseRecordId(%q) returned %v, want *ErrRecordNotFound", recordId, err)
+		}
+	}
+
+	_, _, err := ParseRecordId("stream-2", id)
+	if _, ok := err.(*ErrRecordNotFound); !ok {
+		t.Errorf("ParseRecordId on another stream returned %v, want *ErrRecordNotFound", err)
+	}
+}
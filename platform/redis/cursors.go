@@ -0,0 +1,465 @@
+package redis
+
+import (
+	"encoding/json"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oceanhq/streams/platform"
+)
+
+type cursor struct {
+	id       string
+	streamId string
+	state    cursorState
+}
+
+// cursorState is the cursor's hash. Position is the ID of the last record the cursor has committed, or
+// BEFORE_FIRST_ID. Receipt is empty unless a batch is leased to the cursor.
+type cursorState struct {
+	CreatedAt          int64  `redis:"createdAt"`
+	Position           string `redis:"position"`
+	DeadLetterStreamId string `redis:"deadLetterStreamId"`
+	MaxDeliveries      int    `redis:"maxDeliveries"`
+	Receipt            string `redis:"receipt"`
+	LeasedThrough      string `redis:"leasedThrough"`
+	LeaseExpires       int64  `redis:"leaseExpires"`
+}
+
+// delivery is kept in the cursor's deliveries hash, under the ID of a record past its committed position.
+type delivery struct {
+	Count        int    `json:"count"`
+	Reason       string `json:"reason,omitempty"`
+	Message      string `json:"message,omitempty"`
+	DeadLettered bool   `json:"deadLettered,omitempty"`
+}
+
+func (p *RedisPlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	position, err := s.resolveStart(conn, &start)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := insertCursor(conn, s.id, position, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *RedisPlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	var c *cursor
+	err := update(func() (bool, error) {
+		var s *stream
+		var err error
+		s, c, err = findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		target, err := s.resolveStart(conn, &position)
+		if err != nil {
+			return false, err
+		}
+
+		// Any outstanding batch is abandoned; its receipt can no longer be acknowledged.
+		c.state.Position = target
+		c.release()
+
+		conn.Send("MULTI")
+		c.sendState(conn)
+		conn.Send("DEL", deliveriesKey(c.streamId, c.id))
+		return exec(conn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *RedisPlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	_, c, err := findStreamCursor(conn, streamId, cursorId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *RedisPlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := redigo.Strings(conn.Do("ZRANGE", cursorsKey(s.id), 0, -1))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	for _, id := range ids {
+		conn.Send("HGETALL", cursorKey(s.id, id))
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	out := []platform.Cursor{}
+	for _, id := range ids {
+		reply, err := conn.Receive()
+		c, err := scanCursor(s.id, id, reply, err)
+		if err != nil {
+			return nil, unavailable(err)
+		} else if c != nil {
+			out = append(out, *(c.toExt()))
+		}
+	}
+
+	return out, nil
+}
+
+func (p *RedisPlatform) DeleteCursor(streamId string, cursorId string) error {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return err
+	}
+
+	removed, err := redigo.Int(conn.Do("ZREM", cursorsKey(s.id), cursorId))
+	if err != nil {
+		return unavailable(err)
+	} else if removed == 0 {
+		return &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	_, err = conn.Do("DEL", cursorKey(s.id, cursorId), deliveriesKey(s.id, cursorId))
+
+	return unavailable(err)
+}
+
+func (p *RedisPlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, source, err := findStreamCursor(conn, streamId, cursorId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The clone starts from the source's committed position. Any batch leased to the source stays with it.
+	c, err := insertCursor(conn, s.id, source.state.Position, source.deadLetter())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func (p *RedisPlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	if policy != nil {
+		err := policy.Validate(streamId)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = findStream(conn, policy.StreamId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var c *cursor
+	err := update(func() (bool, error) {
+		var err error
+		_, c, err = findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		c.setDeadLetter(policy)
+
+		conn.Send("MULTI")
+		c.sendState(conn)
+		return exec(conn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toExt(), nil
+}
+
+func insertCursor(conn redigo.Conn, streamId string, position string, deadLetter *platform.DeadLetterPolicy) (*cursor, error) {
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cursor{
+		id:       id,
+		streamId: streamId,
+		state: cursorState{
+			CreatedAt: time.Now().UnixNano(),
+			Position:  position}}
+	c.setDeadLetter(deadLetter)
+
+	conn.Send("MULTI")
+	c.sendState(conn)
+	conn.Send("ZADD", cursorsKey(streamId), c.state.CreatedAt/int64(time.Millisecond), id)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return c, nil
+}
+
+// findStreamCursor looks up a cursor belonging to a stream, returning the matching platform error if either is
+// missing. With watch, the cursor's keys are watched so that a transaction changing it fails if another client
+// changes it first.
+func findStreamCursor(conn redigo.Conn, streamId string, cursorId string, watch bool) (*stream, *cursor, error) {
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if watch {
+		_, err = conn.Do("WATCH", cursorKey(s.id, cursorId), deliveriesKey(s.id, cursorId))
+		if err != nil {
+			return nil, nil, unavailable(err)
+		}
+	}
+
+	reply, err := conn.Do("HGETALL", cursorKey(s.id, cursorId))
+	c, err := scanCursor(s.id, cursorId, reply, err)
+	if err != nil {
+		return nil, nil, unavailable(err)
+	} else if c == nil {
+		return nil, nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	return s, c, nil
+}
+
+// scanCursor reads a cursor from the reply to HGETALL on its hash. A nil cursor means it doesn't exist.
+func scanCursor(streamId string, cursorId string, reply interface{}, err error) (*cursor, error) {
+	values, err := redigo.Values(reply, err)
+	if err != nil {
+		return nil, err
+	} else if len(values) == 0 {
+		return nil, nil
+	}
+
+	c := &cursor{
+		id:       cursorId,
+		streamId: streamId}
+	err = redigo.ScanStruct(values, &c.state)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadDeliveries reads the cursor's deliveries hash, keyed by record ID.
+func (c *cursor) loadDeliveries(conn redigo.Conn) (map[string]*delivery, error) {
+	values, err := redigo.StringMap(conn.Do("HGETALL", deliveriesKey(c.streamId, c.id)))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := map[string]*delivery{}
+	for id, value := range values {
+		d := &delivery{}
+		err = json.Unmarshal([]byte(value), d)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries[id] = d
+	}
+
+	return deliveries, nil
+}
+
+// sendState queues the cursor's hash to be written.
+func (c *cursor) sendState(conn redigo.Conn) {
+	conn.Send("HMSET", redigo.Args{}.Add(cursorKey(c.streamId, c.id)).AddFlat(&c.state)...)
+}
+
+// sendDelivery queues a delivery to be written.
+func (c *cursor) sendDelivery(conn redigo.Conn, recordId string, d *delivery) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return conn.Send("HSET", deliveriesKey(c.streamId, c.id), recordId, value)
+}
+
+// sendForgetDeliveries queues the removal of the deliveries of records up to and including last.
+func (c *cursor) sendForgetDeliveries(conn redigo.Conn, deliveries map[string]*delivery, last entryId) {
+	args := redigo.Args{}.Add(deliveriesKey(c.streamId, c.id))
+	for recordId := range deliveries {
+		id, err := parseEntryId(recordId)
+		if err != nil || !last.before(id) {
+			args = args.Add(recordId)
+		}
+	}
+
+	if len(args) > 1 {
+		conn.Send("HDEL", args...)
+	}
+}
+
+// markFailed records why the cursor's leased batch wasn't acknowledged, returning the deliveries it changed.
+func (c *cursor) markFailed(deliveries map[string]*delivery, reason string, message string) map[string]*delivery {
+	changed := map[string]*delivery{}
+	if c.state.Receipt == "" {
+		return changed
+	}
+
+	position, _ := parseEntryId(c.state.Position)
+	last, _ := parseEntryId(c.state.LeasedThrough)
+	for recordId, d := range deliveries {
+		id, err := parseEntryId(recordId)
+		if err == nil && position.before(id) && !last.before(id) && !d.DeadLettered {
+			d.Reason = reason
+			d.Message = message
+			changed[recordId] = d
+		}
+	}
+
+	return changed
+}
+
+// undelivered uncounts the delivery of each record in the cursor's leased batch, returning the deliveries it changed.
+func (c *cursor) undelivered(deliveries map[string]*delivery) map[string]*delivery {
+	changed := map[string]*delivery{}
+	if c.state.Receipt == "" {
+		return changed
+	}
+
+	position, _ := parseEntryId(c.state.Position)
+	last, _ := parseEntryId(c.state.LeasedThrough)
+	for recordId, d := range deliveries {
+		id, err := parseEntryId(recordId)
+		if err == nil && position.before(id) && !last.before(id) && !d.DeadLettered {
+			d.Count--
+			changed[recordId] = d
+		}
+	}
+
+	return changed
+}
+
+// leased reports whether a batch is leased to the cursor which hasn't expired yet.
+func (c *cursor) leased(now time.Time) bool {
+	return c.state.Receipt != "" && now.UnixNano() < c.state.LeaseExpires
+}
+
+func (c *cursor) release() {
+	c.state.Receipt = ""
+	c.state.LeasedThrough = ""
+	c.state.LeaseExpires = 0
+}
+
+func (c *cursor) deadLetter() *platform.DeadLetterPolicy {
+	if c.state.DeadLetterStreamId == "" {
+		return nil
+	}
+
+	return &platform.DeadLetterPolicy{
+		StreamId:      c.state.DeadLetterStreamId,
+		MaxDeliveries: c.state.MaxDeliveries}
+}
+
+func (c *cursor) setDeadLetter(policy *platform.DeadLetterPolicy) {
+	if policy == nil {
+		c.state.DeadLetterStreamId = ""
+		c.state.MaxDeliveries = 0
+		return
+	}
+
+	c.state.DeadLetterStreamId = policy.StreamId
+	c.state.MaxDeliveries = policy.MaxDeliveries
+}
+
+func (c *cursor) toExt() *platform.Cursor {
+	return &platform.Cursor{
+		Id:         c.id,
+		StreamId:   c.streamId,
+		Position:   c.state.Position,
+		DeadLetter: c.deadLetter()}
+}
+
+// resolveStart finds the ID a cursor should be positioned on for a start position, i.e. the last record it will
+// skip. BEFORE_FIRST_ID positions the cursor before the first record.
+func (s *stream) resolveStart(conn redigo.Conn, start *platform.StartPosition) (string, error) {
+	err := start.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return BEFORE_FIRST_ID, nil
+	case platform.START_AT_TIMESTAMP:
+		// The last record from before the timestamp
+		ms := start.Timestamp.UnixNano() / int64(time.Millisecond)
+		if ms <= 0 {
+			return BEFORE_FIRST_ID, nil
+		}
+
+		return s.lastIdBefore(conn, entryId{ms: uint64(ms)}.previous().String(), 0)
+	case platform.START_AFTER_RECORD_ID:
+		e, err := s.findEntry(conn, start.RecordId)
+		if err != nil {
+			return "", err
+		}
+
+		return e.id, nil
+	case platform.START_LAST:
+		return s.lastIdBefore(conn, "+", start.Count)
+	}
+
+	return s.lastIdBefore(conn, "+", 0)
+}
+
+// lastIdBefore finds the ID of the record skip records back from the last one at or before end, or
+// BEFORE_FIRST_ID if there are too few.
+func (s *stream) lastIdBefore(conn redigo.Conn, end string, skip int) (string, error) {
+	entries, err := readEntries(conn.Do("XREVRANGE", recordsKey(s.id), end, "-", "COUNT", skip+1))
+	if err != nil {
+		return "", unavailable(err)
+	} else if len(entries) <= skip {
+		return BEFORE_FIRST_ID, nil
+	}
+
+	return entries[skip].id, nil
+}
@@ -0,0 +1,704 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oceanhq/streams/platform"
+)
+
+// BEFORE_FIRST_ID is the position of a cursor which hasn't passed any records. Redis never gives it to an entry.
+const BEFORE_FIRST_ID = "0-0"
+
+// CONTENT_FIELD is the field of a stream entry holding the record's content.
+const CONTENT_FIELD = "content"
+
+// Replies from publishScript
+const (
+	PUBLISHED          = 1
+	PUBLISHED_EARLIER  = 0
+	PUBLISH_NOT_FOUND  = -1
+	PUBLISH_TO_DELETED = -2
+)
+
+// publishScript appends a record to a stream unless its idempotency key has been used, doing both at once so that
+// a retry racing the original can't publish twice. The stream's hash is checked too, so records are never added
+// to a stream which has been deleted.
+//
+// The entry is added with the ID "<milliseconds>-<sequence>", taking the next sequence number from the stream's
+// hash. The time is never earlier than the last record's, so entry IDs always increase even if clocks differ.
+//
+// KEYS are the stream's hash, its records and the idempotency key's key, which is empty if it has none. ARGV
+// are the content, its hash in hex, the dedupe window in milliseconds and the time in milliseconds. The reply is
+// PUBLISHED and the new record's entry ID, PUBLISHED_EARLIER and the entry ID and hash stored with the key, or
+// PUBLISH_NOT_FOUND or PUBLISH_TO_DELETED.
+var publishScript = redigo.NewScript(3, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {-1}
+end
+local deletedAt = redis.call("HGET", KEYS[1], "deletedAt")
+if deletedAt and deletedAt ~= "0" then
+	return {-2}
+end
+if KEYS[3] ~= "" then
+	local existing = redis.call("GET", KEYS[3])
+	if existing then
+		return {0, existing}
+	end
+end
+local ms = tonumber(ARGV[4])
+local lastMs = tonumber(redis.call("HGET", KEYS[1], "lastMs") or "0")
+if ms < lastMs then
+	ms = lastMs
+end
+local seq = redis.call("HINCRBY", KEYS[1], "lastSequence", 1)
+redis.call("HSET", KEYS[1], "lastMs", ms)
+local id = redis.call("XADD", KEYS[2], string.format("%d-%d", ms, seq), "content", ARGV[1])
+if KEYS[3] ~= "" then
+	redis.call("SET", KEYS[3], id .. " " .. ARGV[2], "PX", ARGV[3])
+end
+return {1, id}
+`)
+
+// entry is a record read from a stream.
+type entry struct {
+	id      string
+	content []byte
+}
+
+// entryId is a parsed Redis stream entry ID, "<milliseconds>-<sequence>".
+type entryId struct {
+	ms  uint64
+	seq uint64
+}
+
+func (p *RedisPlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findWritableStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := publishScript.Do(conn, s.publishArgs(content, idempotencyKey)...)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return s.published(conn, reply, content, idempotencyKey)
+}
+
+func (p *RedisPlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findWritableStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = publishScript.Load(conn)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	// Every record is sent in one pipeline. The script runs for each in turn, so a key repeated within the batch
+	// finds the record published for it earlier on.
+	results := make([]platform.RecordResult, len(contents))
+	keys := make([]string, len(contents))
+	sent := []int{}
+	for i := range contents {
+		if idempotencyKeys != nil {
+			keys[i] = idempotencyKeys[i]
+		}
+
+		err := platform.ValidateIdempotencyKey(keys[i])
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		err = publishScript.SendHash(conn, s.publishArgs(contents[i], keys[i])...)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		sent = append(sent, i)
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	replies := make([]interface{}, len(contents))
+	for _, i := range sent {
+		reply, err := conn.Receive()
+		if _, ok := err.(redigo.Error); ok {
+			results[i].Err = err
+			continue
+		} else if err != nil {
+			return nil, unavailable(err)
+		}
+
+		replies[i] = reply
+	}
+
+	// Fetching the originals of retried records has to wait until the pipeline has been read
+	for _, i := range sent {
+		if replies[i] != nil {
+			rec, err := s.published(conn, replies[i], contents[i], keys[i])
+			results[i] = platform.RecordResult{Record: rec, Err: err}
+		}
+	}
+
+	return results, nil
+}
+
+// publishArgs gives the keys and arguments to publishScript for a record.
+func (s *stream) publishArgs(content []byte, key string) []interface{} {
+	keyKey := ""
+	if key != "" {
+		keyKey = idempotencyKey(s.id, key)
+	}
+
+	return redigo.Args{}.
+		Add(metaKey(s.id), recordsKey(s.id), keyKey).
+		Add(content, hex.EncodeToString(hashContent(content)), int64(s.dedupeWindow()/time.Millisecond)).
+		Add(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// published turns publishScript's reply into the record that was published, or the one published earlier with
+// the same idempotency key.
+func (s *stream) published(conn redigo.Conn, reply interface{}, content []byte, key string) (*platform.Record, error) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("Unexpected reply publishing to stream %s: %v", s.id, reply)
+	}
+
+	status, err := redigo.Int(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case PUBLISH_NOT_FOUND:
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: s.id}
+	case PUBLISH_TO_DELETED:
+		return nil, &platform.ErrStreamDeleted{StreamID: s.id, PurgeAt: s.purgeAt()}
+	}
+
+	value, err := redigo.String(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == PUBLISHED {
+		return (&entry{id: value, content: content}).toExt(s.id), nil
+	}
+
+	// A retried publish gets back the record it created the first time
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 || parts[1] != hex.EncodeToString(hashContent(content)) {
+		return nil, &platform.ErrIdempotencyKeyReused{IdempotencyKey: key, StreamID: s.id}
+	}
+
+	entries, err := readEntries(conn.Do("XRANGE", recordsKey(s.id), parts[0], parts[0]))
+	if err != nil {
+		return nil, unavailable(err)
+	} else if len(entries) == 0 {
+		return nil, &platform.ErrRecordNotFound{RecordID: parts[0], StreamID: s.id}
+	}
+
+	return entries[0].toExt(s.id), nil
+}
+
+func (p *RedisPlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := s.findEntry(conn, recordId)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.toExt(s.id), nil
+}
+
+func (p *RedisPlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		res, after, retryAt, err := p.leaseRecords(streamId, cursorId)
+		if err != nil || len(res.Records) > 0 {
+			return res, err
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			return res, nil
+		}
+
+		// A batch is already leased. Sleep until it runs out, checking back in case another server has it acknowledged.
+		if after == "" {
+			until := now.Add(LEASE_POLL_INTERVAL)
+			if retryAt.Before(until) {
+				until = retryAt
+			}
+			if deadline.Before(until) {
+				until = deadline
+			}
+
+			time.Sleep(until.Sub(now))
+			continue
+		}
+
+		// Otherwise block until a record is added after the cursor's position
+		err = p.waitForRecords(streamId, after, deadline.Sub(now))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitForRecords blocks until a record is added to a stream after the ID after, or until wait is up.
+func (p *RedisPlatform) waitForRecords(streamId string, after string, wait time.Duration) error {
+	conn := p.conn()
+	defer conn.Close()
+
+	ms := int64(wait / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+
+	_, err := conn.Do("XREAD", "COUNT", 1, "BLOCK", ms, "STREAMS", recordsKey(streamId), after)
+	return unavailable(err)
+}
+
+// leaseRecords leases the cursor's next batch. When there's nothing to hand out, it also returns either the
+// cursor's position to wait for records after or, if a batch is already leased, the time that lease expires.
+func (p *RedisPlatform) leaseRecords(streamId string, cursorId string) (*platform.Batch, string, time.Time, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	var res *platform.Batch
+	var after string
+	var retryAt time.Time
+	err := update(func() (bool, error) {
+		res = &platform.Batch{
+			Records: []platform.Record{}}
+		after = ""
+		retryAt = time.Time{}
+
+		s, c, err := findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		// Only one batch is leased to a cursor at a time. Until it is acknowledged or the lease
+		// expires there is nothing more to hand out.
+		now := time.Now()
+		if c.leased(now) {
+			retryAt = time.Unix(0, c.state.LeaseExpires)
+			return true, nil
+		}
+
+		deliveries, err := c.loadDeliveries(conn)
+		if err != nil {
+			return false, err
+		}
+
+		// Any expired lease is dropped so its records are redelivered from the committed position.
+		expired := c.state.Receipt != ""
+		changed := c.markFailed(deliveries, platform.DEAD_LETTER_LEASE_EXPIRED, "")
+		c.release()
+
+		position, err := parseEntryId(c.state.Position)
+		if err != nil {
+			return false, err
+		}
+
+		entries, err := readEntries(conn.Do("XRANGE", recordsKey(s.id), position.next().String(), "+", "COUNT", MAX_RECORDS))
+		if err != nil {
+			return false, err
+		}
+
+		// The dead-letter stream is looked up before the transaction starts
+		var target *stream
+		if policy := c.deadLetter(); policy != nil {
+			target, err = deadLetterStream(conn, policy.StreamId)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		conn.Send("MULTI")
+
+		// Pass over any records which have run out of deliveries
+		last := c.state.Position
+		for _, e := range entries {
+			last = e.id
+			d := deliveries[e.id]
+			if d == nil {
+				d = &delivery{}
+			}
+
+			skip, err := c.deadLetterRecord(conn, target, e, d)
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			} else if skip {
+				delete(changed, e.id)
+				continue
+			}
+
+			res.Records = append(res.Records, *e.toExt(s.id))
+			d.Count++
+			changed[e.id] = d
+		}
+
+		for recordId, d := range changed {
+			err = c.sendDelivery(conn, recordId, d)
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			}
+		}
+
+		if len(res.Records) == 0 {
+			// Everything left was dead-lettered, so there's nothing to lease and the cursor moves straight past it
+			if last != c.state.Position || expired {
+				lastId, _ := parseEntryId(last)
+				c.state.Position = last
+				c.sendForgetDeliveries(conn, deliveries, lastId)
+				c.sendState(conn)
+			}
+			after = last
+		} else {
+			receipt, err := generateId()
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			}
+
+			c.state.Receipt = receipt
+			c.state.LeasedThrough = last
+			c.state.LeaseExpires = now.Add(p.leaseTimeout()).UnixNano()
+			c.sendState(conn)
+			res.Receipt = receipt
+		}
+
+		return exec(conn)
+	})
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	return res, after, retryAt, nil
+}
+
+func (p *RedisPlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	return update(func() (bool, error) {
+		_, c, err := findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		// An expired lease can still be acknowledged as long as its records haven't been handed out again.
+		if c.state.Receipt != receipt {
+			return false, &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		deliveries, err := c.loadDeliveries(conn)
+		if err != nil {
+			return false, err
+		}
+
+		last, err := parseEntryId(c.state.LeasedThrough)
+		if err != nil {
+			return false, err
+		}
+
+		// Commit the cursor's progress, forgetting the deliveries of the records it has passed
+		c.state.Position = c.state.LeasedThrough
+		c.release()
+
+		conn.Send("MULTI")
+		c.sendForgetDeliveries(conn, deliveries, last)
+		c.sendState(conn)
+		return exec(conn)
+	})
+}
+
+func (p *RedisPlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	return update(func() (bool, error) {
+		_, c, err := findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		if c.state.Receipt != receipt {
+			return false, &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		deliveries, err := c.loadDeliveries(conn)
+		if err != nil {
+			return false, err
+		}
+
+		// Release the lease so the batch is redelivered straight away
+		changed := c.markFailed(deliveries, platform.DEAD_LETTER_NACKED, reason)
+		c.release()
+
+		conn.Send("MULTI")
+		for recordId, d := range changed {
+			err = c.sendDelivery(conn, recordId, d)
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			}
+		}
+		c.sendState(conn)
+		return exec(conn)
+	})
+}
+
+func (p *RedisPlatform) ReleaseRecords(streamId string, cursorId string, receipt string) error {
+	if receipt == "" {
+		return &platform.ErrInvalidParam{Param: "receipt", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	return update(func() (bool, error) {
+		_, c, err := findStreamCursor(conn, streamId, cursorId, true)
+		if err != nil {
+			return false, err
+		}
+
+		if c.state.Receipt != receipt {
+			return false, &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+		}
+
+		deliveries, err := c.loadDeliveries(conn)
+		if err != nil {
+			return false, err
+		}
+
+		// Take back the batch's deliveries and release the lease so it's redelivered straight away
+		changed := c.undelivered(deliveries)
+		c.release()
+
+		conn.Send("MULTI")
+		for recordId, d := range changed {
+			err = c.sendDelivery(conn, recordId, d)
+			if err != nil {
+				conn.Do("DISCARD")
+				return false, err
+			}
+		}
+		c.sendState(conn)
+		return exec(conn)
+	})
+}
+
+// deadLetterRecord reports whether a record should be passed over by the cursor, queueing its publication to
+// the dead-letter stream target if it has just run out of deliveries. It's called within the cursor's transaction.
+func (c *cursor) deadLetterRecord(conn redigo.Conn, target *stream, e *entry, d *delivery) (bool, error) {
+	policy := c.deadLetter()
+	if d.Count == 0 || policy == nil {
+		return false, nil
+	} else if d.DeadLettered {
+		return true, nil
+	} else if d.Count < policy.MaxDeliveries || target == nil {
+		return false, nil
+	}
+
+	reason := d.Reason
+	if reason == "" {
+		reason = platform.DEAD_LETTER_LEASE_EXPIRED
+	}
+
+	content, err := platform.NewDeadLetter(e.toExt(c.streamId), c.id, reason, d.Message, d.Count).Encode()
+	if err != nil {
+		return false, err
+	}
+
+	publishScript.Send(conn, target.publishArgs(content, "")...)
+	d.DeadLettered = true
+	err = c.sendDelivery(conn, e.id, d)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deadLetterStream finds a stream which dead letters can be published to, or nil if it's missing or deleted, in
+// which case records are kept rather than lost. Unlike findStream it never purges streams, as that would end the
+// caller's watch.
+func deadLetterStream(conn redigo.Conn, streamId string) (*stream, error) {
+	reply, err := conn.Do("HGETALL", metaKey(streamId))
+	s, err := scanStream(streamId, reply, err)
+	if err != nil || s == nil || s.meta.DeletedAt != 0 {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// findEntry looks up the entry a record ID refers to. The ID holds both parts of the entry's ID, so it's read
+// directly.
+func (s *stream) findEntry(conn redigo.Conn, recordId string) (*entry, error) {
+	seq, timestamp, err := platform.ParseRecordId(s.id, recordId)
+	if err != nil {
+		return nil, err
+	}
+
+	id := entryId{ms: uint64(timestamp.UnixNano() / int64(time.Millisecond)), seq: seq}.String()
+	entries, err := readEntries(conn.Do("XRANGE", recordsKey(s.id), id, id))
+	if err != nil {
+		return nil, unavailable(err)
+	} else if len(entries) == 0 {
+		return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: s.id}
+	}
+
+	return entries[0], nil
+}
+
+// readEntries parses the reply to XRANGE or XREVRANGE.
+func readEntries(reply interface{}, err error) ([]*entry, error) {
+	values, err := redigo.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*entry, 0, len(values))
+	for _, value := range values {
+		parts, err := redigo.Values(value, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", value)
+		}
+
+		e := &entry{}
+		e.id, err = redigo.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := redigo.ByteSlices(parts[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == CONTENT_FIELD {
+				e.content = fields[i+1]
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func (e *entry) toExt(streamId string) *platform.Record {
+	// publishScript gives each entry an ID made of the time it was added and its sequence number
+	id, _ := parseEntryId(e.id)
+	timestamp := time.Unix(0, int64(id.ms)*int64(time.Millisecond)).UTC()
+
+	return &platform.Record{
+		Id:          platform.FormatRecordId(streamId, id.seq, timestamp),
+		StreamId:    streamId,
+		Sequence:    id.seq,
+		Content:     e.content,
+		ContentHash: hashContent(e.content),
+		Timestamp:   timestamp}
+}
+
+func parseEntryId(s string) (entryId, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return entryId{}, fmt.Errorf("Invalid stream entry ID \"%s\"", s)
+	}
+
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return entryId{}, err
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return entryId{}, err
+	}
+
+	return entryId{ms: ms, seq: seq}, nil
+}
+
+func (id entryId) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id entryId) before(other entryId) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// next gives the smallest ID after id, for reading the entries following it.
+func (id entryId) next() entryId {
+	if id.seq == math.MaxUint64 {
+		return entryId{ms: id.ms + 1}
+	}
+
+	return entryId{ms: id.ms, seq: id.seq + 1}
+}
+
+// previous gives the largest ID before id.
+func (id entryId) previous() entryId {
+	if id.seq == 0 {
+		return entryId{ms: id.ms - 1, seq: math.MaxUint64}
+	}
+
+	return entryId{ms: id.ms, seq: id.seq - 1}
+}
+
+func hashContent(content []byte) []byte {
+	h := sha1.New()
+	h.Write(content)
+	return h.Sum(nil)
+}
@@ -0,0 +1,479 @@
+// Package redis is an implementation of the platform on Redis (5.0 or later), for low-latency workloads.
+//
+// Each stream's records are kept in a Redis Stream, so reads waiting for records block with XREAD. Entry IDs are
+// made of the record's timestamp and sequence number, so the entry a record ID refers to is found directly. A
+// cursor is a hash holding the entry ID of the last record it committed along with the batch leased to it, and a
+// second hash counts its deliveries. Cursors are changed in WATCH/MULTI transactions so that any number of servers
+// can share the same Redis. Idempotency keys are plain keys which expire at the end of the stream's dedupe window.
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	ID_LENGTH   = 16 // 128-bit
+	MAX_RECORDS = 100
+
+	DEFAULT_URL           = "redis://localhost:6379"
+	DEFAULT_LEASE_TIMEOUT = 30 * time.Second
+
+	// MAX_WATCH_ATTEMPTS is how many times a change to a cursor is retried when another client changes it first.
+	MAX_WATCH_ATTEMPTS = 10
+
+	// LEASE_POLL_INTERVAL is how often a read waiting on a leased batch checks whether another server has
+	// acknowledged it.
+	LEASE_POLL_INTERVAL = 500 * time.Millisecond
+
+	// KEY_PREFIX is prepended to every key the platform uses.
+	KEY_PREFIX = "ocean:"
+	// STREAMS_KEY is a sorted set of stream IDs, scored by when they were created.
+	STREAMS_KEY = KEY_PREFIX + "streams"
+)
+
+type RedisPlatform struct {
+	// URL locates the Redis server, e.g. "redis://:password@localhost:6379/0". Defaults to DEFAULT_URL.
+	URL string
+
+	// LeaseTimeout is how long a batch returned by GetRecords stays leased to its cursor
+	// before it is redelivered. Defaults to DEFAULT_LEASE_TIMEOUT.
+	LeaseTimeout time.Duration
+
+	mu   sync.Mutex
+	pool *redigo.Pool
+}
+
+func init() {
+	platform.Register("redis", func(opts platform.Options) (platform.Platform, error) {
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		return &RedisPlatform{
+			URL:          opts["REDIS_URL"],
+			LeaseTimeout: leaseTimeout}, nil
+	})
+}
+
+// conn takes a connection from the platform's pool, creating the pool the first time it's used. Closing the
+// connection returns it to the pool, discarding any transaction or watch left open on it.
+func (p *RedisPlatform) conn() redigo.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pool == nil {
+		url := p.URL
+		if url == "" {
+			url = DEFAULT_URL
+		}
+
+		p.pool = &redigo.Pool{
+			MaxIdle:     10,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redigo.Conn, error) {
+				return redigo.DialURL(url)
+			},
+			TestOnBorrow: func(c redigo.Conn, idleSince time.Time) error {
+				if time.Since(idleSince) < time.Minute {
+					return nil
+				}
+
+				_, err := c.Do("PING")
+				return err
+			}}
+	}
+
+	return p.pool.Get()
+}
+
+// Close closes the platform's idle connections. The platform reconnects if it's used again.
+func (p *RedisPlatform) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pool == nil {
+		return nil
+	}
+
+	err := p.pool.Close()
+	p.pool = nil
+
+	return err
+}
+
+func (p *RedisPlatform) CreateStream(name string) (*platform.Stream, error) {
+	if name == "" {
+		return nil, &platform.ErrInvalidParam{Param: "name", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stream{
+		id: id,
+		meta: streamMeta{
+			Name:      name,
+			CreatedAt: time.Now().UnixNano()}}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", redigo.Args{}.Add(metaKey(id)).AddFlat(&s.meta)...)
+	conn.Send("ZADD", STREAMS_KEY, s.meta.CreatedAt/int64(time.Millisecond), id)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *RedisPlatform) ListStreams() ([]platform.Stream, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	ids, err := redigo.Strings(conn.Do("ZRANGE", STREAMS_KEY, 0, -1))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	for _, id := range ids {
+		conn.Send("HGETALL", metaKey(id))
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	// Read every reply before purging, so the pipeline isn't interleaved with other commands
+	streams := []*stream{}
+	for _, id := range ids {
+		reply, err := conn.Receive()
+		s, err := scanStream(id, reply, err)
+		if err != nil {
+			return nil, unavailable(err)
+		} else if s != nil {
+			streams = append(streams, s)
+		}
+	}
+
+	// Deleted streams vanish once their retention period is up
+	out := []platform.Stream{}
+	now := time.Now()
+	for _, s := range streams {
+		if s.expired(now) {
+			err = purgeStream(conn, s.id)
+			if err != nil {
+				log.Printf("Error purging stream %s: %s", s.id, err)
+			}
+			continue
+		}
+
+		out = append(out, *(s.toExt()))
+	}
+
+	return out, nil
+}
+
+func (p *RedisPlatform) GetStream(streamId string) (*platform.Stream, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *RedisPlatform) DeleteStream(streamId string, retention time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if s.meta.DeletedAt == 0 {
+		s.meta.DeletedAt = now.UnixNano()
+	}
+
+	// Without a retention period there's nothing to restore so remove it straight away
+	if retention <= 0 {
+		s.meta.PurgeAt = now.UnixNano()
+		res := s.toExt()
+
+		return res, unavailable(purgeStream(conn, s.id))
+	}
+
+	s.meta.PurgeAt = now.Add(retention).UnixNano()
+	_, err = conn.Do("HMSET", metaKey(s.id), "deletedAt", s.meta.DeletedAt, "purgeAt", s.meta.PurgeAt)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *RedisPlatform) RestoreStream(streamId string) (*platform.Stream, error) {
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	s.meta.DeletedAt = 0
+	s.meta.PurgeAt = 0
+	_, err = conn.Do("HMSET", metaKey(s.id), "deletedAt", 0, "purgeAt", 0)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return s.toExt(), nil
+}
+
+func (p *RedisPlatform) SetDedupeWindow(streamId string, window time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateDedupeWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := p.conn()
+	defer conn.Close()
+
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys already remembered keep the expiry they were given
+	s.meta.DedupeWindow = int64(window)
+	_, err = conn.Do("HSET", metaKey(s.id), "dedupeWindow", s.meta.DedupeWindow)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return s.toExt(), nil
+}
+
+type stream struct {
+	id   string
+	meta streamMeta
+}
+
+// streamMeta is the part of a stream's state kept in its hash. Times are in Unix nanoseconds, 0 when unset.
+type streamMeta struct {
+	Name         string `redis:"name"`
+	CreatedAt    int64  `redis:"createdAt"`
+	DeletedAt    int64  `redis:"deletedAt"`
+	PurgeAt      int64  `redis:"purgeAt"`
+	DedupeWindow int64  `redis:"dedupeWindow"`
+}
+
+// scanStream reads a stream from the reply to HGETALL on its hash. A nil stream means it doesn't exist.
+func scanStream(id string, reply interface{}, err error) (*stream, error) {
+	values, err := redigo.Values(reply, err)
+	if err != nil {
+		return nil, err
+	} else if len(values) == 0 {
+		return nil, nil
+	}
+
+	s := &stream{id: id}
+	err = redigo.ScanStruct(values, &s.meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// findStream looks up a stream, returning the matching platform error if it's missing. A stream whose retention
+// period is up is purged on the way.
+func findStream(conn redigo.Conn, streamId string) (*stream, error) {
+	reply, err := conn.Do("HGETALL", metaKey(streamId))
+	s, err := scanStream(streamId, reply, err)
+	if err != nil {
+		return nil, unavailable(err)
+	} else if s == nil {
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	// Deleted streams vanish once their retention period is up
+	if s.expired(time.Now()) {
+		err = purgeStream(conn, s.id)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		return nil, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	}
+
+	return s, nil
+}
+
+// findWritableStream looks up a stream which records can be published to.
+func findWritableStream(conn redigo.Conn, streamId string) (*stream, error) {
+	s, err := findStream(conn, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted streams are read-only until they're restored
+	if s.meta.DeletedAt != 0 {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: s.purgeAt()}
+	}
+
+	return s, nil
+}
+
+// purgeStream removes a stream along with its records and cursors. Its idempotency keys are left to expire.
+func purgeStream(conn redigo.Conn, streamId string) error {
+	cursorIds, err := redigo.Strings(conn.Do("ZRANGE", cursorsKey(streamId), 0, -1))
+	if err != nil {
+		return err
+	}
+
+	keys := redigo.Args{}.Add(metaKey(streamId), recordsKey(streamId), cursorsKey(streamId))
+	for _, cursorId := range cursorIds {
+		keys = keys.Add(cursorKey(streamId, cursorId), deliveriesKey(streamId, cursorId))
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", keys...)
+	conn.Send("ZREM", STREAMS_KEY, streamId)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// expired reports whether a deleted stream's retention period is up.
+func (s *stream) expired(now time.Time) bool {
+	return s.meta.DeletedAt != 0 && now.UnixNano() >= s.meta.PurgeAt
+}
+
+func (s *stream) dedupeWindow() time.Duration {
+	if s.meta.DedupeWindow == 0 {
+		return platform.DEFAULT_DEDUPE_WINDOW
+	}
+
+	return time.Duration(s.meta.DedupeWindow)
+}
+
+func (s *stream) purgeAt() time.Time {
+	return unixTime(s.meta.PurgeAt)
+}
+
+func (s *stream) toExt() *platform.Stream {
+	return &platform.Stream{
+		Id:           s.id,
+		Name:         s.meta.Name,
+		DeletedAt:    unixTime(s.meta.DeletedAt),
+		PurgeAt:      s.purgeAt(),
+		DedupeWindow: s.dedupeWindow()}
+}
+
+func (p *RedisPlatform) leaseTimeout() time.Duration {
+	if p.LeaseTimeout <= 0 {
+		return DEFAULT_LEASE_TIMEOUT
+	}
+
+	return p.LeaseTimeout
+}
+
+func metaKey(streamId string) string {
+	return KEY_PREFIX + "stream:" + streamId
+}
+
+func recordsKey(streamId string) string {
+	return KEY_PREFIX + "stream:" + streamId + ":records"
+}
+
+func cursorsKey(streamId string) string {
+	return KEY_PREFIX + "stream:" + streamId + ":cursors"
+}
+
+func cursorKey(streamId string, cursorId string) string {
+	return KEY_PREFIX + "stream:" + streamId + ":cursor:" + cursorId
+}
+
+func deliveriesKey(streamId string, cursorId string) string {
+	return KEY_PREFIX + "stream:" + streamId + ":cursor:" + cursorId + ":deliveries"
+}
+
+func idempotencyKey(streamId string, key string) string {
+	return KEY_PREFIX + "stream:" + streamId + ":key:" + key
+}
+
+// update runs fn until the transaction it ends with goes through. fn returns false when a key it watched was
+// changed by another client, so its transaction was discarded and it should run again.
+func update(fn func() (bool, error)) error {
+	for i := 0; i < MAX_WATCH_ATTEMPTS; i++ {
+		done, err := fn()
+		if err != nil {
+			return unavailable(err)
+		} else if done {
+			return nil
+		}
+	}
+
+	return &platform.ErrConflict{Message: "The cursor is being changed by too many clients at once. Try again."}
+}
+
+// exec runs the commands queued since MULTI, reporting false if a watched key changed and they were discarded.
+func exec(conn redigo.Conn) (bool, error) {
+	_, err := redigo.Values(conn.Do("EXEC"))
+	if err == redigo.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// unavailable wraps an error from failing to reach Redis so that it's reported as temporary. Any other error is
+// returned as it is.
+func unavailable(err error) error {
+	if _, ok := err.(net.Error); ok {
+		return &platform.ErrUnavailable{Service: "Redis", Err: err}
+	}
+
+	return err
+}
+
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos).UTC()
+}
+
+func generateId() (string, error) {
+	b := make([]byte, ID_LENGTH)
+	_, err := rand.Read(b)
+
+	return hex.EncodeToString(b), err
+}
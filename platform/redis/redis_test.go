@@ -0,0 +1,105 @@
+package redis
+
+import (
+	"os"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+// TEST_URL_ENV names the environment variable holding the Redis server the tests run against. Every key under
+// KEY_PREFIX is deleted before each test, so it mustn't be one that's in use.
+const TEST_URL_ENV = "TEST_REDIS_URL"
+
+func TestConformance(t *testing.T) {
+	url := os.Getenv(TEST_URL_ENV)
+	if url == "" {
+		t.Skipf("Set %s to run the Redis tests", TEST_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(url)
+	defer closeLast()
+
+	platformtest.Run(t, factory)
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	url := os.Getenv(TEST_URL_ENV)
+	if url == "" {
+		b.Skipf("Set %s to run the Redis benchmarks", TEST_URL_ENV)
+	}
+
+	factory, closeLast := emptyPlatforms(url)
+	defer closeLast()
+
+	platformtest.Benchmark(b, factory)
+}
+
+// emptyPlatforms returns a factory for platforms on an emptied server. Each platform is closed when the next is
+// made, and closeLast closes the final one.
+func emptyPlatforms(url string) (factory platform.Factory, closeLast func()) {
+	var last *RedisPlatform
+
+	factory = func(opts platform.Options) (platform.Platform, error) {
+		if last != nil {
+			last.Close()
+		}
+
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		p := &RedisPlatform{
+			URL:          url,
+			LeaseTimeout: leaseTimeout}
+		last = p
+
+		err = deleteKeys(p.conn())
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	closeLast = func() {
+		if last != nil {
+			last.Close()
+		}
+	}
+
+	return factory, closeLast
+}
+
+// deleteKeys deletes every key the platform uses, leaving the rest of the database alone.
+func deleteKeys(conn redigo.Conn) error {
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		reply, err := redigo.Values(conn.Do("SCAN", cursor, "MATCH", KEY_PREFIX+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+
+		var keys []interface{}
+		_, err = redigo.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			_, err = conn.Do("DEL", keys...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
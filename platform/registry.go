@@ -0,0 +1,98 @@
+package platform
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Factory creates a platform from its options. It returns an error if any option it reads is invalid.
+type Factory func(opts Options) (Platform, error)
+
+// Options configure a platform, keyed by the name of the environment variable each is read from, e.g. "DATA_DIR".
+// An option which isn't set reads as empty, and leaves the platform's default in place.
+type Options map[string]string
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Factory{}
+)
+
+// Register makes a platform available to Open under name. Each implementation registers itself when its package
+// is imported, so it panics if the name is taken.
+func Register(name string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("platform: Register factory is nil for " + name)
+	} else if _, ok := backends[name]; ok {
+		panic("platform: Register called twice for " + name)
+	}
+
+	backends[name] = factory
+}
+
+// Backends lists the names of the registered platforms in order.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open creates the platform registered under name, configured by opts.
+func Open(name string, opts Options) (Platform, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend \"%s\". Must be one of %v.", name, Backends())
+	}
+
+	if opts == nil {
+		opts = Options{}
+	}
+
+	return factory(opts)
+}
+
+// Duration reads an option holding a whole number of unit, e.g. seconds. An unset option reads as 0.
+func (o Options) Duration(key string, unit time.Duration) (time.Duration, error) {
+	value := o[key]
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s \"%s\". Must be a whole number of %s.", key, value, unitName(unit))
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// LeaseTimeout reads the LEASE_TIMEOUT option common to every platform, expressed in seconds.
+func (o Options) LeaseTimeout() (time.Duration, error) {
+	return o.Duration("LEASE_TIMEOUT", time.Second)
+}
+
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Second:
+		return "seconds"
+	}
+
+	return unit.String() + "s"
+}
@@ -0,0 +1,612 @@
+package sqs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	BACKFILL_BATCH_SIZE = 10
+)
+
+// resolveBackfillStart finds the records table sort key a new cursor should replay from.
+// The key is exclusive and an empty key replays from the first record. When backfill is false
+// the cursor starts at the latest record and only reads from its queue.
+func (p *SqsPlatform) resolveBackfillStart(streamId string, start *platform.StartPosition) (from string, backfill bool, err error) {
+	switch start.Type {
+	case platform.START_EARLIEST:
+		return "", true, nil
+	case platform.START_AT_TIMESTAMP:
+		return formatSortKey(start.Timestamp, ""), true, nil
+	case platform.START_AFTER_RECORD_ID:
+		from, err = p.findRecordSortKey(streamId, start.RecordId)
+		return from, err == nil, err
+	case platform.START_LAST:
+		if start.Count == 0 {
+			return "", false, nil
+		}
+
+		from, err = p.findTailSortKey(streamId, start.Count)
+		return from, err == nil, err
+	}
+
+	return "", false, nil
+}
+
+func (p *SqsPlatform) findRecordSortKey(streamId string, recordId string) (string, error) {
+	item, err := p.findRecordDBItem(streamId, recordId, COLUMN_RECORD_SORTKEY)
+	if err != nil {
+		return "", err
+	}
+
+	return *item[COLUMN_RECORD_SORTKEY].S, nil
+}
+
+// findRecordDBItem fetches the ocean-records item for a record ID, with only the attributes listed in projection
+// if it isn't empty.
+func (p *SqsPlatform) findRecordDBItem(streamId string, recordId string, projection string) (map[string]*dynamodb.AttributeValue, error) {
+	_, timestamp, err := platform.ParseRecordId(streamId, recordId)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := p.config.RecordsTable
+	keyCond := fmt.Sprintf("%s = :s AND %s BETWEEN :from AND :to", COLUMN_STREAM_ID, COLUMN_RECORD_SORTKEY)
+	filter := fmt.Sprintf("%s = :r", COLUMN_RECORD_ID)
+	from := formatSortKey(timestamp, "")
+	to := formatSortKey(timestamp.Add(time.Millisecond), "")
+
+	values := map[string]*dynamodb.AttributeValue{
+		":s":    &dynamodb.AttributeValue{S: &streamId},
+		":r":    &dynamodb.AttributeValue{S: &recordId},
+		":from": &dynamodb.AttributeValue{S: &from},
+		":to":   &dynamodb.AttributeValue{S: &to}}
+
+	// The record ID gives the millisecond the record was published in, so only that part of the stream's records
+	// is paged through until it turns up
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:                 &tableName,
+			KeyConditionExpression:    &keyCond,
+			FilterExpression:          &filter,
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         startKey}
+		if projection != "" {
+			input.ProjectionExpression = &projection
+		}
+
+		out, err := p.svcDynamoDb.Query(input)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(out.Items) > 0 {
+			return out.Items[0], nil
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil, &platform.ErrRecordNotFound{RecordID: recordId, StreamID: streamId}
+		}
+
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// findTailSortKey finds the sort key of the record just before the stream's last count records.
+func (p *SqsPlatform) findTailSortKey(streamId string, count int) (string, error) {
+	tableName := p.config.RecordsTable
+	keyCond := fmt.Sprintf("%s = :s", COLUMN_STREAM_ID)
+	projection := COLUMN_RECORD_SORTKEY
+	limit := int64(count + 1)
+	forward := false
+
+	values := map[string]*dynamodb.AttributeValue{
+		":s": &dynamodb.AttributeValue{S: &streamId}}
+
+	out, err := p.svcDynamoDb.Query(&dynamodb.QueryInput{
+		TableName:                 &tableName,
+		KeyConditionExpression:    &keyCond,
+		ProjectionExpression:      &projection,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          &forward,
+		Limit:                     &limit})
+	if err != nil {
+		return "", err
+	}
+
+	// Fewer records than requested means the whole stream is replayed
+	if int64(len(out.Items)) < limit {
+		return "", nil
+	}
+
+	return *out.Items[count][COLUMN_RECORD_SORTKEY].S, nil
+}
+
+// positionAt gives the position of a cursor which has committed up to the given records table sort key: the
+// sequence number of the last record at or before it, or DEFAULT_CURSOR_POS if there's none.
+func (p *SqsPlatform) positionAt(streamId string, sortKey string) (string, error) {
+	if sortKey == "" {
+		return DEFAULT_CURSOR_POS, nil
+	}
+
+	tableName := p.config.RecordsTable
+	keyCond := fmt.Sprintf("%s = :s AND %s <= :k", COLUMN_STREAM_ID, COLUMN_RECORD_SORTKEY)
+	projection := COLUMN_RECORD_SEQUENCE
+	limit := int64(1)
+	forward := false
+
+	values := map[string]*dynamodb.AttributeValue{
+		":s": &dynamodb.AttributeValue{S: &streamId},
+		":k": &dynamodb.AttributeValue{S: &sortKey}}
+
+	out, err := p.svcDynamoDb.Query(&dynamodb.QueryInput{
+		TableName:                 &tableName,
+		KeyConditionExpression:    &keyCond,
+		ProjectionExpression:      &projection,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          &forward,
+		Limit:                     &limit})
+	if err != nil {
+		return "", err
+	}
+
+	if len(out.Items) == 0 {
+		return DEFAULT_CURSOR_POS, nil
+	}
+
+	return *out.Items[0][COLUMN_RECORD_SEQUENCE].N, nil
+}
+
+// streamStart is the records table sort key before every record, committed by cursors that haven't read any.
+var streamStart = formatSortKey(time.Time{}, "")
+
+// startCursor sets where a cursor reads from, once its queue has been subscribed to the stream's topic. The records
+// are split between the records table and the queue by sequence number rather than by time, as timestamps can be
+// held back to keep them in order: the stream's last sequence number, read after subscribing, is the last record
+// the backfill replays. Anything later is sure to reach the queue.
+func (p *SqsPlatform) startCursor(cursor *cursorItem, backfillFrom string, backfill bool) error {
+	last, err := p.lastSequence(cursor.streamId)
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		cursor.backfillFrom = backfillFrom
+		cursor.backfillUntil = strconv.FormatUint(last, 10)
+		cursor.cutover = 0
+	} else {
+		cursor.committed, err = p.findTailSortKey(cursor.streamId, 0)
+		if err != nil {
+			return err
+		}
+		if cursor.committed == "" {
+			cursor.committed = streamStart
+		}
+
+		cursor.backfillFrom = ""
+		cursor.backfillUntil = ""
+		cursor.cutover = last
+	}
+
+	// The cursor starts as if it had committed everything before its first record
+	cursor.position, err = p.positionAt(cursor.streamId, cursor.committedSortKey())
+	return err
+}
+
+// lastSequence reads the sequence number most recently handed out in a stream, which is 0 if there's none.
+func (p *SqsPlatform) lastSequence(streamId string) (uint64, error) {
+	tableName := p.config.StreamsTable
+	projection := COLUMN_STREAM_LASTSEQUENCE
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId}}
+	out, err := p.svcDynamoDb.GetItem(&dynamodb.GetItemInput{
+		TableName:            &tableName,
+		Key:                  key,
+		ProjectionExpression: &projection,
+		ConsistentRead:       aws.Bool(true)})
+	if err != nil {
+		return 0, err
+	}
+
+	attr, ok := out.Item[COLUMN_STREAM_LASTSEQUENCE]
+	if !ok {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(*attr.N, 10, 64)
+}
+
+// readBackfill leases the cursor's next batch from the records table. A nil batch means the
+// backfill has caught up with the queue and reads should continue from there.
+func (p *SqsPlatform) readBackfill(streamId string, cursorId string, cursor *cursorItem) (*platform.Batch, error) {
+	res := &platform.Batch{
+		Records: []platform.Record{}}
+
+	// Only one backfilled batch is leased at a time
+	now := time.Now()
+	if now.Before(cursor.backfillLeaseExpires) {
+		return res, nil
+	}
+
+	until, err := strconv.ParseUint(cursor.backfillUntil, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := p.config.RecordsTable
+	keyCond := fmt.Sprintf("%s = :s", COLUMN_STREAM_ID)
+	limit := int64(BACKFILL_BATCH_SIZE)
+
+	values := map[string]*dynamodb.AttributeValue{
+		":s": &dynamodb.AttributeValue{S: &streamId}}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 &tableName,
+		KeyConditionExpression:    &keyCond,
+		ExpressionAttributeValues: values,
+		Limit:                     &limit}
+	if cursor.backfillFrom != "" {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			COLUMN_STREAM_ID:      &dynamodb.AttributeValue{S: &streamId},
+			COLUMN_RECORD_SORTKEY: &dynamodb.AttributeValue{S: &cursor.backfillFrom}}
+	}
+
+	out, err := p.svcDynamoDb.Query(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are numbered in the order of their sort keys, so the backfill ends at the first one past until
+	recs := []*platform.Record{}
+	backfillTo := ""
+	for _, item := range out.Items {
+		rec, err := recordFromDBItem(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if rec.Sequence > until {
+			break
+		}
+
+		recs = append(recs, rec)
+		backfillTo = *item[COLUMN_RECORD_SORTKEY].S
+	}
+
+	if len(recs) == 0 {
+		return nil, p.finishBackfill(streamId, cursorId, cursor)
+	}
+
+	deliveries := cursor.backfillDeliveries
+	if deliveries == nil {
+		deliveries = map[string]*backfillDelivery{}
+	}
+
+	// A lease that lapsed without an ack or nack counts against the records it covered
+	if !cursor.backfillLeaseExpires.IsZero() {
+		for _, d := range deliveries {
+			d.reason = platform.DEAD_LETTER_LEASE_EXPIRED
+			d.message = ""
+		}
+	}
+
+	// There's no redrive for the records table, so deliveries are counted per record in the cursor's item and the
+	// records that run out are dead-lettered. They're skipped from then on, and committed along with the rest of
+	// the batch.
+	letters := []*platform.DeadLetter{}
+	for _, rec := range recs {
+		d, ok := deliveries[rec.Id]
+		if ok && d.deadLettered {
+			continue
+		}
+
+		if ok && cursor.deadLetterStreamId != "" && d.count >= cursor.maxDeliveries {
+			reason := d.reason
+			if reason == "" {
+				reason = platform.DEAD_LETTER_LEASE_EXPIRED
+			}
+
+			letters = append(letters, platform.NewDeadLetter(rec, cursorId, reason, d.message, d.count))
+			d.deadLettered = true
+			continue
+		}
+
+		if !ok {
+			d = &backfillDelivery{}
+			deliveries[rec.Id] = d
+		}
+		d.count++
+
+		res.Records = append(res.Records, *rec)
+	}
+
+	position := recs[len(recs)-1].Sequence
+
+	if len(letters) > 0 {
+		err = p.publishDeadLetters(cursor, letters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// With every record dead-lettered, the cursor moves past the batch as if it had been acknowledged
+	if len(res.Records) == 0 {
+		err = p.advanceBackfill(streamId, cursorId, cursor.backfillFrom, "", backfillTo, position)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+			// Another reader moved the backfill on first
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	lease, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lease the batch so it isn't handed out again until it has been acknowledged or the lease lapses
+	expires := strconv.FormatInt(now.Add(p.leaseTimeout()).UnixNano(), 10)
+	err = p.updateBackfill(streamId, cursorId, cursor.backfillFrom, "",
+		fmt.Sprintf("SET %s = :o, %s = :e, %s = :d", COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLDELIVERIES),
+		map[string]*dynamodb.AttributeValue{
+			":o": &dynamodb.AttributeValue{S: &lease},
+			":e": &dynamodb.AttributeValue{N: &expires},
+			":d": backfillDeliveriesToAttr(deliveries)})
+
+	// Another reader leased the batch or moved the backfill on first
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return &platform.Batch{Records: []platform.Record{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res.Receipt, err = encodeReceipt(&receipt{
+		BackfillFrom: cursor.backfillFrom,
+		BackfillTo:   backfillTo,
+		Lease:        lease,
+		Position:     position})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// finishBackfill switches a cursor whose backfill has caught up over to its queue. The queue goes on from the last
+// record the backfill committed, so records that also reached the queue aren't delivered twice.
+func (p *SqsPlatform) finishBackfill(streamId string, cursorId string, cursor *cursorItem) error {
+	committed := cursor.backfillFrom
+	if committed == "" {
+		committed = streamStart
+	}
+
+	cutover := cursor.position
+	if cutover == DEFAULT_CURSOR_POS {
+		cutover = "0"
+	}
+
+	// The last batch acknowledged has already set the cursor's position
+	update, values := endBackfillUpdate(committed, "", cutover)
+	err := p.updateBackfill(streamId, cursorId, cursor.backfillFrom, "", update, values)
+
+	// Another reader has leased a batch or moved the backfill on, so there's more to read first
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return nil
+	}
+
+	return err
+}
+
+// ackBackfill moves the cursor's backfill position past an acknowledged batch.
+func (p *SqsPlatform) ackBackfill(streamId string, cursorId string, encoded string, r *receipt) error {
+	err := p.advanceBackfill(streamId, cursorId, r.BackfillFrom, r.Lease, r.BackfillTo, r.Position)
+
+	// The backfill position has moved, or the batch has been leased again, since it was read so the receipt is stale
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return &platform.ErrReceiptNotFound{Receipt: encoded, CursorID: cursorId}
+	}
+
+	return err
+}
+
+// nackBackfill releases the lease on a backfilled batch so that it's redelivered straight away, recording the reason
+// against each of its records.
+func (p *SqsPlatform) nackBackfill(streamId string, cursorId string, encoded string, r *receipt, reason string, cursor *cursorItem) error {
+	for _, d := range cursor.backfillDeliveries {
+		d.reason = platform.DEAD_LETTER_NACKED
+		d.message = reason
+	}
+
+	err := p.updateBackfill(streamId, cursorId, r.BackfillFrom, r.Lease,
+		fmt.Sprintf("SET %s = :d REMOVE %s, %s", COLUMN_CURSOR_BACKFILLDELIVERIES, COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES),
+		map[string]*dynamodb.AttributeValue{
+			":d": backfillDeliveriesToAttr(cursor.backfillDeliveries)})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return &platform.ErrReceiptNotFound{Receipt: encoded, CursorID: cursorId}
+	}
+
+	return err
+}
+
+// advanceBackfill moves the cursor's backfill position from one batch to the next, committing the batch. position
+// is the sequence number of the batch's last record. lease is the batch's lease, or empty if it isn't leased.
+func (p *SqsPlatform) advanceBackfill(streamId string, cursorId string, from string, lease string, to string, position uint64) error {
+	seq := strconv.FormatUint(position, 10)
+
+	return p.updateBackfill(streamId, cursorId, from, lease,
+		fmt.Sprintf("SET %s = :t, %s = :t, %s = :p REMOVE %s, %s, %s", COLUMN_CURSOR_BACKFILLFROM, COLUMN_CURSOR_COMMITTED, COLUMN_CURSOR_POSITION, COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLDELIVERIES),
+		map[string]*dynamodb.AttributeValue{
+			":t": &dynamodb.AttributeValue{S: &to},
+			":p": &dynamodb.AttributeValue{N: &seq}})
+}
+
+// restartBackfill points the cursor's backfill at a new range of the records table, abandoning any leased batch.
+// until is the sequence number of the last record to replay, and position is the cursor's position at from, as
+// given by positionAt.
+func (p *SqsPlatform) restartBackfill(streamId string, cursorId string, from string, until string, position string) error {
+	tableName := p.config.CursorsTable
+
+	update := fmt.Sprintf("SET %s = :u, %s = :p REMOVE %s, %s, %s, %s", COLUMN_CURSOR_BACKFILLUNTIL, COLUMN_CURSOR_POSITION, COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLDELIVERIES, COLUMN_CURSOR_CUTOVER)
+	values := map[string]*dynamodb.AttributeValue{
+		":u": &dynamodb.AttributeValue{N: &until},
+		":p": &dynamodb.AttributeValue{N: &position}}
+	if from != "" {
+		update = fmt.Sprintf("SET %s = :u, %s = :p, %s = :f REMOVE %s, %s, %s, %s", COLUMN_CURSOR_BACKFILLUNTIL, COLUMN_CURSOR_POSITION, COLUMN_CURSOR_BACKFILLFROM, COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLDELIVERIES, COLUMN_CURSOR_CUTOVER)
+		values[":f"] = &dynamodb.AttributeValue{S: &from}
+	} else {
+		update = fmt.Sprintf("%s, %s", update, COLUMN_CURSOR_BACKFILLFROM)
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
+	_, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &tableName,
+		Key:                       key,
+		UpdateExpression:          &update,
+		ExpressionAttributeValues: values})
+
+	return err
+}
+
+// endBackfill switches the cursor over to reading from its queue, having committed up to the given sort key, and
+// abandons any leased batch.
+func (p *SqsPlatform) endBackfill(streamId string, cursorId string, committed string, position string, cutover string) error {
+	tableName := p.config.CursorsTable
+	update, values := endBackfillUpdate(committed, position, cutover)
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
+	_, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &tableName,
+		Key:                       key,
+		UpdateExpression:          &update,
+		ExpressionAttributeValues: values})
+
+	return err
+}
+
+// endBackfillUpdate builds the update which switches a cursor over to its queue. The queue drops records up to the
+// cutover sequence number. The cursor's position is set to position, unless it's empty.
+func endBackfillUpdate(committed string, position string, cutover string) (string, map[string]*dynamodb.AttributeValue) {
+	set := fmt.Sprintf("SET %s = :c, %s = :x", COLUMN_CURSOR_COMMITTED, COLUMN_CURSOR_CUTOVER)
+	values := map[string]*dynamodb.AttributeValue{
+		":c": &dynamodb.AttributeValue{S: &committed},
+		":x": &dynamodb.AttributeValue{N: &cutover}}
+	if position != "" {
+		set = fmt.Sprintf("%s, %s = :p", set, COLUMN_CURSOR_POSITION)
+		values[":p"] = &dynamodb.AttributeValue{N: &position}
+	}
+
+	update := fmt.Sprintf("%s REMOVE %s, %s, %s, %s, %s", set, COLUMN_CURSOR_BACKFILLFROM, COLUMN_CURSOR_BACKFILLUNTIL, COLUMN_CURSOR_BACKFILLLEASE, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLDELIVERIES)
+
+	return update, values
+}
+
+// commitQueueBatch records that the cursor has processed its queue up to the given sort key, which belongs to the
+// record numbered position. Commits only move forwards since acknowledgements can arrive out of order.
+func (p *SqsPlatform) commitQueueBatch(streamId string, cursorId string, committed string, position uint64) error {
+	tableName := p.config.CursorsTable
+	seq := strconv.FormatUint(position, 10)
+	update := fmt.Sprintf("SET %s = :c, %s = :p", COLUMN_CURSOR_COMMITTED, COLUMN_CURSOR_POSITION)
+	cond := fmt.Sprintf("attribute_not_exists(%s) OR %s < :c", COLUMN_CURSOR_COMMITTED, COLUMN_CURSOR_COMMITTED)
+	values := map[string]*dynamodb.AttributeValue{
+		":c": &dynamodb.AttributeValue{S: &committed},
+		":p": &dynamodb.AttributeValue{N: &seq}}
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
+	_, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &tableName,
+		Key:                       key,
+		UpdateExpression:          &update,
+		ConditionExpression:       &cond,
+		ExpressionAttributeValues: values})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return nil
+	}
+
+	return err
+}
+
+// updateBackfill applies an update to the cursor's backfill attributes on the condition that the backfill position
+// is still at from. With a lease, only the reader holding it can make the update. Without one, it's only made while
+// no reader holds an unexpired lease.
+func (p *SqsPlatform) updateBackfill(streamId string, cursorId string, from string, lease string, update string, values map[string]*dynamodb.AttributeValue) error {
+	tableName := p.config.CursorsTable
+
+	cond := fmt.Sprintf("attribute_exists(%s) AND attribute_not_exists(%s)", COLUMN_CURSOR_BACKFILLUNTIL, COLUMN_CURSOR_BACKFILLFROM)
+	if from != "" {
+		cond = fmt.Sprintf("attribute_exists(%s) AND %s = :f", COLUMN_CURSOR_BACKFILLUNTIL, COLUMN_CURSOR_BACKFILLFROM)
+		values[":f"] = &dynamodb.AttributeValue{S: &from}
+	}
+
+	if lease != "" {
+		cond = fmt.Sprintf("%s AND %s = :lease", cond, COLUMN_CURSOR_BACKFILLLEASE)
+		values[":lease"] = &dynamodb.AttributeValue{S: &lease}
+	} else {
+		now := strconv.FormatInt(time.Now().UnixNano(), 10)
+		cond = fmt.Sprintf("%s AND (attribute_not_exists(%s) OR %s <= :now)", cond, COLUMN_CURSOR_BACKFILLLEASEEXPIRES, COLUMN_CURSOR_BACKFILLLEASEEXPIRES)
+		values[":now"] = &dynamodb.AttributeValue{N: &now}
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
+	_, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &tableName,
+		Key:                       key,
+		UpdateExpression:          &update,
+		ConditionExpression:       &cond,
+		ExpressionAttributeValues: values})
+
+	return err
+}
+
+func recordFromDBItem(item map[string]*dynamodb.AttributeValue) (*platform.Record, error) {
+	content, err := base64Encoding.DecodeString(*item[COLUMN_RECORD_CONTENT].S)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hex.DecodeString(*item[COLUMN_RECORD_CONTENTHASH].S)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := time.Parse(TIME_FORMAT, *item[COLUMN_RECORD_TIMESTAMP].S)
+	if err != nil {
+		return nil, err
+	}
+
+	sequence, err := strconv.ParseUint(*item[COLUMN_RECORD_SEQUENCE].N, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &platform.Record{
+		Id:          *item[COLUMN_RECORD_ID].S,
+		StreamId:    *item[COLUMN_STREAM_ID].S,
+		Sequence:    sequence,
+		Content:     content,
+		ContentHash: hash,
+		Timestamp:   timestamp}
+
+	return rec, nil
+}
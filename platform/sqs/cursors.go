@@ -2,89 +2,405 @@ package sqs
 
 import (
 	"fmt"
+	"strconv"
+	"time"
 
-	"strings"
-
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/oceanhq/streams/platform"
 )
 
-func (p *SqsPlatform) CreateCursor(streamId string) (*platform.Cursor, error) {
-	cursorId, err := generateId()
+func (p *SqsPlatform) CreateCursor(streamId string, start platform.StartPosition) (*platform.Cursor, error) {
+	err := start.Validate()
 	if err != nil {
 		return nil, err
 	}
 
-	cursorPosition := DEFAULT_CURSOR_POS
+	// Work out where in the records table the cursor should replay from, if at all
+	backfillFrom, backfill, err := p.resolveBackfillStart(streamId, &start)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.provisionCursor(streamId, backfillFrom, backfill)
+}
 
-	url, err := createCursorSQSQueue(cursorId, streamId)
+// provisionCursor creates a cursor's queue, subscription and ocean-cursors item.
+// When backfill is set the cursor replays the records table after backfillFrom before reading from its queue.
+func (p *SqsPlatform) provisionCursor(streamId string, backfillFrom string, backfill bool) (*platform.Cursor, error) {
+	cursorId, err := generateId()
 	if err != nil {
 		return nil, err
 	}
 
-	// Subscribe SQS Queue to SNS Topic
-	protocol := "sqs"
-	endpoint := getQueueArn(cursorId)
-	topicArn, err := getStreamTopicArn(streamId)
+	topicArn, err := p.getStreamTopicArn(streamId)
 	if err != nil {
 		return nil, err
 	}
 
-	svcSns.Subscribe(&sns.SubscribeInput{
+	url, endpoint, err := p.createCursorSQSQueue(cursorId, topicArn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscribe SQS Queue to SNS Topic
+	protocol := "sqs"
+	sub, err := p.svcSns.Subscribe(&sns.SubscribeInput{
 		Protocol: &protocol,
 		Endpoint: &endpoint,
 		TopicArn: &topicArn,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	err = createCursorDBItem(cursorId, streamId, cursorPosition, url)
+	item := &cursorItem{
+		cursorId:        cursorId,
+		streamId:        streamId,
+		queueUrl:        url,
+		subscriptionArn: *sub.SubscriptionArn}
+	err = p.startCursor(item, backfillFrom, backfill)
 	if err != nil {
 		return nil, err
 	}
 
-	res := &platform.Cursor{
-		Id:       cursorId,
-		StreamId: streamId,
-		Position: cursorPosition}
+	err = p.createCursorDBItem(item)
+	if err != nil {
+		return nil, err
+	}
 
-	return res, nil
+	return item.toExt(), nil
 }
 
-func createCursorDBItem(cursorId string, streamId string, cursorPosition string, queueUrl string) error {
-	tableName := TABLE_CURSORS
+func (p *SqsPlatform) SeekCursor(streamId string, cursorId string, position platform.StartPosition) (*platform.Cursor, error) {
+	err := position.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateId(cursorId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	backfillFrom, backfill, err := p.resolveBackfillStart(streamId, &position)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything already queued is either skipped or covered by the new backfill, so drop it.
+	// Purging also invalidates the receipts of any outstanding batches.
+	_, err = p.svcSqs.PurgeQueue(&sqs.PurgeQueueInput{
+		QueueUrl: &cursor.queueUrl})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.startCursor(cursor, backfillFrom, backfill)
+	if err != nil {
+		return nil, err
+	}
+
+	if backfill {
+		err = p.restartBackfill(streamId, cursorId, backfillFrom, cursor.backfillUntil, cursor.position)
+	} else {
+		err = p.endBackfill(streamId, cursorId, cursor.committed, cursor.position, strconv.FormatUint(cursor.cutover, 10))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cursor.toExt(), nil
+}
+
+func (p *SqsPlatform) GetCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	err := validateId(cursorId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursor.toExt(), nil
+}
+
+func (p *SqsPlatform) ListCursors(streamId string) ([]platform.Cursor, error) {
+	err := validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	// Make sure the stream exists so that a missing stream isn't reported as having no cursors
+	_, err = p.getStreamTopicArn(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := p.queryCursorDBItems(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := make([]platform.Cursor, len(items))
+	for i, item := range items {
+		cursors[i] = *item.toExt()
+	}
+
+	return cursors, nil
+}
+
+func (p *SqsPlatform) queryCursorDBItems(streamId string) ([]*cursorItem, error) {
+	tableName := p.config.CursorsTable
+	keyCond := fmt.Sprintf("%s = :s", COLUMN_STREAM_ID)
+	values := map[string]*dynamodb.AttributeValue{
+		":s": &dynamodb.AttributeValue{S: &streamId}}
+
+	items := []*cursorItem{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := p.svcDynamoDb.Query(&dynamodb.QueryInput{
+			TableName:                 &tableName,
+			KeyConditionExpression:    &keyCond,
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         startKey})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, attrs := range out.Items {
+			item, err := cursorItemFromAttrs(attrs)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+func (p *SqsPlatform) DeleteCursor(streamId string, cursorId string) error {
+	err := validateId(cursorId)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	topicArn, err := p.getStreamTopicArn(streamId)
+	if err != nil {
+		return err
+	}
+
+	return p.deprovisionCursor(cursor, topicArn)
+}
+
+func (p *SqsPlatform) CloneCursor(streamId string, cursorId string) (*platform.Cursor, error) {
+	err := validateId(cursorId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	source, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages can't be copied between queues, so the clone replays the records table from wherever the
+	// source has committed up to. Cursors created before commits were tracked are cloned at the latest record.
+	var clone *platform.Cursor
+	if source.backfilling() {
+		clone, err = p.provisionCursor(streamId, source.backfillFrom, true)
+	} else {
+		clone, err = p.provisionCursor(streamId, source.committed, source.committed != "")
+	}
+	if err != nil || source.deadLetterStreamId == "" {
+		return clone, err
+	}
+
+	return p.SetDeadLetterPolicy(streamId, clone.Id, source.deadLetterPolicy())
+}
+
+// deprovisionCursor tears down a cursor's subscription to the stream topic, its queue and its ocean-cursors item.
+func (p *SqsPlatform) deprovisionCursor(cursor *cursorItem, topicArn string) error {
+	// Cursors created before subscription ARNs were recorded need theirs looked up
+	subscriptionArn := cursor.subscriptionArn
+	if subscriptionArn == "" {
+		queueArn, err := p.getQueueArnFromUrl(cursor.queueUrl)
+		if err != nil {
+			return err
+		}
+
+		subscriptionArn, err = p.findSubscriptionArn(topicArn, queueArn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if subscriptionArn != "" {
+		_, err := p.svcSns.Unsubscribe(&sns.UnsubscribeInput{
+			SubscriptionArn: &subscriptionArn})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := p.svcSqs.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: &cursor.queueUrl})
+	if err != nil {
+		return err
+	}
+
+	if cursor.deadLetterQueueUrl != "" {
+		_, err = p.svcSqs.DeleteQueue(&sqs.DeleteQueueInput{
+			QueueUrl: &cursor.deadLetterQueueUrl})
+		if err != nil {
+			return err
+		}
+	}
+
+	tableName := p.config.CursorsTable
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &cursor.streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursor.cursorId}}
+	_, err = p.svcDynamoDb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &tableName,
+		Key:       key})
+
+	return err
+}
+
+func (p *SqsPlatform) findSubscriptionArn(topicArn string, queueArn string) (string, error) {
+	var nextToken *string
+	for {
+		out, err := p.svcSns.ListSubscriptionsByTopic(&sns.ListSubscriptionsByTopicInput{
+			TopicArn:  &topicArn,
+			NextToken: nextToken})
+		if err != nil {
+			return "", err
+		}
+
+		for _, sub := range out.Subscriptions {
+			if *sub.Endpoint == queueArn {
+				return *sub.SubscriptionArn, nil
+			}
+		}
+
+		if out.NextToken == nil {
+			return "", nil
+		}
+
+		nextToken = out.NextToken
+	}
+}
+
+func (p *SqsPlatform) createCursorDBItem(item *cursorItem) error {
+	tableName := p.config.CursorsTable
 
 	attrs := map[string]*dynamodb.AttributeValue{
-		COLUMN_CURSOR_ID:          &dynamodb.AttributeValue{S: &cursorId},
-		COLUMN_STREAM_ID:          &dynamodb.AttributeValue{S: &streamId},
-		COLUMN_CURSOR_POSITION:    &dynamodb.AttributeValue{N: &cursorPosition},
-		COLUMN_CURSOR_SQSQUEUEURL: &dynamodb.AttributeValue{S: &queueUrl}}
+		COLUMN_CURSOR_ID:                 &dynamodb.AttributeValue{S: &item.cursorId},
+		COLUMN_STREAM_ID:                 &dynamodb.AttributeValue{S: &item.streamId},
+		COLUMN_CURSOR_POSITION:           &dynamodb.AttributeValue{N: &item.position},
+		COLUMN_CURSOR_SQSQUEUEURL:        &dynamodb.AttributeValue{S: &item.queueUrl},
+		COLUMN_CURSOR_SNSSUBSCRIPTIONARN: &dynamodb.AttributeValue{S: &item.subscriptionArn}}
+
+	if item.backfillFrom != "" {
+		attrs[COLUMN_CURSOR_BACKFILLFROM] = &dynamodb.AttributeValue{S: &item.backfillFrom}
+	}
+	if item.backfillUntil != "" {
+		attrs[COLUMN_CURSOR_BACKFILLUNTIL] = &dynamodb.AttributeValue{N: &item.backfillUntil}
+	}
+	if item.cutover != 0 {
+		attrs[COLUMN_CURSOR_CUTOVER] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(item.cutover, 10))}
+	}
+	if item.committed != "" {
+		attrs[COLUMN_CURSOR_COMMITTED] = &dynamodb.AttributeValue{S: &item.committed}
+	}
 
-	_, err := svcDynamoDb.PutItem(&dynamodb.PutItemInput{
+	_, err := p.svcDynamoDb.PutItem(&dynamodb.PutItemInput{
 		TableName: &tableName,
 		Item:      attrs})
 
 	return err
 }
 
-func createCursorSQSQueue(cursorId string, streamId string) (string, error) {
-	policyTmpl := &sqsPolicy{
-		cursorId: cursorId,
-		streamId: streamId}
+// createCursorSQSQueue creates a cursor's queue, allowing the stream's topic to send to it, and returns its URL and ARN.
+// The queue is FIFO if the topic is, as a FIFO topic can only deliver to FIFO queues.
+func (p *SqsPlatform) createCursorSQSQueue(cursorId string, topicArn string) (string, string, error) {
+	queueUrl, err := p.createQueue(fmt.Sprintf("%s%s", p.config.QueuePrefix, cursorId), isFifo(topicArn))
+	if err != nil {
+		return "", "", err
+	}
+
+	// The policy names the queue by its ARN, which is only known once it exists
+	queueArn, err := p.getQueueArnFromUrl(queueUrl)
+	if err != nil {
+		return "", "", err
+	}
 
-	queueName := fmt.Sprintf("%s%s", SQS_QUEUE_PREFIX, cursorId)
-	println("Generating policy...")
+	policyTmpl := &sqsPolicy{
+		QueueArn: queueArn,
+		TopicArn: topicArn}
 	policy, err := policyTmpl.buildPolicy()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	attrs := map[string]*string{
-		"Policy": &policy}
+	_, err = p.svcSqs.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl:   &queueUrl,
+		Attributes: map[string]*string{"Policy": &policy}})
+	if err != nil {
+		return "", "", err
+	}
+
+	return queueUrl, queueArn, nil
+}
+
+// createQueue creates a queue, or finds the one which already has the name, and returns its URL. FIFO queues have
+// FIFO_SUFFIX added to their names.
+func (p *SqsPlatform) createQueue(name string, fifo bool) (string, error) {
+	input := &sqs.CreateQueueInput{
+		QueueName: &name}
+	if fifo {
+		input.QueueName = aws.String(name + FIFO_SUFFIX)
+		input.Attributes = map[string]*string{
+			sqs.QueueAttributeNameFifoQueue: aws.String("true")}
+	}
 
-	out, err := svcSqs.CreateQueue(&sqs.CreateQueueInput{
-		QueueName:  &queueName,
-		Attributes: attrs})
+	out, err := p.svcSqs.CreateQueue(input)
 	if err != nil {
 		return "", err
 	}
@@ -92,25 +408,205 @@ func createCursorSQSQueue(cursorId string, streamId string) (string, error) {
 	return *out.QueueUrl, nil
 }
 
-func getCursorQueueUrl(streamId string, cursorId string) (string, error) {
-	tableName := TABLE_CURSORS
+// cursorItem holds the attributes of an ocean-cursors item.
+type cursorItem struct {
+	cursorId             string
+	streamId             string
+	position             string
+	queueUrl             string
+	subscriptionArn      string
+	backfillFrom         string
+	backfillLeaseExpires time.Time
+	// backfillUntil is the sequence number of the last record the backfill replays. Later ones reach the queue.
+	backfillUntil string
+	// cutover is the sequence number of the last record read from the records table. Anything up to it that
+	// also reached the queue has already been delivered.
+	cutover uint64
+	// committed is the records table sort key the cursor has processed up to, where known.
+	committed string
+	// backfillDeliveries tracks the records after backfillFrom that have been handed out, keyed by record ID.
+	backfillDeliveries map[string]*backfillDelivery
 
-	attrs := strings.Join([]string{COLUMN_CURSOR_SQSQUEUEURL}, ",")
+	deadLetterStreamId string
+	maxDeliveries      int
+	deadLetterQueueUrl string
+	// lastNackReason is the reason given by the cursor's most recent nack, cleared on the next ack.
+	lastNackReason string
+}
+
+// backfillDelivery tracks a backfilled record that has been handed out but not yet committed, as SQS's receive
+// count does for records read from the queue.
+type backfillDelivery struct {
+	count        int
+	reason       string
+	message      string
+	deadLettered bool
+}
+
+func backfillDeliveriesFromAttr(attr *dynamodb.AttributeValue) (map[string]*backfillDelivery, error) {
+	deliveries := make(map[string]*backfillDelivery, len(attr.M))
+	for recordId, value := range attr.M {
+		d := &backfillDelivery{}
+		if v, ok := value.M[BACKFILL_DELIVERY_COUNT]; ok {
+			count, err := strconv.Atoi(*v.N)
+			if err != nil {
+				return nil, err
+			}
+
+			d.count = count
+		}
+		if v, ok := value.M[BACKFILL_DELIVERY_REASON]; ok {
+			d.reason = *v.S
+		}
+		if v, ok := value.M[BACKFILL_DELIVERY_MESSAGE]; ok {
+			d.message = *v.S
+		}
+		if v, ok := value.M[BACKFILL_DELIVERY_DEADLETTERED]; ok {
+			d.deadLettered = *v.BOOL
+		}
+
+		deliveries[recordId] = d
+	}
+
+	return deliveries, nil
+}
+
+func backfillDeliveriesToAttr(deliveries map[string]*backfillDelivery) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(deliveries))
+	for recordId, d := range deliveries {
+		value := map[string]*dynamodb.AttributeValue{
+			BACKFILL_DELIVERY_COUNT: &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(d.count))}}
+		if d.reason != "" {
+			value[BACKFILL_DELIVERY_REASON] = &dynamodb.AttributeValue{S: aws.String(d.reason)}
+		}
+		if d.message != "" {
+			value[BACKFILL_DELIVERY_MESSAGE] = &dynamodb.AttributeValue{S: aws.String(d.message)}
+		}
+		if d.deadLettered {
+			value[BACKFILL_DELIVERY_DEADLETTERED] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+		}
+
+		m[recordId] = &dynamodb.AttributeValue{M: value}
+	}
+
+	return &dynamodb.AttributeValue{M: m}
+}
+
+// backfilling reports whether the cursor is still replaying the records table.
+func (c *cursorItem) backfilling() bool {
+	return c.backfillUntil != ""
+}
+
+// committedSortKey returns the records table sort key the cursor has processed up to, which is empty if it's
+// replaying the stream from the start.
+func (c *cursorItem) committedSortKey() string {
+	if c.backfilling() {
+		return c.backfillFrom
+	}
+
+	return c.committed
+}
+
+// deadLetterPolicy returns the cursor's dead-letter policy, or nil if it has none.
+func (c *cursorItem) deadLetterPolicy() *platform.DeadLetterPolicy {
+	if c.deadLetterStreamId == "" {
+		return nil
+	}
+
+	return &platform.DeadLetterPolicy{
+		StreamId:      c.deadLetterStreamId,
+		MaxDeliveries: c.maxDeliveries}
+}
+
+func (c *cursorItem) toExt() *platform.Cursor {
+	return &platform.Cursor{
+		Id:         c.cursorId,
+		StreamId:   c.streamId,
+		Position:   c.position,
+		DeadLetter: c.deadLetterPolicy()}
+}
+
+func (p *SqsPlatform) getCursorDBItem(streamId string, cursorId string) (*cursorItem, error) {
+	tableName := p.config.CursorsTable
 
 	key := map[string]*dynamodb.AttributeValue{
 		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
 		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
-	out, err := svcDynamoDb.GetItem(&dynamodb.GetItemInput{
-		TableName:            &tableName,
-		ProjectionExpression: &attrs,
-		Key:                  key})
+	out, err := p.svcDynamoDb.GetItem(&dynamodb.GetItemInput{
+		TableName: &tableName,
+		Key:       key})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(out.Item) == 0 {
-		return "", &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+		return nil, &platform.ErrCursorNotFound{CursorID: cursorId, StreamID: streamId}
+	}
+
+	return cursorItemFromAttrs(out.Item)
+}
+
+func cursorItemFromAttrs(attrs map[string]*dynamodb.AttributeValue) (*cursorItem, error) {
+	item := &cursorItem{
+		cursorId: *attrs[COLUMN_CURSOR_ID].S,
+		streamId: *attrs[COLUMN_STREAM_ID].S,
+		position: *attrs[COLUMN_CURSOR_POSITION].N,
+		queueUrl: *attrs[COLUMN_CURSOR_SQSQUEUEURL].S}
+
+	if attr, ok := attrs[COLUMN_CURSOR_SNSSUBSCRIPTIONARN]; ok {
+		item.subscriptionArn = *attr.S
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_BACKFILLFROM]; ok {
+		item.backfillFrom = *attr.S
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_BACKFILLUNTIL]; ok {
+		item.backfillUntil = *attr.N
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_CUTOVER]; ok {
+		cutover, err := strconv.ParseUint(*attr.N, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		item.cutover = cutover
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_BACKFILLLEASEEXPIRES]; ok {
+		expires, err := strconv.ParseInt(*attr.N, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		item.backfillLeaseExpires = time.Unix(0, expires)
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_COMMITTED]; ok {
+		item.committed = *attr.S
+	}
+	// Items written before deliveries were counted per record hold a number here, which is ignored
+	if attr, ok := attrs[COLUMN_CURSOR_BACKFILLDELIVERIES]; ok && attr.M != nil {
+		deliveries, err := backfillDeliveriesFromAttr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		item.backfillDeliveries = deliveries
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_DEADLETTERSTREAMID]; ok {
+		item.deadLetterStreamId = *attr.S
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_MAXDELIVERIES]; ok {
+		maxDeliveries, err := strconv.Atoi(*attr.N)
+		if err != nil {
+			return nil, err
+		}
+
+		item.maxDeliveries = maxDeliveries
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_DEADLETTERQUEUEURL]; ok {
+		item.deadLetterQueueUrl = *attr.S
+	}
+	if attr, ok := attrs[COLUMN_CURSOR_LASTNACKREASON]; ok {
+		item.lastNackReason = *attr.S
 	}
 
-	return *out.Item[COLUMN_CURSOR_SQSQUEUEURL].S, nil
+	return item, nil
 }
@@ -0,0 +1,280 @@
+package sqs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/oceanhq/streams/platform"
+)
+
+// SetDeadLetterPolicy gives the cursor's queue a redrive policy onto a queue of its own, which GetRecords
+// drains into the dead-letter stream. Backfilled batches are counted in the cursor item instead.
+func (p *SqsPlatform) SetDeadLetterPolicy(streamId string, cursorId string, policy *platform.DeadLetterPolicy) (*platform.Cursor, error) {
+	err := validateId(cursorId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == nil {
+		err = p.clearDeadLetterPolicy(cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		return cursor.toExt(), nil
+	}
+
+	err = policy.Validate(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dead letters have to be publishable to the target
+	_, err = p.getWritableStreamTopicArn(policy.StreamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// A redrive policy can only move messages to a queue of the same kind
+	queueUrl := cursor.deadLetterQueueUrl
+	if queueUrl == "" {
+		queueUrl, err = p.createQueue(fmt.Sprintf("%s%s%s", p.config.QueuePrefix, cursorId, p.config.DeadLetterQueueSuffix), isFifo(cursor.queueUrl))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queueArn, err := p.getQueueArnFromUrl(queueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.setRedrivePolicy(cursor.queueUrl, queueArn, policy.MaxDeliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	maxDeliveries := strconv.Itoa(policy.MaxDeliveries)
+	err = p.updateCursorDBItem(streamId, cursorId,
+		fmt.Sprintf("SET %s = :s, %s = :m, %s = :q", COLUMN_CURSOR_DEADLETTERSTREAMID, COLUMN_CURSOR_MAXDELIVERIES, COLUMN_CURSOR_DEADLETTERQUEUEURL),
+		map[string]*dynamodb.AttributeValue{
+			":s": &dynamodb.AttributeValue{S: &policy.StreamId},
+			":m": &dynamodb.AttributeValue{N: &maxDeliveries},
+			":q": &dynamodb.AttributeValue{S: &queueUrl}})
+	if err != nil {
+		return nil, err
+	}
+
+	cursor.deadLetterStreamId = policy.StreamId
+	cursor.maxDeliveries = policy.MaxDeliveries
+	cursor.deadLetterQueueUrl = queueUrl
+
+	return cursor.toExt(), nil
+}
+
+// clearDeadLetterPolicy removes the cursor's redrive policy, passing on anything already in its dead-letter
+// queue before deleting it.
+func (p *SqsPlatform) clearDeadLetterPolicy(cursor *cursorItem) error {
+	if cursor.deadLetterQueueUrl == "" {
+		return nil
+	}
+
+	err := p.setRedrivePolicy(cursor.queueUrl, "", 0)
+	if err != nil {
+		return err
+	}
+
+	err = p.drainDeadLetterQueue(cursor)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.svcSqs.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: &cursor.deadLetterQueueUrl})
+	if err != nil {
+		return err
+	}
+
+	err = p.updateCursorDBItem(cursor.streamId, cursor.cursorId,
+		fmt.Sprintf("REMOVE %s, %s, %s", COLUMN_CURSOR_DEADLETTERSTREAMID, COLUMN_CURSOR_MAXDELIVERIES, COLUMN_CURSOR_DEADLETTERQUEUEURL),
+		nil)
+	if err != nil {
+		return err
+	}
+
+	cursor.deadLetterStreamId = ""
+	cursor.maxDeliveries = 0
+	cursor.deadLetterQueueUrl = ""
+
+	return nil
+}
+
+// setRedrivePolicy has SQS move messages from a queue to targetArn once they've been received maxReceiveCount
+// times. An empty targetArn removes the policy.
+func (p *SqsPlatform) setRedrivePolicy(queueUrl string, targetArn string, maxReceiveCount int) error {
+	policy := ""
+	if targetArn != "" {
+		bJson, err := json.Marshal(map[string]string{
+			"maxReceiveCount":     strconv.Itoa(maxReceiveCount),
+			"deadLetterTargetArn": targetArn})
+		if err != nil {
+			return err
+		}
+
+		policy = string(bJson)
+	}
+
+	_, err := p.svcSqs.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl: &queueUrl,
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameRedrivePolicy: &policy}})
+
+	return err
+}
+
+func (p *SqsPlatform) getQueueArnFromUrl(queueUrl string) (string, error) {
+	name := sqs.QueueAttributeNameQueueArn
+	out, err := p.svcSqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueUrl,
+		AttributeNames: []*string{&name}})
+	if err != nil {
+		return "", err
+	}
+
+	arn, ok := out.Attributes[name]
+	if !ok {
+		return "", fmt.Errorf("No ARN returned for queue %s", queueUrl)
+	}
+
+	return *arn, nil
+}
+
+// drainDeadLetterQueue publishes every message in the cursor's dead-letter queue to its dead-letter stream.
+// Corrupt messages are quarantined and messages that can't be published are left in the queue to be tried again.
+func (p *SqsPlatform) drainDeadLetterQueue(cursor *cursorItem) error {
+	var maxNumberOfMessages int64 = 10
+	var waitTimeSeconds int64 = 0
+
+	for {
+		out, err := p.svcSqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            &cursor.deadLetterQueueUrl,
+			MaxNumberOfMessages: &maxNumberOfMessages,
+			WaitTimeSeconds:     &waitTimeSeconds})
+		if err != nil {
+			return err
+		}
+
+		if len(out.Messages) == 0 {
+			return nil
+		}
+
+		for _, msg := range out.Messages {
+			rec, err := recordFromMessage(msg)
+			if err != nil {
+				log.Printf("Quarantining corrupt dead-lettered message %s: %s", *msg.MessageId, err)
+				p.quarantineMessage(cursor, cursor.deadLetterQueueUrl, msg, err)
+				continue
+			}
+
+			err = p.publishDeadLetters(cursor, []*platform.DeadLetter{cursor.queueDeadLetter(rec)})
+			if err != nil {
+				return err
+			}
+
+			_, err = p.svcSqs.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      &cursor.deadLetterQueueUrl,
+				ReceiptHandle: msg.ReceiptHandle})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// queueDeadLetter wraps a record redriven from the cursor's queue. SQS doesn't keep a reason per message, so it's
+// given the cursor's most recent nack reason.
+func (c *cursorItem) queueDeadLetter(rec *platform.Record) *platform.DeadLetter {
+	reason := platform.DEAD_LETTER_LEASE_EXPIRED
+	if c.lastNackReason != "" {
+		reason = platform.DEAD_LETTER_NACKED
+	}
+
+	// Redrive happens after exactly maxReceiveCount deliveries
+	return platform.NewDeadLetter(rec, c.cursorId, reason, c.lastNackReason, c.maxDeliveries)
+}
+
+// publishDeadLetters publishes records the cursor has given up on to its dead-letter stream.
+func (p *SqsPlatform) publishDeadLetters(cursor *cursorItem, letters []*platform.DeadLetter) error {
+	contents := make([][]byte, len(letters))
+	for i, letter := range letters {
+		content, err := letter.Encode()
+		if err != nil {
+			return err
+		}
+
+		contents[i] = content
+	}
+
+	results, err := p.CreateRecords(cursor.deadLetterStreamId, contents, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+
+	return nil
+}
+
+// setNackReason remembers why the cursor's latest batch was nacked.
+func (p *SqsPlatform) setNackReason(streamId string, cursorId string, reason string) error {
+	if reason == "" {
+		// An empty string can't be stored, but the nack itself still counts
+		reason = platform.DEAD_LETTER_NACKED
+	}
+
+	return p.updateCursorDBItem(streamId, cursorId,
+		fmt.Sprintf("SET %s = :r", COLUMN_CURSOR_LASTNACKREASON),
+		map[string]*dynamodb.AttributeValue{
+			":r": &dynamodb.AttributeValue{S: &reason}})
+}
+
+func (p *SqsPlatform) clearNackReason(streamId string, cursorId string) error {
+	return p.updateCursorDBItem(streamId, cursorId,
+		fmt.Sprintf("REMOVE %s", COLUMN_CURSOR_LASTNACKREASON),
+		nil)
+}
+
+func (p *SqsPlatform) updateCursorDBItem(streamId string, cursorId string, update string, values map[string]*dynamodb.AttributeValue) error {
+	tableName := p.config.CursorsTable
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId},
+		COLUMN_CURSOR_ID: &dynamodb.AttributeValue{S: &cursorId}}
+	input := &dynamodb.UpdateItemInput{
+		TableName:        &tableName,
+		Key:              key,
+		UpdateExpression: &update}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err := p.svcDynamoDb.UpdateItem(input)
+
+	return err
+}
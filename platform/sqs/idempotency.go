@@ -0,0 +1,241 @@
+package sqs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/oceanhq/streams/platform"
+)
+
+const (
+	// A claim is pending while its record is published, and committed once it has been.
+	IDEMPOTENCY_PENDING   = "pending"
+	IDEMPOTENCY_COMMITTED = "committed"
+
+	// IDEMPOTENCY_PENDING_TIMEOUT is how long a pending claim holds its key. It is only reached if the publishing
+	// server dies or stalls, after which another request may take the key over.
+	IDEMPOTENCY_PENDING_TIMEOUT = 1 * time.Minute
+	// IDEMPOTENCY_PENDING_WAIT is how long a retried publish waits for a pending claim to be committed before it
+	// gives up with an ErrConflict.
+	IDEMPOTENCY_PENDING_WAIT  = 5 * time.Second
+	IDEMPOTENCY_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+// idempotencyClaim is an idempotency key held for a record that is being published. token tells this claim apart
+// from any other made for the same key once it has expired.
+type idempotencyClaim struct {
+	streamId string
+	key      string
+	token    string
+	window   time.Duration
+}
+
+// claimIdempotencyKey takes an idempotency key for content about to be published. The claim is pending until
+// commitIdempotencyKey records the published record against it, or releaseIdempotencyKey gives it up. When the key
+// was already committed within the stream's dedupe window, the record published then is returned instead, or
+// ErrIdempotencyKeyReused if its content differs. A key still pending for the same content is waited on for up to
+// IDEMPOTENCY_PENDING_WAIT, after which ErrConflict is returned. Nothing is claimed for an empty key.
+//
+// Claims are kept in the idempotency table, which should have DynamoDB's TTL enabled on ExpiresAt so that
+// expired keys are cleaned up. Until then an expired claim is simply overwritten.
+func (p *SqsPlatform) claimIdempotencyKey(stream *streamItem, key string, content []byte, contentHash string) (*idempotencyClaim, *platform.Record, error) {
+	if key == "" {
+		return nil, nil, nil
+	}
+
+	token, err := generateId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claim := &idempotencyClaim{
+		streamId: stream.streamId,
+		key:      key,
+		token:    token,
+		window:   stream.effectiveDedupeWindow()}
+
+	tableName := p.config.IdempotencyTable
+	state := IDEMPOTENCY_PENDING
+	condition := fmt.Sprintf("attribute_not_exists(%s) OR %s < :now", COLUMN_IDEMPOTENCY_KEY, COLUMN_IDEMPOTENCY_EXPIRESAT)
+	giveUpAt := time.Now().Add(IDEMPOTENCY_PENDING_WAIT)
+
+	for {
+		now := time.Now()
+		nowUnix := strconv.FormatInt(now.Unix(), 10)
+		expiresAt := strconv.FormatInt(now.Add(IDEMPOTENCY_PENDING_TIMEOUT).Unix(), 10)
+
+		_, err = p.svcDynamoDb.PutItem(&dynamodb.PutItemInput{
+			TableName: &tableName,
+			Item: map[string]*dynamodb.AttributeValue{
+				COLUMN_STREAM_ID:              &dynamodb.AttributeValue{S: &claim.streamId},
+				COLUMN_IDEMPOTENCY_KEY:        &dynamodb.AttributeValue{S: &key},
+				COLUMN_IDEMPOTENCY_STATE:      &dynamodb.AttributeValue{S: &state},
+				COLUMN_IDEMPOTENCY_CLAIMTOKEN: &dynamodb.AttributeValue{S: &token},
+				COLUMN_RECORD_CONTENTHASH:     &dynamodb.AttributeValue{S: &contentHash},
+				COLUMN_IDEMPOTENCY_EXPIRESAT:  &dynamodb.AttributeValue{N: &expiresAt}},
+			ConditionExpression: &condition,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": &dynamodb.AttributeValue{N: &nowUnix}}})
+		if err == nil {
+			return claim, nil, nil
+		}
+
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "ConditionalCheckFailedException" {
+			return nil, nil, err
+		}
+
+		// The key is taken, so look up the record it was claimed for
+		consistentRead := true
+		out, err := p.svcDynamoDb.GetItem(&dynamodb.GetItemInput{
+			TableName:      &tableName,
+			ConsistentRead: &consistentRead,
+			Key: map[string]*dynamodb.AttributeValue{
+				COLUMN_STREAM_ID:       &dynamodb.AttributeValue{S: &claim.streamId},
+				COLUMN_IDEMPOTENCY_KEY: &dynamodb.AttributeValue{S: &key}}})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(out.Item) == 0 {
+			// The claim was released or expired and was removed in between
+			continue
+		}
+
+		if hash := out.Item[COLUMN_RECORD_CONTENTHASH]; hash != nil && *hash.S != contentHash {
+			return nil, nil, &platform.ErrIdempotencyKeyReused{
+				IdempotencyKey: key,
+				StreamID:       claim.streamId}
+		}
+
+		if itemState := out.Item[COLUMN_IDEMPOTENCY_STATE]; itemState == nil || *itemState.S != IDEMPOTENCY_PENDING {
+			original, err := committedRecord(claim.streamId, out.Item, content)
+			if original != nil || err != nil {
+				return nil, original, err
+			}
+		}
+
+		// The original request is still publishing, so wait to see whether it succeeds
+		if now.After(giveUpAt) {
+			return nil, nil, &platform.ErrConflict{
+				Message: fmt.Sprintf("The record for idempotency key \"%s\" is still being published. Try again shortly.", key)}
+		}
+
+		time.Sleep(IDEMPOTENCY_POLL_INTERVAL)
+	}
+}
+
+// committedRecord rebuilds the record a committed claim was made for. content is the retried request's copy, which
+// stands in for the original as their hashes match. It returns nil if the claim hasn't been committed.
+func committedRecord(streamId string, item map[string]*dynamodb.AttributeValue, content []byte) (*platform.Record, error) {
+	recordId := item[COLUMN_RECORD_ID]
+	sequence := item[COLUMN_RECORD_SEQUENCE]
+	contentHash := item[COLUMN_RECORD_CONTENTHASH]
+	timestamp := item[COLUMN_RECORD_TIMESTAMP]
+	if recordId == nil || sequence == nil || contentHash == nil || timestamp == nil {
+		return nil, nil
+	}
+
+	original, err := time.Parse(TIME_FORMAT, *timestamp.S)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hex.DecodeString(*contentHash.S)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := strconv.ParseUint(*sequence.N, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &platform.Record{
+		Id:          *recordId.S,
+		StreamId:    streamId,
+		Sequence:    seq,
+		Content:     content,
+		ContentHash: hash,
+		Timestamp:   original}, nil
+}
+
+// commitIdempotencyKey records the published record against its claim, so that retries get it back for the rest
+// of the stream's dedupe window. The record has already been published, so failures are only logged: the claim
+// then expires after IDEMPOTENCY_PENDING_TIMEOUT, and a retry after that would publish the record again.
+func (p *SqsPlatform) commitIdempotencyKey(claim *idempotencyClaim, rec *record) {
+	if claim == nil {
+		return
+	}
+
+	tableName := p.config.IdempotencyTable
+	state := IDEMPOTENCY_COMMITTED
+	sequence := strconv.FormatUint(rec.Sequence, 10)
+	expiresAt := strconv.FormatInt(time.Now().Add(claim.window).Unix(), 10)
+	update := "SET #state = :state, #id = :id, #seq = :seq, #ts = :ts, #expires = :expires"
+	condition := "#token = :token"
+
+	_, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: &tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			COLUMN_STREAM_ID:       &dynamodb.AttributeValue{S: &claim.streamId},
+			COLUMN_IDEMPOTENCY_KEY: &dynamodb.AttributeValue{S: &claim.key}},
+		UpdateExpression:    &update,
+		ConditionExpression: &condition,
+		ExpressionAttributeNames: map[string]*string{
+			"#state":   aws.String(COLUMN_IDEMPOTENCY_STATE),
+			"#id":      aws.String(COLUMN_RECORD_ID),
+			"#seq":     aws.String(COLUMN_RECORD_SEQUENCE),
+			"#ts":      aws.String(COLUMN_RECORD_TIMESTAMP),
+			"#expires": aws.String(COLUMN_IDEMPOTENCY_EXPIRESAT),
+			"#token":   aws.String(COLUMN_IDEMPOTENCY_CLAIMTOKEN)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":state":   &dynamodb.AttributeValue{S: &state},
+			":id":      &dynamodb.AttributeValue{S: &rec.RecordId},
+			":seq":     &dynamodb.AttributeValue{N: &sequence},
+			":ts":      &dynamodb.AttributeValue{S: &rec.Timestamp},
+			":expires": &dynamodb.AttributeValue{N: &expiresAt},
+			":token":   &dynamodb.AttributeValue{S: &claim.token}}})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ConditionalCheckFailedException" {
+		log.Printf("Idempotency key %q on stream %s expired before record %s was published", claim.key, claim.streamId, rec.RecordId)
+	} else if err != nil {
+		log.Printf("Error committing idempotency key %q on stream %s: %s", claim.key, claim.streamId, err)
+	}
+}
+
+// releaseIdempotencyKey gives up a claim made for a record that couldn't be published, so the publish can be
+// retried with the same key. The claim is only removed if it is still pending and still this one.
+func (p *SqsPlatform) releaseIdempotencyKey(claim *idempotencyClaim) {
+	if claim == nil {
+		return
+	}
+
+	tableName := p.config.IdempotencyTable
+	state := IDEMPOTENCY_PENDING
+	condition := "#token = :token AND #state = :state"
+
+	_, err := p.svcDynamoDb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			COLUMN_STREAM_ID:       &dynamodb.AttributeValue{S: &claim.streamId},
+			COLUMN_IDEMPOTENCY_KEY: &dynamodb.AttributeValue{S: &claim.key}},
+		ConditionExpression: &condition,
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String(COLUMN_IDEMPOTENCY_CLAIMTOKEN),
+			"#state": aws.String(COLUMN_IDEMPOTENCY_STATE)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": &dynamodb.AttributeValue{S: &claim.token},
+			":state": &dynamodb.AttributeValue{S: &state}}})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ConditionalCheckFailedException" {
+		// The claim has already expired and been taken by another record
+		return
+	} else if err != nil {
+		// The claim expires on its own, so this only delays a retry with the same key
+		log.Printf("Error releasing idempotency key %q on stream %s: %s", claim.key, claim.streamId, err)
+	}
+}
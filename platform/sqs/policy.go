@@ -3,15 +3,12 @@ package sqs
 import (
 	"bytes"
 	"html/template"
-
-	"fmt"
-	"os"
 )
 
 const (
 	SQS_POLICY_TEMPLATE = `{
   "Version": "2012-10-17",
-  "Id": "{{.PredictSQSQueueARN}}/SQSDefaultPolicy",
+  "Id": "{{.QueueArn}}/SQSDefaultPolicy",
   "Statement": [
     {
       "Sid": "Sid1464041142853",
@@ -20,46 +17,22 @@ const (
         "AWS": "*"
       },
       "Action": "SQS:SendMessage",
-      "Resource": "{{.PredictSQSQueueARN}}",
+      "Resource": "{{.QueueArn}}",
       "Condition": {
         "ArnEquals": {
-          "aws:SourceArn": "{{.FetchSNSTopicARN}}"
+          "aws:SourceArn": "{{.TopicArn}}"
         }
       }
     }
   ]
 }`
-	SQS_QUEUE_ARN_FORMAT = `arn:aws:sqs:us-west-2:%s:%s`
 )
 
+// sqsPolicy allows the topic at TopicArn to send to the queue at QueueArn. Both are taken from AWS's responses
+// rather than built up, so that they're right whatever the region, account or endpoint.
 type sqsPolicy struct {
-	streamId string
-	cursorId string
-	topicArn string
-}
-
-func (p *sqsPolicy) PredictSQSQueueARN() string {
-	return getQueueArn(p.cursorId)
-}
-
-func (p *sqsPolicy) FetchSNSTopicARN() (string, error) {
-	err := validateId(p.streamId)
-	if err != nil {
-		return "", err
-	}
-
-	if p.topicArn != "" {
-		return p.topicArn, nil
-	}
-
-	topicArn, err := getStreamTopicArn(p.streamId)
-	if err != nil {
-		return "", err
-	}
-
-	p.topicArn = topicArn
-
-	return p.topicArn, nil
+	QueueArn string
+	TopicArn string
 }
 
 func (p *sqsPolicy) buildPolicy() (string, error) {
@@ -79,8 +52,3 @@ func (p *sqsPolicy) buildPolicy() (string, error) {
 
 	return policy, nil
 }
-
-func getQueueArn(cursorId string) string {
-	acctNum := os.Getenv("AWS_ACCOUNT_ID")
-	return fmt.Sprintf(SQS_QUEUE_ARN_FORMAT, acctNum, fmt.Sprintf("%s%s", SQS_QUEUE_PREFIX, cursorId))
-}
@@ -0,0 +1,100 @@
+package sqs
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SQS_MAX_MESSAGE_SIZE is the most SQS accepts in a message body, in bytes.
+const SQS_MAX_MESSAGE_SIZE = 256 * 1024
+
+// quarantinedMessage is the body sent to the quarantine queue for a message which couldn't be read. A body too big
+// to quarantine whole is cut short, with Truncated set and BodySize giving its original length.
+type quarantinedMessage struct {
+	StreamId      string `json:"streamId"`
+	CursorId      string `json:"cursorId"`
+	QueueUrl      string `json:"queueUrl"`
+	MessageId     string `json:"messageId"`
+	Body          string `json:"body"`
+	Truncated     bool   `json:"truncated,omitempty"`
+	BodySize      int    `json:"bodySize,omitempty"`
+	Error         string `json:"error"`
+	QuarantinedAt string `json:"quarantinedAt"`
+}
+
+// quarantineMessage moves a corrupt message out of queueUrl and into the quarantine queue with a note of what
+// was wrong with it. If it can't be quarantined it's left where it is, to be skipped again when it's redelivered.
+func (p *SqsPlatform) quarantineMessage(cursor *cursorItem, queueUrl string, msg *sqs.Message, cause error) {
+	err := p.sendToQuarantine(&quarantinedMessage{
+		StreamId:      cursor.streamId,
+		CursorId:      cursor.cursorId,
+		QueueUrl:      queueUrl,
+		MessageId:     *msg.MessageId,
+		Body:          *msg.Body,
+		Error:         cause.Error(),
+		QuarantinedAt: time.Now().UTC().Format(TIME_FORMAT)})
+	if err != nil {
+		log.Printf("Error quarantining message %s: %s", *msg.MessageId, err)
+		return
+	}
+
+	_, err = p.svcSqs.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      &queueUrl,
+		ReceiptHandle: msg.ReceiptHandle})
+	if err != nil {
+		// The message will come round again and be quarantined a second time
+		log.Printf("Error removing quarantined message %s: %s", *msg.MessageId, err)
+	}
+}
+
+func (p *SqsPlatform) sendToQuarantine(q *quarantinedMessage) error {
+	bJson, err := encodeQuarantined(q)
+	if err != nil {
+		return err
+	}
+
+	// Creating a queue that already exists just returns its URL
+	queueName := p.config.QuarantineQueue
+	out, err := p.svcSqs.CreateQueue(&sqs.CreateQueueInput{
+		QueueName: &queueName})
+	if err != nil {
+		return err
+	}
+
+	body := string(bJson)
+	_, err = p.svcSqs.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    out.QueueUrl,
+		MessageBody: &body})
+
+	return err
+}
+
+// encodeQuarantined encodes a quarantined message to send. A body that came close to the size limit is over it once
+// it has been escaped and wrapped, and would never leave its queue, so it's cut short until the message fits.
+func encodeQuarantined(q *quarantinedMessage) ([]byte, error) {
+	bJson, err := json.Marshal(q)
+	for err == nil && len(bJson) > SQS_MAX_MESSAGE_SIZE && q.Body != "" {
+		if !q.Truncated {
+			q.Truncated = true
+			q.BodySize = len(q.Body)
+		}
+
+		// Each byte cut saves at least one once encoded, and the cut is kept to a whole character
+		cut := len(q.Body) - (len(bJson) - SQS_MAX_MESSAGE_SIZE)
+		if cut < 0 {
+			cut = 0
+		}
+		for cut > 0 && !utf8.RuneStart(q.Body[cut]) {
+			cut--
+		}
+
+		q.Body = q.Body[:cut]
+		bJson, err = json.Marshal(q)
+	}
+
+	return bJson, err
+}
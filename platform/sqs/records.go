@@ -17,6 +17,12 @@ import (
 
 	"fmt"
 
+	"strconv"
+
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/oceanhq/streams/platform"
@@ -24,68 +30,403 @@ import (
 
 const (
 	TIME_FORMAT = time.RFC3339Nano
+
+	PUBLISH_CONCURRENCY  = 10
+	BATCH_WRITE_ATTEMPTS = 3
+
+	// PUBLISH_BATCH_SIZE is the most messages SNS accepts in one PublishBatch call.
+	PUBLISH_BATCH_SIZE = 10
 )
 
 var (
 	base64Encoding = base64.StdEncoding
 )
 
-func (p *SqsPlatform) CreateRecord(streamId string, content []byte) (*platform.Record, error) {
-	err := validateId(streamId)
+func (p *SqsPlatform) CreateRecord(streamId string, content []byte, idempotencyKey string) (*platform.Record, error) {
+	err := platform.ValidateIdempotencyKey(idempotencyKey)
 	if err != nil {
 		return nil, err
 	}
 
-	topicArn, err := getStreamTopicArn(streamId)
+	stream, err := p.getWritableStreamDBItem(streamId)
 	if err != nil {
 		return nil, err
 	}
 
-	recordId, err := generateId()
+	// A retried publish gets back the record it created the first time
+	hash := hashContent(content)
+	claim, original, err := p.claimIdempotencyKey(stream, idempotencyKey, content, hex.EncodeToString(hash))
+	if original != nil || err != nil {
+		return original, err
+	}
+
+	// Only records which will be published are numbered, so a retry doesn't leave a gap
+	sequence, timestamp, err := p.reserveSequences(streamId, 1)
 	if err != nil {
+		p.releaseIdempotencyKey(claim)
 		return nil, err
 	}
 
-	encContent := base64Encoding.EncodeToString(content)
+	record, res := newRecord(streamId, sequence, timestamp, content, hash)
 
-	hash := hashContent(content)
+	// Keep a copy of the record so that new cursors can replay the stream's history
+	err = p.createRecordDBItem(record)
+	if err == nil {
+		err = p.publishRecord(stream.topicArn, record)
+	}
+	if err != nil {
+		p.releaseIdempotencyKey(claim)
+		return nil, err
+	}
 
-	timestamp := time.Now().UTC()
+	p.commitIdempotencyKey(claim, record)
 
-	record := &record{
-		RecordId:    recordId,
-		StreamId:    streamId,
-		Content:     encContent,
-		ContentHash: hex.EncodeToString(hash),
-		Timestamp:   timestamp.Format(TIME_FORMAT)}
+	return res, nil
+}
 
-	bJson, err := json.Marshal(record)
+func (p *SqsPlatform) CreateRecords(streamId string, contents [][]byte, idempotencyKeys []string) ([]platform.RecordResult, error) {
+	stream, err := p.getWritableStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
 
-	// Base64 encode the content
-	enc := base64Encoding.EncodeToString(bJson)
+	if len(contents) == 0 {
+		return []platform.RecordResult{}, nil
+	}
 
-	out, err := svcSns.Publish(&sns.PublishInput{
-		TopicArn: &topicArn,
-		Message:  &enc})
+	results := make([]platform.RecordResult, len(contents))
+	records := make([]*record, len(contents))
+	keys := make([]string, len(contents))
+	hashes := make([][]byte, len(contents))
+	for i, content := range contents {
+		hashes[i] = hashContent(content)
+
+		if idempotencyKeys != nil {
+			keys[i] = idempotencyKeys[i]
+		}
+	}
+
+	// A key repeated within the batch is only claimed for its first record, so that the claims don't race
+	firsts := map[string]int{}
+	duplicateOf := make([]int, len(contents))
+	for i, key := range keys {
+		duplicateOf[i] = -1
+		if first, ok := firsts[key]; ok && key != "" {
+			duplicateOf[i] = first
+		} else {
+			firsts[key] = i
+		}
+	}
+
+	// Claim the batch's idempotency keys. Records published before are returned as they were and
+	// aren't published again.
+	claimed := make([]bool, len(contents))
+	claims := make([]*idempotencyClaim, len(contents))
+	inParallel(len(contents), func(i int) {
+		if duplicateOf[i] >= 0 {
+			return
+		}
+
+		err := platform.ValidateIdempotencyKey(keys[i])
+		if err != nil {
+			results[i] = platform.RecordResult{Err: err}
+			return
+		}
+
+		claim, original, err := p.claimIdempotencyKey(stream, keys[i], contents[i], hex.EncodeToString(hashes[i]))
+		if original != nil || err != nil {
+			results[i] = platform.RecordResult{Record: original, Err: err}
+			return
+		}
+
+		claims[i] = claim
+		claimed[i] = true
+	})
+
+	pending := []int{}
+	for i := range contents {
+		if claimed[i] {
+			pending = append(pending, i)
+		}
+	}
+
+	if len(pending) == 0 {
+		resolveDuplicates(streamId, results, keys, hashes, duplicateOf)
+		return results, nil
+	}
+
+	// The records still to publish are numbered at once, so they're numbered in order
+	first, timestamp, err := p.reserveSequences(streamId, len(pending))
 	if err != nil {
+		for _, i := range pending {
+			p.releaseIdempotencyKey(claims[i])
+		}
+
 		return nil, err
 	}
 
-	if *out.MessageId == "" {
-		return nil, errors.New("Failed to send message.")
+	for k, i := range pending {
+		records[i], results[i].Record = newRecord(streamId, first+uint64(k), timestamp, contents[i], hashes[i])
+	}
+
+	// Records which couldn't be stored aren't published
+	pendingRecords := make([]*record, len(pending))
+	for k, i := range pending {
+		pendingRecords[k] = records[i]
+	}
+	failures := p.createRecordDBItems(pendingRecords)
+
+	publishable := []int{}
+	for k, i := range pending {
+		if failures[k] != nil {
+			results[i] = platform.RecordResult{Err: failures[k]}
+			p.releaseIdempotencyKey(claims[i])
+		} else {
+			publishable = append(publishable, i)
+		}
+	}
+
+	toPublish := make([]*record, len(publishable))
+	for k, i := range publishable {
+		toPublish[k] = records[i]
+	}
+	failures = p.publishRecords(stream.topicArn, toPublish)
+
+	for k, i := range publishable {
+		if failures[k] != nil {
+			results[i] = platform.RecordResult{Err: failures[k]}
+			p.releaseIdempotencyKey(claims[i])
+		} else {
+			p.commitIdempotencyKey(claims[i], records[i])
+		}
 	}
 
+	resolveDuplicates(streamId, results, keys, hashes, duplicateOf)
+
+	return results, nil
+}
+
+// resolveDuplicates gives each record whose idempotency key was already used earlier in its batch the result of
+// the earlier record, as a retry would get, or ErrIdempotencyKeyReused if its content differs. duplicateOf holds
+// the index of the earlier record, or -1 for records whose key is the first of its kind.
+func resolveDuplicates(streamId string, results []platform.RecordResult, keys []string, hashes [][]byte, duplicateOf []int) {
+	for i, first := range duplicateOf {
+		if first < 0 {
+			continue
+		}
+
+		// An invalid key fails every record it's given to, whatever their content
+		_, invalid := results[first].Err.(*platform.ErrInvalidParam)
+		if invalid || bytes.Equal(hashes[i], hashes[first]) {
+			results[i] = results[first]
+		} else {
+			results[i] = platform.RecordResult{Err: &platform.ErrIdempotencyKeyReused{
+				IdempotencyKey: keys[i],
+				StreamID:       streamId}}
+		}
+	}
+}
+
+// inParallel calls fn with each index from 0 to n-1, spread over a pool of PUBLISH_CONCURRENCY workers.
+func inParallel(n int, fn func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < PUBLISH_CONCURRENCY; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// getWritableStreamTopicArn looks up the topic of a stream which records can be published to.
+func (p *SqsPlatform) getWritableStreamTopicArn(streamId string) (string, error) {
+	stream, err := p.getWritableStreamDBItem(streamId)
+	if err != nil {
+		return "", err
+	}
+
+	return stream.topicArn, nil
+}
+
+// getWritableStreamDBItem fetches a stream which records can be published to.
+func (p *SqsPlatform) getWritableStreamDBItem(streamId string) (*streamItem, error) {
+	err := validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	stream, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted streams are read-only until they're restored
+	if !stream.deletedAt.IsZero() {
+		return nil, &platform.ErrStreamDeleted{StreamID: streamId, PurgeAt: stream.purgeAt}
+	}
+
+	return stream, nil
+}
+
+// newRecord builds a record in both its message format and the format returned to callers. hash is the
+// content's hash, as given by hashContent.
+func newRecord(streamId string, sequence uint64, timestamp time.Time, content []byte, hash []byte) (*record, *platform.Record) {
+	encContent := base64Encoding.EncodeToString(content)
+
+	recordId := platform.FormatRecordId(streamId, sequence, timestamp)
+
+	rec := &record{
+		RecordId:    recordId,
+		StreamId:    streamId,
+		Sequence:    sequence,
+		Content:     encContent,
+		ContentHash: hex.EncodeToString(hash),
+		Timestamp:   timestamp.Format(TIME_FORMAT)}
+
 	res := &platform.Record{
 		Id:          recordId,
 		StreamId:    streamId,
+		Sequence:    sequence,
 		Content:     content,
 		ContentHash: hash,
 		Timestamp:   timestamp}
 
-	return res, nil
+	return rec, res
+}
+
+func (p *SqsPlatform) publishRecord(topicArn string, rec *record) error {
+	enc, err := encodeMessage(rec)
+	if err != nil {
+		return err
+	}
+
+	input := &sns.PublishInput{
+		TopicArn: &topicArn,
+		Message:  &enc}
+	if isFifo(topicArn) {
+		input.MessageGroupId = &rec.StreamId
+		input.MessageDeduplicationId = &rec.RecordId
+	}
+
+	out, err := p.svcSns.Publish(input)
+	if err != nil {
+		return err
+	}
+
+	if *out.MessageId == "" {
+		return errors.New("Failed to send message.")
+	}
+
+	return nil
+}
+
+// publishRecords publishes records in order with PublishBatch, returning the error, if any, for each record. On a
+// FIFO topic every record of a stream is in the same message group, so cursors receive them in this order too.
+func (p *SqsPlatform) publishRecords(topicArn string, recs []*record) []error {
+	failures := make([]error, len(recs))
+
+	for offset := 0; offset < len(recs); offset += PUBLISH_BATCH_SIZE {
+		end := offset + PUBLISH_BATCH_SIZE
+		if end > len(recs) {
+			end = len(recs)
+		}
+
+		// Entries are matched back up to their records by ID, which is their index in recs
+		entries := []*sns.PublishBatchRequestEntry{}
+		for i := offset; i < end; i++ {
+			enc, err := encodeMessage(recs[i])
+			if err != nil {
+				failures[i] = err
+				continue
+			}
+
+			entry := &sns.PublishBatchRequestEntry{
+				Id:      aws.String(strconv.Itoa(i)),
+				Message: aws.String(enc)}
+			if isFifo(topicArn) {
+				entry.MessageGroupId = &recs[i].StreamId
+				entry.MessageDeduplicationId = &recs[i].RecordId
+			}
+			entries = append(entries, entry)
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		out, err := p.svcSns.PublishBatch(&sns.PublishBatchInput{
+			TopicArn:                   &topicArn,
+			PublishBatchRequestEntries: entries})
+		if err != nil {
+			for i := offset; i < end; i++ {
+				if failures[i] == nil {
+					failures[i] = err
+				}
+			}
+			continue
+		}
+
+		for _, failed := range out.Failed {
+			i, err := strconv.Atoi(*failed.Id)
+			if err != nil || i < offset || i >= end {
+				continue
+			}
+
+			failures[i] = fmt.Errorf("Failed to send message. %s: %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+		}
+	}
+
+	return failures
+}
+
+// encodeMessage gives the message published to a stream's topic for a record.
+func encodeMessage(rec *record) (string, error) {
+	bJson, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	// Base64 encode the content
+	return base64Encoding.EncodeToString(bJson), nil
+}
+
+// GetRecord reads a record from the ocean-records table, so unlike GetRecords it doesn't touch any queue.
+func (p *SqsPlatform) GetRecord(streamId string, recordId string) (*platform.Record, error) {
+	err := validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	_, err = p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := p.findRecordDBItem(streamId, recordId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return recordFromDBItem(item)
 }
 
-func (p *SqsPlatform) GetRecords(streamId string, cursorId string) ([]platform.Record, error) {
+func (p *SqsPlatform) GetRecords(streamId string, cursorId string, wait time.Duration) (*platform.Batch, error) {
 	err := validateId(streamId)
 	if err != nil {
 		// This is an expected error so don't treat as fatal.
@@ -106,98 +447,436 @@ func (p *SqsPlatform) GetRecords(streamId string, cursorId string) ([]platform.R
 
 		err = &platform.ErrInvalidParam{
 			Param: "CursorID",
-			Value: streamId,
+			Value: cursorId,
 			Err:   err}
 
 		return nil, err
 	}
 
 	var maxNumberOfMessages int64 = 10
-	queueUrl, err := getCursorQueueUrl(streamId, cursorId)
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
 	if err != nil {
 		// This is an expected error (in the event the cursor does not exist) so don't treat as fatal.
-		log.Printf("Error getting cursor Queue URL: %s", err)
+		log.Printf("Error getting cursor: %s", err)
 		return nil, err
 	}
 
-	out, err := svcSqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+	// Cursors started before the latest record replay the records table before switching over to their queue
+	if cursor.backfilling() {
+		batch, err := p.readBackfill(streamId, cursorId, cursor)
+		if err != nil || batch != nil {
+			return batch, err
+		}
+	}
+	queueUrl := cursor.queueUrl
+
+	// Move anything the queue's redrive policy has given up on to the dead-letter stream
+	if cursor.deadLetterQueueUrl != "" {
+		err = p.drainDeadLetterQueue(cursor)
+		if err != nil {
+			log.Printf("Error draining dead-letter queue for cursor %s: %s", cursorId, err)
+		}
+	}
+
+	// Received messages stay invisible to other reads until they are deleted by AckRecords or
+	// the visibility timeout lapses, at which point SQS redelivers them.
+	// Waiting maps directly onto SQS long polling, which returns as soon as any message is available.
+	visibilityTimeout := int64(p.leaseTimeout().Seconds())
+	if wait > platform.MAX_WAIT {
+		wait = platform.MAX_WAIT
+	}
+	waitTimeSeconds := int64(wait.Seconds())
+	out, err := p.svcSqs.ReceiveMessage(&sqs.ReceiveMessageInput{
 		MaxNumberOfMessages: &maxNumberOfMessages,
+		VisibilityTimeout:   &visibilityTimeout,
+		WaitTimeSeconds:     &waitTimeSeconds,
 		QueueUrl:            &queueUrl})
 	if err != nil {
-		log.Fatalf("Error receiving message from SQS service: %s", err)
+		log.Printf("Error receiving message from SQS service: %s", err)
 		return nil, err
 	}
 
-	results := make([]platform.Record, len(out.Messages))
-	for k, sqsMessage := range out.Messages {
-		bodyJson := *sqsMessage.Body
-
-		body := &sqsMessageBody{}
-		err = json.Unmarshal([]byte(bodyJson), body)
+	results := []platform.Record{}
+	receiptHandles := []string{}
+	skipped := 0
+	for _, sqsMessage := range out.Messages {
+		rec, err := recordFromMessage(sqsMessage)
 		if err != nil {
-			log.Fatalf("Error parsing message body json: %s", err)
+			// One bad message shouldn't hold up the rest, so it's set aside for inspection
+			log.Printf("Quarantining corrupt message %s on cursor %s: %s", *sqsMessage.MessageId, cursorId, err)
+			p.quarantineMessage(cursor, queueUrl, sqsMessage, err)
+			skipped++
+			continue
+		}
 
-			// This will mean we return none of the records on error which may not be ideal
-			return nil, err
+		// Records published while the cursor switched over from the records table were read from there already
+		if rec.Sequence <= cursor.cutover {
+			_, err = p.svcSqs.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      &queueUrl,
+				ReceiptHandle: sqsMessage.ReceiptHandle})
+			if err != nil {
+				log.Printf("Error deleting message %s already read by cursor %s: %s", *sqsMessage.MessageId, cursorId, err)
+			}
+			continue
 		}
 
-		// Deserialize internal message format
-		bJson, err := base64Encoding.DecodeString(body.Message)
-		if err != nil {
-			log.Fatalf("Error decoding message body: %s (body: %s)", err, body)
+		results = append(results, *rec)
+		receiptHandles = append(receiptHandles, *sqsMessage.ReceiptHandle)
+	}
 
-			// This will mean we return none of the records on error which may not be ideal
-			return nil, err
+	res := &platform.Batch{
+		Records: results,
+		Skipped: skipped}
+
+	if len(receiptHandles) > 0 {
+		// A FIFO queue delivers the stream's records in order, so the batch commits the cursor up to its last
+		// record. Standard queues aren't ordered, so there it can only commit up to its oldest.
+		commit := results[len(results)-1]
+		if !isFifo(queueUrl) {
+			for _, rec := range results {
+				if formatSortKey(rec.Timestamp, rec.Id) < formatSortKey(commit.Timestamp, commit.Id) {
+					commit = rec
+				}
+			}
 		}
 
-		rec := &record{}
-		err = json.Unmarshal(bJson, rec)
+		res.Receipt, err = encodeReceipt(&receipt{
+			ReceiptHandles: receiptHandles,
+			Commit:         formatSortKey(commit.Timestamp, commit.Id),
+			Position:       commit.Sequence})
 		if err != nil {
-			log.Fatalf("Error parsing message json: %s", err)
-
-			// This will mean we return none of the records on error which may not be ideal
 			return nil, err
 		}
+	}
 
-		// Compute a fresh hash
-		bContent, err := base64Encoding.DecodeString(rec.Content)
-		if err != nil {
-			log.Fatalf("Error decoding record content: %s", err)
+	return res, nil
+}
 
-			// This will mean we return none of the records on error which may not be ideal
-			return nil, err
-		}
-		hash := hashContent(bContent)
+func (p *SqsPlatform) AckRecords(streamId string, cursorId string, receipt string) error {
+	err := validateId(streamId)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
 
-		// Compare the hashes to ensure the data integrity
-		originalHash, err := hex.DecodeString(rec.ContentHash)
+	err = validateId(cursorId)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	decoded, err := decodeReceipt(receipt)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "Receipt",
+			Value: receipt,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if decoded.isBackfill() {
+		return p.ackBackfill(streamId, cursorId, receipt, decoded)
+	}
+
+	queueUrl := cursor.queueUrl
+	receiptHandles := decoded.ReceiptHandles
+
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(receiptHandles))
+	for k := range receiptHandles {
+		id := fmt.Sprintf("%d", k)
+		entries[k] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            &id,
+			ReceiptHandle: &receiptHandles[k]}
+	}
+
+	out, err := p.svcSqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: &queueUrl,
+		Entries:  entries})
+	if err != nil {
+		return err
+	}
+
+	// Receipt handles are rejected once their messages have been redelivered.
+	if len(out.Failed) > 0 {
+		log.Printf("Failed to delete %d of %d messages for cursor %s: %s", len(out.Failed), len(entries), cursorId, *out.Failed[0].Code)
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	if cursor.lastNackReason != "" {
+		err = p.clearNackReason(streamId, cursorId)
 		if err != nil {
-			log.Fatalf("Error decoding original record content hash: %s", err)
+			return err
+		}
+	}
 
-			return nil, err
+	return p.commitQueueBatch(streamId, cursorId, decoded.Commit, decoded.Position)
+}
+
+func (p *SqsPlatform) NackRecords(streamId string, cursorId string, receipt string, reason string) error {
+	err := validateId(streamId)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	err = validateId(cursorId)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "CursorID",
+			Value: cursorId,
+			Err:   err}
+	}
+
+	decoded, err := decodeReceipt(receipt)
+	if err != nil {
+		return &platform.ErrInvalidParam{
+			Param: "Receipt",
+			Value: receipt,
+			Err:   err}
+	}
+
+	cursor, err := p.getCursorDBItem(streamId, cursorId)
+	if err != nil {
+		return err
+	}
+
+	if decoded.isBackfill() {
+		return p.nackBackfill(streamId, cursorId, receipt, decoded, reason, cursor)
+	}
+
+	// Making the messages visible again has SQS redeliver them straight away
+	queueUrl := cursor.queueUrl
+	receiptHandles := decoded.ReceiptHandles
+	var visibilityTimeout int64 = 0
+
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(receiptHandles))
+	for k := range receiptHandles {
+		id := fmt.Sprintf("%d", k)
+		entries[k] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                &id,
+			ReceiptHandle:     &receiptHandles[k],
+			VisibilityTimeout: &visibilityTimeout}
+	}
+
+	out, err := p.svcSqs.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: &queueUrl,
+		Entries:  entries})
+	if err != nil {
+		return err
+	}
+
+	if len(out.Failed) > 0 {
+		log.Printf("Failed to release %d of %d messages for cursor %s: %s", len(out.Failed), len(entries), cursorId, *out.Failed[0].Code)
+		return &platform.ErrReceiptNotFound{Receipt: receipt, CursorID: cursorId}
+	}
+
+	// SQS doesn't keep a reason with each message, so the cursor remembers the latest one for its dead letters
+	return p.setNackReason(streamId, cursorId, reason)
+}
+
+// receipt identifies a leased batch. Batches read from the queue carry the SQS receipt handles of
+// their messages and the sort key of the record acknowledging them commits the cursor up to, while
+// backfilled batches carry the range of sort keys they cover and their lease. Position is the sequence
+// number of the record the batch commits the cursor up to.
+type receipt struct {
+	ReceiptHandles []string `json:"handles,omitempty"`
+	BackfillFrom   string   `json:"from,omitempty"`
+	BackfillTo     string   `json:"to,omitempty"`
+	Lease          string   `json:"lease,omitempty"`
+	Commit         string   `json:"commit,omitempty"`
+	Position       uint64   `json:"position,omitempty"`
+}
+
+func (r *receipt) isBackfill() bool {
+	return r.BackfillTo != ""
+}
+
+// encodeReceipt packs a receipt into a single opaque string for clients.
+func encodeReceipt(r *receipt) (string, error) {
+	bJson, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(bJson), nil
+}
+
+func decodeReceipt(encoded string) (*receipt, error) {
+	if encoded == "" {
+		return nil, errors.New("Receipt must not be empty")
+	}
+
+	bJson, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &receipt{}
+	err = json.Unmarshal(bJson, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.isBackfill() && (len(r.ReceiptHandles) == 0 || len(r.ReceiptHandles) > 10) {
+		return nil, errors.New("Receipt is malformed")
+	}
+
+	return r, nil
+}
+
+// recordFromMessage decodes a record delivered to a cursor queue by the stream topic, verifying its content hash.
+func recordFromMessage(sqsMessage *sqs.Message) (*platform.Record, error) {
+	body := &sqsMessageBody{}
+	err := json.Unmarshal([]byte(*sqsMessage.Body), body)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing message body json: %s", err)
+	}
+
+	// Deserialize internal message format
+	bJson, err := base64Encoding.DecodeString(body.Message)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding message body: %s (body: %s)", err, body)
+	}
+
+	rec := &record{}
+	err = json.Unmarshal(bJson, rec)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing message json: %s", err)
+	}
+
+	// Compute a fresh hash
+	bContent, err := base64Encoding.DecodeString(rec.Content)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding record content: %s", err)
+	}
+	hash := hashContent(bContent)
+
+	// Compare the hashes to ensure the data integrity
+	originalHash, err := hex.DecodeString(rec.ContentHash)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding original record content hash: %s", err)
+	}
+	if !bytes.Equal(hash, originalHash) {
+		return nil, fmt.Errorf("The content hash did not match the content. Expected: %X; Received: %X", originalHash, hash)
+	}
+
+	timestamp, err := time.Parse(TIME_FORMAT, rec.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing record timestamp: %s", err)
+	}
+
+	res := &platform.Record{
+		Id:          rec.RecordId,
+		StreamId:    rec.StreamId,
+		Sequence:    rec.Sequence,
+		Content:     bContent,
+		ContentHash: hash,
+		Timestamp:   timestamp}
+
+	return res, nil
+}
+
+func (p *SqsPlatform) createRecordDBItem(rec *record) error {
+	tableName := p.config.RecordsTable
+
+	_, err := p.svcDynamoDb.PutItem(&dynamodb.PutItemInput{
+		TableName: &tableName,
+		Item:      recordDBItemAttrs(rec)})
+
+	return err
+}
+
+// createRecordDBItems stores a batch of records, returning the error, if any, for each record.
+func (p *SqsPlatform) createRecordDBItems(recs []*record) []error {
+	tableName := p.config.RecordsTable
+	failures := make([]error, len(recs))
+
+	// BatchWriteItem accepts up to 25 requests at a time
+	for offset := 0; offset < len(recs); offset += 25 {
+		end := offset + 25
+		if end > len(recs) {
+			end = len(recs)
 		}
-		if !bytes.Equal(hash, originalHash) {
-			err = errors.New(fmt.Sprintf("The content hash did not match the content. Expected: %X; Received: %X", originalHash, hash))
-			log.Fatalf("Error validating content hash: %s", err)
 
-			return nil, err
+		// Requests are matched back up to their records by sort key when DynamoDB leaves some unprocessed
+		pending := map[string]int{}
+		requests := []*dynamodb.WriteRequest{}
+		for i := offset; i < end; i++ {
+			attrs := recordDBItemAttrs(recs[i])
+			pending[*attrs[COLUMN_RECORD_SORTKEY].S] = i
+			requests = append(requests, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: attrs}})
 		}
 
-		timestamp, err := time.Parse(TIME_FORMAT, rec.Timestamp)
-		if err != nil {
-			log.Fatalf("Error parsing record timestamp: %s", err)
-			return nil, err
+		for attempt := 0; len(requests) > 0; attempt++ {
+			if attempt == BATCH_WRITE_ATTEMPTS {
+				for _, i := range pending {
+					failures[i] = errors.New("Failed to store record.")
+				}
+				break
+			} else if attempt > 0 {
+				// Unprocessed items mean the table is being throttled, so back off before retrying
+				time.Sleep(time.Duration(attempt*100) * time.Millisecond)
+			}
+
+			out, err := p.svcDynamoDb.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{
+					tableName: requests}})
+			if err != nil {
+				for _, i := range pending {
+					failures[i] = err
+				}
+				break
+			}
+
+			requests = out.UnprocessedItems[tableName]
+			unprocessed := map[string]int{}
+			for _, req := range requests {
+				sortKey := *req.PutRequest.Item[COLUMN_RECORD_SORTKEY].S
+				unprocessed[sortKey] = pending[sortKey]
+			}
+			pending = unprocessed
 		}
+	}
 
-		results[k] = platform.Record{
-			Id:          rec.RecordId,
-			StreamId:    rec.StreamId,
-			Content:     bContent,
-			ContentHash: hash,
-			Timestamp:   timestamp}
+	return failures
+}
+
+func recordDBItemAttrs(rec *record) map[string]*dynamodb.AttributeValue {
+	// Timestamps are only ever written by newRecord so they always parse
+	timestamp, _ := time.Parse(TIME_FORMAT, rec.Timestamp)
+	sortKey := formatSortKey(timestamp, rec.RecordId)
+	sequence := strconv.FormatUint(rec.Sequence, 10)
+
+	return map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID:          &dynamodb.AttributeValue{S: &rec.StreamId},
+		COLUMN_RECORD_SORTKEY:     &dynamodb.AttributeValue{S: &sortKey},
+		COLUMN_RECORD_ID:          &dynamodb.AttributeValue{S: &rec.RecordId},
+		COLUMN_RECORD_SEQUENCE:    &dynamodb.AttributeValue{N: &sequence},
+		COLUMN_RECORD_CONTENT:     &dynamodb.AttributeValue{S: &rec.Content},
+		COLUMN_RECORD_CONTENTHASH: &dynamodb.AttributeValue{S: &rec.ContentHash},
+		COLUMN_RECORD_TIMESTAMP:   &dynamodb.AttributeValue{S: &rec.Timestamp}}
+}
+
+// formatSortKey builds the records table range key. Keys sort by timestamp and then by record ID.
+// An empty record ID gives a key which sorts before every record written at that timestamp.
+func formatSortKey(timestamp time.Time, recordId string) string {
+	key := timestamp.UTC().Format(SORT_KEY_TIME_FORMAT)
+	if recordId == "" {
+		return key
 	}
 
-	return results, nil
+	return fmt.Sprintf("%s_%s", key, recordId)
 }
 
 func hashContent(content []byte) []byte {
@@ -209,6 +888,7 @@ func hashContent(content []byte) []byte {
 type record struct {
 	RecordId    string `json:"recordId"`
 	StreamId    string `json:"streamId"`
+	Sequence    uint64 `json:"sequence"`
 	Content     string `json:"content"`
 	ContentHash string `json:"contentHash"`
 	Timestamp   string `json:"timestamp"`
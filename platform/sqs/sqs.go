@@ -5,39 +5,303 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/oceanhq/streams/platform"
 )
 
 const (
 	ID_LENGTH          = 16 // 128-bit
 	DEFAULT_CURSOR_POS = "-1"
 
-	TABLE_STREAMS = "ocean-streams"
-	TABLE_CURSORS = "ocean-cursors"
+	DEFAULT_LEASE_TIMEOUT  = 30 * time.Second
+	DEFAULT_PURGE_INTERVAL = time.Minute
 
-	COLUMN_STREAM_ID          = "StreamId"
-	COLUMN_STREAM_NAME        = "Name"
-	COLUMN_STREAM_SNSTOPICARN = "SNSTopicARN"
-	COLUMN_CURSOR_ID          = "CursorId"
-	COLUMN_CURSOR_POSITION    = "Position"
-	COLUMN_CURSOR_SQSQUEUEURL = "SQSQueueURL"
+	// Defaults for the names in Config.
+	DEFAULT_TABLE_STREAMS     = "ocean-streams"
+	DEFAULT_TABLE_CURSORS     = "ocean-cursors"
+	DEFAULT_TABLE_RECORDS     = "ocean-records"
+	DEFAULT_TABLE_IDEMPOTENCY = "ocean-idempotency"
 
-	SNS_TOPIC_PREFIX = "ocean_stream-"
-	SQS_QUEUE_PREFIX = "ocean_cursor-"
-)
+	COLUMN_STREAM_ID                   = "StreamId"
+	COLUMN_STREAM_NAME                 = "Name"
+	COLUMN_STREAM_SNSTOPICARN          = "SNSTopicARN"
+	COLUMN_STREAM_DELETEDAT            = "DeletedAt"
+	COLUMN_STREAM_PURGEAT              = "PurgeAt"
+	COLUMN_STREAM_DEDUPEWINDOW         = "DedupeWindow"
+	COLUMN_STREAM_LASTSEQUENCE         = "LastSequence"
+	COLUMN_STREAM_LASTTIMESTAMP        = "LastTimestamp"
+	COLUMN_CURSOR_ID                   = "CursorId"
+	COLUMN_CURSOR_POSITION             = "Position"
+	COLUMN_CURSOR_SQSQUEUEURL          = "SQSQueueURL"
+	COLUMN_CURSOR_SNSSUBSCRIPTIONARN   = "SNSSubscriptionARN"
+	COLUMN_CURSOR_COMMITTED            = "CommittedSortKey"
+	COLUMN_CURSOR_BACKFILLFROM         = "BackfillFrom"
+	COLUMN_CURSOR_BACKFILLUNTIL        = "BackfillUntilSequence"
+	COLUMN_CURSOR_BACKFILLLEASE        = "BackfillLease"
+	COLUMN_CURSOR_BACKFILLLEASEEXPIRES = "BackfillLeaseExpires"
+	COLUMN_CURSOR_CUTOVER              = "CutoverSequence"
+	COLUMN_CURSOR_BACKFILLDELIVERIES   = "BackfillDeliveries"
+	COLUMN_CURSOR_DEADLETTERSTREAMID   = "DeadLetterStreamId"
+	COLUMN_CURSOR_MAXDELIVERIES        = "MaxDeliveries"
+	COLUMN_CURSOR_DEADLETTERQUEUEURL   = "DeadLetterQueueURL"
+	COLUMN_CURSOR_LASTNACKREASON       = "LastNackReason"
+	COLUMN_RECORD_SORTKEY              = "SortKey"
+	COLUMN_RECORD_ID                   = "RecordId"
+	COLUMN_RECORD_SEQUENCE             = "Sequence"
+	COLUMN_RECORD_CONTENT              = "Content"
+	COLUMN_RECORD_CONTENTHASH          = "ContentHash"
+	COLUMN_RECORD_TIMESTAMP            = "Timestamp"
+	COLUMN_IDEMPOTENCY_KEY             = "IdempotencyKey"
+	COLUMN_IDEMPOTENCY_EXPIRESAT       = "ExpiresAt"
+	COLUMN_IDEMPOTENCY_STATE           = "ClaimState"
+	COLUMN_IDEMPOTENCY_CLAIMTOKEN      = "ClaimToken"
+
+	// Keys of each record's entry in a cursor's BackfillDeliveries map.
+	BACKFILL_DELIVERY_COUNT        = "Count"
+	BACKFILL_DELIVERY_REASON       = "Reason"
+	BACKFILL_DELIVERY_MESSAGE      = "Message"
+	BACKFILL_DELIVERY_DEADLETTERED = "DeadLettered"
+
+	// Fixed-width so that record sort keys order lexically by time.
+	SORT_KEY_TIME_FORMAT = "2006-01-02T15:04:05.000000000Z"
+
+	// Topics and queues are FIFO, so that each stream's records reach its cursors in the order they were published.
+	// SNS and SQS require their names to end in FIFO_SUFFIX.
+	FIFO_SUFFIX = ".fifo"
 
-var (
-	sess        = session.New()
-	svcDynamoDb = dynamodb.New(sess)
-	svcSns      = sns.New(sess)
-	svcSqs      = sqs.New(sess)
+	DEFAULT_SNS_TOPIC_PREFIX             = "ocean_stream-"
+	DEFAULT_SQS_QUEUE_PREFIX             = "ocean_cursor-"
+	DEFAULT_SQS_DEAD_LETTER_QUEUE_SUFFIX = "-dlq"
+	DEFAULT_SQS_QUARANTINE_QUEUE         = "ocean_quarantine"
 )
 
+// Config locates the AWS resources an SqsPlatform uses. Any field left empty takes its default.
+type Config struct {
+	// Region is the AWS region to use. Defaults to the SDK's own, i.e. the AWS_REGION environment variable.
+	Region string
+	// Endpoint overrides the URL of every service, e.g. to run against LocalStack at http://localhost:4566.
+	Endpoint string
+
+	StreamsTable     string
+	CursorsTable     string
+	RecordsTable     string
+	IdempotencyTable string
+
+	// TopicPrefix and QueuePrefix are prepended to stream and cursor IDs to name their topics and queues.
+	TopicPrefix string
+	QueuePrefix string
+	// DeadLetterQueueSuffix is appended to a cursor's queue name to name the queue its redrive policy moves messages to.
+	DeadLetterQueueSuffix string
+	// QuarantineQueue is the queue corrupt messages from every cursor are moved to, along with why they couldn't be read.
+	QuarantineQueue string
+
+	// LeaseTimeout is used as the visibility timeout of received messages, i.e. how long a
+	// batch returned by GetRecords stays leased before SQS redelivers it.
+	// Defaults to DEFAULT_LEASE_TIMEOUT.
+	LeaseTimeout time.Duration
+
+	// PurgeInterval is how often Open's sweeper tears down deleted streams whose retention period is up.
+	// Defaults to DEFAULT_PURGE_INTERVAL.
+	PurgeInterval time.Duration
+}
+
 type SqsPlatform struct {
+	config Config
+
+	svcDynamoDb *dynamodb.DynamoDB
+	svcSns      *sns.SNS
+	svcSqs      *sqs.SQS
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// NewSqsPlatform creates a platform on the AWS resources described by config. The tables must already exist;
+// topics and queues are created as they're needed.
+func NewSqsPlatform(config Config) (*SqsPlatform, error) {
+	setDefault(&config.StreamsTable, DEFAULT_TABLE_STREAMS)
+	setDefault(&config.CursorsTable, DEFAULT_TABLE_CURSORS)
+	setDefault(&config.RecordsTable, DEFAULT_TABLE_RECORDS)
+	setDefault(&config.IdempotencyTable, DEFAULT_TABLE_IDEMPOTENCY)
+	setDefault(&config.TopicPrefix, DEFAULT_SNS_TOPIC_PREFIX)
+	setDefault(&config.QueuePrefix, DEFAULT_SQS_QUEUE_PREFIX)
+	setDefault(&config.DeadLetterQueueSuffix, DEFAULT_SQS_DEAD_LETTER_QUEUE_SUFFIX)
+	setDefault(&config.QuarantineQueue, DEFAULT_SQS_QUARANTINE_QUEUE)
+
+	awsConfig := &aws.Config{}
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+	if config.Endpoint != "" {
+		endpoint, err := url.Parse(config.Endpoint)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("Invalid endpoint \"%s\". Must be an absolute URL.", config.Endpoint)
+		}
+
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+
+	sess := session.New(awsConfig)
+	sess.Handlers.AfterRetry.PushBack(translateError)
+
+	return &SqsPlatform{
+		config:      config,
+		svcDynamoDb: dynamodb.New(sess),
+		svcSns:      sns.New(sess),
+		svcSqs:      sqs.New(sess)}, nil
+}
+
+func init() {
+	platform.Register("sqs", func(opts platform.Options) (platform.Platform, error) {
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		purgeInterval, err := opts.Duration("SQS_PURGE_INTERVAL", time.Second)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := NewSqsPlatform(Config{
+			Region:                opts["AWS_REGION"],
+			Endpoint:              opts["SQS_ENDPOINT"],
+			StreamsTable:          opts["SQS_STREAMS_TABLE"],
+			CursorsTable:          opts["SQS_CURSORS_TABLE"],
+			RecordsTable:          opts["SQS_RECORDS_TABLE"],
+			IdempotencyTable:      opts["SQS_IDEMPOTENCY_TABLE"],
+			TopicPrefix:           opts["SQS_TOPIC_PREFIX"],
+			QueuePrefix:           opts["SQS_QUEUE_PREFIX"],
+			DeadLetterQueueSuffix: opts["SQS_DEAD_LETTER_QUEUE_SUFFIX"],
+			QuarantineQueue:       opts["SQS_QUARANTINE_QUEUE"],
+			LeaseTimeout:          leaseTimeout,
+			PurgeInterval:         purgeInterval})
+		if err != nil {
+			return nil, err
+		}
+
+		p.Open()
+		return p, nil
+	})
+}
+
+// Open starts purging deleted streams in the background once their retention period is up, so that reads never
+// have to. Several servers sharing the tables can each run a sweeper.
+func (p *SqsPlatform) Open() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	go p.purgeEvery(p.purgeInterval(), p.stop)
+}
+
+// Close stops the sweeper started by Open.
+func (p *SqsPlatform) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+
+	return nil
+}
+
+func setDefault(value *string, def string) {
+	if *value == "" {
+		*value = def
+	}
+}
+
+func (p *SqsPlatform) purgeInterval() time.Duration {
+	if p.config.PurgeInterval <= 0 {
+		return DEFAULT_PURGE_INTERVAL
+	}
+
+	return p.config.PurgeInterval
+}
+
+func (p *SqsPlatform) leaseTimeout() time.Duration {
+	if p.config.LeaseTimeout <= 0 {
+		return DEFAULT_LEASE_TIMEOUT
+	}
+
+	return p.config.LeaseTimeout
+}
+
+// unavailableCodes are the AWS error codes for throttled requests and services which couldn't be reached or
+// failed internally. The SDK retries these itself, so any that reach the platform are reported as temporary.
+var unavailableCodes = map[string]bool{
+	"RequestError":                           true,
+	"RequestTimeout":                         true,
+	"RequestTimeoutException":                true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"LimitExceededException":                 true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"Throttled":                              true,
+	"RequestThrottled":                       true,
+	"InternalFailure":                        true,
+	"InternalError":                          true,
+	"InternalServerError":                    true,
+	"ServiceUnavailable":                     true,
+}
+
+// quotaCodes name the quota behind each AWS error code for a limit on what an account can create or store.
+var quotaCodes = map[string]string{
+	"TopicLimitExceeded":                       "SNS topics",
+	"SubscriptionLimitExceeded":                "SNS subscriptions",
+	"OverLimit":                                "SQS in-flight messages",
+	"ItemCollectionSizeLimitExceededException": "DynamoDB item collection size",
+}
+
+var serviceNames = map[string]string{
+	"dynamodb": "DynamoDB",
+	"sns":      "SNS",
+	"sqs":      "SQS",
+}
+
+// translateError runs once the SDK has given up retrying a request, turning throttling, connection and quota
+// errors into the platform's own. Any other error is left for the caller to inspect.
+func translateError(r *request.Request) {
+	awsErr, ok := r.Error.(awserr.Error)
+	if !ok {
+		return
+	}
+
+	if quota, ok := quotaCodes[awsErr.Code()]; ok {
+		r.Error = &platform.ErrQuotaExceeded{Quota: quota}
+	} else if unavailableCodes[awsErr.Code()] {
+		service := serviceNames[r.ClientInfo.ServiceName]
+		if service == "" {
+			service = r.ClientInfo.ServiceName
+		}
+
+		r.Error = &platform.ErrUnavailable{Service: service, Err: awsErr}
+	}
+}
+
+// isFifo reports whether the topic or queue with the given ARN or URL is FIFO. Streams created before topics were
+// FIFO keep their standard topics and queues, which don't keep records in order.
+func isFifo(arnOrUrl string) bool {
+	return strings.HasSuffix(arnOrUrl, FIFO_SUFFIX)
 }
 
 func generateId() (string, error) {
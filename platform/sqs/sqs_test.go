@@ -0,0 +1,463 @@
+package sqs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/oceanhq/streams/platform"
+	"github.com/oceanhq/streams/platform/platformtest"
+)
+
+// TEST_ENDPOINT_ENV names the environment variable holding the endpoint the tests run against, e.g. LocalStack's
+// http://localhost:4566. Each test gets its own tables, topics and queues, which are deleted afterwards.
+const TEST_ENDPOINT_ENV = "TEST_SQS_ENDPOINT"
+
+// testTables gives each table's key schema as its hash key and range key.
+var testTables = map[string][2]string{
+	"streams":     {COLUMN_STREAM_ID, ""},
+	"cursors":     {COLUMN_STREAM_ID, COLUMN_CURSOR_ID},
+	"records":     {COLUMN_STREAM_ID, COLUMN_RECORD_SORTKEY},
+	"idempotency": {COLUMN_STREAM_ID, COLUMN_IDEMPOTENCY_KEY},
+}
+
+func TestConformance(t *testing.T) {
+	endpoint := testEndpoint(t)
+
+	factory, removeLast := testPlatforms(endpoint)
+	defer removeLast()
+
+	platformtest.Run(t, factory)
+}
+
+func BenchmarkPlatform(b *testing.B) {
+	endpoint := testEndpoint(b)
+
+	factory, removeLast := testPlatforms(endpoint)
+	defer removeLast()
+
+	platformtest.Benchmark(b, factory)
+}
+
+// TestDeadLetterRedrivePolicy checks that a dead-letter policy is carried out with a redrive policy on the
+// cursor's queue, and that clearing it removes both the redrive policy and the dead-letter queue.
+func TestDeadLetterRedrivePolicy(t *testing.T) {
+	endpoint := testEndpoint(t)
+
+	factory, removeLast := testPlatforms(endpoint)
+	defer removeLast()
+
+	p, err := factory(platform.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := p.(*SqsPlatform)
+
+	stream := mustCreateStream(t, sp, "orders")
+	dlq := mustCreateStream(t, sp, "orders-dlq")
+	cursor, err := sp.CreateCursor(stream.Id, platform.StartPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sp.SetDeadLetterPolicy(stream.Id, cursor.Id, &platform.DeadLetterPolicy{StreamId: dlq.Id, MaxDeliveries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := sp.getCursorDBItem(stream.Id, cursor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.deadLetterQueueUrl == "" {
+		t.Fatal("The cursor has no dead-letter queue")
+	}
+
+	dlqArn, err := sp.getQueueArnFromUrl(item.deadLetterQueueUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redrive := redrivePolicy(t, sp, item.queueUrl)
+	if fmt.Sprint(redrive["deadLetterTargetArn"]) != dlqArn {
+		t.Errorf("deadLetterTargetArn = %v, want %s", redrive["deadLetterTargetArn"], dlqArn)
+	}
+	if fmt.Sprint(redrive["maxReceiveCount"]) != "2" {
+		t.Errorf("maxReceiveCount = %v, want 2", redrive["maxReceiveCount"])
+	}
+
+	// Out of deliveries, SQS redrives the record and the next read passes it on to the dead-letter stream
+	rec, err := sp.CreateRecord(stream.Id, []byte("poison"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		batch := mustGetRecords(t, sp, stream.Id, cursor.Id)
+		if len(batch.Records) != 1 || batch.Records[0].Id != rec.Id {
+			t.Fatalf("Delivery %d got %d records, want record %s", i+1, len(batch.Records), rec.Id)
+		}
+
+		err = sp.NackRecords(stream.Id, cursor.Id, batch.Receipt, "bad input")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch, err := sp.GetRecords(stream.Id, cursor.Id, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Records) != 0 {
+		t.Fatalf("Got %d records after the record was dead-lettered, want none", len(batch.Records))
+	}
+
+	dlqCursor, err := sp.CreateCursor(dlq.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters := mustGetRecords(t, sp, dlq.Id, dlqCursor.Id)
+	if len(letters.Records) != 1 {
+		t.Fatalf("Got %d dead letters, want 1", len(letters.Records))
+	}
+
+	var letter platform.DeadLetter
+	err = json.Unmarshal(letters.Records[0].Content, &letter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if letter.RecordId != rec.Id || letter.DeliveryCount != 2 || letter.Message != "bad input" {
+		t.Errorf("Dead letter = %+v, want record %s after 2 deliveries with message %q", letter, rec.Id, "bad input")
+	}
+
+	// Clearing the policy removes the redrive policy and deletes the dead-letter queue
+	_, err = sp.SetDeadLetterPolicy(stream.Id, cursor.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redrive := redrivePolicy(t, sp, item.queueUrl); len(redrive) != 0 {
+		t.Errorf("Redrive policy after clearing = %v, want none", redrive)
+	}
+
+	_, err = sp.svcSqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &item.deadLetterQueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)}})
+	if err == nil {
+		t.Error("The dead-letter queue still exists after clearing the policy")
+	}
+}
+
+// TestCursorPosition checks that a cursor's position follows its commits, whether from the records table or its
+// queue, and that seeking returns the cursor at its new position.
+func TestCursorPosition(t *testing.T) {
+	endpoint := testEndpoint(t)
+
+	factory, removeLast := testPlatforms(endpoint)
+	defer removeLast()
+
+	p, err := factory(platform.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := p.(*SqsPlatform)
+
+	stream := mustCreateStream(t, sp, "orders")
+	first, err := sp.CreateRecord(stream.Id, []byte("a"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sp.CreateRecord(stream.Id, []byte("b"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := sp.CreateCursor(stream.Id, platform.StartPosition{Type: platform.START_EARLIEST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Position != DEFAULT_CURSOR_POS {
+		t.Errorf("New cursor is at %s, want %s", cursor.Position, DEFAULT_CURSOR_POS)
+	}
+
+	// Both records are backfilled in one batch
+	batch := mustGetRecords(t, sp, stream.Id, cursor.Id)
+	err = sp.AckRecords(stream.Id, cursor.Id, batch.Receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPosition(t, sp, stream.Id, cursor.Id, "2")
+
+	// The backfill has caught up, so the next record comes through the queue
+	_, err = sp.CreateRecord(stream.Id, []byte("c"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch = mustGetRecords(t, sp, stream.Id, cursor.Id)
+	err = sp.AckRecords(stream.Id, cursor.Id, batch.Receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPosition(t, sp, stream.Id, cursor.Id, "3")
+
+	sought, err := sp.SeekCursor(stream.Id, cursor.Id, platform.StartPosition{Type: platform.START_AFTER_RECORD_ID, RecordId: first.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sought.Position != "1" {
+		t.Errorf("SeekCursor returned the cursor at %s, want 1", sought.Position)
+	}
+	expectPosition(t, sp, stream.Id, cursor.Id, "1")
+}
+
+func TestResolveDuplicates(t *testing.T) {
+	rec := &platform.Record{Id: "first"}
+	invalid := &platform.ErrInvalidParam{Param: "idempotencyKey"}
+	results := []platform.RecordResult{{Record: rec}, {}, {}, {Err: invalid}, {}}
+	keys := []string{"a", "a", "a", "long", "long"}
+	hashes := [][]byte{hashContent([]byte("x")), hashContent([]byte("x")), hashContent([]byte("y")), hashContent([]byte("x")), hashContent([]byte("y"))}
+
+	resolveDuplicates("stream", results, keys, hashes, []int{-1, 0, 0, -1, 3})
+
+	if results[1].Record != rec || results[1].Err != nil {
+		t.Errorf("Repeated key with the same content got %+v, want the first record", results[1])
+	}
+	if _, ok := results[2].Err.(*platform.ErrIdempotencyKeyReused); !ok {
+		t.Errorf("Repeated key with different content got %+v, want ErrIdempotencyKeyReused", results[2])
+	}
+	if results[4].Err != invalid {
+		t.Errorf("Repeated invalid key got %+v, want the first record's error", results[4])
+	}
+}
+
+func TestBackfillDeliveriesAttr(t *testing.T) {
+	deliveries := map[string]*backfillDelivery{
+		"a": {count: 3, reason: platform.DEAD_LETTER_NACKED, message: "bad input", deadLettered: true},
+		"b": {count: 1}}
+
+	decoded, err := backfillDeliveriesFromAttr(backfillDeliveriesToAttr(deliveries))
+	if err != nil {
+		t.Fatalf("Decoding deliveries: %s", err)
+	}
+
+	if len(decoded) != len(deliveries) {
+		t.Fatalf("Got %d deliveries, want %d", len(decoded), len(deliveries))
+	}
+	for id, d := range deliveries {
+		if *decoded[id] != *d {
+			t.Errorf("Record %s got %+v, want %+v", id, *decoded[id], *d)
+		}
+	}
+}
+
+func TestEncodeQuarantined(t *testing.T) {
+	// Control characters are escaped six bytes to one, and the accents stop a cut from landing on a whole byte
+	body := strings.Repeat("\x01é", SQS_MAX_MESSAGE_SIZE/3)
+	q := &quarantinedMessage{MessageId: "big", Body: body, Error: "Invalid record"}
+
+	encoded, err := encodeQuarantined(q)
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+
+	if len(encoded) > SQS_MAX_MESSAGE_SIZE {
+		t.Errorf("Encoded to %d bytes, want at most %d", len(encoded), SQS_MAX_MESSAGE_SIZE)
+	}
+	decoded := &quarantinedMessage{}
+	err = json.Unmarshal(encoded, decoded)
+	if err != nil {
+		t.Fatalf("Error decoding: %s", err)
+	}
+	if !decoded.Truncated || decoded.BodySize != len(body) {
+		t.Errorf("Got truncated %t with size %d, want true with %d", decoded.Truncated, decoded.BodySize, len(body))
+	}
+	if !utf8.ValidString(decoded.Body) || !strings.HasPrefix(body, decoded.Body) {
+		t.Errorf("Expected the body to be cut short at a whole character")
+	}
+
+	small := &quarantinedMessage{MessageId: "small", Body: "{}", Error: "Invalid record"}
+	encoded, err = encodeQuarantined(small)
+	if err != nil || small.Truncated || !strings.Contains(string(encoded), `"body":"{}"`) {
+		t.Errorf("Expected a small body to be sent whole, got %s, %v", encoded, err)
+	}
+}
+
+func testEndpoint(tb testing.TB) string {
+	endpoint := os.Getenv(TEST_ENDPOINT_ENV)
+	if endpoint == "" {
+		tb.Skipf("Set %s to run the SNS/SQS tests, e.g. against LocalStack", TEST_ENDPOINT_ENV)
+	}
+
+	// LocalStack accepts any credentials, but the SDK won't sign requests without some
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		tb.Setenv("AWS_ACCESS_KEY_ID", "test")
+		tb.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	if os.Getenv("AWS_REGION") == "" {
+		tb.Setenv("AWS_REGION", "us-east-1")
+	}
+
+	return endpoint
+}
+
+// testPlatforms returns a factory for platforms with tables, topics and queues of their own. Each platform's
+// resources are removed when the next is made, and removeLast removes the final one's.
+func testPlatforms(endpoint string) (factory platform.Factory, removeLast func()) {
+	var last *SqsPlatform
+
+	factory = func(opts platform.Options) (platform.Platform, error) {
+		if last != nil {
+			removeTestPlatform(last)
+		}
+
+		leaseTimeout, err := opts.LeaseTimeout()
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := generateId()
+		if err != nil {
+			return nil, err
+		}
+		prefix := "ocean-test-" + id[:8] + "-"
+
+		p, err := NewSqsPlatform(Config{
+			Endpoint:         endpoint,
+			StreamsTable:     prefix + "streams",
+			CursorsTable:     prefix + "cursors",
+			RecordsTable:     prefix + "records",
+			IdempotencyTable: prefix + "idempotency",
+			TopicPrefix:      prefix,
+			QueuePrefix:      prefix,
+			QuarantineQueue:  prefix + "quarantine",
+			LeaseTimeout:     leaseTimeout})
+		if err != nil {
+			return nil, err
+		}
+		last = p
+
+		for suffix, key := range testTables {
+			err = createTestTable(p, prefix+suffix, key[0], key[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return p, nil
+	}
+
+	removeLast = func() {
+		if last != nil {
+			removeTestPlatform(last)
+		}
+	}
+
+	return factory, removeLast
+}
+
+func createTestTable(p *SqsPlatform, name string, hashKey string, rangeKey string) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: &name,
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(hashKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)}},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(hashKey), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(100),
+			WriteCapacityUnits: aws.Int64(100)}}
+	if rangeKey != "" {
+		input.AttributeDefinitions = append(input.AttributeDefinitions,
+			&dynamodb.AttributeDefinition{AttributeName: aws.String(rangeKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)})
+		input.KeySchema = append(input.KeySchema,
+			&dynamodb.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: aws.String(dynamodb.KeyTypeRange)})
+	}
+
+	_, err := p.svcDynamoDb.CreateTable(input)
+	if err != nil {
+		return err
+	}
+
+	return p.svcDynamoDb.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: &name})
+}
+
+// removeTestPlatform purges every stream, which takes their topics and queues with them, then drops the tables.
+func removeTestPlatform(p *SqsPlatform) {
+	streams, err := p.ListStreams()
+	if err == nil {
+		for _, stream := range streams {
+			p.DeleteStream(stream.Id, 0)
+		}
+	}
+
+	out, err := p.svcSqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &p.config.QuarantineQueue})
+	if err == nil {
+		p.svcSqs.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: out.QueueUrl})
+	}
+
+	for _, table := range []string{p.config.StreamsTable, p.config.CursorsTable, p.config.RecordsTable, p.config.IdempotencyTable} {
+		p.svcDynamoDb.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	}
+}
+
+// redrivePolicy returns the queue's redrive policy, which is empty if it has none.
+func redrivePolicy(t *testing.T, p *SqsPlatform, queueUrl string) map[string]interface{} {
+	out, err := p.svcSqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameRedrivePolicy)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := map[string]interface{}{}
+	if attr := out.Attributes[sqs.QueueAttributeNameRedrivePolicy]; attr != nil && *attr != "" {
+		err = json.Unmarshal([]byte(*attr), &policy)
+		if err != nil {
+			t.Fatalf("Error decoding redrive policy %q: %s", *attr, err)
+		}
+	}
+
+	return policy
+}
+
+func expectPosition(t *testing.T, p *SqsPlatform, streamId string, cursorId string, want string) {
+	cursor, err := p.GetCursor(streamId, cursorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cursor.Position != want {
+		t.Errorf("Cursor is at %s, want %s", cursor.Position, want)
+	}
+}
+
+func mustCreateStream(t *testing.T, p *SqsPlatform, name string) *platform.Stream {
+	stream, err := p.CreateStream(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream
+}
+
+// mustGetRecords reads a batch, retrying for a while as SQS may take a moment to deliver.
+func mustGetRecords(t *testing.T, p *SqsPlatform, streamId string, cursorId string) *platform.Batch {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		batch, err := p.GetRecords(streamId, cursorId, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(batch.Records) > 0 || time.Now().After(deadline) {
+			return batch
+		}
+	}
+}
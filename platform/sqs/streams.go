@@ -1,58 +1,70 @@
 package sqs
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/oceanhq/streams/platform"
 )
 
 func (p *SqsPlatform) CreateStream(name string) (*platform.Stream, error) {
+	if name == "" {
+		return nil, &platform.ErrInvalidParam{Param: "name", Value: "", Err: errors.New("Must not be empty.")}
+	}
+
 	streamId, err := generateId()
 	if err != nil {
 		return nil, err
 	}
 
-	arn, err := createStreamSNSTopic(streamId)
+	arn, err := p.createStreamSNSTopic(streamId)
 	if err != nil {
 		return nil, err
 	}
 
-	err = createStreamDBItem(streamId, name, arn)
+	err = p.createStreamDBItem(streamId, name, arn)
 	if err != nil {
 		return nil, err
 	}
 
 	res := &platform.Stream{
-		Id:   streamId,
-		Name: name}
+		Id:           streamId,
+		Name:         name,
+		DedupeWindow: platform.DEFAULT_DEDUPE_WINDOW}
 
 	return res, nil
 }
 
-func createStreamDBItem(streamId string, name string, topicArn string) error {
-	tableName := TABLE_STREAMS
+func (p *SqsPlatform) createStreamDBItem(streamId string, name string, topicArn string) error {
+	tableName := p.config.StreamsTable
 
 	attrs := map[string]*dynamodb.AttributeValue{
 		COLUMN_STREAM_ID:          &dynamodb.AttributeValue{S: &streamId},
 		COLUMN_STREAM_NAME:        &dynamodb.AttributeValue{S: &name},
 		COLUMN_STREAM_SNSTOPICARN: &dynamodb.AttributeValue{S: &topicArn}}
 
-	_, err := svcDynamoDb.PutItem(&dynamodb.PutItemInput{
+	_, err := p.svcDynamoDb.PutItem(&dynamodb.PutItemInput{
 		TableName: &tableName,
 		Item:      attrs})
 
 	return err
 }
 
-func createStreamSNSTopic(streamId string) (string, error) {
-	topicName := fmt.Sprintf("%s%s", SNS_TOPIC_PREFIX, streamId)
-	out, err := svcSns.CreateTopic(&sns.CreateTopicInput{
-		Name: &topicName})
+func (p *SqsPlatform) createStreamSNSTopic(streamId string) (string, error) {
+	topicName := fmt.Sprintf("%s%s%s", p.config.TopicPrefix, streamId, FIFO_SUFFIX)
+	out, err := p.svcSns.CreateTopic(&sns.CreateTopicInput{
+		Name: &topicName,
+		Attributes: map[string]*string{
+			"FifoTopic": aws.String("true")}})
 	if err != nil {
 		return "", err
 	}
@@ -61,33 +73,96 @@ func createStreamSNSTopic(streamId string) (string, error) {
 }
 
 func (p *SqsPlatform) ListStreams() ([]platform.Stream, error) {
-	tableName := TABLE_STREAMS
+	items, err := p.scanStreamDBItems()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	streams := make([]platform.Stream, 0, len(items))
+	for _, item := range items {
+		// Deleted streams vanish once their retention period is up, even before they're purged
+		if item.expired(now) {
+			continue
+		}
+
+		streams = append(streams, *item.toExt())
+	}
+
+	return streams, nil
+}
 
-	// "Name" is a reserved keyword in DynamoDB so we need to use an ExpressionAttributeName to request it.
-	name := COLUMN_STREAM_NAME
-	ean := map[string]*string{
-		"#n": &name}
+// scanStreamDBItems reads every item in the streams table, a page at a time.
+func (p *SqsPlatform) scanStreamDBItems() ([]*streamItem, error) {
+	tableName := p.config.StreamsTable
+
+	items := []*streamItem{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := p.svcDynamoDb.Scan(&dynamodb.ScanInput{
+			TableName:         &tableName,
+			ExclusiveStartKey: startKey})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, attrs := range out.Items {
+			item, err := streamItemFromAttrs(attrs)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+
+		startKey = out.LastEvaluatedKey
+	}
+}
 
-	attrs := strings.Join([]string{COLUMN_STREAM_ID, "#n"}, ",")
+// purgeEvery purges expired streams until stop is closed.
+func (p *SqsPlatform) purgeEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := p.purgeExpiredStreams()
+		if err != nil {
+			log.Printf("Error purging expired streams: %s", err)
+		}
+	}
+}
 
-	out, err := svcDynamoDb.Scan(&dynamodb.ScanInput{
-		TableName:                &tableName,
-		ProjectionExpression:     &attrs,
-		ExpressionAttributeNames: ean})
+// purgeExpiredStreams tears down every deleted stream whose retention period is up. A stream that fails to purge
+// is logged and tried again on the next sweep.
+func (p *SqsPlatform) purgeExpiredStreams() error {
+	items, err := p.scanStreamDBItems()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	streams := make([]platform.Stream, *out.Count)
-	for idx, item := range out.Items {
-		stream := platform.Stream{
-			Id:   *(item[COLUMN_STREAM_ID].S),
-			Name: *(item[COLUMN_STREAM_NAME].S)}
+	now := time.Now()
+	for _, item := range items {
+		if !item.expired(now) {
+			continue
+		}
 
-		streams[idx] = stream
+		err = p.purgeStream(item)
+		if err != nil {
+			log.Printf("Error purging stream %s: %s", item.streamId, err)
+		}
 	}
 
-	return streams, nil
+	return nil
 }
 
 func (p *SqsPlatform) GetStream(streamId string) (*platform.Stream, error) {
@@ -104,22 +179,171 @@ func (p *SqsPlatform) GetStream(streamId string) (*platform.Stream, error) {
 		return nil, err
 	}
 
-	tableName := TABLE_STREAMS
+	item, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.toExt(), nil
+}
+
+func (p *SqsPlatform) DeleteStream(streamId string, retention time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	item, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if item.deletedAt.IsZero() {
+		item.deletedAt = now
+	}
+	item.purgeAt = now.Add(retention)
+
+	// Without a retention period there's nothing to restore so tear everything down straight away
+	if retention <= 0 {
+		return item.toExt(), p.purgeStream(item)
+	}
+
+	deletedAt := item.deletedAt.Format(TIME_FORMAT)
+	purgeAt := item.purgeAt.Format(TIME_FORMAT)
+	err = p.updateStreamDBItem(streamId,
+		fmt.Sprintf("SET %s = :d, %s = :p", COLUMN_STREAM_DELETEDAT, COLUMN_STREAM_PURGEAT),
+		map[string]*dynamodb.AttributeValue{
+			":d": &dynamodb.AttributeValue{S: &deletedAt},
+			":p": &dynamodb.AttributeValue{S: &purgeAt}})
+	if err != nil {
+		return nil, err
+	}
+
+	return item.toExt(), nil
+}
+
+func (p *SqsPlatform) RestoreStream(streamId string) (*platform.Stream, error) {
+	err := validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	item, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.updateStreamDBItem(streamId,
+		fmt.Sprintf("REMOVE %s, %s", COLUMN_STREAM_DELETEDAT, COLUMN_STREAM_PURGEAT), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	item.deletedAt = time.Time{}
+	item.purgeAt = time.Time{}
+
+	return item.toExt(), nil
+}
+
+func (p *SqsPlatform) SetDedupeWindow(streamId string, window time.Duration) (*platform.Stream, error) {
+	err := platform.ValidateDedupeWindow(window)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateId(streamId)
+	if err != nil {
+		return nil, &platform.ErrInvalidParam{
+			Param: "StreamID",
+			Value: streamId,
+			Err:   err}
+	}
+
+	item, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Windows are stored in whole seconds, matching the TTL on ocean-idempotency
+	seconds := strconv.FormatInt(int64(window/time.Second), 10)
+	err = p.updateStreamDBItem(streamId,
+		fmt.Sprintf("SET %s = :w", COLUMN_STREAM_DEDUPEWINDOW),
+		map[string]*dynamodb.AttributeValue{
+			":w": &dynamodb.AttributeValue{N: &seconds}})
+	if err != nil {
+		return nil, err
+	}
+
+	item.dedupeWindow = window / time.Second * time.Second
+
+	return item.toExt(), nil
+}
+
+func (p *SqsPlatform) getStreamTopicArn(streamId string) (string, error) {
+	item, err := p.getStreamDBItem(streamId)
+	if err != nil {
+		return "", err
+	}
+
+	return item.topicArn, nil
+}
+
+// streamItem holds the attributes of an ocean-streams item.
+type streamItem struct {
+	streamId  string
+	name      string
+	topicArn  string
+	deletedAt time.Time
+	purgeAt   time.Time
+	// dedupeWindow is zero unless the stream's default has been overridden.
+	dedupeWindow time.Duration
+}
+
+// expired reports whether a deleted stream's retention period is up.
+func (s *streamItem) expired(now time.Time) bool {
+	return !s.deletedAt.IsZero() && !now.Before(s.purgeAt)
+}
 
-	// "Name" is a reserved keyword in DynamoDB so we need to use an ExpressionAttributeName to request it.
-	name := COLUMN_STREAM_NAME
-	ean := map[string]*string{
-		"#n": &name}
+// effectiveDedupeWindow returns how long the stream remembers idempotency keys.
+func (s *streamItem) effectiveDedupeWindow() time.Duration {
+	if s.dedupeWindow == 0 {
+		return platform.DEFAULT_DEDUPE_WINDOW
+	}
 
-	attrs := fmt.Sprintf("%s,#n", COLUMN_STREAM_ID)
+	return s.dedupeWindow
+}
+
+func (s *streamItem) toExt() *platform.Stream {
+	return &platform.Stream{
+		Id:           s.streamId,
+		Name:         s.name,
+		DeletedAt:    s.deletedAt,
+		PurgeAt:      s.purgeAt,
+		DedupeWindow: s.effectiveDedupeWindow()}
+}
+
+// getStreamDBItem fetches a stream. One that was deleted and whose retention period is up is reported missing,
+// and left for the sweeper to purge.
+func (p *SqsPlatform) getStreamDBItem(streamId string) (*streamItem, error) {
+	tableName := p.config.StreamsTable
 
 	key := map[string]*dynamodb.AttributeValue{
 		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId}}
-	out, err := svcDynamoDb.GetItem(&dynamodb.GetItemInput{
-		TableName:                &tableName,
-		ExpressionAttributeNames: ean,
-		ProjectionExpression:     &attrs,
-		Key:                      key})
+	out, err := p.svcDynamoDb.GetItem(&dynamodb.GetItemInput{
+		TableName: &tableName,
+		Key:       key})
 	if err != nil {
 		return nil, err
 	}
@@ -130,32 +354,206 @@ func (p *SqsPlatform) GetStream(streamId string) (*platform.Stream, error) {
 			Value:       streamId}
 	}
 
-	res := &platform.Stream{
-		Id:   *(out.Item[COLUMN_STREAM_ID].S),
-		Name: *(out.Item[COLUMN_STREAM_NAME].S)}
+	item, err := streamItemFromAttrs(out.Item)
+	if err != nil {
+		return nil, err
+	}
 
-	return res, nil
+	if item.expired(time.Now()) {
+		return nil, &platform.ErrStreamNotFound{
+			SearchParam: "ID",
+			Value:       streamId}
+	}
+
+	return item, nil
+}
+
+func streamItemFromAttrs(attrs map[string]*dynamodb.AttributeValue) (*streamItem, error) {
+	item := &streamItem{
+		streamId: *(attrs[COLUMN_STREAM_ID].S),
+		name:     *(attrs[COLUMN_STREAM_NAME].S),
+		topicArn: *(attrs[COLUMN_STREAM_SNSTOPICARN].S)}
+
+	var err error
+	if attr, ok := attrs[COLUMN_STREAM_DELETEDAT]; ok {
+		item.deletedAt, err = time.Parse(TIME_FORMAT, *attr.S)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if attr, ok := attrs[COLUMN_STREAM_PURGEAT]; ok {
+		item.purgeAt, err = time.Parse(TIME_FORMAT, *attr.S)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if attr, ok := attrs[COLUMN_STREAM_DEDUPEWINDOW]; ok {
+		seconds, err := strconv.ParseInt(*attr.N, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		item.dedupeWindow = time.Duration(seconds) * time.Second
+	}
+
+	return item, nil
 }
 
-func getStreamTopicArn(streamId string) (string, error) {
-	tableName := TABLE_STREAMS
-	attrs := strings.Join([]string{COLUMN_STREAM_SNSTOPICARN}, ",")
+func (p *SqsPlatform) updateStreamDBItem(streamId string, update string, values map[string]*dynamodb.AttributeValue) error {
+	tableName := p.config.StreamsTable
+
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId}}
+	input := &dynamodb.UpdateItemInput{
+		TableName:        &tableName,
+		Key:              key,
+		UpdateExpression: &update}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err := p.svcDynamoDb.UpdateItem(input)
 
+	return err
+}
+
+// reserveSequences takes the next n sequence numbers for records published to a stream, returning the first of
+// them and the timestamp the records are given. The stream's item counts them with an atomic ADD, so no number is
+// handed out twice, but those taken by records which then fail to publish are skipped.
+//
+// The item also keeps the latest timestamp handed out, in Unix nanoseconds. A server whose clock is behind it gets
+// that timestamp instead of its own, so that timestamps never go backwards as sequence numbers go up.
+func (p *SqsPlatform) reserveSequences(streamId string, n int) (uint64, time.Time, error) {
+	tableName := p.config.StreamsTable
 	key := map[string]*dynamodb.AttributeValue{
 		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &streamId}}
-	out, err := svcDynamoDb.GetItem(&dynamodb.GetItemInput{
-		TableName:            &tableName,
-		ProjectionExpression: &attrs,
-		Key:                  key})
+	count := strconv.Itoa(n)
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	returnValues := dynamodb.ReturnValueAllNew
+
+	// Usually the clock is ahead of every timestamp so far, and becomes the latest
+	update := fmt.Sprintf("ADD %s :n SET %s = :now", COLUMN_STREAM_LASTSEQUENCE, COLUMN_STREAM_LASTTIMESTAMP)
+	condition := fmt.Sprintf("attribute_exists(%s) AND (attribute_not_exists(%s) OR %s <= :now)",
+		COLUMN_STREAM_ID, COLUMN_STREAM_LASTTIMESTAMP, COLUMN_STREAM_LASTTIMESTAMP)
+	out, err := p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &tableName,
+		Key:                 key,
+		UpdateExpression:    &update,
+		ConditionExpression: &condition,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":n":   &dynamodb.AttributeValue{N: &count},
+			":now": &dynamodb.AttributeValue{N: &now}},
+		ReturnValues: &returnValues})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ConditionalCheckFailedException" {
+		// Either another server has handed out a later timestamp, which is reused, or the stream has gone
+		update = fmt.Sprintf("ADD %s :n", COLUMN_STREAM_LASTSEQUENCE)
+		condition = fmt.Sprintf("attribute_exists(%s)", COLUMN_STREAM_ID)
+		out, err = p.svcDynamoDb.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:           &tableName,
+			Key:                 key,
+			UpdateExpression:    &update,
+			ConditionExpression: &condition,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":n": &dynamodb.AttributeValue{N: &count}},
+			ReturnValues: &returnValues})
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ConditionalCheckFailedException" {
+		// The stream was purged after it was looked up
+		return 0, time.Time{}, &platform.ErrStreamNotFound{SearchParam: "ID", Value: streamId}
+	} else if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	last, err := strconv.ParseUint(*out.Attributes[COLUMN_STREAM_LASTSEQUENCE].N, 10, 64)
 	if err != nil {
-		return "", err
+		return 0, time.Time{}, err
 	}
 
-	if len(out.Item) == 0 {
-		return "", &platform.ErrStreamNotFound{
-			SearchParam: "ID",
-			Value:       streamId}
+	latest := now
+	if attr := out.Attributes[COLUMN_STREAM_LASTTIMESTAMP]; attr != nil {
+		latest = *attr.N
 	}
 
-	return *out.Item[COLUMN_STREAM_SNSTOPICARN].S, nil
+	nanos, err := strconv.ParseInt(latest, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return last - uint64(n) + 1, time.Unix(0, nanos).UTC(), nil
+}
+
+// purgeStream tears down everything belonging to a stream: its cursors, its topic, its records and finally
+// its ocean-streams item. The item goes last so that a failed purge is retried by the next sweep.
+func (p *SqsPlatform) purgeStream(item *streamItem) error {
+	cursors, err := p.queryCursorDBItems(item.streamId)
+	if err != nil {
+		return err
+	}
+
+	for _, cursor := range cursors {
+		err = p.deprovisionCursor(cursor, item.topicArn)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = p.svcSns.DeleteTopic(&sns.DeleteTopicInput{
+		TopicArn: &item.topicArn})
+	if err != nil {
+		return err
+	}
+
+	err = p.deleteRecordDBItems(item.streamId)
+	if err != nil {
+		return err
+	}
+
+	tableName := p.config.StreamsTable
+	key := map[string]*dynamodb.AttributeValue{
+		COLUMN_STREAM_ID: &dynamodb.AttributeValue{S: &item.streamId}}
+	_, err = p.svcDynamoDb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &tableName,
+		Key:       key})
+
+	return err
+}
+
+func (p *SqsPlatform) deleteRecordDBItems(streamId string) error {
+	tableName := p.config.RecordsTable
+	keyCond := fmt.Sprintf("%s = :s", COLUMN_STREAM_ID)
+	projection := strings.Join([]string{COLUMN_STREAM_ID, COLUMN_RECORD_SORTKEY}, ",")
+	values := map[string]*dynamodb.AttributeValue{
+		":s": &dynamodb.AttributeValue{S: &streamId}}
+
+	// BatchWriteItem accepts up to 25 requests at a time
+	var limit int64 = 25
+	for {
+		out, err := p.svcDynamoDb.Query(&dynamodb.QueryInput{
+			TableName:                 &tableName,
+			KeyConditionExpression:    &keyCond,
+			ProjectionExpression:      &projection,
+			ExpressionAttributeValues: values,
+			Limit:                     &limit})
+		if err != nil {
+			return err
+		}
+
+		if len(out.Items) == 0 {
+			return nil
+		}
+
+		requests := make([]*dynamodb.WriteRequest, len(out.Items))
+		for k, key := range out.Items {
+			requests[k] = &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: key}}
+		}
+
+		// Unprocessed deletes are picked up again by the next query
+		_, err = p.svcDynamoDb.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				tableName: requests}})
+		if err != nil {
+			return err
+		}
+	}
 }
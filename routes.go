@@ -9,18 +9,61 @@ import (
 
 func buildRoutes() http.Handler {
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(api.NotFoundHandler)
 	r.HandleFunc("/streams", api.StreamCollectionPostHandler).
 		Methods("POST")
 	r.HandleFunc("/streams", api.StreamCollectionGetHandler).
 		Methods("GET")
 	r.HandleFunc("/streams/{stream_id}", api.StreamDocumentGetHandler).
 		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}", api.StreamDocumentPatchHandler).
+		Methods("PATCH")
+	r.HandleFunc("/streams/{stream_id}", api.StreamDocumentDeleteHandler).
+		Methods("DELETE")
+	r.HandleFunc("/streams/{stream_id}/restore", api.StreamRestorePostHandler).
+		Methods("POST")
 	r.HandleFunc("/streams/{stream_id}/records", api.RecordCollectionGetHandler).
 		Methods("GET")
 	r.HandleFunc("/streams/{stream_id}/records", api.RecordCollectionPostHandler).
 		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/records/events", api.RecordEventsGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/records/{record_id}", api.RecordDocumentGetHandler).
+		Methods("GET")
 	r.HandleFunc("/streams/{stream_id}/cursors", api.CursorCollectionPostHandler).
 		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/cursors", api.CursorCollectionGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}", api.CursorDocumentGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}", api.CursorDocumentPatchHandler).
+		Methods("PATCH")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}", api.CursorDocumentDeleteHandler).
+		Methods("DELETE")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}/clone", api.CursorClonePostHandler).
+		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}/records", api.RecordCollectionGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}/ack", api.CursorAckPostHandler).
+		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/cursors/{cursor_id}/nack", api.CursorNackPostHandler).
+		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/subscriptions", api.SubscriptionCollectionPostHandler).
+		Methods("POST")
+	r.HandleFunc("/streams/{stream_id}/subscriptions", api.SubscriptionCollectionGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/subscriptions/{subscription_id}", api.SubscriptionDocumentGetHandler).
+		Methods("GET")
+	r.HandleFunc("/streams/{stream_id}/subscriptions/{subscription_id}", api.SubscriptionDocumentDeleteHandler).
+		Methods("DELETE")
+	r.HandleFunc("/streams/{stream_id}/subscriptions/{subscription_id}/resume", api.SubscriptionResumePostHandler).
+		Methods("POST")
+	r.HandleFunc("/ws", api.WebSocketHandler).
+		Methods("GET")
+	r.HandleFunc("/admin/snapshot", api.AdminSnapshotPostHandler).
+		Methods("POST")
+	r.HandleFunc("/admin/restore", api.AdminRestorePostHandler).
+		Methods("POST")
 
 	return r
 }